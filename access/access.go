@@ -0,0 +1,149 @@
+// Package access decides who may call which route. Authentication middleware attaches the Principal making a request
+// to its context, services declare the action each of their routes performs and the resource it acts on when they
+// Mount them, and an Enforcer checks the former against the latter. Actions are named like the scopes granting them.
+package access
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Actions declared by the routes of this application, and the scopes granting them.
+const (
+	UsersRead  = "users:read"
+	UsersWrite = "users:write"
+	// Grants every scope.
+	Admin = "admin"
+)
+
+// Known reports whether the action or scope is declared by the routes of this application, and so may be granted.
+func Known(scope string) bool {
+	switch scope {
+	case UsersRead, UsersWrite, Admin:
+		return true
+	}
+	return false
+}
+
+var (
+	ErrUnauthenticated = errors.New("authentication required")
+	ErrForbidden       = errors.New("not allowed")
+)
+
+type key int
+
+const principalKey key = 0
+
+// Principal is an authenticated caller and the scopes it was granted.
+type Principal struct {
+	// Identifies the caller, e.g. "user:42" or "key:ab12cd34", and is recorded as the actor of the request.
+	ID     string
+	Scopes []string
+	// Whether the caller proved a second factor, such as a TOTP code, besides its password when it logged in.
+	MultiFactor bool
+	// The tenant the credentials were issued in, which they may not be used outside of, or "" if they aren't bound to
+	// one.
+	Tenant string
+}
+
+// HasScope reports whether the principal was granted scope, or admin.
+func (p *Principal) HasScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope || granted == Admin {
+			return true
+		}
+	}
+	return false
+}
+
+// HasExactScope reports whether the principal was granted scope itself, admin granting nothing else.
+func (p *Principal) HasExactScope(scope string) bool {
+	for _, granted := range p.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// WithPrincipal returns a copy of ctx identifying the principal making the request.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey, p)
+}
+
+// FromContext returns the principal stored by WithPrincipal, or nil for unauthenticated requests.
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey).(*Principal)
+	return p
+}
+
+// BearerToken returns the token of an "Authorization: Bearer" header, or "".
+func BearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// Resource names what a request acts on, such as "users" or "users/42".
+type Resource func(r *http.Request) string
+
+// Static returns the Resource of routes acting on name whatever the request.
+func Static(name string) Resource {
+	return func(*http.Request) string { return name }
+}
+
+// Var returns the Resource of routes acting on a member of collection, identified by the path variable named name.
+func Var(collection, name string) Resource {
+	return func(r *http.Request) string { return collection + "/" + mux.Vars(r)[name] }
+}
+
+// Enforcer decides whether a request may perform an action on a resource.
+type Enforcer interface {
+	// Authorize returns nil if the request may proceed, ErrUnauthenticated or ErrForbidden otherwise.
+	Authorize(r *http.Request, action, resource string) error
+}
+
+// Scopes is the Enforcer admitting principals granted the scope of the action, whatever the resource.
+type Scopes struct{}
+
+// Authorize implements Enforcer.
+func (Scopes) Authorize(r *http.Request, action, resource string) error {
+	p := FromContext(r.Context())
+	if p == nil {
+		return ErrUnauthenticated
+	}
+
+	if !p.HasScope(action) {
+		return ErrForbidden
+	}
+
+	return nil
+}
+
+// Require returns next guarded by e for action on resource. A nil Enforcer lets every request through, for deployments
+// and tests which don't authenticate requests.
+func Require(e Enforcer, action string, resource Resource, next http.HandlerFunc) http.Handler {
+	if e == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch err := e.Authorize(r, action, resource(r)); err {
+		case nil:
+			next(w, r)
+		case ErrUnauthenticated:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case ErrForbidden:
+			http.Error(w, "not allowed to "+action+" "+resource(r), http.StatusForbidden)
+		default:
+			http.Error(w, "", http.StatusInternalServerError)
+		}
+	})
+}
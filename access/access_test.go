@@ -0,0 +1,35 @@
+package access_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequire(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+
+	send := func(enforcer access.Enforcer, principal *access.Principal) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://localhost:9090/users", nil)
+		if principal != nil {
+			req = req.WithContext(access.WithPrincipal(req.Context(), principal))
+		}
+		w := httptest.NewRecorder()
+		access.Require(enforcer, access.UsersWrite, access.Static("users"), ok).ServeHTTP(w, req)
+		return w
+	}
+
+	// Without an enforcer every request is let through.
+	require.Equal(t, 200, send(nil, nil).Code)
+
+	w := send(access.Scopes{}, nil)
+	require.Equal(t, 401, w.Code)
+	require.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	require.Equal(t, 403, send(access.Scopes{}, &access.Principal{ID: "key:1", Scopes: []string{access.UsersRead}}).Code)
+	require.Equal(t, 200, send(access.Scopes{}, &access.Principal{ID: "key:2", Scopes: []string{access.UsersWrite}}).Code)
+	require.Equal(t, 200, send(access.Scopes{}, &access.Principal{ID: "key:3", Scopes: []string{access.Admin}}).Code)
+}
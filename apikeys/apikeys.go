@@ -0,0 +1,423 @@
+// Package apikeys authenticates machine clients with long-lived API keys. A key is shown once when it is created and
+// only its SHA-256 hash is stored, next to a short prefix which identifies the key in logs, audit trails and listings
+// without revealing it. Keys carry the scopes they grant, may expire, and are revoked rather than deleted so audit
+// trails naming them stay meaningful.
+package apikeys
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// KeyPrefix starts every API key, so keys are recognizable when they leak into code or logs and can be told apart from
+// other bearer tokens.
+const KeyPrefix = "tfk_"
+
+// Largest request body accepted by the write endpoints.
+const maxBodyBytes = 1 << 16
+
+var errInvalidKey = errors.New("invalid API key")
+
+type (
+	// Config for the API keys service.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /api-keys.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// Authorizes requests against the action and resource each route declares. Keys are always managed behind one,
+		// access.Scopes if nil.
+		Enforcer access.Enforcer
+	}
+
+	// Service: API keys.
+	Service struct {
+		ctx        context.Context
+		logger     *log.Logger
+		db         *sqlx.DB
+		pathPrefix string
+		renderer   *render.Renderer
+		enforcer   access.Enforcer
+	}
+
+	// APIKey as it is listed, without its secret.
+	APIKey struct {
+		ID         int64          `json:"id" db:"id"`
+		Name       string         `json:"name" db:"name"`
+		Prefix     string         `json:"prefix" db:"prefix"`
+		Scopes     pq.StringArray `json:"scopes" db:"scopes"`
+		CreatedBy  string         `json:"createdBy" db:"created_by"`
+		CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+		ExpiresAt  *time.Time     `json:"expiresAt" db:"expires_at"`
+		LastUsedAt *time.Time     `json:"lastUsedAt" db:"last_used_at"`
+		RevokedAt  *time.Time     `json:"revokedAt" db:"revoked_at"`
+		// The key itself, only returned when it is created.
+		Key string `json:"key,omitempty" db:"-"`
+	}
+
+	// Input is the body accepted by the Create and Update endpoints. Fields left out of an update are left as they are.
+	Input struct {
+		Name      *string    `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expiresAt"`
+	}
+
+	// ValidationError maps the fields of an Input to what is wrong with them.
+	ValidationError map[string]string
+
+	// credential is a key with the hash a presented secret is checked against.
+	credential struct {
+		APIKey
+		Hash string `db:"hash"`
+	}
+)
+
+// New: Instantiate a new API keys service. Fail hard if its table can't be created.
+func New(config *Config) *Service {
+	if _, err := config.DB.ExecContext(context.Background(), CreateTableStmt); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "api-keys"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	enforcer := config.Enforcer
+	if enforcer == nil {
+		enforcer = access.Scopes{}
+	}
+
+	return &Service{
+		ctx:        config.Ctx,
+		logger:     config.Logger,
+		db:         config.DB,
+		pathPrefix: pathPrefix,
+		renderer:   renderer,
+		enforcer:   enforcer,
+	}
+}
+
+// Mount the subRouter of this service to the root router. Managing keys requires the admin scope.
+func (s *Service) Mount(r *mux.Router) {
+	keys, key := access.Static("api-keys"), access.Var("api-keys", "id")
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.Handle("", s.require(keys, s.Get)).Methods("GET")
+	subRouter.Handle("", s.require(keys, s.Create)).Methods("POST")
+	subRouter.Handle("/{id:[0-9]+}", s.require(key, s.GetOne)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}", s.require(key, s.Update)).Methods("PATCH")
+	subRouter.Handle("/{id:[0-9]+}", s.require(key, s.Revoke)).Methods("DELETE")
+}
+
+// require guards a route acting on resource with the enforcer of the service.
+func (s *Service) require(resource access.Resource, handler http.HandlerFunc) http.Handler {
+	return access.Require(s.enforcer, access.Admin, resource, handler)
+}
+
+// Authenticate returns next behind a middleware authenticating requests carrying an API key as an
+// "Authorization: Bearer" header. The key becomes the principal and actor of the request, as "key:<prefix>". Requests
+// presenting an unknown, expired or revoked key are answered with 401 Unauthorized, requests presenting no key, or
+// another kind of bearer token, are passed through as they are.
+func (s *Service) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := access.BearerToken(r)
+		if !strings.HasPrefix(token, KeyPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := s.authenticate(r.Context(), token)
+		if err == errInvalidKey {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		principal := &access.Principal{ID: "key:" + key.Prefix, Scopes: key.Scopes}
+		ctx := access.WithPrincipal(r.Context(), principal)
+		ctx = reqctx.WithActor(ctx, principal.ID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticate returns the key token is the secret of, if it is still valid, and records its use.
+func (s *Service) authenticate(ctx context.Context, token string) (*APIKey, error) {
+	prefix, ok := parseKey(token)
+	if !ok {
+		return nil, errInvalidKey
+	}
+
+	key := &credential{}
+	if err := s.db.GetContext(ctx, key, SelectByPrefixStmt, prefix); err == sql.ErrNoRows {
+		return nil, errInvalidKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashKey(token)), []byte(key.Hash)) != 1 {
+		return nil, errInvalidKey
+	}
+
+	if key.RevokedAt != nil || (key.ExpiresAt != nil && !key.ExpiresAt.After(time.Now())) {
+		return nil, errInvalidKey
+	}
+
+	// A failure to record the use of a key is no reason to turn its holder away.
+	if _, err := s.db.ExecContext(ctx, TouchStmt, key.ID); err != nil {
+		s.logger.Println(err)
+	}
+
+	return &key.APIKey, nil
+}
+
+// Issue creates a key, returned with its secret which is not stored and can't be recovered. createdBy names the actor
+// issuing it. Invalid inputs are reported with a ValidationError.
+func (s *Service) Issue(ctx context.Context, input *Input, createdBy string) (*APIKey, error) {
+	if problems := input.validate(true); len(problems) > 0 {
+		return nil, problems
+	}
+
+	token, prefix, err := generateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	name := ""
+	if input.Name != nil {
+		name = *input.Name
+	}
+
+	key := &APIKey{}
+	err = s.db.GetContext(ctx, key, InsertOneStmt,
+		name, prefix, hashKey(token), pq.StringArray(input.Scopes), createdBy, input.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Key = token
+	return key, nil
+}
+
+// Get endpoint returns every key, most recently created first, without their secrets.
+func (s *Service) Get(w http.ResponseWriter, r *http.Request) {
+	keys := []*APIKey{}
+	if err := s.db.SelectContext(r.Context(), &keys, SelectManyStmt); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, keys)
+}
+
+// GetOne endpoint returns a single key by ID, without its secret.
+func (s *Service) GetOne(w http.ResponseWriter, r *http.Request) {
+	key := &APIKey{}
+	if err := s.db.GetContext(r.Context(), key, SelectOneStmt, mux.Vars(r)["id"]); err != nil {
+		s.writeDBError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, key)
+}
+
+// Create endpoint issues a key, responding with 201 Created and the key including its secret. This is the only time
+// the secret is returned.
+func (s *Service) Create(w http.ResponseWriter, r *http.Request) {
+	input := &Input{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	key, err := s.Issue(r.Context(), input, reqctx.Actor(r.Context()))
+	if problems, ok := err.(ValidationError); ok {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusCreated, key)
+}
+
+// Update endpoint renames a key, replaces its scopes or changes its expiry. Revoked keys can't be updated and are
+// answered with 404 Not Found.
+func (s *Service) Update(w http.ResponseWriter, r *http.Request) {
+	input := &Input{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if problems := input.validate(false); len(problems) > 0 {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
+	var scopes pq.StringArray
+	if input.Scopes != nil {
+		scopes = pq.StringArray(input.Scopes)
+	}
+
+	key := &APIKey{}
+	err := s.db.GetContext(r.Context(), key, UpdateOneStmt, mux.Vars(r)["id"], input.Name, scopes, input.ExpiresAt)
+	if err != nil {
+		s.writeDBError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, key)
+}
+
+// Revoke endpoint revokes a key for good, responding with 204 No Content. Revoked keys are still listed.
+func (s *Service) Revoke(w http.ResponseWriter, r *http.Request) {
+	result, err := s.db.ExecContext(r.Context(), RevokeOneStmt, mux.Vars(r)["id"])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		s.writeError(w, err)
+		return
+	} else if n == 0 {
+		http.Error(w, "no such API key, or it has already been revoked", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validate checks an input, keyed by field. Keys can only be created with a name and at least one scope, which may not
+// be admin: that action is only granted by roles, so an admin key would be allowed nothing more.
+func (in *Input) validate(create bool) ValidationError {
+	problems := ValidationError{}
+
+	if (create || in.Name != nil) && (in.Name == nil || strings.TrimSpace(*in.Name) == "") {
+		problems["name"] = "must not be empty"
+	}
+
+	if create || in.Scopes != nil {
+		if len(in.Scopes) == 0 {
+			problems["scopes"] = "must grant at least one scope"
+		}
+		for _, scope := range in.Scopes {
+			if !access.Known(scope) {
+				problems["scopes"] = "unknown scope " + scope
+			} else if scope == access.Admin {
+				problems["scopes"] = "admin is only granted by roles, assign one to the key instead"
+			}
+		}
+	}
+
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(time.Now()) {
+		problems["expiresAt"] = "must be in the future"
+	}
+
+	return problems
+}
+
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, problem := range e {
+		fields = append(fields, field+": "+problem)
+	}
+	sort.Strings(fields)
+	return "invalid API key: " + strings.Join(fields, ", ")
+}
+
+// generateKey returns a new key, "tfk_<prefix>_<secret>", and its prefix. The prefix is public, the secret carries 256
+// bits of entropy which is why a fast hash is enough to store it.
+func generateKey() (string, string, error) {
+	buf := make([]byte, 6+32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+
+	prefix := hex.EncodeToString(buf[:6])
+	return KeyPrefix + prefix + "_" + base64.RawURLEncoding.EncodeToString(buf[6:]), prefix, nil
+}
+
+// parseKey returns the prefix of a key.
+func parseKey(token string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(token, KeyPrefix), "_", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func hashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+func (s *Service) writeDBError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such API key", http.StatusNotFound)
+		return
+	}
+
+	s.writeError(w, err)
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,126 @@
+package apikeys_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/apikeys"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+// admins is an access.Enforcer allowing the principals it lists everything, standing in for their roles.
+type admins map[string]bool
+
+func (a admins) Authorize(r *http.Request, action, resource string) error {
+	p := access.FromContext(r.Context())
+	if p == nil {
+		return access.ErrUnauthenticated
+	}
+	if !a[p.ID] {
+		return access.ErrForbidden
+	}
+	return nil
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+
+	roles := admins{}
+	service := apikeys.New(&apikeys.Config{
+		Ctx:      ctx,
+		Logger:   log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:       db,
+		Enforcer: roles,
+	})
+
+	_, err = db.ExecContext(ctx, apikeys.DeleteManyStmt)
+	require.Nil(t, err)
+
+	admin := "admin"
+	adminKey, err := service.Issue(ctx, &apikeys.Input{Name: &admin, Scopes: []string{access.UsersWrite}}, "system:test")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(adminKey.Key, apikeys.KeyPrefix+adminKey.Prefix+"_"))
+	roles["key:"+adminKey.Prefix] = true
+
+	// Unknown scopes, and admin which only roles grant, are refused.
+	for _, scope := range []string{"everything", access.Admin} {
+		_, err = service.Issue(ctx, &apikeys.Input{Name: &admin, Scopes: []string{scope}}, "system:test")
+		require.IsType(t, apikeys.ValidationError{}, err)
+	}
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	// Downstream handlers see the key as the principal and actor of the request.
+	var actor string
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		actor = reqctx.Actor(r.Context())
+	})
+
+	handler := service.Authenticate(router)
+	send := func(method, target, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, 401, send("GET", "http://localhost:9090/api-keys", "", "").Code)
+	require.Equal(t, 401, send("GET", "http://localhost:9090/api-keys", "", adminKey.Key+"x").Code)
+
+	send("GET", "http://localhost:9090/whoami", "", adminKey.Key)
+	require.Equal(t, "key:"+adminKey.Prefix, actor)
+
+	w := send("POST", "http://localhost:9090/api-keys", `{"name": "reader", "scopes": ["users:read"]}`, adminKey.Key)
+	require.Equal(t, 201, w.Code)
+	reader := &apikeys.APIKey{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), reader))
+	require.NotEmpty(t, reader.Key)
+	require.Equal(t, "key:"+adminKey.Prefix, reader.CreatedBy)
+
+	adminURL := "http://localhost:9090/api-keys/" + strconv.FormatInt(adminKey.ID, 10)
+	readerURL := "http://localhost:9090/api-keys/" + strconv.FormatInt(reader.ID, 10)
+
+	require.Equal(t, 422, send("POST", "http://localhost:9090/api-keys", `{"name": "", "scopes": []}`, adminKey.Key).Code)
+
+	// The secret is never listed, and keys without a role allowing the admin action can't manage keys.
+	w = send("GET", "http://localhost:9090/api-keys", "", adminKey.Key)
+	require.Equal(t, 200, w.Code)
+	require.NotContains(t, w.Body.String(), reader.Key)
+	require.Equal(t, 403, send("GET", "http://localhost:9090/api-keys", "", reader.Key).Code)
+
+	w = send("GET", adminURL, "", adminKey.Key)
+	require.Equal(t, 200, w.Code)
+	listed := &apikeys.APIKey{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), listed))
+	require.NotNil(t, listed.LastUsedAt)
+
+	w = send("PATCH", readerURL, `{"scopes": ["users:read", "users:write"]}`, adminKey.Key)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "users:write")
+
+	// Revoked keys stop authenticating at once.
+	require.Equal(t, 204, send("DELETE", readerURL, "", adminKey.Key).Code)
+	require.Equal(t, 404, send("DELETE", readerURL, "", adminKey.Key).Code)
+	require.Equal(t, 401, send("GET", "http://localhost:9090/whoami", "", reader.Key).Code)
+}
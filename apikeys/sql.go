@@ -0,0 +1,73 @@
+package apikeys
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id SERIAL PRIMARY KEY,
+		name TEXT NOT NULL,
+		prefix TEXT NOT NULL UNIQUE,
+		hash TEXT NOT NULL,
+		scopes TEXT[] NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone,
+		last_used_at timestamp with time zone,
+		revoked_at timestamp with time zone
+	);
+	`
+
+	// Columns of an APIKey, the hash is only ever selected to authenticate a request.
+	keyColumns = `id, name, prefix, scopes, created_by, created_at, expires_at, last_used_at, revoked_at`
+
+	InsertOneStmt = `
+	INSERT INTO api_keys
+		(name, prefix, hash, scopes, created_by, expires_at)
+	VALUES
+		($1, $2, $3, $4, $5, $6)
+	RETURNING ` + keyColumns + `;
+	`
+
+	SelectManyStmt = `
+	SELECT ` + keyColumns + `
+	FROM api_keys
+	ORDER BY id DESC;
+	`
+
+	SelectOneStmt = `
+	SELECT ` + keyColumns + `
+	FROM api_keys
+	WHERE id = $1;
+	`
+
+	// Select the key with the given prefix to check a presented secret against its hash.
+	SelectByPrefixStmt = `
+	SELECT ` + keyColumns + `, hash
+	FROM api_keys
+	WHERE prefix = $1;
+	`
+
+	// Update the name, scopes and expiry of a key which hasn't been revoked, each left as is when NULL.
+	UpdateOneStmt = `
+	UPDATE api_keys SET
+		name = COALESCE($2, name),
+		scopes = COALESCE($3, scopes),
+		expires_at = COALESCE($4, expires_at)
+	WHERE id = $1 AND revoked_at IS NULL
+	RETURNING ` + keyColumns + `;
+	`
+
+	RevokeOneStmt = `
+	UPDATE api_keys SET
+		revoked_at = now()
+	WHERE id = $1 AND revoked_at IS NULL;
+	`
+
+	// Record the use of a key, at most once a minute so busy keys don't write on every request.
+	TouchStmt = `
+	UPDATE api_keys SET
+		last_used_at = now()
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute');
+	`
+
+	DeleteManyStmt = `DELETE FROM api_keys;`
+)
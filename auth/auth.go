@@ -0,0 +1,880 @@
+// Package auth logs users in with their password and keeps them logged in without server side state: it issues short
+// lived JWT access tokens, verified by every replica with the public keys it publishes, and long lived refresh tokens
+// exchanged for new access tokens. Refresh tokens are stored hashed and rotate on every exchange; presenting one which
+// was already exchanged means it was stolen, so the whole chain it belongs to is revoked.
+//
+// Browsers log in to server side sessions instead, identified by an HttpOnly cookie, see sessions.go.
+//
+// Users enrolled in TOTP log in in two steps, their password and then a code, see twofactor.go. Users who forgot their
+// password reset it, and verify their email address, with single use links sent by email, see email.go.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/b3ntly/twelvefactor_databases/lockout"
+	"github.com/b3ntly/twelvefactor_databases/mail"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// RefreshTokenPrefix starts every refresh token, so they are recognizable when they leak into code or logs.
+const RefreshTokenPrefix = "tfr_"
+
+// Largest request body accepted by the endpoints of this service.
+const maxBodyBytes = 1 << 16
+
+// Authentication methods recorded in access tokens, as RFC 8176 names them.
+const (
+	methodPassword = "pwd"
+	methodOTP      = "otp"
+	methodMFA      = "mfa"
+)
+
+var (
+	errInvalidCredentials  = errors.New("invalid username or password")
+	errInvalidRefreshToken = errors.New("invalid refresh token, log in again")
+)
+
+type (
+	// Config for the authentication service.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /auth.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// Authorizes requests against the action and resource each route declares, nil lets every request through.
+		Enforcer access.Enforcer
+		// Signs access tokens and verifies those presented.
+		Keys *jwt.KeySet
+		// The iss and aud claims of access tokens, required of those presented.
+		Issuer   string
+		Audience string
+		// How long access tokens are valid. Defaults to 15 minutes.
+		AccessTTL time.Duration
+		// How long refresh tokens are valid, extended by every exchange. Defaults to 30 days.
+		RefreshTTL time.Duration
+		// How long a session lasts without being used, extended by every request. Defaults to 30 minutes.
+		SessionIdleTimeout time.Duration
+		// How long a session lasts however much it's used. Defaults to 12 hours.
+		SessionMaxAge time.Duration
+		// Send session cookies over plain HTTP too, for development without TLS. Off by default.
+		InsecureCookies bool
+		// How often RunExpirer removes expired refresh tokens and sessions, zero or less disables removal.
+		ExpireInterval time.Duration
+		// PBKDF2 iterations of new password hashes. Defaults to 600000.
+		PasswordIterations int
+		// The clock TOTP codes are checked against, defaults to time.Now.
+		Now func() time.Time
+		// Sends password reset and email verification links, defaults to writing them to standard output.
+		Mailer mail.Mailer
+		// The URL links sent by email lead to, followed by /reset-password or /verify-email and the token.
+		PublicURL string
+		// Directory of templates overriding the default messages, see PasswordResetTemplate and VerifyEmailTemplate.
+		TemplatesDir string
+		// How long password reset links are valid. Defaults to 1 hour.
+		PasswordResetTTL time.Duration
+		// How long email verification links are valid. Defaults to 24 hours.
+		EmailVerificationTTL time.Duration
+		// Counts failed logins, delaying and locking out the accounts and addresses guessing passwords. Nil disables it.
+		Lockout *lockout.Service
+		// Refuses setting the password or resetting the second factor of users holding a role requiring one which the
+		// caller doesn't hold, such as rbac.Service. Nil disables the check.
+		Roles Outranker
+		// Decrypts the emails of users and encrypts TOTP secrets, see users.Config. Nil stores secrets in plaintext, only
+		// acceptable in development.
+		Keyring *fieldcrypt.Keyring
+	}
+
+	// Service: authentication.
+	Service struct {
+		ctx                context.Context
+		logger             *log.Logger
+		db                 *sqlx.DB
+		pathPrefix         string
+		renderer           *render.Renderer
+		enforcer           access.Enforcer
+		keys               *jwt.KeySet
+		issuer             string
+		audience           string
+		accessTTL          time.Duration
+		refreshTTL         time.Duration
+		sessionIdleTimeout time.Duration
+		sessionMaxAge      time.Duration
+		insecureCookies    bool
+		expireInterval     time.Duration
+		passwordIterations int
+		now                func() time.Time
+		mailer             mail.Mailer
+		publicURL          string
+		templates          map[string]*mail.Template
+		resetTTL           time.Duration
+		verificationTTL    time.Duration
+		lockout            *lockout.Service
+		roles              Outranker
+		keyring            *fieldcrypt.Keyring
+		// Checked against the password of unknown users, so they take as long to turn away as known ones.
+		dummyHash string
+	}
+
+	// Outranker tells whether a subject holds a role another doesn't, which is stricter than theirs.
+	Outranker interface {
+		Outranks(ctx context.Context, subject, than string) (bool, error)
+	}
+
+	// Credentials is the body accepted by the Login endpoint.
+	Credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+
+	// RefreshInput is the body accepted by the Refresh and Logout endpoints.
+	RefreshInput struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	// PasswordInput is the body accepted by the SetPassword endpoint.
+	PasswordInput struct {
+		Password string `json:"password"`
+	}
+
+	// Tokens answer a login or a refresh.
+	Tokens struct {
+		AccessToken string `json:"accessToken"`
+		TokenType   string `json:"tokenType"`
+		// Lifetime of the access token, in seconds.
+		ExpiresIn    int    `json:"expiresIn"`
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	// Session is a chain of refresh tokens, each exchanged for the next, started by a login.
+	Session struct {
+		Family    string     `json:"family" db:"family"`
+		CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+		ExpiresAt time.Time  `json:"expiresAt" db:"expires_at"`
+		RevokedAt *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+	}
+
+	// CredentialsArchive is what the service stores about a user, as returned to an access request.
+	CredentialsArchive struct {
+		PasswordUpdatedAt *time.Time       `json:"passwordUpdatedAt"`
+		Sessions          []*Session       `json:"sessions"`
+		CookieSessions    []*CookieSession `json:"cookieSessions"`
+		TOTPConfirmedAt   *time.Time       `json:"totpConfirmedAt"`
+		RecoveryCodesLeft int              `json:"recoveryCodesLeft"`
+		EmailVerifiedAt   *time.Time       `json:"emailVerifiedAt"`
+	}
+
+	login struct {
+		ID           int64  `db:"id"`
+		Status       string `db:"status"`
+		PasswordHash string `db:"password_hash"`
+	}
+
+	refreshToken struct {
+		ID          int64      `db:"id"`
+		Family      string     `db:"family"`
+		UserID      int64      `db:"user_id"`
+		MultiFactor bool       `db:"multi_factor"`
+		ExpiresAt   time.Time  `db:"expires_at"`
+		UsedAt      *time.Time `db:"used_at"`
+		RevokedAt   *time.Time `db:"revoked_at"`
+	}
+)
+
+// New: Instantiate a new authentication service. Fail hard if its tables can't be created, which requires the users
+// table.
+func New(config *Config) *Service {
+	if _, err := config.DB.ExecContext(context.Background(), CreateTableStmt); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "auth"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	accessTTL := config.AccessTTL
+	if accessTTL <= 0 {
+		accessTTL = 15 * time.Minute
+	}
+
+	refreshTTL := config.RefreshTTL
+	if refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+
+	sessionIdleTimeout := config.SessionIdleTimeout
+	if sessionIdleTimeout <= 0 {
+		sessionIdleTimeout = 30 * time.Minute
+	}
+
+	sessionMaxAge := config.SessionMaxAge
+	if sessionMaxAge <= 0 {
+		sessionMaxAge = 12 * time.Hour
+	}
+
+	passwordIterations := config.PasswordIterations
+	if passwordIterations <= 0 {
+		passwordIterations = 600000
+	}
+
+	now := config.Now
+	if now == nil {
+		now = time.Now
+	}
+
+	mailer := config.Mailer
+	if mailer == nil {
+		mailer = mail.NewLog(os.Stdout, "")
+	}
+
+	templates, err := loadTemplates(config.TemplatesDir)
+	if err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	resetTTL := config.PasswordResetTTL
+	if resetTTL <= 0 {
+		resetTTL = time.Hour
+	}
+
+	verificationTTL := config.EmailVerificationTTL
+	if verificationTTL <= 0 {
+		verificationTTL = 24 * time.Hour
+	}
+
+	dummyHash, err := hashPassword("not a password", passwordIterations)
+	if err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	return &Service{
+		ctx:                config.Ctx,
+		logger:             config.Logger,
+		db:                 config.DB,
+		pathPrefix:         pathPrefix,
+		renderer:           renderer,
+		enforcer:           config.Enforcer,
+		keys:               config.Keys,
+		issuer:             config.Issuer,
+		audience:           config.Audience,
+		accessTTL:          accessTTL,
+		refreshTTL:         refreshTTL,
+		sessionIdleTimeout: sessionIdleTimeout,
+		sessionMaxAge:      sessionMaxAge,
+		insecureCookies:    config.InsecureCookies,
+		expireInterval:     config.ExpireInterval,
+		passwordIterations: passwordIterations,
+		now:                now,
+		mailer:             mailer,
+		publicURL:          config.PublicURL,
+		templates:          templates,
+		resetTTL:           resetTTL,
+		verificationTTL:    verificationTTL,
+		lockout:            config.Lockout,
+		roles:              config.Roles,
+		keyring:            config.Keyring,
+		dummyHash:          dummyHash,
+	}
+}
+
+// Mount the subRouter of this service to the root router. Logging in is open to everyone, the current session and
+// TOTP enrollment are those of the caller, and setting the password, revoking the sessions or resetting the TOTP
+// enrollment of a user is a change to that user.
+func (s *Service) Mount(r *mux.Router) {
+	one := access.Var("users", "id")
+
+	r.HandleFunc("/.well-known/jwks.json", s.JWKS).Methods("GET")
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.HandleFunc("/login", s.Login).Methods("POST")
+	subRouter.HandleFunc("/login/verify", s.VerifyLogin).Methods("POST")
+	subRouter.HandleFunc("/refresh", s.Refresh).Methods("POST")
+	subRouter.HandleFunc("/logout", s.Logout).Methods("POST")
+	subRouter.HandleFunc("/sessions", s.CreateSession).Methods("POST")
+	subRouter.HandleFunc("/sessions/verify", s.VerifySession).Methods("POST")
+	subRouter.HandleFunc("/sessions/current", s.GetCurrentSession).Methods("GET")
+	subRouter.HandleFunc("/sessions/current", s.DeleteCurrentSession).Methods("DELETE")
+	subRouter.HandleFunc("/totp", s.EnrollTOTP).Methods("POST")
+	subRouter.HandleFunc("/totp", s.DisableTOTP).Methods("DELETE")
+	subRouter.HandleFunc("/totp/confirm", s.ConfirmTOTP).Methods("POST")
+	subRouter.HandleFunc("/totp/recovery-codes", s.RegenerateRecoveryCodes).Methods("POST")
+	subRouter.HandleFunc("/password-reset", s.RequestPasswordReset).Methods("POST")
+	subRouter.HandleFunc("/password-reset/confirm", s.ResetPassword).Methods("POST")
+	subRouter.HandleFunc("/email-verification", s.RequestEmailVerification).Methods("POST")
+	subRouter.HandleFunc("/email-verification/confirm", s.VerifyEmail).Methods("POST")
+	subRouter.Handle("/users/{id:[0-9]+}/password",
+		access.Require(s.enforcer, access.Admin, one, s.SetPassword)).Methods("PUT")
+	subRouter.Handle("/users/{id:[0-9]+}/sessions",
+		access.Require(s.enforcer, access.UsersRead, one, s.ListSessions)).Methods("GET")
+	subRouter.Handle("/users/{id:[0-9]+}/sessions",
+		access.Require(s.enforcer, access.UsersWrite, one, s.RevokeSessions)).Methods("DELETE")
+	subRouter.Handle("/users/{id:[0-9]+}/sessions/{session:[0-9]+}",
+		access.Require(s.enforcer, access.UsersWrite, one, s.RevokeSession)).Methods("DELETE")
+	subRouter.Handle("/users/{id:[0-9]+}/totp",
+		access.Require(s.enforcer, access.Admin, one, s.ResetTOTP)).Methods("DELETE")
+	subRouter.Handle("/users/{id:[0-9]+}/email-verification",
+		access.Require(s.enforcer, access.UsersRead, one, s.GetEmailVerification)).Methods("GET")
+}
+
+// Authenticate returns next behind a middleware authenticating requests carrying an access token as an
+// "Authorization: Bearer" header. The subject of the token becomes the principal and actor of the request, granted the
+// scopes of the token if it has any, and proving a second factor if the token says so. Requests presenting an invalid
+// or expired token are answered with 401 Unauthorized, requests already authenticated or presenting no token are
+// passed through as they are.
+func (s *Service) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := access.BearerToken(r)
+		if token == "" || access.FromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims := &jwt.Claims{}
+		err := s.keys.Parse(token, claims)
+		if err == nil {
+			err = claims.Valid(s.issuer, s.audience, time.Now())
+		}
+		if err != nil || claims.Subject == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			http.Error(w, "invalid access token", http.StatusUnauthorized)
+			return
+		}
+
+		principal := &access.Principal{
+			ID:          claims.Subject,
+			MultiFactor: hasMethod(claims.AuthMethods, methodMFA),
+			Tenant:      claims.Tenant,
+		}
+		if claims.Scope != "" {
+			principal.Scopes = strings.Fields(claims.Scope)
+		}
+
+		ctx := access.WithPrincipal(r.Context(), principal)
+		ctx = reqctx.WithActor(ctx, principal.ID)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// JWKS endpoint publishes the public keys access tokens are verified with. Always JSON, as RFC 7517 requires.
+func (s *Service) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(s.keys.JWKS())
+}
+
+// Login endpoint exchanges the username and password of an active user for tokens. Unknown users, wrong passwords
+// and inactive users are all answered alike, with 401 Unauthorized. Users enrolled in TOTP are answered with 202
+// Accepted and a Challenge instead, exchanged for tokens along with a code by VerifyLogin.
+func (s *Service) Login(w http.ResponseWriter, r *http.Request) {
+	input := &Credentials{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	userID, ok := s.checkCredentials(w, r, input)
+	if !ok {
+		return
+	}
+
+	if s.challenge(w, r, userID) {
+		return
+	}
+
+	var tokens *Tokens
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		tokens, err = s.issue(r.Context(), tx, userID, newFamily(), false)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.loginSucceeded(r, input.Username)
+	s.render(w, r, http.StatusOK, tokens)
+}
+
+// checkCredentials returns the ID of the active user the credentials belong to. Otherwise it answers the request and
+// returns false: with 401 Unauthorized for wrong credentials, or with 429 Too Many Requests, before checking them, if
+// the account or the address has to wait after failing too often.
+func (s *Service) checkCredentials(w http.ResponseWriter, r *http.Request, input *Credentials) (int64, bool) {
+	if s.lockout != nil {
+		wait, err := s.lockout.Check(r.Context(), input.Username, clientIP(r))
+		if err != nil {
+			s.writeError(w, err)
+			return 0, false
+		}
+		if wait > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many failed logins, retry later", http.StatusTooManyRequests)
+			return 0, false
+		}
+	}
+
+	user := &login{}
+	err := s.db.GetContext(r.Context(), user, SelectLoginStmt, input.Username)
+	if err != nil && err != sql.ErrNoRows {
+		s.writeError(w, err)
+		return 0, false
+	}
+
+	hash := user.PasswordHash
+	if hash == "" {
+		hash = s.dummyHash
+	}
+
+	if !checkPassword(input.Password, hash) || user.PasswordHash == "" || user.Status != users.StatusActive {
+		s.loginFailed(r, lockout.EventLoginFailed, input.Username)
+		http.Error(w, errInvalidCredentials.Error(), http.StatusUnauthorized)
+		return 0, false
+	}
+
+	return user.ID, true
+}
+
+// loginFailed counts a failed login on username, if failures are counted. Counting failures doesn't fail the login.
+func (s *Service) loginFailed(r *http.Request, event, username string) {
+	if s.lockout == nil {
+		return
+	}
+	if err := s.lockout.Failed(r.Context(), event, username, clientIP(r)); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+// loginSucceeded forgets the failed logins on username once it logged in, if failures are counted.
+func (s *Service) loginSucceeded(r *http.Request, username string) {
+	if s.lockout == nil {
+		return
+	}
+	if err := s.lockout.Succeeded(r.Context(), username, clientIP(r)); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+// secondFactorChecked counts the second factor presented for a login of a user, as a failed login on its account if
+// result is errInvalidSecondFactor and as a login if it is nil.
+func (s *Service) secondFactorChecked(r *http.Request, userID int64, result error) {
+	if s.lockout == nil || userID == 0 || (result != nil && result != errInvalidSecondFactor) {
+		return
+	}
+
+	var username string
+	if err := s.db.GetContext(r.Context(), &username, SelectUsernameStmt, userID); err != nil {
+		s.logger.Println(err)
+		return
+	}
+
+	if result != nil {
+		s.loginFailed(r, lockout.EventSecondFactorFailed, username)
+	} else {
+		s.loginSucceeded(r, username)
+	}
+}
+
+// Refresh endpoint exchanges a refresh token for new tokens, the refresh token included: each refresh token can only
+// be exchanged once. Exchanging one twice revokes every token of its session, since either the client or whoever stole
+// the token from it is presenting a token it shouldn't have.
+func (s *Service) Refresh(w http.ResponseWriter, r *http.Request) {
+	input := &RefreshInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var tokens *Tokens
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		tokens, err = s.exchange(r.Context(), tx, input.RefreshToken)
+		return err
+	})
+	if err == errInvalidRefreshToken {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, tokens)
+}
+
+// exchange rotates a refresh token within tx. Revocations it makes are kept when it returns errInvalidRefreshToken.
+func (s *Service) exchange(ctx context.Context, tx *sqlx.Tx, token string) (*Tokens, error) {
+	current := &refreshToken{}
+	err := tx.GetContext(ctx, current, SelectRefreshTokenForUpdateStmt, hashToken(token))
+	if err == sql.ErrNoRows {
+		return nil, errInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if current.RevokedAt != nil || !current.ExpiresAt.After(time.Now()) {
+		return nil, errInvalidRefreshToken
+	}
+
+	if current.UsedAt != nil {
+		s.logger.Printf("refresh token reused for user %d, revoking session %s", current.UserID, current.Family)
+		return nil, s.revokeFamily(ctx, tx, current.Family)
+	}
+
+	var status string
+	err = tx.GetContext(ctx, &status, SelectUserStatusStmt, current.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if status != users.StatusActive {
+		return nil, s.revokeFamily(ctx, tx, current.Family)
+	}
+
+	if _, err := tx.ExecContext(ctx, UseRefreshTokenStmt, current.ID); err != nil {
+		return nil, err
+	}
+
+	return s.issue(ctx, tx, current.UserID, current.Family, current.MultiFactor)
+}
+
+// revokeFamily revokes every token of a session, returning errInvalidRefreshToken unless that fails.
+func (s *Service) revokeFamily(ctx context.Context, tx *sqlx.Tx, family string) error {
+	if _, err := tx.ExecContext(ctx, RevokeFamilyStmt, family); err != nil {
+		return err
+	}
+	return errInvalidRefreshToken
+}
+
+// Logout endpoint revokes the session of a refresh token, responding with 204 No Content whether or not the token was
+// valid.
+func (s *Service) Logout(w http.ResponseWriter, r *http.Request) {
+	input := &RefreshInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if _, err := s.db.ExecContext(r.Context(), RevokeFamilyByTokenStmt, hashToken(input.RefreshToken)); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetPassword endpoint sets the password of a user, responding with 204 No Content. Every session of the user is
+// revoked, so a stolen password, refresh token or session cookie stops working once the password is changed. Users
+// holding a role stricter than the caller's are answered with 403 Forbidden.
+func (s *Service) SetPassword(w http.ResponseWriter, r *http.Request) {
+	input := &PasswordInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if problem := validatePassword(input.Password); problem != "" {
+		s.render(w, r, http.StatusUnprocessableEntity, map[string]string{"password": problem})
+		return
+	}
+
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if !s.mayTakeOver(w, r, userID) {
+		return
+	}
+
+	err := s.setPassword(r.Context(), userID, input.Password)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPassword hashes and stores the password of a user and revokes its sessions. Returns sql.ErrNoRows if the user
+// doesn't exist.
+func (s *Service) setPassword(ctx context.Context, userID int64, password string) error {
+	hash, err := hashPassword(password, s.passwordIterations)
+	if err != nil {
+		return err
+	}
+
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return storePassword(ctx, tx, userID, hash)
+	})
+}
+
+// storePassword stores the hash of the password of a user and revokes its sessions within tx. Returns sql.ErrNoRows
+// if the user doesn't exist.
+func storePassword(ctx context.Context, tx *sqlx.Tx, userID int64, hash string) error {
+	var status string
+	if err := tx.GetContext(ctx, &status, SelectUserStatusStmt, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, UpsertPasswordStmt, userID, hash); err != nil {
+		return err
+	}
+
+	return revokeUser(ctx, tx, userID)
+}
+
+// revokeUser revokes every refresh token and session of a user within tx.
+func revokeUser(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	for _, stmt := range []string{RevokeUserTokensStmt, RevokeUserSessionsStmt} {
+		if _, err := tx.ExecContext(ctx, stmt, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// issue signs an access token for a user and stores a refresh token continuing its session, within tx. Both remember
+// whether the user proved a second factor when the session started. The access token is bound to the tenant of ctx.
+func (s *Service) issue(ctx context.Context, tx *sqlx.Tx, userID int64, family string, multiFactor bool) (*Tokens, error) {
+	methods := []string{methodPassword}
+	if multiFactor {
+		methods = append(methods, methodOTP, methodMFA)
+	}
+
+	now := time.Now()
+	accessToken, err := s.keys.Sign(&jwt.Claims{
+		Issuer:      s.issuer,
+		Subject:     "user:" + strconv.FormatInt(userID, 10),
+		Audience:    s.audience,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   now.Add(s.accessTTL).Unix(),
+		ID:          jwt.NewID(),
+		AuthMethods: methods,
+		Tenant:      reqctx.Tenant(ctx),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refresh := RefreshTokenPrefix + randomString(32)
+	_, err = tx.ExecContext(ctx, InsertRefreshTokenStmt, family, userID, hashToken(refresh), multiFactor,
+		s.refreshTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(s.accessTTL.Seconds()),
+		RefreshToken: refresh,
+	}, nil
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds or returns errInvalidRefreshToken or errInvalidSecondFactor,
+// which may follow a revocation or a failed attempt that must stick.
+func (s *Service) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil && err != errInvalidRefreshToken && err != errInvalidSecondFactor {
+		return err
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return commitErr
+	}
+
+	return err
+}
+
+// Expire removes expired refresh tokens, sessions, login challenges and tokens sent by email. Returns the number of
+// rows removed.
+func (s *Service) Expire(ctx context.Context) (int64, error) {
+	var removed int64
+	for _, stmt := range []string{ExpireStmt, ExpireSessionsStmt, ExpireChallengesStmt, ExpireEmailTokensStmt} {
+		result, err := s.db.ExecContext(ctx, stmt)
+		if err != nil {
+			return removed, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// RunExpirer calls Expire every expire interval until ctx is done. Blocks, so run it in its own goroutine. Expired
+// tokens and sessions are never accepted whether or not they have been removed, so removal only keeps the table small.
+func (s *Service) RunExpirer(ctx context.Context) {
+	if s.expireInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Expire(ctx); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+}
+
+// Name implements users.PersonalData.
+func (s *Service) Name() string {
+	return "credentials"
+}
+
+// Export implements users.PersonalData: when the password of the user was set, its sessions, whether it is enrolled
+// in TOTP and when it verified its email, never the hashes of the password or tokens nor the TOTP secret.
+func (s *Service) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	archive := &CredentialsArchive{Sessions: []*Session{}, CookieSessions: []*CookieSession{}}
+
+	var updatedAt time.Time
+	err := tx.GetContext(ctx, &updatedAt, SelectCredentialsStmt, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil {
+		archive.PasswordUpdatedAt = &updatedAt
+	}
+
+	if err := tx.SelectContext(ctx, &archive.Sessions, SelectUserSessionsStmt, userID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.SelectContext(ctx, &archive.CookieSessions, SelectAllUserCookieSessionsStmt, userID); err != nil {
+		return nil, err
+	}
+	for _, session := range archive.CookieSessions {
+		session.CSRFToken = ""
+	}
+
+	err = tx.GetContext(ctx, &archive.TOTPConfirmedAt, SelectTOTPConfirmedAtStmt, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err := tx.GetContext(ctx, &archive.RecoveryCodesLeft, CountRecoveryCodesStmt, userID); err != nil {
+		return nil, err
+	}
+
+	err = tx.GetContext(ctx, &archive.EmailVerifiedAt, SelectEmailVerifiedAtStmt, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	return archive, nil
+}
+
+// Erase implements users.PersonalData: the password, sessions, second factor and email tokens and verification of the
+// user are deleted.
+func (s *Service) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	for _, stmt := range []string{DeleteCredentialsStmt, DeleteUserTokensStmt, DeleteUserSessionsStmt,
+		DeleteUserEmailTokensStmt, DeleteEmailVerificationStmt} {
+		if _, err := tx.ExecContext(ctx, stmt, userID); err != nil {
+			return err
+		}
+	}
+	return removeSecondFactor(ctx, tx, userID)
+}
+
+// hasMethod reports whether methods includes method.
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// newFamily returns the ID of a new session.
+func newFamily() string {
+	return randomString(16)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms, see its documentation.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashToken returns the hash refresh tokens and session cookies are stored as. They carry 256 bits of entropy, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
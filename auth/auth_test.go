@@ -0,0 +1,649 @@
+package auth_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/auth"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/b3ntly/twelvefactor_databases/lockout"
+	"github.com/b3ntly/twelvefactor_databases/mail"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/b3ntly/twelvefactor_databases/totp"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	service := auth.New(&auth.Config{
+		Ctx:                ctx,
+		Logger:             log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:                 db,
+		Keys:               keys,
+		Issuer:             "twelvefactor",
+		Audience:           "twelvefactor",
+		PasswordIterations: 1000,
+	})
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "wilma", "", "", users.StatusActive, ""))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	var actor string
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		actor = reqctx.Actor(r.Context())
+	})
+
+	handler := service.Authenticate(router)
+	send := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	login := func(password string) (int, *auth.Tokens) {
+		w := send("POST", "http://localhost:9090/auth/login", fmt.Sprintf(`{"username": "Wilma", "password": %q}`, password), "")
+		tokens := &auth.Tokens{}
+		if w.Code == 200 {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), tokens))
+		}
+		return w.Code, tokens
+	}
+
+	refresh := func(token string) (int, *auth.Tokens) {
+		w := send("POST", "http://localhost:9090/auth/refresh", fmt.Sprintf(`{"refreshToken": %q}`, token), "")
+		tokens := &auth.Tokens{}
+		if w.Code == 200 {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), tokens))
+		}
+		return w.Code, tokens
+	}
+
+	passwordURL := fmt.Sprintf("http://localhost:9090/auth/users/%d/password", user.ID)
+
+	// Users without a password can't log in, and unknown users are answered alike.
+	code, _ := login("yabba dabba doo")
+	require.Equal(t, 401, code)
+	w := send("POST", "http://localhost:9090/auth/login", `{"username": "betty", "password": "yabba dabba doo"}`, "")
+	require.Equal(t, 401, w.Code)
+
+	require.Equal(t, 422, send("PUT", passwordURL, `{"password": "short"}`, "").Code)
+	require.Equal(t, 204, send("PUT", passwordURL, `{"password": "yabba dabba doo"}`, "").Code)
+	require.Equal(t, 404, send("PUT", "http://localhost:9090/auth/users/0/password", `{"password": "yabba dabba doo"}`, "").Code)
+
+	code, _ = login("wrong password")
+	require.Equal(t, 401, code)
+
+	code, tokens := login("yabba dabba doo")
+	require.Equal(t, 200, code)
+	require.Equal(t, "Bearer", tokens.TokenType)
+	require.True(t, strings.HasPrefix(tokens.RefreshToken, auth.RefreshTokenPrefix))
+
+	// Access tokens authenticate requests as the user.
+	require.Equal(t, 200, send("GET", "http://localhost:9090/whoami", "", tokens.AccessToken).Code)
+	require.Equal(t, fmt.Sprintf("user:%d", user.ID), actor)
+	require.Equal(t, 401, send("GET", "http://localhost:9090/whoami", "", tokens.AccessToken+"x").Code)
+
+	// Refresh tokens rotate.
+	code, rotated := refresh(tokens.RefreshToken)
+	require.Equal(t, 200, code)
+	require.NotEqual(t, tokens.RefreshToken, rotated.RefreshToken)
+
+	code, next := refresh(rotated.RefreshToken)
+	require.Equal(t, 200, code)
+
+	// Reusing an exchanged token revokes the whole session, including the token issued last.
+	code, _ = refresh(rotated.RefreshToken)
+	require.Equal(t, 401, code)
+	code, _ = refresh(next.RefreshToken)
+	require.Equal(t, 401, code)
+
+	// Logging out revokes the session.
+	_, tokens = login("yabba dabba doo")
+	require.Equal(t, 204, send("POST", "http://localhost:9090/auth/logout", fmt.Sprintf(`{"refreshToken": %q}`, tokens.RefreshToken), "").Code)
+	code, _ = refresh(tokens.RefreshToken)
+	require.Equal(t, 401, code)
+
+	// Changing the password revokes every session.
+	_, tokens = login("yabba dabba doo")
+	require.Equal(t, 204, send("PUT", passwordURL, `{"password": "bedrock forever"}`, "").Code)
+	code, _ = refresh(tokens.RefreshToken)
+	require.Equal(t, 401, code)
+
+	// Suspended users can neither log in nor refresh.
+	_, tokens = login("bedrock forever")
+	_, err = db.ExecContext(ctx, "UPDATE users SET status = $2 WHERE id = $1", user.ID, users.StatusSuspended)
+	require.Nil(t, err)
+	code, _ = login("bedrock forever")
+	require.Equal(t, 401, code)
+	code, _ = refresh(tokens.RefreshToken)
+	require.Equal(t, 401, code)
+
+	w = send("GET", "http://localhost:9090/.well-known/jwks.json", "", "")
+	require.Equal(t, 200, w.Code)
+	jwks := &jwt.JWKS{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), jwks))
+	require.Equal(t, "test", jwks.Keys[0].KeyID)
+}
+
+func TestService_Sessions(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	service := auth.New(&auth.Config{
+		Ctx:                ctx,
+		Logger:             log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:                 db,
+		Keys:               keys,
+		PasswordIterations: 1000,
+	})
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "fred", "", "", users.StatusActive, ""))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	var actor string
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		actor = reqctx.Actor(r.Context())
+	}).Methods("GET", "POST")
+
+	handler := service.AuthenticateSession(service.ProtectCSRF(router))
+	send := func(method, target, body string, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+		actor = ""
+		req := httptest.NewRequest(method, "https://localhost:9090"+target, strings.NewReader(body))
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		if csrf != "" {
+			req.Header.Set(auth.CSRFHeader, csrf)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	login := func() (*http.Cookie, *auth.CookieSession) {
+		w := send("POST", "/auth/sessions", `{"username": "fred", "password": "yabba dabba doo"}`, nil, "")
+		require.Equal(t, 201, w.Code)
+
+		cookies := w.Result().Cookies()
+		require.Len(t, cookies, 1)
+		require.True(t, cookies[0].HttpOnly)
+		require.True(t, cookies[0].Secure)
+		require.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+		require.True(t, strings.HasPrefix(cookies[0].Value, auth.SessionCookiePrefix))
+
+		session := &auth.CookieSession{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), session))
+		require.NotEmpty(t, session.CSRFToken)
+		return cookies[0], session
+	}
+
+	sessionsURL := fmt.Sprintf("/auth/users/%d/sessions", user.ID)
+
+	require.Equal(t, 401, send("POST", "/auth/sessions", `{"username": "fred", "password": "yabba dabba doo"}`, nil, "").Code)
+	require.Equal(t, 204, send("PUT", fmt.Sprintf("/auth/users/%d/password", user.ID), `{"password": "yabba dabba doo"}`, nil, "").Code)
+
+	cookie, session := login()
+
+	// The cookie authenticates requests as the user.
+	require.Equal(t, 200, send("GET", "/whoami", "", cookie, "").Code)
+	require.Equal(t, fmt.Sprintf("user:%d", user.ID), actor)
+
+	w := send("GET", "/auth/sessions/current", "", cookie, "")
+	require.Equal(t, 200, w.Code)
+	current := &auth.CookieSession{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), current))
+	require.Equal(t, session.ID, current.ID)
+	require.Equal(t, session.CSRFToken, current.CSRFToken)
+
+	// Unsafe methods require the CSRF token of the session.
+	require.Equal(t, 403, send("POST", "/whoami", "", cookie, "").Code)
+	require.Equal(t, 403, send("POST", "/whoami", "", cookie, "not the token").Code)
+	require.Equal(t, 200, send("POST", "/whoami", "", cookie, session.CSRFToken).Code)
+
+	// Sessions are listed without their CSRF tokens, and logged out one at a time.
+	other, _ := login()
+	w = send("GET", sessionsURL, "", nil, "")
+	require.Equal(t, 200, w.Code)
+	listed := []*auth.CookieSession{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &listed))
+	require.Len(t, listed, 2)
+	require.Empty(t, listed[0].CSRFToken)
+
+	require.Equal(t, 204, send("DELETE", fmt.Sprintf("%s/%d", sessionsURL, session.ID), "", nil, "").Code)
+	require.Equal(t, 404, send("DELETE", fmt.Sprintf("%s/%d", sessionsURL, session.ID), "", nil, "").Code)
+
+	// Revoked cookies are cleared and no longer authenticate.
+	w = send("GET", "/whoami", "", cookie, "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "", actor)
+	require.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+	require.Equal(t, 401, send("GET", "/auth/sessions/current", "", cookie, "").Code)
+
+	// Logging out everywhere revokes every session.
+	require.Equal(t, 200, send("GET", "/whoami", "", other, "").Code)
+	require.NotEqual(t, "", actor)
+	require.Equal(t, 204, send("DELETE", sessionsURL, "", nil, "").Code)
+	require.Equal(t, 200, send("GET", "/whoami", "", other, "").Code)
+	require.Equal(t, "", actor)
+
+	// Logging out requires the CSRF token like any unsafe request.
+	cookie, session = login()
+	require.Equal(t, 403, send("DELETE", "/auth/sessions/current", "", cookie, "").Code)
+	require.Equal(t, 204, send("DELETE", "/auth/sessions/current", "", cookie, session.CSRFToken).Code)
+	require.Equal(t, 401, send("GET", "/auth/sessions/current", "", cookie, "").Code)
+
+	// Sessions of suspended users stop authenticating.
+	cookie, _ = login()
+	_, err = db.ExecContext(ctx, "UPDATE users SET status = $2 WHERE id = $1", user.ID, users.StatusSuspended)
+	require.Nil(t, err)
+	require.Equal(t, 401, send("GET", "/auth/sessions/current", "", cookie, "").Code)
+}
+
+func TestService_TwoFactor(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	// Codes are checked against a clock the test moves forward, a period at a time.
+	now := time.Unix(1700000000, 0)
+	service := auth.New(&auth.Config{
+		Ctx:                ctx,
+		Logger:             log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:                 db,
+		Keys:               keys,
+		Issuer:             "twelvefactor",
+		PasswordIterations: 1000,
+		Now:                func() time.Time { return now },
+	})
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "barney", "", "", users.StatusActive, ""))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	handler := service.Authenticate(router)
+	send := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:9090"+target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	decode := func(w *httptest.ResponseRecorder, v interface{}) {
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), v), w.Body.String())
+	}
+
+	code := func() string {
+		now = now.Add(totp.Period)
+		c, err := totp.Code(secretOf(t, db, user.ID), totp.Counter(now))
+		require.Nil(t, err)
+		return c
+	}
+
+	challenge := func() string {
+		w := send("POST", "/auth/login", `{"username": "barney", "password": "yabba dabba doo"}`, "")
+		require.Equal(t, 202, w.Code)
+		c := &auth.Challenge{}
+		decode(w, c)
+		require.True(t, strings.HasPrefix(c.Challenge, auth.ChallengePrefix))
+		return c.Challenge
+	}
+
+	verify := func(challenge, field, value string) (int, *auth.Tokens) {
+		w := send("POST", "/auth/login/verify", fmt.Sprintf(`{"challenge": %q, %q: %q}`, challenge, field, value), "")
+		tokens := &auth.Tokens{}
+		if w.Code == 200 {
+			decode(w, tokens)
+		}
+		return w.Code, tokens
+	}
+
+	require.Equal(t, 204, send("PUT", fmt.Sprintf("/auth/users/%d/password", user.ID), `{"password": "yabba dabba doo"}`, "").Code)
+
+	w := send("POST", "/auth/login", `{"username": "barney", "password": "yabba dabba doo"}`, "")
+	require.Equal(t, 200, w.Code)
+	password := &auth.Tokens{}
+	decode(w, password)
+
+	// Enrolling.
+	require.Equal(t, 401, send("POST", "/auth/totp", "", "").Code)
+	w = send("POST", "/auth/totp", "", password.AccessToken)
+	require.Equal(t, 201, w.Code)
+	enrollment := &auth.Enrollment{}
+	decode(w, enrollment)
+	require.True(t, strings.HasPrefix(enrollment.ProvisioningURI, "otpauth://totp/twelvefactor:barney?"))
+	require.Equal(t, enrollment.Secret, secretOf(t, db, user.ID))
+
+	require.Equal(t, 422, send("POST", "/auth/totp/confirm", `{"code": "000000"}`, password.AccessToken).Code)
+	w = send("POST", "/auth/totp/confirm", fmt.Sprintf(`{"code": %q}`, code()), password.AccessToken)
+	require.Equal(t, 200, w.Code)
+	recovery := &auth.RecoveryCodes{}
+	decode(w, recovery)
+	require.Len(t, recovery.RecoveryCodes, 10)
+	require.Equal(t, 409, send("POST", "/auth/totp", "", password.AccessToken).Code)
+
+	// Logging in takes a code from then on, each accepted once.
+	c := challenge()
+	status, _ := verify(c, "code", "000000")
+	require.Equal(t, 401, status)
+	current := code()
+	status, tokens := verify(c, "code", current)
+	require.Equal(t, 200, status)
+	status, _ = verify(challenge(), "code", current)
+	require.Equal(t, 401, status)
+
+	claims := &jwt.Claims{}
+	require.Nil(t, keys.Parse(tokens.AccessToken, claims))
+	require.Contains(t, claims.AuthMethods, "mfa")
+
+	// Refreshed tokens keep the second factor.
+	w = send("POST", "/auth/refresh", fmt.Sprintf(`{"refreshToken": %q}`, tokens.RefreshToken), "")
+	require.Equal(t, 200, w.Code)
+	refreshed := &auth.Tokens{}
+	decode(w, refreshed)
+	claims = &jwt.Claims{}
+	require.Nil(t, keys.Parse(refreshed.AccessToken, claims))
+	require.Contains(t, claims.AuthMethods, "mfa")
+
+	// Challenges are dropped after too many wrong codes.
+	c = challenge()
+	for i := 0; i < 5; i++ {
+		status, _ = verify(c, "code", "000000")
+		require.Equal(t, 401, status)
+	}
+	status, _ = verify(c, "code", code())
+	require.Equal(t, 401, status)
+
+	// Recovery codes are accepted once, in any case.
+	status, _ = verify(challenge(), "recoveryCode", strings.ToUpper(recovery.RecoveryCodes[0]))
+	require.Equal(t, 200, status)
+	status, _ = verify(challenge(), "recoveryCode", recovery.RecoveryCodes[0])
+	require.Equal(t, 401, status)
+
+	// Browsers complete their login the same way.
+	w = send("POST", "/auth/sessions", `{"username": "barney", "password": "yabba dabba doo"}`, "")
+	require.Equal(t, 202, w.Code)
+	sessionChallenge := &auth.Challenge{}
+	decode(w, sessionChallenge)
+	w = send("POST", "/auth/sessions/verify", fmt.Sprintf(`{"challenge": %q, "code": %q}`, sessionChallenge.Challenge, code()), "")
+	require.Equal(t, 201, w.Code)
+	session := &auth.CookieSession{}
+	decode(w, session)
+	require.True(t, session.MultiFactor)
+
+	// Disabling takes a login with a second factor.
+	require.Equal(t, 403, send("DELETE", "/auth/totp", "", password.AccessToken).Code)
+	require.Equal(t, 403, send("POST", "/auth/totp/recovery-codes", "", password.AccessToken).Code)
+	require.Equal(t, 200, send("POST", "/auth/totp/recovery-codes", "", tokens.AccessToken).Code)
+	require.Equal(t, 204, send("DELETE", "/auth/totp", "", tokens.AccessToken).Code)
+	require.Equal(t, 200, send("POST", "/auth/login", `{"username": "barney", "password": "yabba dabba doo"}`, "").Code)
+	require.Equal(t, 404, send("DELETE", fmt.Sprintf("/auth/users/%d/totp", user.ID), "", "").Code)
+}
+
+// secretOf returns the TOTP secret of a user as stored, in plaintext without a keyring.
+func secretOf(t *testing.T, db *sqlx.DB, userID int64) string {
+	var secret string
+	require.Nil(t, db.Get(&secret, "SELECT secret FROM user_totp WHERE user_id = $1", userID))
+	return secret
+}
+
+func TestService_Email(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	// Emails are stored encrypted, and messages are sent to their plaintext.
+	keyring, err := fieldcrypt.NewKeyring("k1", map[string][]byte{"k1": make([]byte, fieldcrypt.KeySize)},
+		make([]byte, fieldcrypt.KeySize))
+	require.Nil(t, err)
+	sealed := func(email string) string {
+		ciphertext, err := keyring.Seal(email)
+		require.Nil(t, err)
+		return ciphertext
+	}
+
+	mailer := &mail.Memory{}
+	service := auth.New(&auth.Config{
+		Ctx:                ctx,
+		Logger:             log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:                 db,
+		Keys:               keys,
+		PasswordIterations: 1000,
+		Mailer:             mailer,
+		PublicURL:          "https://admin.example.com/",
+		Keyring:            keyring,
+	})
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "pebbles", sealed("pebbles@example.com"), "",
+		users.StatusActive, keyring.BlindIndex("pebbles@example.com")))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	handler := service.Authenticate(router)
+	send := func(method, target, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "http://localhost:9090"+target, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// The token of the link in the last message sent to an address, after checking the link.
+	linked := func(to, path string) string {
+		msg := mailer.Last(to)
+		require.NotNil(t, msg)
+		match := regexp.MustCompile(`https://admin\.example\.com/` + path + `\?token=(\S+)`).FindStringSubmatch(msg.Text)
+		require.Len(t, match, 2, msg.Text)
+		token, err := url.QueryUnescape(match[1])
+		require.Nil(t, err)
+		return token
+	}
+
+	verified := func() bool {
+		w := send("GET", fmt.Sprintf("/auth/users/%d/email-verification", user.ID), "", "")
+		require.Equal(t, 200, w.Code)
+		verification := &auth.EmailVerification{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), verification))
+		return verification.Verified
+	}
+
+	// Unknown addresses are answered alike, without a message.
+	require.Equal(t, 202, send("POST", "/auth/password-reset", `{"email": "bamm-bamm@example.com"}`, "").Code)
+	require.Len(t, mailer.Sent(), 0)
+
+	require.Equal(t, 202, send("POST", "/auth/password-reset", `{"email": "Pebbles@Example.com"}`, "").Code)
+	first := linked("pebbles@example.com", "reset-password")
+	require.Equal(t, "Reset your password", mailer.Last("pebbles@example.com").Subject)
+	require.Contains(t, mailer.Last("pebbles@example.com").Text, "within 1 hour")
+
+	// Only the last link sent works, once.
+	require.Equal(t, 202, send("POST", "/auth/password-reset", `{"email": "pebbles@example.com"}`, "").Code)
+	second := linked("pebbles@example.com", "reset-password")
+	require.NotEqual(t, first, second)
+
+	require.Equal(t, 400, send("POST", "/auth/password-reset/confirm", fmt.Sprintf(`{"token": %q, "password": "rock and roll forever"}`, first), "").Code)
+	require.Equal(t, 422, send("POST", "/auth/password-reset/confirm", fmt.Sprintf(`{"token": %q, "password": "short"}`, second), "").Code)
+	require.Equal(t, 204, send("POST", "/auth/password-reset/confirm", fmt.Sprintf(`{"token": %q, "password": "rock and roll forever"}`, second), "").Code)
+	require.Equal(t, 400, send("POST", "/auth/password-reset/confirm", fmt.Sprintf(`{"token": %q, "password": "rock and roll forever"}`, second), "").Code)
+
+	w := send("POST", "/auth/login", `{"username": "pebbles", "password": "rock and roll forever"}`, "")
+	require.Equal(t, 200, w.Code)
+	tokens := &auth.Tokens{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), tokens))
+
+	// Resetting the password proved the address, until it changes.
+	require.True(t, verified())
+	_, err = db.ExecContext(ctx, "UPDATE users SET email = $2, email_index = $3 WHERE id = $1",
+		user.ID, sealed("pebbles@bedrock.example.com"), keyring.BlindIndex("pebbles@bedrock.example.com"))
+	require.Nil(t, err)
+	require.False(t, verified())
+
+	require.Equal(t, 401, send("POST", "/auth/email-verification", "", "").Code)
+	require.Equal(t, 202, send("POST", "/auth/email-verification", "", tokens.AccessToken).Code)
+	token := linked("pebbles@bedrock.example.com", "verify-email")
+
+	// Tokens only work for their own purpose.
+	require.Equal(t, 400, send("POST", "/auth/password-reset/confirm", fmt.Sprintf(`{"token": %q, "password": "rock and roll forever"}`, token), "").Code)
+	require.Equal(t, 204, send("POST", "/auth/email-verification/confirm", fmt.Sprintf(`{"token": %q}`, token), "").Code)
+	require.True(t, verified())
+	require.Equal(t, 400, send("POST", "/auth/email-verification/confirm", fmt.Sprintf(`{"token": %q}`, token), "").Code)
+
+	// Links sent to an address the user changed since don't verify the new one.
+	require.Equal(t, 202, send("POST", "/auth/email-verification", "", tokens.AccessToken).Code)
+	token = linked("pebbles@bedrock.example.com", "verify-email")
+	_, err = db.ExecContext(ctx, "UPDATE users SET email = $2, email_index = $3 WHERE id = $1",
+		user.ID, sealed("pebbles@example.org"), keyring.BlindIndex("pebbles@example.org"))
+	require.Nil(t, err)
+	require.Equal(t, 409, send("POST", "/auth/email-verification/confirm", fmt.Sprintf(`{"token": %q}`, token), "").Code)
+	require.False(t, verified())
+}
+
+func TestService_Lockout(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
+	lockouts := lockout.New(&lockout.Config{
+		Ctx:    ctx,
+		Logger: logger,
+		DB:     db,
+		Policy: lockout.Policy{DelayAfter: 100, AccountThreshold: 3, IPThreshold: 1000},
+	})
+	_, err = db.ExecContext(ctx, "DELETE FROM login_attempts; DELETE FROM security_events;")
+	require.Nil(t, err)
+
+	service := auth.New(&auth.Config{
+		Ctx:                ctx,
+		Logger:             logger,
+		DB:                 db,
+		Keys:               keys,
+		PasswordIterations: 1000,
+		Lockout:            lockouts,
+	})
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "barney", "", "", users.StatusActive, ""))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+	lockouts.Mount(router)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, "http://localhost:9090"+target, strings.NewReader(body)))
+		return w
+	}
+	login := func(username, password string) *httptest.ResponseRecorder {
+		return send("POST", "/auth/login", fmt.Sprintf(`{"username": %q, "password": %q}`, username, password))
+	}
+
+	require.Equal(t, 204, send("PUT", fmt.Sprintf("/auth/users/%d/password", user.ID), `{"password": "yabba dabba doo"}`).Code)
+
+	// Known and unknown usernames are locked out alike, and locked out accounts aren't told whether the password was
+	// right.
+	for _, username := range []string{"barney", "dino"} {
+		for i := 0; i < 3; i++ {
+			require.Equal(t, 401, login(username, "wrong password").Code)
+		}
+		w := login(username, "yabba dabba doo")
+		require.Equal(t, 429, w.Code)
+		require.NotEmpty(t, w.Header().Get("Retry-After"))
+		require.Equal(t, "too many failed logins, retry later\n", w.Body.String())
+	}
+
+	require.Equal(t, 204, send("DELETE", "/lockouts/account/barney", "").Code)
+	require.Equal(t, 200, login("barney", "yabba dabba doo").Code)
+
+	// Logging in forgets earlier failures.
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 401, login("barney", "wrong password").Code)
+	}
+	require.Equal(t, 200, login("barney", "yabba dabba doo").Code)
+	require.Equal(t, 401, login("barney", "wrong password").Code)
+	require.Equal(t, 200, login("barney", "yabba dabba doo").Code)
+}
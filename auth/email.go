@@ -0,0 +1,343 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/mail"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// EmailTokenPrefix starts every token sent by email.
+const EmailTokenPrefix = "tfe_"
+
+// Purposes of the tokens sent by email. A token is only accepted for its own purpose.
+const (
+	purposePasswordReset = "password_reset"
+	purposeVerifyEmail   = "verify_email"
+)
+
+// Templates of the messages sent, overridden by files of the same name with a .tmpl extension in the templates
+// directory. They are executed with a MessageData.
+const (
+	PasswordResetTemplate = "password_reset"
+	VerifyEmailTemplate   = "verify_email"
+)
+
+var defaultTemplates = map[string]string{
+	PasswordResetTemplate: `Subject: Reset your password
+
+Hello {{.Username}},
+
+Someone asked to reset the password of your account. If it was you, choose a new password within {{.ExpiresIn}}:
+
+{{.URL}}
+
+If it wasn't, ignore this message: your password hasn't changed.
+`,
+	VerifyEmailTemplate: `Subject: Verify your email address
+
+Hello {{.Username}},
+
+Confirm this is your email address within {{.ExpiresIn}}:
+
+{{.URL}}
+`,
+}
+
+var (
+	errInvalidEmailToken = errors.New("invalid or expired token")
+	errEmailChanged      = errors.New("the email address changed since the token was sent")
+)
+
+type (
+	// EmailInput is the body accepted by the endpoint requesting a password reset.
+	EmailInput struct {
+		Email string `json:"email"`
+	}
+
+	// ResetPasswordInput is the body accepted by the endpoint resetting a password.
+	ResetPasswordInput struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	// TokenInput is the body accepted by the endpoint verifying an email.
+	TokenInput struct {
+		Token string `json:"token"`
+	}
+
+	// EmailVerification tells whether the current email of a user was verified.
+	EmailVerification struct {
+		Verified   bool       `json:"verified"`
+		VerifiedAt *time.Time `json:"verifiedAt,omitempty"`
+	}
+
+	// MessageData is what templates are executed with.
+	MessageData struct {
+		Username string
+		// The link completing the flow, to the public URL with the token as a query parameter.
+		URL   string
+		Token string
+		// How long the link is valid, in words.
+		ExpiresIn string
+	}
+
+	contact struct {
+		ID         int64  `db:"id"`
+		Username   string `db:"username"`
+		Email      string `db:"email"`
+		EmailIndex string `db:"email_index"`
+		Status     string `db:"status"`
+	}
+
+	usedEmailToken struct {
+		UserID     int64  `db:"user_id"`
+		EmailIndex string `db:"email_index"`
+	}
+)
+
+// loadTemplates parses the templates of the messages sent, from dir where it has them.
+func loadTemplates(dir string) (map[string]*mail.Template, error) {
+	templates := map[string]*mail.Template{}
+	for name, fallback := range defaultTemplates {
+		tmpl, err := mail.LoadTemplate(dir, name, fallback)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		templates[name] = tmpl
+	}
+	return templates, nil
+}
+
+// RequestPasswordReset endpoint emails a link resetting the password to the active user the address belongs to,
+// invalidating links sent before. Responds with 202 Accepted whether or not there is such a user, so the endpoint
+// doesn't tell which addresses have an account.
+func (s *Service) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	input := &EmailInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	user := &contact{}
+	index := s.keyring.BlindIndex(strings.ToLower(strings.TrimSpace(input.Email)))
+	err := s.db.GetContext(r.Context(), user, SelectUserByEmailStmt, index)
+	if err != nil && err != sql.ErrNoRows {
+		s.writeError(w, err)
+		return
+	}
+
+	if err == nil && user.Status == users.StatusActive {
+		if err := s.sendToken(r.Context(), user, purposePasswordReset, "reset-password", s.resetTTL); err != nil {
+			s.logger.Println(err)
+		}
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// ResetPassword endpoint sets the password of the user a password reset link was sent to, responding with 204 No
+// Content. Like changing it, resetting it revokes every session of the user; its second factor stays required.
+// Tokens which were used, expired or replaced by a later one are answered with 400 Bad Request.
+func (s *Service) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	input := &ResetPasswordInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if problem := validatePassword(input.Password); problem != "" {
+		s.render(w, r, http.StatusUnprocessableEntity, map[string]string{"password": problem})
+		return
+	}
+
+	hash, err := hashPassword(input.Password, s.passwordIterations)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	err = s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		token, err := useEmailToken(r.Context(), tx, input.Token, purposePasswordReset)
+		if err != nil {
+			return err
+		}
+
+		if err := storePassword(r.Context(), tx, token.UserID, hash); err != nil {
+			return err
+		}
+
+		// The link was delivered to the address, which proves it belongs to the user.
+		_, err = tx.ExecContext(r.Context(), VerifyEmailStmt, token.UserID, token.EmailIndex)
+		return err
+	})
+	if err == errInvalidEmailToken || err == sql.ErrNoRows {
+		http.Error(w, errInvalidEmailToken.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RequestEmailVerification endpoint emails a link verifying the address of the user making the request, responding
+// with 202 Accepted, or 422 Unprocessable Entity if the user has no email.
+func (s *Service) RequestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.self(w, r, false)
+	if !ok {
+		return
+	}
+
+	user := &contact{}
+	err := s.db.GetContext(r.Context(), user, SelectUserContactStmt, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if user.Email == "" {
+		s.render(w, r, http.StatusUnprocessableEntity, map[string]string{"email": "is not set"})
+		return
+	}
+
+	if err := s.sendToken(r.Context(), user, purposeVerifyEmail, "verify-email", s.verificationTTL); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyEmail endpoint marks the address an email verification link was sent to as verified, responding with 204 No
+// Content. Invalid tokens are answered with 400 Bad Request, and tokens sent to an address the user has since
+// changed with 409 Conflict.
+func (s *Service) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	input := &TokenInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		token, err := useEmailToken(r.Context(), tx, input.Token, purposeVerifyEmail)
+		if err != nil {
+			return err
+		}
+
+		result, err := tx.ExecContext(r.Context(), VerifyEmailStmt, token.UserID, token.EmailIndex)
+		if err != nil {
+			return err
+		}
+
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			return errEmailChanged
+		}
+		return nil
+	})
+	switch err {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errInvalidEmailToken:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errEmailChanged:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		s.writeError(w, err)
+	}
+}
+
+// GetEmailVerification endpoint returns whether the current email of a user was verified.
+func (s *Service) GetEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	verification := &EmailVerification{}
+	err := s.db.GetContext(r.Context(), &verification.VerifiedAt, SelectEmailVerifiedAtStmt, userID)
+	if err != nil && err != sql.ErrNoRows {
+		s.writeError(w, err)
+		return
+	}
+	verification.Verified = verification.VerifiedAt != nil
+
+	s.render(w, r, http.StatusOK, verification)
+}
+
+// sendToken stores a token for purpose, replacing the unused ones sent before, and emails it to the user as a link to
+// path under the public URL.
+func (s *Service) sendToken(ctx context.Context, user *contact, purpose, path string, ttl time.Duration) error {
+	token := EmailTokenPrefix + randomString(32)
+
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, DeleteEmailTokensStmt, user.ID, purpose); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, InsertEmailTokenStmt, hashToken(token), user.ID, purpose, user.EmailIndex,
+			ttl.Seconds())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	name := PasswordResetTemplate
+	if purpose == purposeVerifyEmail {
+		name = VerifyEmailTemplate
+	}
+
+	email, err := s.keyring.Open(user.Email)
+	if err != nil {
+		return err
+	}
+
+	msg, err := s.templates[name].Render(email, &MessageData{
+		Username:  user.Username,
+		URL:       strings.TrimSuffix(s.publicURL, "/") + "/" + path + "?token=" + url.QueryEscape(token),
+		Token:     token,
+		ExpiresIn: inWords(ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(ctx, msg)
+}
+
+// useEmailToken uses up a token sent for purpose within tx, returning errInvalidEmailToken if it can't be used.
+func useEmailToken(ctx context.Context, tx *sqlx.Tx, token, purpose string) (*usedEmailToken, error) {
+	used := &usedEmailToken{}
+	err := tx.GetContext(ctx, used, UseEmailTokenStmt, hashToken(token), purpose)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidEmailToken
+	}
+	return used, err
+}
+
+// inWords writes a duration the way messages read it, e.g. "1 hour" or "30 minutes".
+func inWords(d time.Duration) string {
+	n, unit := int64(d/time.Minute), "minute"
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		n, unit = int64(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		n, unit = int64(d/time.Hour), "hour"
+	}
+
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
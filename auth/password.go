@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bounds of a password, in characters. The upper bound keeps hashing a password cheap enough not to be an attack.
+const (
+	minPasswordLength = 10
+	maxPasswordLength = 256
+)
+
+// The scheme of password hashes, written as "pbkdf2-sha256$<iterations>$<salt>$<hash>" so the work factor can be raised
+// without invalidating existing hashes.
+const passwordScheme = "pbkdf2-sha256"
+
+// hashPassword derives the hash of a password with a random salt.
+func hashPassword(password string, iterations int) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s$%d$%s$%s", passwordScheme, iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches hash, in constant time.
+func checkPassword(password, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// validatePassword returns what is wrong with a new password, or "".
+func validatePassword(password string) string {
+	if n := utf8.RuneCountInString(password); n < minPasswordLength || n > maxPasswordLength {
+		return fmt.Sprintf("must be %d to %d characters", minPasswordLength, maxPasswordLength)
+	}
+	return ""
+}
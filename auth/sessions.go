@@ -0,0 +1,283 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// SessionCookiePrefix starts the value of every session cookie.
+const SessionCookiePrefix = "tfs_"
+
+// CSRFHeader carries the CSRF token of the session on requests with unsafe methods.
+const CSRFHeader = "X-CSRF-Token"
+
+// Names of the session cookie. The __Host- prefix makes browsers refuse the cookie unless it is Secure, scoped to the
+// whole host and set without a Domain, so neither plain HTTP nor a sibling subdomain can plant or overwrite it.
+const (
+	secureCookieName   = "__Host-tf_session"
+	insecureCookieName = "tf_session"
+)
+
+type sessionContextKey struct{}
+
+type (
+	// CookieSession is a browser logged in with a session cookie. Only the hash of the cookie is stored.
+	CookieSession struct {
+		ID        int64  `json:"id" db:"id"`
+		UserID    int64  `json:"userId" db:"user_id"`
+		UserAgent string `json:"userAgent" db:"user_agent"`
+		IP        string `json:"ip" db:"ip"`
+		// Whether the user proved a second factor when logging in.
+		MultiFactor bool `json:"multiFactor" db:"multi_factor"`
+		// Required of requests with unsafe methods, returned only to the session itself.
+		CSRFToken  string     `json:"csrfToken,omitempty" db:"csrf_token"`
+		CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+		LastSeenAt time.Time  `json:"lastSeenAt" db:"last_seen_at"`
+		ExpiresAt  time.Time  `json:"expiresAt" db:"expires_at"`
+		RevokedAt  *time.Time `json:"revokedAt,omitempty" db:"revoked_at"`
+	}
+)
+
+// AuthenticateSession returns next behind a middleware authenticating requests carrying a session cookie. The user of
+// the session becomes the principal and actor of the request, and the session slides: it expires after the idle
+// timeout from now, though never later than the maximum age after it started. Invalid or expired cookies are cleared
+// and the request passed through unauthenticated, as are requests already authenticated by a token or without a
+// cookie.
+func (s *Service) AuthenticateSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(s.cookieName())
+		if err != nil || access.FromContext(r.Context()) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		session := &CookieSession{}
+		err = s.db.GetContext(r.Context(), session, SelectSessionStmt, hashToken(cookie.Value))
+		if err == sql.ErrNoRows {
+			s.clearCookie(w)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		_, err = s.db.ExecContext(r.Context(), TouchSessionStmt, session.ID,
+			s.sessionIdleTimeout.Seconds(), s.sessionMaxAge.Seconds())
+		if err != nil {
+			s.logger.Println(err)
+		}
+
+		principal := &access.Principal{
+			ID:          "user:" + strconv.FormatInt(session.UserID, 10),
+			MultiFactor: session.MultiFactor,
+		}
+
+		ctx := access.WithPrincipal(r.Context(), principal)
+		ctx = reqctx.WithActor(ctx, principal.ID)
+		ctx = context.WithValue(ctx, sessionContextKey{}, session)
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ProtectCSRF returns next behind a middleware requiring requests authenticated by a session cookie to repeat the CSRF
+// token of their session in the X-CSRF-Token header unless their method is safe, answering 403 Forbidden otherwise.
+// Browsers attach cookies to requests other sites make them send, but those sites can't read the token to send along.
+// Requests authenticated otherwise carry no ambient credentials and are passed through. Mount it inside
+// AuthenticateSession.
+func (s *Service) ProtectCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromContext(r.Context())
+		if session == nil || isSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := r.Header.Get(CSRFHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) != 1 {
+			http.Error(w, "missing or invalid CSRF token", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CreateSession endpoint logs a browser in with the username and password of an active user, setting the session
+// cookie and responding with 201 Created and the session, CSRF token included. Wrong credentials and users enrolled in
+// TOTP are answered like the Login endpoint answers them, the latter completing the login with VerifySession.
+func (s *Service) CreateSession(w http.ResponseWriter, r *http.Request) {
+	input := &Credentials{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	userID, ok := s.checkCredentials(w, r, input)
+	if !ok {
+		return
+	}
+
+	if s.challenge(w, r, userID) {
+		return
+	}
+
+	s.loginSucceeded(r, input.Username)
+	s.startSession(w, r, userID, false)
+}
+
+// startSession starts a session of a user, setting its cookie and responding with 201 Created and the session.
+func (s *Service) startSession(w http.ResponseWriter, r *http.Request, userID int64, multiFactor bool) {
+	value := SessionCookiePrefix + randomString(32)
+	session := &CookieSession{}
+	err := s.db.GetContext(r.Context(), session, InsertSessionStmt, hashToken(value), userID, randomString(32),
+		r.UserAgent(), clientIP(r), multiFactor, s.sessionIdleTimeout.Seconds())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    value,
+		Path:     "/",
+		Expires:  session.CreatedAt.Add(s.sessionMaxAge),
+		Secure:   !s.insecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	s.render(w, r, http.StatusCreated, session)
+}
+
+// GetCurrentSession endpoint returns the session of the request cookie, CSRF token included, so a page loaded after
+// logging in can recover it. Requests without a session are answered with 401 Unauthorized.
+func (s *Service) GetCurrentSession(w http.ResponseWriter, r *http.Request) {
+	session := sessionFromContext(r.Context())
+	if session == nil {
+		http.Error(w, "no session", http.StatusUnauthorized)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, session)
+}
+
+// DeleteCurrentSession endpoint logs out the session of the request cookie and clears the cookie, responding with 204
+// No Content whether or not there was a session.
+func (s *Service) DeleteCurrentSession(w http.ResponseWriter, r *http.Request) {
+	if session := sessionFromContext(r.Context()); session != nil {
+		if _, err := s.db.ExecContext(r.Context(), RevokeSessionStmt, session.ID, session.UserID); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	s.clearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessions endpoint returns the live sessions of a user, most recent first, without their CSRF tokens.
+func (s *Service) ListSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	sessions := []*CookieSession{}
+	if err := s.db.SelectContext(r.Context(), &sessions, SelectUserCookieSessionsStmt, userID); err != nil {
+		s.writeError(w, err)
+		return
+	}
+	for _, session := range sessions {
+		session.CSRFToken = ""
+	}
+
+	s.render(w, r, http.StatusOK, sessions)
+}
+
+// RevokeSessions endpoint logs a user out everywhere, revoking its sessions and refresh tokens alike, and responds with
+// 204 No Content. Access tokens already issued stay valid until they expire.
+func (s *Service) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		return revokeUser(r.Context(), tx, userID)
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeSession endpoint logs out one live session of a user, responding with 204 No Content, or 404 Not Found if
+// the user has no such session.
+func (s *Service) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, _ := strconv.ParseInt(vars["id"], 10, 64)
+	sessionID, _ := strconv.ParseInt(vars["session"], 10, 64)
+
+	result, err := s.db.ExecContext(r.Context(), RevokeSessionStmt, sessionID, userID)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "no such session", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) cookieName() string {
+	if s.insecureCookies {
+		return insecureCookieName
+	}
+	return secureCookieName
+}
+
+func (s *Service) clearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   !s.insecureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func sessionFromContext(ctx context.Context) *CookieSession {
+	session, _ := ctx.Value(sessionContextKey{}).(*CookieSession)
+	return session
+}
+
+// isSafeMethod reports whether method is safe as defined by RFC 9110, only retrieving resources.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// clientIP returns the address of the peer of the request, without its port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
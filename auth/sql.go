@@ -0,0 +1,414 @@
+package auth
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS user_credentials (
+		user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+		password_hash TEXT NOT NULL,
+		updated_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		family TEXT NOT NULL,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		hash TEXT NOT NULL UNIQUE,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone,
+		revoked_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON refresh_tokens (user_id);
+	CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
+	CREATE TABLE IF NOT EXISTS user_sessions (
+		id BIGSERIAL PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		csrf_token TEXT NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		last_seen_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		revoked_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS user_sessions_user_id_idx ON user_sessions (user_id);
+	CREATE INDEX IF NOT EXISTS user_sessions_expires_at_idx ON user_sessions (expires_at);
+	ALTER TABLE refresh_tokens ADD COLUMN IF NOT EXISTS multi_factor BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE user_sessions ADD COLUMN IF NOT EXISTS multi_factor BOOLEAN NOT NULL DEFAULT false;
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+		secret TEXT NOT NULL,
+		last_counter BIGINT NOT NULL DEFAULT 0,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		confirmed_at timestamp with time zone
+	);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		hash TEXT NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		used_at timestamp with time zone,
+		PRIMARY KEY (user_id, hash)
+	);
+	CREATE TABLE IF NOT EXISTS login_challenges (
+		hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		expires_at timestamp with time zone NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS login_challenges_expires_at_idx ON login_challenges (expires_at);
+	CREATE TABLE IF NOT EXISTS email_tokens (
+		hash TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		purpose TEXT NOT NULL,
+		email_index TEXT NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS email_tokens_user_id_idx ON email_tokens (user_id);
+	CREATE INDEX IF NOT EXISTS email_tokens_expires_at_idx ON email_tokens (expires_at);
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		user_id INTEGER PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+		email_index TEXT NOT NULL,
+		verified_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	`
+
+	// Columns of a CookieSession.
+	sessionColumns = `id, user_id, csrf_token, user_agent, ip, multi_factor, created_at, last_seen_at, expires_at, ` +
+		`revoked_at`
+
+	// Select the user logging in by username, with the hash of its password if it has one.
+	SelectLoginStmt = `
+	SELECT u.id, u.status, COALESCE(c.password_hash, '') AS password_hash
+	FROM users u
+	LEFT JOIN user_credentials c ON c.user_id = u.id
+	WHERE lower(u.username) = lower($1) AND u.deleted_at IS NULL;
+	`
+
+	SelectUserStatusStmt = `
+	SELECT status
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	SelectUsernameStmt = `
+	SELECT username
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	UpsertPasswordStmt = `
+	INSERT INTO user_credentials (user_id, password_hash)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET
+		password_hash = EXCLUDED.password_hash,
+		updated_at = now();
+	`
+
+	SelectCredentialsStmt = `
+	SELECT updated_at
+	FROM user_credentials
+	WHERE user_id = $1;
+	`
+
+	DeleteCredentialsStmt = `
+	DELETE FROM user_credentials
+	WHERE user_id = $1;
+	`
+
+	InsertRefreshTokenStmt = `
+	INSERT INTO refresh_tokens
+		(family, user_id, hash, multi_factor, expires_at)
+	VALUES
+		($1, $2, $3, $4, now() + make_interval(secs => $5));
+	`
+
+	// Lock a refresh token while it is exchanged, so concurrent exchanges of the same token are serialized and all but
+	// the first see it used.
+	SelectRefreshTokenForUpdateStmt = `
+	SELECT id, family, user_id, multi_factor, expires_at, used_at, revoked_at
+	FROM refresh_tokens
+	WHERE hash = $1
+	FOR UPDATE;
+	`
+
+	UseRefreshTokenStmt = `
+	UPDATE refresh_tokens SET
+		used_at = now()
+	WHERE id = $1;
+	`
+
+	RevokeFamilyStmt = `
+	UPDATE refresh_tokens SET
+		revoked_at = now()
+	WHERE family = $1 AND revoked_at IS NULL;
+	`
+
+	// Revoke the family of a refresh token, logging out the session it belongs to.
+	RevokeFamilyByTokenStmt = `
+	UPDATE refresh_tokens SET
+		revoked_at = now()
+	WHERE family = (SELECT family FROM refresh_tokens WHERE hash = $1) AND revoked_at IS NULL;
+	`
+
+	RevokeUserTokensStmt = `
+	UPDATE refresh_tokens SET
+		revoked_at = now()
+	WHERE user_id = $1 AND revoked_at IS NULL;
+	`
+
+	// Sessions of a user, the families of refresh tokens it holds.
+	SelectUserSessionsStmt = `
+	SELECT family, min(created_at) AS created_at, max(expires_at) AS expires_at, max(revoked_at) AS revoked_at
+	FROM refresh_tokens
+	WHERE user_id = $1
+	GROUP BY family
+	ORDER BY min(created_at);
+	`
+
+	DeleteUserTokensStmt = `
+	DELETE FROM refresh_tokens
+	WHERE user_id = $1;
+	`
+
+	ExpireStmt = `
+	DELETE FROM refresh_tokens
+	WHERE expires_at < now();
+	`
+
+	ExpireSessionsStmt = `
+	DELETE FROM user_sessions
+	WHERE expires_at < now();
+	`
+
+	ExpireChallengesStmt = `
+	DELETE FROM login_challenges
+	WHERE expires_at < now();
+	`
+
+	// Start a session expiring after $7 seconds of inactivity.
+	InsertSessionStmt = `
+	INSERT INTO user_sessions
+		(hash, user_id, csrf_token, user_agent, ip, multi_factor, expires_at)
+	VALUES
+		($1, $2, $3, $4, $5, $6, now() + make_interval(secs => $7))
+	RETURNING ` + sessionColumns + `;
+	`
+
+	// Select a live session of an active user by the hash of its cookie.
+	SelectSessionStmt = `
+	SELECT ` + sessionColumns + `
+	FROM user_sessions s
+	WHERE s.hash = $1 AND s.revoked_at IS NULL AND s.expires_at > now() AND EXISTS (
+		SELECT 1 FROM users u WHERE u.id = s.user_id AND u.deleted_at IS NULL AND u.status = 'active'
+	);
+	`
+
+	// Slide the expiry of a session to $2 seconds from now, but no further than $3 seconds after it started. At most
+	// once a minute, so busy sessions don't write on every request.
+	TouchSessionStmt = `
+	UPDATE user_sessions SET
+		last_seen_at = now(),
+		expires_at = LEAST(created_at + make_interval(secs => $3), now() + make_interval(secs => $2))
+	WHERE id = $1 AND last_seen_at < now() - interval '1 minute';
+	`
+
+	SelectUserCookieSessionsStmt = `
+	SELECT ` + sessionColumns + `
+	FROM user_sessions
+	WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > now()
+	ORDER BY created_at DESC;
+	`
+
+	// Every session of a user, revoked and expired included, for access requests.
+	SelectAllUserCookieSessionsStmt = `
+	SELECT ` + sessionColumns + `
+	FROM user_sessions
+	WHERE user_id = $1
+	ORDER BY created_at;
+	`
+
+	RevokeSessionStmt = `
+	UPDATE user_sessions SET
+		revoked_at = now()
+	WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL;
+	`
+
+	RevokeUserSessionsStmt = `
+	UPDATE user_sessions SET
+		revoked_at = now()
+	WHERE user_id = $1 AND revoked_at IS NULL;
+	`
+
+	DeleteUserSessionsStmt = `
+	DELETE FROM user_sessions
+	WHERE user_id = $1;
+	`
+
+	// Start enrolling a user in TOTP, replacing an enrollment it didn't confirm. Enrollments it confirmed are kept.
+	UpsertTOTPStmt = `
+	INSERT INTO user_totp (user_id, secret)
+	VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET
+		secret = EXCLUDED.secret,
+		created_at = now()
+	WHERE user_totp.confirmed_at IS NULL;
+	`
+
+	// Lock the TOTP enrollment of a user while a code is checked, so a code can't be used twice concurrently.
+	SelectTOTPForUpdateStmt = `
+	SELECT secret, last_counter, confirmed_at
+	FROM user_totp
+	WHERE user_id = $1
+	FOR UPDATE;
+	`
+
+	SelectTOTPConfirmedAtStmt = `
+	SELECT confirmed_at
+	FROM user_totp
+	WHERE user_id = $1;
+	`
+
+	SelectTOTPSecretsForUpdateStmt = `
+	SELECT user_id, secret
+	FROM user_totp
+	FOR UPDATE;
+	`
+
+	UpdateTOTPSecretStmt = `
+	UPDATE user_totp SET
+		secret = $2
+	WHERE user_id = $1;
+	`
+
+	// Record the counter of the code just accepted, confirming the enrollment if it wasn't.
+	UseTOTPStmt = `
+	UPDATE user_totp SET
+		last_counter = $2,
+		confirmed_at = COALESCE(confirmed_at, now())
+	WHERE user_id = $1;
+	`
+
+	DeleteTOTPStmt = `
+	DELETE FROM user_totp
+	WHERE user_id = $1;
+	`
+
+	InsertRecoveryCodeStmt = `
+	INSERT INTO recovery_codes (user_id, hash)
+	VALUES ($1, $2);
+	`
+
+	UseRecoveryCodeStmt = `
+	UPDATE recovery_codes SET
+		used_at = now()
+	WHERE user_id = $1 AND hash = $2 AND used_at IS NULL;
+	`
+
+	CountRecoveryCodesStmt = `
+	SELECT count(*)
+	FROM recovery_codes
+	WHERE user_id = $1 AND used_at IS NULL;
+	`
+
+	DeleteRecoveryCodesStmt = `
+	DELETE FROM recovery_codes
+	WHERE user_id = $1;
+	`
+
+	InsertChallengeStmt = `
+	INSERT INTO login_challenges (hash, user_id, expires_at)
+	VALUES ($1, $2, now() + make_interval(secs => $3));
+	`
+
+	SelectChallengeForUpdateStmt = `
+	SELECT user_id, attempts
+	FROM login_challenges
+	WHERE hash = $1 AND expires_at > now()
+	FOR UPDATE;
+	`
+
+	FailChallengeStmt = `
+	UPDATE login_challenges SET
+		attempts = attempts + 1
+	WHERE hash = $1;
+	`
+
+	DeleteChallengeStmt = `
+	DELETE FROM login_challenges
+	WHERE hash = $1;
+	`
+
+	DeleteUserChallengesStmt = `
+	DELETE FROM login_challenges
+	WHERE user_id = $1;
+	`
+
+	// Select the user an email address, by its blind index, belongs to.
+	SelectUserByEmailStmt = `
+	SELECT id, username, email, email_index, status
+	FROM users
+	WHERE email_index = $1 AND email_index <> '' AND deleted_at IS NULL;
+	`
+
+	SelectUserContactStmt = `
+	SELECT id, username, email, email_index, status
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	// Drop the unused tokens of a user for a purpose, so only the last one sent works.
+	DeleteEmailTokensStmt = `
+	DELETE FROM email_tokens
+	WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL;
+	`
+
+	InsertEmailTokenStmt = `
+	INSERT INTO email_tokens (hash, user_id, purpose, email_index, expires_at)
+	VALUES ($1, $2, $3, $4, now() + make_interval(secs => $5));
+	`
+
+	// Use up a token for a purpose, unless it was used or expired.
+	UseEmailTokenStmt = `
+	UPDATE email_tokens SET
+		used_at = now()
+	WHERE hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+	RETURNING user_id, email_index;
+	`
+
+	DeleteUserEmailTokensStmt = `
+	DELETE FROM email_tokens
+	WHERE user_id = $1;
+	`
+
+	ExpireEmailTokensStmt = `
+	DELETE FROM email_tokens
+	WHERE expires_at < now();
+	`
+
+	// Record that a user verified its email, given as its blind index $2, unless it changed since.
+	VerifyEmailStmt = `
+	INSERT INTO email_verifications (user_id, email_index)
+	SELECT id, email_index
+	FROM users
+	WHERE id = $1 AND email_index = $2 AND email_index <> '' AND deleted_at IS NULL
+	ON CONFLICT (user_id) DO UPDATE SET
+		email_index = EXCLUDED.email_index,
+		verified_at = now();
+	`
+
+	// When a user verified its current email. Verifications of an earlier email don't count.
+	SelectEmailVerifiedAtStmt = `
+	SELECT v.verified_at
+	FROM email_verifications v
+	JOIN users u ON u.id = v.user_id AND u.email_index = v.email_index
+	WHERE v.user_id = $1;
+	`
+
+	DeleteEmailVerificationStmt = `
+	DELETE FROM email_verifications
+	WHERE user_id = $1;
+	`
+)
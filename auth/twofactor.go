@@ -0,0 +1,551 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/b3ntly/twelvefactor_databases/totp"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// ChallengePrefix starts every login challenge.
+const ChallengePrefix = "tfc_"
+
+const (
+	// How long a user has to complete a login with its second factor.
+	challengeTTL = 5 * time.Minute
+	// Wrong codes presented for a challenge before it is dropped, so codes can't be guessed one login at a time.
+	maxChallengeAttempts = 5
+	// Periods before and after the current one whose TOTP codes are accepted.
+	totpSkew = 1
+	// Recovery codes issued at once.
+	recoveryCodeCount = 10
+)
+
+var errInvalidSecondFactor = errors.New("invalid code, or the login expired")
+
+// Recovery codes are lower case base32, easy to read back from paper.
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+type (
+	// Challenge answers a login by a user enrolled in two-factor authentication: the login is completed by presenting
+	// the challenge with a code to the verify endpoint matching the login endpoint.
+	Challenge struct {
+		Challenge string `json:"challenge"`
+		// Lifetime of the challenge, in seconds.
+		ExpiresIn int `json:"expiresIn"`
+	}
+
+	// SecondFactorInput is the body accepted by the verify endpoints: a challenge and either a TOTP code or a recovery
+	// code.
+	SecondFactorInput struct {
+		Challenge    string `json:"challenge"`
+		Code         string `json:"code,omitempty"`
+		RecoveryCode string `json:"recoveryCode,omitempty"`
+	}
+
+	// Enrollment answers the start of a TOTP enrollment. Show the provisioning URI as a QR code, or the secret for
+	// manual entry, then confirm the enrollment with a code.
+	Enrollment struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioningUri"`
+	}
+
+	// CodeInput is the body accepted by the endpoint confirming an enrollment.
+	CodeInput struct {
+		Code string `json:"code"`
+	}
+
+	// RecoveryCodes are one-time codes standing in for a TOTP code when the authenticator is lost. They are only ever
+	// returned when they are issued.
+	RecoveryCodes struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+
+	enrollment struct {
+		Secret      string     `db:"secret"`
+		LastCounter int64      `db:"last_counter"`
+		ConfirmedAt *time.Time `db:"confirmed_at"`
+	}
+
+	challenge struct {
+		UserID   int64 `db:"user_id"`
+		Attempts int   `db:"attempts"`
+	}
+)
+
+// challenge answers a login by a user with a confirmed TOTP enrollment with 202 Accepted and a Challenge, returning
+// true. Returns false, having written nothing, for other users.
+func (s *Service) challenge(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	var confirmedAt *time.Time
+	err := s.db.GetContext(r.Context(), &confirmedAt, SelectTOTPConfirmedAtStmt, userID)
+	if err == sql.ErrNoRows || (err == nil && confirmedAt == nil) {
+		return false
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return true
+	}
+
+	token := ChallengePrefix + randomString(32)
+	if _, err := s.db.ExecContext(r.Context(), InsertChallengeStmt, hashToken(token), userID,
+		challengeTTL.Seconds()); err != nil {
+		s.writeError(w, err)
+		return true
+	}
+
+	s.render(w, r, http.StatusAccepted, &Challenge{Challenge: token, ExpiresIn: int(challengeTTL.Seconds())})
+	return true
+}
+
+// VerifyLogin endpoint completes a login challenged for a second factor, exchanging the challenge and a code for
+// tokens. Wrong codes are answered with 401 Unauthorized, and drop the challenge once there were too many.
+func (s *Service) VerifyLogin(w http.ResponseWriter, r *http.Request) {
+	input := &SecondFactorInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var userID int64
+	var tokens *Tokens
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		userID, err = s.verifySecondFactor(r.Context(), tx, input)
+		if err != nil {
+			return err
+		}
+
+		tokens, err = s.issue(r.Context(), tx, userID, newFamily(), true)
+		return err
+	})
+	s.secondFactorChecked(r, userID, err)
+	if err == errInvalidSecondFactor {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, tokens)
+}
+
+// VerifySession endpoint completes a browser login challenged for a second factor, like VerifyLogin, starting a
+// session.
+func (s *Service) VerifySession(w http.ResponseWriter, r *http.Request) {
+	input := &SecondFactorInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var userID int64
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		userID, err = s.verifySecondFactor(r.Context(), tx, input)
+		return err
+	})
+	s.secondFactorChecked(r, userID, err)
+	if err == errInvalidSecondFactor {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.startSession(w, r, userID, true)
+}
+
+// verifySecondFactor checks the code presented for a challenge within tx, returning the user logging in. The
+// challenge is consumed by a right code and counts a wrong one, which returns errInvalidSecondFactor along with the
+// user the challenge was for.
+func (s *Service) verifySecondFactor(ctx context.Context, tx *sqlx.Tx, input *SecondFactorInput) (int64, error) {
+	hash := hashToken(input.Challenge)
+
+	current := &challenge{}
+	err := tx.GetContext(ctx, current, SelectChallengeForUpdateStmt, hash)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidSecondFactor
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	ok := false
+	if input.RecoveryCode != "" {
+		ok, err = useRecoveryCode(ctx, tx, current.UserID, input.RecoveryCode)
+	} else {
+		ok, err = s.checkCode(ctx, tx, current.UserID, input.Code, true)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		stmt := FailChallengeStmt
+		if current.Attempts+1 >= maxChallengeAttempts {
+			stmt = DeleteChallengeStmt
+		}
+		if _, err := tx.ExecContext(ctx, stmt, hash); err != nil {
+			return 0, err
+		}
+		return current.UserID, errInvalidSecondFactor
+	}
+
+	if _, err := tx.ExecContext(ctx, DeleteChallengeStmt, hash); err != nil {
+		return 0, err
+	}
+
+	var status string
+	err = tx.GetContext(ctx, &status, SelectUserStatusStmt, current.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if status != users.StatusActive {
+		return 0, errInvalidSecondFactor
+	}
+
+	return current.UserID, nil
+}
+
+// checkCode reports whether code is the current TOTP code of a user whose enrollment is confirmed, or not, within
+// tx. Accepted codes are recorded, so neither they nor earlier codes are accepted again.
+func (s *Service) checkCode(ctx context.Context, tx *sqlx.Tx, userID int64, code string, confirmed bool) (bool, error) {
+	current := &enrollment{}
+	err := tx.GetContext(ctx, current, SelectTOTPForUpdateStmt, userID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if (current.ConfirmedAt != nil) != confirmed {
+		return false, nil
+	}
+
+	secret, err := s.keyring.Open(current.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	counter, ok := totp.Verify(secret, code, s.now(), totpSkew)
+	if !ok || counter <= current.LastCounter {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, UseTOTPStmt, userID, counter)
+	return err == nil, err
+}
+
+// useRecoveryCode reports whether code is an unused recovery code of a user, using it up, within tx.
+func useRecoveryCode(ctx context.Context, tx *sqlx.Tx, userID int64, code string) (bool, error) {
+	result, err := tx.ExecContext(ctx, UseRecoveryCodeStmt, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// EnrollTOTP endpoint starts enrolling the user making the request in TOTP, responding with 201 Created and the
+// Enrollment, which takes effect once confirmed. Starting again replaces an unconfirmed enrollment; users already
+// enrolled are answered with 409 Conflict and must disable TOTP first.
+func (s *Service) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.self(w, r, false)
+	if !ok {
+		return
+	}
+
+	var username string
+	err := s.db.GetContext(r.Context(), &username, SelectUsernameStmt, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	sealed, err := s.keyring.Seal(secret)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	result, err := s.db.ExecContext(r.Context(), UpsertTOTPStmt, userID, sealed)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "already enrolled, disable TOTP first", http.StatusConflict)
+		return
+	}
+
+	s.render(w, r, http.StatusCreated, &Enrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(s.issuer, username, secret),
+	})
+}
+
+// ConfirmTOTP endpoint confirms the enrollment of the user making the request with a code from its authenticator,
+// responding with its recovery codes. From then on logging in requires a second factor. Codes which don't match an
+// unconfirmed enrollment are answered with 422 Unprocessable Entity.
+func (s *Service) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.self(w, r, false)
+	if !ok {
+		return
+	}
+
+	input := &CodeInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var codes []string
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		ok, err := s.checkCode(r.Context(), tx, userID, input.Code, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errInvalidSecondFactor
+		}
+
+		codes, err = replaceRecoveryCodes(r.Context(), tx, userID)
+		return err
+	})
+	if err == errInvalidSecondFactor {
+		s.render(w, r, http.StatusUnprocessableEntity,
+			map[string]string{"code": "doesn't match an enrollment waiting for confirmation"})
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, &RecoveryCodes{RecoveryCodes: codes})
+}
+
+// DisableTOTP endpoint removes the TOTP enrollment and recovery codes of the user making the request, responding with
+// 204 No Content. Requires a login with a second factor, so a stolen password alone can't remove it.
+func (s *Service) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.self(w, r, true)
+	if !ok {
+		return
+	}
+
+	if err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		return removeSecondFactor(r.Context(), tx, userID)
+	}); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes endpoint replaces the recovery codes of the user making the request, responding with the new
+// ones. Requires a login with a second factor.
+func (s *Service) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID, ok := s.self(w, r, true)
+	if !ok {
+		return
+	}
+
+	var codes []string
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		codes, err = replaceRecoveryCodes(r.Context(), tx, userID)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, &RecoveryCodes{RecoveryCodes: codes})
+}
+
+// ResetTOTP endpoint removes the TOTP enrollment and recovery codes of a user who lost both, so it can log in with its
+// password and enroll again. Responds with 204 No Content, 404 Not Found if the user isn't enrolled, or 403 Forbidden
+// if the user holds a role stricter than the caller's.
+func (s *Service) ResetTOTP(w http.ResponseWriter, r *http.Request) {
+	userID, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if !s.mayTakeOver(w, r, userID) {
+		return
+	}
+
+	var confirmedAt *time.Time
+	err := s.db.GetContext(r.Context(), &confirmedAt, SelectTOTPConfirmedAtStmt, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "not enrolled", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		return removeSecondFactor(r.Context(), tx, userID)
+	}); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mayTakeOver answers the request with 403 Forbidden if the user with userID holds a role requiring a second factor
+// which the caller doesn't, and reports whether the caller may reset the credentials of the user.
+func (s *Service) mayTakeOver(w http.ResponseWriter, r *http.Request, userID int64) bool {
+	if s.roles == nil {
+		return true
+	}
+
+	outranks, err := s.roles.Outranks(r.Context(), "user:"+strconv.FormatInt(userID, 10), reqctx.Actor(r.Context()))
+	if err != nil {
+		s.writeError(w, err)
+		return false
+	}
+	if outranks {
+		http.Error(w, "the user holds a role the caller doesn't", http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// RotateKeys re-encrypts TOTP secrets sealed with a key other than the primary one, or not sealed at all, with the
+// primary key. Returns the number of secrets re-encrypted.
+func (s *Service) RotateKeys(ctx context.Context) (int64, error) {
+	primary := s.keyring.Primary()
+
+	var rotated int64
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		rows := []struct {
+			UserID int64  `db:"user_id"`
+			Secret string `db:"secret"`
+		}{}
+		if err := tx.SelectContext(ctx, &rows, SelectTOTPSecretsForUpdateStmt); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if keyID, _ := fieldcrypt.KeyID(row.Secret); keyID == primary {
+				continue
+			}
+
+			secret, err := s.keyring.Open(row.Secret)
+			if err != nil {
+				return err
+			}
+
+			sealed, err := s.keyring.Seal(secret)
+			if err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(ctx, UpdateTOTPSecretStmt, row.UserID, sealed); err != nil {
+				return err
+			}
+			rotated++
+		}
+		return nil
+	})
+
+	return rotated, err
+}
+
+// self returns the ID of the user the request is authenticated as. Answers 401 Unauthorized and returns false if it
+// isn't authenticated, and 403 Forbidden if it isn't authenticated as a user or, when multiFactor, without a second
+// factor.
+func (s *Service) self(w http.ResponseWriter, r *http.Request, multiFactor bool) (int64, bool) {
+	p := access.FromContext(r.Context())
+	if p == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return 0, false
+	}
+
+	userID, err := strconv.ParseInt(strings.TrimPrefix(p.ID, "user:"), 10, 64)
+	if !strings.HasPrefix(p.ID, "user:") || err != nil {
+		http.Error(w, "only users have a second factor", http.StatusForbidden)
+		return 0, false
+	}
+
+	if multiFactor && !p.MultiFactor {
+		http.Error(w, "log in with your second factor first", http.StatusForbidden)
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// replaceRecoveryCodes issues new recovery codes to a user within tx, invalidating the previous ones.
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int64) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, DeleteRecoveryCodesStmt, userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := recoveryEncoding.EncodeToString(b)
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+
+		if _, err := tx.ExecContext(ctx, InsertRecoveryCodeStmt, userID, hashRecoveryCode(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, nil
+}
+
+// removeSecondFactor deletes the TOTP enrollment, recovery codes and pending challenges of a user within tx.
+func removeSecondFactor(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	for _, stmt := range []string{DeleteTOTPStmt, DeleteRecoveryCodesStmt, DeleteUserChallengesStmt} {
+		if _, err := tx.ExecContext(ctx, stmt, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as, ignoring case, dashes and spaces. Codes carry 80
+// bits of entropy, so a fast hash is enough.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
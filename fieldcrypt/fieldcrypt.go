@@ -0,0 +1,272 @@
+// Package fieldcrypt encrypts individual database columns with AES-256-GCM so personal data can't be read by anyone who
+// only has access to the database. Every ciphertext names the key it was sealed with, so keys can be rotated without
+// downtime: new values are sealed with the primary key while older ones stay readable until they are re-encrypted.
+//
+// Blind indexes, keyed hashes of normalized plaintexts, allow equality lookups and unique constraints on encrypted
+// columns. They use a key of their own which must never be rotated, or every index would have to be rebuilt.
+package fieldcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Prefix of every ciphertext, followed by the key ID, a colon and the base64 encoded nonce and sealed value.
+const prefix = "enc:v1:"
+
+// KeySize is the length in bytes of every key: AES-256.
+const KeySize = 32
+
+var (
+	ErrUnknownKey = errors.New("fieldcrypt: ciphertext sealed with an unknown key")
+	ErrMalformed  = errors.New("fieldcrypt: malformed ciphertext")
+	ErrNoKeyring  = errors.New("fieldcrypt: no keyring to decrypt with")
+)
+
+// Keyring holds the keys values are encrypted with and the key of their blind indexes.
+type Keyring struct {
+	primary  string
+	aeads    map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// NewKeyring returns a keyring sealing with the key named primary and opening with any key in keys. Keys must be
+// KeySize bytes long and IDs must not contain colons.
+func NewKeyring(primary string, keys map[string][]byte, indexKey []byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("fieldcrypt: primary key %q is not in the keyring", primary)
+	}
+
+	if len(indexKey) < KeySize {
+		return nil, fmt.Errorf("fieldcrypt: the blind index key must be at least %d bytes", KeySize)
+	}
+
+	k := &Keyring{primary: primary, aeads: map[string]cipher.AEAD{}, indexKey: indexKey}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("fieldcrypt: key %q: %v", id, err)
+		}
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("fieldcrypt: key ID %q must be non-empty and free of colons", id)
+		}
+		k.aeads[id] = aead
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Primary returns the ID of the key new values are sealed with, empty without a keyring.
+func (k *Keyring) Primary() string {
+	if k == nil {
+		return ""
+	}
+	return k.primary
+}
+
+// Encrypt seals plaintext with the primary key. The key ID is authenticated along with it so a ciphertext can't be
+// passed off as sealed by another key.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := k.aeads[k.primary]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.primary))
+	return prefix + k.primary + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt with any key of the keyring.
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, payload, ok := split(ciphertext)
+	if !ok {
+		return "", ErrMalformed
+	}
+
+	aead, ok := k.aeads[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(payload)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", ErrMalformed
+	}
+
+	return string(plaintext), nil
+}
+
+// Seal encrypts a value for storage with the primary key. Empty values are stored as is so "no value" stays queryable.
+// Without a keyring values are stored in plaintext: only acceptable in development.
+func (k *Keyring) Seal(value string) (string, error) {
+	if value == "" || k == nil {
+		return value, nil
+	}
+
+	return k.Encrypt(value)
+}
+
+// Open returns the plaintext of a stored value. Plaintexts, such as values left by older versions or stored without a
+// keyring, are returned as is until they are re-encrypted.
+func (k *Keyring) Open(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	if k == nil {
+		return "", ErrNoKeyring
+	}
+
+	return k.Decrypt(value)
+}
+
+// BlindIndex returns a keyed hash of value for equality lookups. Normalize values first, e.g. lower case emails, so
+// equal values always produce equal indexes. Empty values have an empty index. Without a keyring the index is keyed
+// with nothing, which still supports lookups and unique constraints but hides nothing: only acceptable in development.
+func (k *Keyring) BlindIndex(value string) string {
+	if k == nil {
+		return blindIndex(nil, value)
+	}
+	return blindIndex(k.indexKey, value)
+}
+
+func blindIndex(key []byte, value string) string {
+	if value == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsEncrypted reports whether value looks like a ciphertext rather than a plaintext.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// KeyID returns the ID of the key a ciphertext was sealed with.
+func KeyID(ciphertext string) (string, bool) {
+	id, _, ok := split(ciphertext)
+	return id, ok
+}
+
+func split(ciphertext string) (id, payload string, ok bool) {
+	if !IsEncrypted(ciphertext) {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ciphertext, prefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// WrapKey seals a data key with a master key, producing the base64 form read by ParseKeys when given that master key.
+func WrapKey(master, key []byte) (string, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return "", fmt.Errorf("fieldcrypt: master key: %v", err)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(key)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, key, nil)), nil
+}
+
+func unwrapKey(aead cipher.AEAD, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrMalformed
+	}
+
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+}
+
+// ParseKeys reads keys written as "id:base64" pairs separated by commas or newlines. When master is set every key is
+// expected to be wrapped by it, see WrapKey, so the data keys themselves never sit in the environment or on disk.
+// Returns the keys and the ID of the last one listed, the conventional primary.
+func ParseKeys(spec string, master []byte) (map[string][]byte, string, error) {
+	var unwrap cipher.AEAD
+	if master != nil {
+		var err error
+		if unwrap, err = newAEAD(master); err != nil {
+			return nil, "", fmt.Errorf("fieldcrypt: master key: %v", err)
+		}
+	}
+
+	keys := map[string][]byte{}
+	last := ""
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, "", fmt.Errorf("fieldcrypt: key %q must be written as id:base64", entry)
+		}
+
+		id := strings.TrimSpace(parts[0])
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, "", fmt.Errorf("fieldcrypt: key %q: %v", id, err)
+		}
+
+		if unwrap != nil {
+			if key, err = unwrapKey(unwrap, key); err != nil {
+				return nil, "", fmt.Errorf("fieldcrypt: key %q can't be unwrapped with the master key", id)
+			}
+		}
+
+		keys[id] = key
+		last = id
+	}
+
+	return keys, last, nil
+}
+
+// LoadKeys reads ParseKeys formatted keys from a file, such as a mounted secret.
+func LoadKeys(path string, master []byte) (map[string][]byte, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return ParseKeys(string(data), master)
+}
@@ -0,0 +1,113 @@
+package fieldcrypt_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/stretchr/testify/require"
+)
+
+func key(b byte) []byte {
+	k := make([]byte, fieldcrypt.KeySize)
+	k[0] = b
+	return k
+}
+
+func newKeyring(t *testing.T, primary string) *fieldcrypt.Keyring {
+	k, err := fieldcrypt.NewKeyring(primary, map[string][]byte{"k1": key(1), "k2": key(2)}, key(3))
+	require.Nil(t, err)
+	return k
+}
+
+func TestKeyring_Encrypt(t *testing.T) {
+	k1 := newKeyring(t, "k1")
+
+	first, err := k1.Encrypt("fred@example.com")
+	require.Nil(t, err)
+	second, err := k1.Encrypt("fred@example.com")
+	require.Nil(t, err)
+
+	require.True(t, fieldcrypt.IsEncrypted(first))
+	require.NotContains(t, first, "fred")
+	require.NotEqual(t, first, second)
+
+	id, ok := fieldcrypt.KeyID(first)
+	require.True(t, ok)
+	require.Equal(t, "k1", id)
+
+	// Values sealed with an older key stay readable after rotation.
+	k2 := newKeyring(t, "k2")
+	plaintext, err := k2.Decrypt(first)
+	require.Nil(t, err)
+	require.Equal(t, "fred@example.com", plaintext)
+
+	// The key ID is authenticated.
+	_, err = k2.Decrypt("enc:v1:k2:" + first[len("enc:v1:k1:"):])
+	require.Equal(t, fieldcrypt.ErrMalformed, err)
+
+	_, err = k2.Decrypt("enc:v1:k9:" + first[len("enc:v1:k1:"):])
+	require.Equal(t, fieldcrypt.ErrUnknownKey, err)
+}
+
+func TestKeyring_BlindIndex(t *testing.T) {
+	k1 := newKeyring(t, "k1")
+	k2 := newKeyring(t, "k2")
+
+	require.Equal(t, k1.BlindIndex("fred@example.com"), k2.BlindIndex("fred@example.com"))
+	require.NotEqual(t, k1.BlindIndex("fred@example.com"), k1.BlindIndex("wilma@example.com"))
+	require.Equal(t, "", k1.BlindIndex(""))
+}
+
+func TestParseKeys(t *testing.T) {
+	spec := "k1:" + base64.StdEncoding.EncodeToString(key(1)) + ",k2:" + base64.StdEncoding.EncodeToString(key(2))
+	keys, last, err := fieldcrypt.ParseKeys(spec, nil)
+	require.Nil(t, err)
+	require.Equal(t, "k2", last)
+	require.Equal(t, key(1), keys["k1"])
+
+	wrapped, err := fieldcrypt.WrapKey(key(9), key(1))
+	require.Nil(t, err)
+
+	keys, _, err = fieldcrypt.ParseKeys("# wrapped\nk1:"+wrapped+"\n", key(9))
+	require.Nil(t, err)
+	require.Equal(t, key(1), keys["k1"])
+
+	_, _, err = fieldcrypt.ParseKeys("k1:"+wrapped, key(8))
+	require.NotNil(t, err)
+
+	_, _, err = fieldcrypt.ParseKeys("k1", nil)
+	require.NotNil(t, err)
+}
+
+func TestKeyring_Seal(t *testing.T) {
+	k1 := newKeyring(t, "k1")
+
+	sealed, err := k1.Seal("fred@example.com")
+	require.Nil(t, err)
+	require.True(t, fieldcrypt.IsEncrypted(sealed))
+
+	opened, err := k1.Open(sealed)
+	require.Nil(t, err)
+	require.Equal(t, "fred@example.com", opened)
+
+	// Empty values and plaintexts written before encryption are passed through.
+	sealed, err = k1.Seal("")
+	require.Nil(t, err)
+	require.Equal(t, "", sealed)
+
+	opened, err = k1.Open("wilma@example.com")
+	require.Nil(t, err)
+	require.Equal(t, "wilma@example.com", opened)
+
+	// Without a keyring values are stored in plaintext, and ciphertexts can't be read.
+	var none *fieldcrypt.Keyring
+	sealed, err = none.Seal("fred@example.com")
+	require.Nil(t, err)
+	require.Equal(t, "fred@example.com", sealed)
+	require.Equal(t, k1.BlindIndex("x"), k1.BlindIndex("x"))
+	require.NotEqual(t, k1.BlindIndex("x"), none.BlindIndex("x"))
+
+	_, err = none.Open("enc:v1:k1:AAAA")
+	require.Equal(t, fieldcrypt.ErrNoKeyring, err)
+}
@@ -0,0 +1,349 @@
+// Package idempotency makes retries of mutating requests safe. A client sends an Idempotency-Key header with a request;
+// the first request carrying a key runs and its response is stored, every retry with the same key is answered with the
+// stored response instead of running again.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// Header is the request header carrying the idempotency key.
+const Header = "Idempotency-Key"
+
+// The longest key accepted, and the largest request body fingerprinted.
+const (
+	maxKeyLength = 255
+	maxBodyBytes = 1 << 20
+)
+
+type (
+	// Config for the idempotency middleware.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// How long a key is remembered after its first use. Defaults to 24 hours.
+		TTL time.Duration
+		// How long a request may hold a key before it is presumed lost, e.g. to a crashed replica, and the key may be
+		// claimed again. Keep it above the longest request. Defaults to one minute.
+		Lease time.Duration
+		// Path prefixes whose responses are never stored because they carry credentials, e.g. "/auth". Requests to
+		// them run whether or not they carry a key.
+		Exclude []string
+		// How often RunExpirer removes expired keys, zero or less disables removal.
+		ExpireInterval time.Duration
+	}
+
+	// Middleware stores responses to requests carrying an idempotency key.
+	Middleware struct {
+		ctx            context.Context
+		logger         *log.Logger
+		db             *sqlx.DB
+		ttl            time.Duration
+		lease          time.Duration
+		exclude        []string
+		expireInterval time.Duration
+	}
+
+	// record is a claimed key, with the response to replay once the request holding it completed.
+	record struct {
+		Scope       string          `db:"scope"`
+		Key         string          `db:"key"`
+		Fingerprint string          `db:"fingerprint"`
+		Status      *int            `db:"status"`
+		Header      *types.JSONText `db:"header"`
+		Body        []byte          `db:"body"`
+		CreatedAt   time.Time       `db:"created_at"`
+	}
+
+	// StoredKey is a key used by a user, as exported in answer to access requests.
+	StoredKey struct {
+		Key       string    `json:"key" db:"key"`
+		Status    *int      `json:"status" db:"status"`
+		CreatedAt time.Time `json:"createdAt" db:"created_at"`
+		ExpiresAt time.Time `json:"expiresAt" db:"expires_at"`
+	}
+)
+
+// New: Instantiate the middleware. Fail hard if its table can't be created.
+func New(config *Config) *Middleware {
+	if _, err := config.DB.ExecContext(context.Background(), CreateTableStmt); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	ttl := config.TTL
+	if ttl <= 0 {
+		ttl = 24 * time.Hour
+	}
+
+	lease := config.Lease
+	if lease <= 0 {
+		lease = time.Minute
+	}
+
+	return &Middleware{
+		ctx:            config.Ctx,
+		logger:         config.Logger,
+		db:             config.DB,
+		ttl:            ttl,
+		lease:          lease,
+		exclude:        config.Exclude,
+		expireInterval: config.ExpireInterval,
+	}
+}
+
+// Wrap returns next guarded by idempotency keys. Only mutating requests which carry a key are affected:
+//
+//   - the first request with a key runs and its response is stored, unless it failed with a server error, in which
+//     case the key is released so the request can be retried
+//   - retries with the same key and payload are answered with the stored response and Idempotent-Replayed: true
+//   - reusing a key for a different method, path or body is answered with 422 Unprocessable Entity
+//   - retries arriving while the first request is still running are answered with 409 Conflict, until its lease
+//     runs out
+//
+// Keys are scoped to the tenant and actor of the request so clients can't replay each other's responses, and to the
+// client address for anonymous requests. Requests to excluded paths run unguarded.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(Header)
+		if key == "" || !mutating(r.Method) || m.excluded(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > maxKeyLength {
+			http.Error(w, Header+" must be at most "+strconv.Itoa(maxKeyLength)+" characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		ctx := r.Context()
+		scope := reqctx.Tenant(ctx) + "/" + client(r)
+		fingerprint := fingerprint(r, body)
+
+		claimed := &record{}
+		err = m.db.GetContext(ctx, claimed, ClaimStmt, scope, key, fingerprint, m.lease.Seconds())
+		if err == sql.ErrNoRows {
+			m.replay(w, r, scope, key, fingerprint)
+			return
+		}
+		if err != nil {
+			m.writeError(w, err)
+			return
+		}
+
+		recorder := &recorder{header: http.Header{}, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// Stored outside of the request context, which may have timed out by now.
+		if recorder.status >= 500 {
+			if _, err := m.db.ExecContext(context.Background(), ReleaseStmt, scope, key, claimed.CreatedAt); err != nil {
+				m.logger.Println(err)
+			}
+		} else if err := m.complete(claimed, recorder); err != nil {
+			m.logger.Println(err)
+		}
+
+		recorder.writeTo(w)
+	})
+}
+
+// client identifies who sent a request: its actor when it is known, its address otherwise. Clients sharing an address,
+// e.g. behind a NAT, share the keys of their anonymous requests.
+func client(r *http.Request) string {
+	if actor := reqctx.Actor(r.Context()); actor != "" {
+		return actor
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "addr:" + host
+}
+
+// complete stores the response recorded for a claimed key, which is kept for the TTL from then on. Nothing is stored if
+// the lease ran out and the key was claimed again meanwhile.
+func (m *Middleware) complete(claimed *record, recorder *recorder) error {
+	header, err := json.Marshal(recorder.header)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.db.ExecContext(context.Background(), CompleteStmt, claimed.Scope, claimed.Key, claimed.CreatedAt,
+		recorder.status, types.JSONText(header), recorder.body.Bytes(), m.ttl.Seconds())
+	return err
+}
+
+// replay answers a retry of a request whose key is already claimed.
+func (m *Middleware) replay(w http.ResponseWriter, r *http.Request, scope, key, fingerprint string) {
+	stored := &record{}
+	if err := m.db.GetContext(r.Context(), stored, SelectOneStmt, scope, key); err != nil {
+		m.writeError(w, err)
+		return
+	}
+
+	if stored.Fingerprint != fingerprint {
+		http.Error(w, Header+" was already used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+
+	if stored.Status == nil {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "a request with this "+Header+" is still in progress", http.StatusConflict)
+		return
+	}
+
+	header := http.Header{}
+	if stored.Header != nil {
+		if err := json.Unmarshal(*stored.Header, &header); err != nil {
+			m.writeError(w, err)
+			return
+		}
+	}
+
+	for name, values := range header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(*stored.Status)
+	w.Write(stored.Body)
+}
+
+// Name implements users.PersonalData.
+func (m *Middleware) Name() string {
+	return "idempotency"
+}
+
+// Export implements users.PersonalData: the keys the user sent, without the responses stored for them.
+func (m *Middleware) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	keys := []*StoredKey{}
+	err := tx.SelectContext(ctx, &keys, SelectActorKeysStmt, "user:"+strconv.FormatInt(userID, 10))
+	return keys, err
+}
+
+// Erase implements users.PersonalData: the keys the user sent are deleted with their responses. Responses to requests
+// made by others about the user are not tied to them, they expire with the TTL.
+func (m *Middleware) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	_, err := tx.ExecContext(ctx, DeleteActorKeysStmt, "user:"+strconv.FormatInt(userID, 10))
+	return err
+}
+
+// Expire removes expired keys. Returns the number of keys removed.
+func (m *Middleware) Expire(ctx context.Context) (int64, error) {
+	result, err := m.db.ExecContext(ctx, ExpireStmt)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// RunExpirer calls Expire every expire interval until ctx is done. Blocks, so run it in its own goroutine. Expired keys
+// are never replayed whether or not they have been removed, so removal only keeps the table small.
+func (m *Middleware) RunExpirer(ctx context.Context) {
+	if m.expireInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(m.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := m.Expire(ctx); err != nil {
+				m.logger.Println(err)
+			}
+		}
+	}
+}
+
+// Error handling logic for this middleware.
+func (m *Middleware) writeError(w http.ResponseWriter, err error) {
+	m.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
+
+// excluded reports whether requests to path are never guarded.
+func (m *Middleware) excluded(path string) bool {
+	for _, prefix := range m.exclude {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// mutating reports whether requests with method change state, the only ones worth guarding: the others are safe to
+// retry already.
+func mutating(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// fingerprint identifies the payload of a request, so a key can't be reused for something else.
+func fingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// recorder buffers a response so it can be stored before it is sent.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	wrote  bool
+}
+
+func (rec *recorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wrote {
+		rec.status, rec.wrote = status, true
+	}
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	rec.wrote = true
+	return rec.body.Write(p)
+}
+
+func (rec *recorder) writeTo(w http.ResponseWriter) {
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
@@ -0,0 +1,155 @@
+package idempotency_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/idempotency"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestMiddleware_Wrap(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+
+	middleware := idempotency.New(&idempotency.Config{
+		Ctx:     ctx,
+		Logger:  log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:      db,
+		Exclude: []string{"/auth"},
+	})
+
+	_, err = db.ExecContext(ctx, "DELETE FROM idempotency_keys")
+	require.Nil(t, err)
+
+	calls := 0
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.URL.Path == "/fail" {
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "/users/1")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "call %d", calls)
+	}))
+
+	send := func(method, target, body, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(reqctx.WithActor(req.Context(), "user:1"))
+		if key != "" {
+			req.Header.Set(idempotency.Header, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	first := send("POST", "http://localhost:9090/users", `{"username": "dino"}`, "abc")
+	require.Equal(t, 201, first.Code)
+	require.Equal(t, "call 1", first.Body.String())
+
+	retry := send("POST", "http://localhost:9090/users", `{"username": "dino"}`, "abc")
+	require.Equal(t, 201, retry.Code)
+	require.Equal(t, "call 1", retry.Body.String())
+	require.Equal(t, "/users/1", retry.Header().Get("Location"))
+	require.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	require.Equal(t, 1, calls)
+
+	require.Equal(t, 422, send("POST", "http://localhost:9090/users", `{"username": "hoppy"}`, "abc").Code)
+
+	// Requests without a key, or which can't change anything, always run.
+	send("POST", "http://localhost:9090/users", `{"username": "dino"}`, "")
+	send("GET", "http://localhost:9090/users", "", "abc")
+	require.Equal(t, 3, calls)
+
+	// Server errors release the key.
+	require.Equal(t, 500, send("POST", "http://localhost:9090/fail", "", "def").Code)
+	require.Equal(t, 500, send("POST", "http://localhost:9090/fail", "", "def").Code)
+	require.Equal(t, 5, calls)
+
+	// Other actors and tenants don't see the key.
+	other := httptest.NewRequest("POST", "http://localhost:9090/users", strings.NewReader(`{"username": "dino"}`))
+	other = other.WithContext(reqctx.WithTenant(reqctx.WithActor(other.Context(), "user:1"), "acme"))
+	other.Header.Set(idempotency.Header, "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, other)
+	require.Equal(t, "call 6", w.Body.String())
+
+	// Anonymous requests are scoped to their address, and excluded paths always run.
+	anonymous := func(addr string) string {
+		r := httptest.NewRequest("POST", "http://localhost:9090/users", strings.NewReader(`{"username": "dino"}`))
+		r.RemoteAddr = addr
+		r.Header.Set(idempotency.Header, "ghi")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	require.Equal(t, "call 7", anonymous("192.0.2.1:1234"))
+	require.Equal(t, "call 7", anonymous("192.0.2.1:5678"))
+	require.Equal(t, "call 8", anonymous("192.0.2.2:1234"))
+
+	send("POST", "http://localhost:9090/auth/login", "", "jkl")
+	send("POST", "http://localhost:9090/auth/login", "", "jkl")
+	require.Equal(t, 10, calls)
+}
+
+func TestMiddleware_Lease(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+
+	middleware := idempotency.New(&idempotency.Config{
+		Ctx:    ctx,
+		Logger: log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:     db,
+		Lease:  time.Second,
+	})
+
+	_, err = db.ExecContext(ctx, "DELETE FROM idempotency_keys")
+	require.Nil(t, err)
+
+	// A claim left behind by a crashed replica.
+	_, err = db.ExecContext(ctx, idempotency.ClaimStmt, "/user:1", "abc", "fingerprint", -1)
+	require.Nil(t, err)
+
+	handler := middleware.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	req := httptest.NewRequest("POST", "http://localhost:9090/users", strings.NewReader(`{"username": "dino"}`))
+	req = req.WithContext(reqctx.WithActor(req.Context(), "user:1"))
+	req.Header.Set(idempotency.Header, "abc")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 201, w.Code)
+
+	// The key is covered by access and erasure requests of its actor.
+	tx, err := db.BeginTxx(ctx, nil)
+	require.Nil(t, err)
+	defer tx.Rollback()
+
+	keys, err := middleware.Export(ctx, tx, 1)
+	require.Nil(t, err)
+	require.Len(t, keys, 1)
+
+	require.Nil(t, middleware.Erase(ctx, tx, 1))
+	keys, err = middleware.Export(ctx, tx, 1)
+	require.Nil(t, err)
+	require.Len(t, keys, 0)
+}
@@ -0,0 +1,79 @@
+package idempotency
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		scope TEXT NOT NULL,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER,
+		header JSONB,
+		body BYTEA,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		PRIMARY KEY (scope, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
+	`
+
+	// Claim a key for a request, or reclaim one which has expired but not been removed yet. Returns no rows if the key
+	// is held by another request. A NULL status marks the request as in flight, for no longer than the lease in $4 so
+	// the key of a request lost with its replica can be claimed again.
+	ClaimStmt = `
+	INSERT INTO idempotency_keys
+		(scope, key, fingerprint, expires_at)
+	VALUES
+		($1, $2, $3, now() + make_interval(secs => $4))
+	ON CONFLICT (scope, key) DO UPDATE SET
+		fingerprint = EXCLUDED.fingerprint,
+		status = NULL,
+		header = NULL,
+		body = NULL,
+		created_at = now(),
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at < now()
+	RETURNING scope, key, fingerprint, status, header, body, created_at;
+	`
+
+	SelectOneStmt = `
+	SELECT
+	scope, key, fingerprint, status, header, body, created_at
+	FROM idempotency_keys
+	WHERE scope = $1 AND key = $2;
+	`
+
+	// Store the response to replay to retries of the request holding the key, for the TTL in $7. The claim is matched
+	// on created_at so a request which outlived its lease can't overwrite the key of the one which reclaimed it.
+	CompleteStmt = `
+	UPDATE idempotency_keys SET
+		status = $4,
+		header = $5,
+		body = $6,
+		expires_at = now() + make_interval(secs => $7)
+	WHERE scope = $1 AND key = $2 AND created_at = $3 AND status IS NULL;
+	`
+
+	// Release a key so the request may be retried, used when it failed on our side.
+	ReleaseStmt = `
+	DELETE FROM idempotency_keys
+	WHERE scope = $1 AND key = $2 AND created_at = $3 AND status IS NULL;
+	`
+
+	// Scopes are the tenant and the actor separated by a slash, tenant slugs never contain one.
+	SelectActorKeysStmt = `
+	SELECT key, status, created_at, expires_at
+	FROM idempotency_keys
+	WHERE substr(scope, strpos(scope, '/') + 1) = $1
+	ORDER BY created_at;
+	`
+
+	DeleteActorKeysStmt = `
+	DELETE FROM idempotency_keys
+	WHERE substr(scope, strpos(scope, '/') + 1) = $1;
+	`
+
+	ExpireStmt = `
+	DELETE FROM idempotency_keys
+	WHERE expires_at < now();
+	`
+)
@@ -0,0 +1,420 @@
+// Package jsonschema validates decoded JSON documents against a practical subset of JSON Schema (draft 7).
+//
+// Supported keywords: type, enum, const, properties, required, additionalProperties, minProperties, maxProperties,
+// items, minItems, maxItems, uniqueItems, minLength, maxLength, pattern, minimum, maximum, exclusiveMinimum,
+// exclusiveMaximum, multipleOf, allOf, anyOf, oneOf and not. Unknown keywords, including $ref, are ignored.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type (
+	// Schema is a parsed JSON Schema document.
+	Schema struct {
+		root     interface{}
+		patterns map[string]*regexp.Regexp
+	}
+
+	// ValidationError lists every violation found in a document, each prefixed with a JSON pointer to the value.
+	ValidationError []string
+)
+
+func (e ValidationError) Error() string {
+	return "schema violation: " + strings.Join(e, "; ")
+}
+
+// Load parses the schema stored at path.
+func Load(path string) (*Schema, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse a schema document, compiling every pattern up front so bad schemas fail at startup rather than per request.
+func Parse(data []byte) (*Schema, error) {
+	var root interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+
+	schema := &Schema{root: root, patterns: map[string]*regexp.Regexp{}}
+	if err := schema.compile(root); err != nil {
+		return nil, err
+	}
+
+	return schema, nil
+}
+
+// ValidateJSON decodes a raw document and validates it.
+func (s *Schema) ValidateJSON(data []byte) error {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return err
+	}
+
+	return s.Validate(doc)
+}
+
+// Validate a document decoded by encoding/json into interface{}. Returns a ValidationError or nil.
+func (s *Schema) Validate(doc interface{}) error {
+	problems := s.validate(s.root, doc, "")
+	if len(problems) > 0 {
+		return ValidationError(problems)
+	}
+
+	return nil
+}
+
+func (s *Schema) compile(node interface{}) error {
+	switch value := node.(type) {
+	case map[string]interface{}:
+		if pattern, ok := value["pattern"].(string); ok {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+			s.patterns[pattern] = compiled
+		}
+
+		for _, child := range value {
+			if err := s.compile(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, child := range value {
+			if err := s.compile(child); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Schema) validate(node interface{}, doc interface{}, path string) []string {
+	switch schema := node.(type) {
+	case bool:
+		if !schema {
+			return []string{at(path, "no value is allowed")}
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validateObjectSchema(schema, doc, path)
+	default:
+		return nil
+	}
+}
+
+func (s *Schema) validateObjectSchema(schema map[string]interface{}, doc interface{}, path string) []string {
+	problems := []string{}
+	fail := func(format string, args ...interface{}) {
+		problems = append(problems, at(path, fmt.Sprintf(format, args...)))
+	}
+
+	if types, ok := schema["type"]; ok && !matchesType(types, doc) {
+		fail("must be of type %v", types)
+		// Every other keyword assumes the type matched.
+		return problems
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, candidate := range enum {
+			if equal(candidate, doc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %v", enum)
+		}
+	}
+
+	if constant, ok := schema["const"]; ok && !equal(constant, doc) {
+		fail("must equal %v", constant)
+	}
+
+	switch value := doc.(type) {
+	case map[string]interface{}:
+		problems = append(problems, s.validateObject(schema, value, path)...)
+	case []interface{}:
+		problems = append(problems, s.validateArray(schema, value, path)...)
+	case string:
+		length := float64(utf8.RuneCountInString(value))
+		if limit, ok := number(schema["minLength"]); ok && length < limit {
+			fail("must be at least %v characters", limit)
+		}
+		if limit, ok := number(schema["maxLength"]); ok && length > limit {
+			fail("must be at most %v characters", limit)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !s.patterns[pattern].MatchString(value) {
+			fail("must match %s", pattern)
+		}
+	default:
+		if n, ok := number(doc); ok {
+			if limit, ok := number(schema["minimum"]); ok && n < limit {
+				fail("must be >= %v", limit)
+			}
+			if limit, ok := number(schema["maximum"]); ok && n > limit {
+				fail("must be <= %v", limit)
+			}
+			if limit, ok := number(schema["exclusiveMinimum"]); ok && n <= limit {
+				fail("must be > %v", limit)
+			}
+			if limit, ok := number(schema["exclusiveMaximum"]); ok && n >= limit {
+				fail("must be < %v", limit)
+			}
+			if divisor, ok := number(schema["multipleOf"]); ok && divisor != 0 {
+				if quotient := n / divisor; quotient != math.Trunc(quotient) {
+					fail("must be a multiple of %v", divisor)
+				}
+			}
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			problems = append(problems, s.validate(sub, doc, path)...)
+		}
+	}
+
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if len(s.validate(sub, doc, path)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one schema in anyOf")
+		}
+	}
+
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if len(s.validate(sub, doc, path)) == 0 {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one schema in oneOf, matched %d", matched)
+		}
+	}
+
+	if not, ok := schema["not"]; ok && len(s.validate(not, doc, path)) == 0 {
+		fail("must not match the schema in not")
+	}
+
+	return problems
+}
+
+func (s *Schema) validateObject(schema map[string]interface{}, doc map[string]interface{}, path string) []string {
+	problems := []string{}
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := doc[key]; !present {
+					problems = append(problems, at(path, fmt.Sprintf("missing required property %q", key)))
+				}
+			}
+		}
+	}
+
+	count := float64(len(doc))
+	if limit, ok := number(schema["minProperties"]); ok && count < limit {
+		problems = append(problems, at(path, fmt.Sprintf("must have at least %v properties", limit)))
+	}
+	if limit, ok := number(schema["maxProperties"]); ok && count > limit {
+		problems = append(problems, at(path, fmt.Sprintf("must have at most %v properties", limit)))
+	}
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+
+	// Visit keys in order so error messages are stable.
+	keys := make([]string, 0, len(doc))
+	for key := range doc {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		child := path + "/" + escapePointer(key)
+
+		if property, ok := properties[key]; ok {
+			problems = append(problems, s.validate(property, doc[key], child)...)
+		} else if hasAdditional {
+			problems = append(problems, s.validate(additional, doc[key], child)...)
+		}
+	}
+
+	return problems
+}
+
+func (s *Schema) validateArray(schema map[string]interface{}, doc []interface{}, path string) []string {
+	problems := []string{}
+
+	count := float64(len(doc))
+	if limit, ok := number(schema["minItems"]); ok && count < limit {
+		problems = append(problems, at(path, fmt.Sprintf("must have at least %v items", limit)))
+	}
+	if limit, ok := number(schema["maxItems"]); ok && count > limit {
+		problems = append(problems, at(path, fmt.Sprintf("must have at most %v items", limit)))
+	}
+
+	if unique, ok := schema["uniqueItems"].(bool); ok && unique {
+	duplicates:
+		for i := range doc {
+			for j := i + 1; j < len(doc); j++ {
+				if equal(doc[i], doc[j]) {
+					problems = append(problems, at(path, "items must be unique"))
+					break duplicates
+				}
+			}
+		}
+	}
+
+	if items, ok := schema["items"]; ok {
+		if tuple, ok := items.([]interface{}); ok {
+			for i, item := range doc {
+				if i < len(tuple) {
+					problems = append(problems, s.validate(tuple[i], item, fmt.Sprintf("%s/%d", path, i))...)
+				}
+			}
+		} else {
+			for i, item := range doc {
+				problems = append(problems, s.validate(items, item, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	}
+
+	return problems
+}
+
+// matchesType reports whether doc is of the named type, or any of a list of named types.
+func matchesType(types interface{}, doc interface{}) bool {
+	switch value := types.(type) {
+	case string:
+		return matchesNamedType(value, doc)
+	case []interface{}:
+		for _, name := range value {
+			if named, ok := name.(string); ok && matchesNamedType(named, doc) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
+
+func matchesNamedType(name string, doc interface{}) bool {
+	switch name {
+	case "null":
+		return doc == nil
+	case "boolean":
+		_, ok := doc.(bool)
+		return ok
+	case "object":
+		_, ok := doc.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := doc.([]interface{})
+		return ok
+	case "string":
+		_, ok := doc.(string)
+		return ok
+	case "number":
+		_, ok := number(doc)
+		return ok
+	case "integer":
+		n, ok := number(doc)
+		return ok && n == math.Trunc(n)
+	default:
+		return false
+	}
+}
+
+// number converts the numeric representations produced by encoding/json to float64.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// equal compares two decoded JSON values, treating numbers by value regardless of representation.
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+
+	switch x := a.(type) {
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for key, value := range x {
+			other, present := y[key]
+			if !present || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(a, b)
+	}
+}
+
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func at(path, problem string) string {
+	if path == "" {
+		path = "/"
+	}
+	return path + " " + problem
+}
@@ -0,0 +1,70 @@
+package jsonschema_test
+
+import (
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/jsonschema"
+	"github.com/stretchr/testify/require"
+)
+
+const planSchema = `{
+	"type": "object",
+	"required": ["plan"],
+	"additionalProperties": false,
+	"properties": {
+		"plan": {"enum": ["free", "pro", "enterprise"]},
+		"seats": {"type": "integer", "minimum": 1, "maximum": 1000},
+		"region": {"type": "string", "pattern": "^[a-z]{2}-[a-z]+$"},
+		"features": {"type": "array", "items": {"type": "string", "maxLength": 16}, "uniqueItems": true}
+	}
+}`
+
+func TestSchema_Validate(t *testing.T) {
+	schema, err := jsonschema.Parse([]byte(planSchema))
+	require.Nil(t, err)
+
+	valid := []string{
+		`{"plan": "pro"}`,
+		`{"plan": "enterprise", "seats": 20, "region": "us-east", "features": ["sso", "audit"]}`,
+	}
+
+	for _, doc := range valid {
+		require.Nil(t, schema.ValidateJSON([]byte(doc)), doc)
+	}
+
+	invalid := map[string]string{
+		`[]`:                               "/ must be of type object",
+		`{}`:                               `/ missing required property "plan"`,
+		`{"plan": "gold"}`:                 "/plan must be one of",
+		`{"plan": "pro", "seats": 1.5}`:    "/seats must be of type integer",
+		`{"plan": "pro", "seats": 0}`:      "/seats must be >= 1",
+		`{"plan": "pro", "region": "US"}`:  "/region must match",
+		`{"plan": "pro", "colour": "red"}`: "/colour no value is allowed",
+		`{"plan": "pro", "features": ["a", "a"]}`: "/features items must be unique",
+	}
+
+	for doc, problem := range invalid {
+		err := schema.ValidateJSON([]byte(doc))
+		require.NotNil(t, err, doc)
+
+		problems, ok := err.(jsonschema.ValidationError)
+		require.True(t, ok, doc)
+		require.Contains(t, problems[0], problem, doc)
+	}
+}
+
+func TestParse_InvalidPattern(t *testing.T) {
+	_, err := jsonschema.Parse([]byte(`{"properties": {"a": {"pattern": "("}}}`))
+	require.NotNil(t, err)
+}
+
+func BenchmarkSchema_Validate(b *testing.B) {
+	schema, err := jsonschema.Parse([]byte(planSchema))
+	require.Nil(b, err)
+
+	doc := []byte(`{"plan": "enterprise", "seats": 20, "region": "us-east", "features": ["sso", "audit"]}`)
+
+	for i := 0; i < b.N; i++ {
+		schema.ValidateJSON(doc)
+	}
+}
@@ -0,0 +1,358 @@
+// Package jwt signs and verifies JSON Web Tokens (RFC 7519) with EdDSA or RS256 keys. A KeySet signs with one of its
+// keys and verifies with any of them, so keys are rotated by adding the new key, signing with it once every replica
+// knows it, and removing the old key once the tokens it signed have expired. The public half of the set is published as
+// a JSON Web Key Set for other services to verify tokens with.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Signing algorithms.
+const (
+	EdDSA = "EdDSA"
+	RS256 = "RS256"
+)
+
+// Leeway absorbs the clock skew between the replicas issuing and verifying tokens.
+const Leeway = 30 * time.Second
+
+// The longest token parsed.
+const maxTokenBytes = 8 << 10
+
+var (
+	ErrMalformed  = errors.New("jwt: malformed token")
+	ErrUnknownKey = errors.New("jwt: unknown signing key")
+	ErrSignature  = errors.New("jwt: invalid signature")
+	ErrExpired    = errors.New("jwt: token has expired")
+	ErrNotYet     = errors.New("jwt: token is not valid yet")
+	ErrIssuer     = errors.New("jwt: unexpected issuer")
+	ErrAudience   = errors.New("jwt: unexpected audience")
+)
+
+type (
+	// Key is a private signing key, identified in the kid header of the tokens it signs.
+	Key struct {
+		ID        string
+		Algorithm string
+		signer    crypto.Signer
+	}
+
+	// KeySet signs tokens with its signing key and verifies tokens signed by any of its keys.
+	KeySet struct {
+		signing *Key
+		keys    map[string]*Key
+	}
+
+	// Claims registered by RFC 7519. Embed them in a struct to sign or parse further claims.
+	Claims struct {
+		Issuer    string `json:"iss,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		Audience  string `json:"aud,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		NotBefore int64  `json:"nbf,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		ID        string `json:"jti,omitempty"`
+		// Space separated scopes granted to the bearer, from RFC 8693.
+		Scope string `json:"scope,omitempty"`
+		// How the subject authenticated, such as "pwd" and "otp", from RFC 8176.
+		AuthMethods []string `json:"amr,omitempty"`
+		// The organization the token was issued in, binding it to that tenant.
+		Tenant string `json:"tenant,omitempty"`
+	}
+
+	// JWK is the public half of a key as RFC 7517 represents it.
+	JWK struct {
+		KeyType   string `json:"kty"`
+		KeyID     string `json:"kid"`
+		Algorithm string `json:"alg"`
+		Use       string `json:"use"`
+		// Ed25519 keys.
+		Curve string `json:"crv,omitempty"`
+		X     string `json:"x,omitempty"`
+		// RSA keys.
+		N string `json:"n,omitempty"`
+		E string `json:"e,omitempty"`
+	}
+
+	// JWKS is a JSON Web Key Set, as served at /.well-known/jwks.json.
+	JWKS struct {
+		Keys []JWK `json:"keys"`
+	}
+
+	header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+		Type      string `json:"typ,omitempty"`
+	}
+)
+
+// NewKey returns the key named id signing with signer, an ed25519.PrivateKey or an *rsa.PrivateKey of at least 2048
+// bits.
+func NewKey(id string, signer crypto.Signer) (*Key, error) {
+	if id == "" {
+		return nil, errors.New("jwt: keys must have an ID")
+	}
+
+	switch k := signer.(type) {
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Algorithm: EdDSA, signer: k}, nil
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("jwt: RSA key %s must have at least 2048 bits", id)
+		}
+		return &Key{ID: id, Algorithm: RS256, signer: k}, nil
+	default:
+		return nil, fmt.Errorf("jwt: key %s must be an Ed25519 or RSA key", id)
+	}
+}
+
+// GenerateKey returns a new Ed25519 key named id.
+func GenerateKey(id string) (*Key, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(id, private)
+}
+
+// ParsePEM reads the key named id from a PEM encoded PKCS #8 private key, or a PKCS #1 RSA private key.
+func ParsePEM(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("jwt: key %s is not PEM encoded", id)
+	}
+
+	var private interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %s: %v", id, err)
+	}
+
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("jwt: key %s can't sign", id)
+	}
+	return NewKey(id, signer)
+}
+
+// LoadKeys reads every *.pem file of dir as a key named after the file, sorted by name.
+func LoadKeys(dir string) ([]*Key, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	keys := []*Key{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParsePEM(strings.TrimSuffix(filepath.Base(path), ".pem"), data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwt: no *.pem keys in %s", dir)
+	}
+	return keys, nil
+}
+
+// NewKeySet returns a set of keys signing with the key named signing.
+func NewKeySet(signing string, keys []*Key) (*KeySet, error) {
+	set := &KeySet{keys: map[string]*Key{}}
+	for _, key := range keys {
+		if _, ok := set.keys[key.ID]; ok {
+			return nil, fmt.Errorf("jwt: key %s is listed twice", key.ID)
+		}
+		set.keys[key.ID] = key
+	}
+
+	set.signing = set.keys[signing]
+	if set.signing == nil {
+		return nil, fmt.Errorf("jwt: signing key %q is not in the set", signing)
+	}
+
+	return set, nil
+}
+
+// Sign returns a token carrying claims, any value encoding/json marshals to an object, signed with the signing key.
+func (ks *KeySet) Sign(claims interface{}) (string, error) {
+	key := ks.signing
+
+	head, err := json.Marshal(&header{Algorithm: key.Algorithm, KeyID: key.ID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := encode(head) + "." + encode(payload)
+
+	var signature []byte
+	switch key.Algorithm {
+	case EdDSA:
+		signature, err = key.signer.Sign(rand.Reader, []byte(input), crypto.Hash(0))
+	default:
+		digest := sha256.Sum256([]byte(input))
+		signature, err = key.signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + encode(signature), nil
+}
+
+// Parse verifies the signature of token and decodes its claims into claims. It doesn't validate the claims, see
+// Claims.Valid. Tokens must name a key of the set and the algorithm of that key, so a token can't pick a weaker one.
+func (ks *KeySet) Parse(token string, claims interface{}) error {
+	if len(token) > maxTokenBytes {
+		return ErrMalformed
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrMalformed
+	}
+
+	head := &header{}
+	if err := decodeJSON(parts[0], head); err != nil {
+		return ErrMalformed
+	}
+
+	key := ks.keys[head.KeyID]
+	if key == nil {
+		return ErrUnknownKey
+	}
+	if head.Algorithm != key.Algorithm {
+		return ErrSignature
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ErrMalformed
+	}
+
+	input := []byte(parts[0] + "." + parts[1])
+	switch public := key.signer.Public().(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(public, input, signature) {
+			return ErrSignature
+		}
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(input)
+		if rsa.VerifyPKCS1v15(public, crypto.SHA256, digest[:], signature) != nil {
+			return ErrSignature
+		}
+	}
+
+	if err := decodeJSON(parts[1], claims); err != nil {
+		return ErrMalformed
+	}
+
+	return nil
+}
+
+// JWKS returns the public keys of the set, sorted by ID.
+func (ks *KeySet) JWKS() *JWKS {
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := &JWKS{Keys: []JWK{}}
+	for _, id := range ids {
+		key := ks.keys[id]
+		jwk := JWK{KeyID: key.ID, Algorithm: key.Algorithm, Use: "sig"}
+
+		switch public := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve, jwk.X = "OKP", "Ed25519", encode(public)
+		case *rsa.PublicKey:
+			jwk.KeyType, jwk.N, jwk.E = "RSA", encode(public.N.Bytes()), encode(big.NewInt(int64(public.E)).Bytes())
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+// Valid checks the registered claims at now: the token must have been issued by issuer for audience, and be within
+// its validity period give or take Leeway. Empty issuer or audience aren't checked.
+func (c *Claims) Valid(issuer, audience string, now time.Time) error {
+	if c.ExpiresAt == 0 || now.Add(-Leeway).Unix() >= c.ExpiresAt {
+		return ErrExpired
+	}
+
+	if c.NotBefore != 0 && now.Add(Leeway).Unix() < c.NotBefore {
+		return ErrNotYet
+	}
+
+	if issuer != "" && c.Issuer != issuer {
+		return ErrIssuer
+	}
+
+	if audience != "" && c.Audience != audience {
+		return ErrAudience
+	}
+
+	return nil
+}
+
+// NewID returns a random token ID, for the jti claim.
+func NewID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return encode(b)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
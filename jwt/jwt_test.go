@@ -0,0 +1,117 @@
+package jwt_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySet_Sign(t *testing.T) {
+	ed, err := jwt.GenerateKey("2024-01")
+	require.Nil(t, err)
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	rs, err := jwt.NewKey("2023-12", private)
+	require.Nil(t, err)
+	require.Equal(t, jwt.RS256, rs.Algorithm)
+
+	now := time.Now()
+	claims := &jwt.Claims{Issuer: "twelvefactor", Subject: "user:1", Audience: "api", ExpiresAt: now.Add(time.Minute).Unix()}
+
+	for _, key := range []*jwt.Key{ed, rs} {
+		keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{ed, rs})
+		require.Nil(t, err)
+
+		token, err := keys.Sign(claims)
+		require.Nil(t, err)
+
+		parsed := &jwt.Claims{}
+		require.Nil(t, keys.Parse(token, parsed))
+		require.Equal(t, claims, parsed)
+		require.Nil(t, parsed.Valid("twelvefactor", "api", now))
+	}
+
+	// Tokens signed by a retired key are rejected, tokens signed before a rotation aren't.
+	old, err := jwt.NewKeySet(rs.ID, []*jwt.Key{rs})
+	require.Nil(t, err)
+	token, err := old.Sign(claims)
+	require.Nil(t, err)
+
+	rotated, err := jwt.NewKeySet(ed.ID, []*jwt.Key{ed, rs})
+	require.Nil(t, err)
+	require.Nil(t, rotated.Parse(token, &jwt.Claims{}))
+
+	retired, err := jwt.NewKeySet(ed.ID, []*jwt.Key{ed})
+	require.Nil(t, err)
+	require.Equal(t, jwt.ErrUnknownKey, retired.Parse(token, &jwt.Claims{}))
+
+	require.Len(t, rotated.JWKS().Keys, 2)
+	require.Equal(t, "2023-12", rotated.JWKS().Keys[0].KeyID)
+	require.Equal(t, "OKP", rotated.JWKS().Keys[1].KeyType)
+}
+
+func TestKeySet_Parse(t *testing.T) {
+	key, err := jwt.GenerateKey("k1")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet("k1", []*jwt.Key{key})
+	require.Nil(t, err)
+
+	token, err := keys.Sign(&jwt.Claims{Subject: "user:1", ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	require.Nil(t, err)
+	parts := strings.Split(token, ".")
+
+	// Tampered claims.
+	forged := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user:2"}`)) + "." + parts[2]
+	require.Equal(t, jwt.ErrSignature, keys.Parse(forged, &jwt.Claims{}))
+
+	// Algorithms other than the key's, such as none.
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"k1"}`)) + "." + parts[1] + "."
+	require.Equal(t, jwt.ErrSignature, keys.Parse(none, &jwt.Claims{}))
+
+	require.Equal(t, jwt.ErrMalformed, keys.Parse("not a token", &jwt.Claims{}))
+}
+
+func TestClaims_Valid(t *testing.T) {
+	now := time.Now()
+	claims := &jwt.Claims{Issuer: "a", Audience: "b", ExpiresAt: now.Unix() + 60, NotBefore: now.Unix()}
+
+	require.Nil(t, claims.Valid("a", "b", now))
+	require.Nil(t, claims.Valid("", "", now.Add(80*time.Second)), "within the leeway")
+	require.Equal(t, jwt.ErrExpired, claims.Valid("a", "b", now.Add(2*time.Minute)))
+	require.Equal(t, jwt.ErrNotYet, claims.Valid("a", "b", now.Add(-time.Minute)))
+	require.Equal(t, jwt.ErrIssuer, claims.Valid("c", "b", now))
+	require.Equal(t, jwt.ErrAudience, claims.Valid("a", "c", now))
+	require.Equal(t, jwt.ErrExpired, (&jwt.Claims{}).Valid("", "", now))
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "2024-02.pem"), data, 0600))
+
+	keys, err := jwt.LoadKeys(dir)
+	require.Nil(t, err)
+	require.Len(t, keys, 1)
+	require.Equal(t, "2024-02", keys[0].ID)
+	require.Equal(t, jwt.RS256, keys[0].Algorithm)
+
+	_, err = jwt.LoadKeys(filepath.Join(dir, "missing"))
+	require.NotNil(t, err)
+}
@@ -0,0 +1,513 @@
+// Package lockout protects logins against guessing. It counts failed attempts per account and per client address in
+// Postgres: past a few failures each further attempt on an account must wait, twice as long every time, and past a
+// threshold the account or address is locked out for a while. Accounts are counted by the username attempted, whether
+// or not it exists, so neither the counting nor the lockouts tell which usernames do. Logins and lockouts are recorded
+// as security events, and administrators list and clear lockouts.
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of what failures are counted against.
+const (
+	KindAccount = "account"
+	KindIP      = "ip"
+)
+
+// Kinds of security events.
+const (
+	EventLoginSucceeded     = "login_succeeded"
+	EventLoginFailed        = "login_failed"
+	EventSecondFactorFailed = "second_factor_failed"
+	EventLoginThrottled     = "login_throttled"
+	EventAccountLocked      = "account_locked"
+	EventIPLocked           = "ip_locked"
+	EventLockoutCleared     = "lockout_cleared"
+)
+
+// Bounds of the number of events returned at once.
+const (
+	defaultEventsLimit = 100
+	maxEventsLimit     = 1000
+)
+
+type (
+	// Policy holds the thresholds of the service. Zero values take the defaults.
+	Policy struct {
+		// Failures of an account after which each attempt must wait, BaseDelay after the first and twice as long after
+		// every further one, up to MaxDelay. Default to 3, 1 second and 30 seconds.
+		DelayAfter int
+		BaseDelay  time.Duration
+		MaxDelay   time.Duration
+		// Failures within Window locking an account or an address out for LockoutDuration, again on every further
+		// failure. Default to 10, 100, 15 minutes and 15 minutes.
+		AccountThreshold int
+		IPThreshold      int
+		Window           time.Duration
+		LockoutDuration  time.Duration
+	}
+
+	// Config for the lockout service.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /lockouts.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// Authorizes requests against the action and resource each route declares, nil lets every request through.
+		Enforcer access.Enforcer
+		Policy   Policy
+		// How long security events are kept. Defaults to 90 days.
+		EventRetention time.Duration
+		// How often RunExpirer forgets old failures and events, zero or less disables it.
+		ExpireInterval time.Duration
+	}
+
+	// Service: failed login tracking and security events.
+	Service struct {
+		ctx            context.Context
+		logger         *log.Logger
+		db             *sqlx.DB
+		pathPrefix     string
+		renderer       *render.Renderer
+		enforcer       access.Enforcer
+		policy         Policy
+		eventRetention time.Duration
+		expireInterval time.Duration
+	}
+
+	// Attempts counts the failures of an account or an address.
+	Attempts struct {
+		Kind          string     `json:"kind" db:"kind"`
+		Key           string     `json:"key" db:"key"`
+		Failures      int        `json:"failures" db:"failures"`
+		FirstFailedAt time.Time  `json:"firstFailedAt" db:"first_failed_at"`
+		LastFailedAt  time.Time  `json:"lastFailedAt" db:"last_failed_at"`
+		LockedUntil   *time.Time `json:"lockedUntil,omitempty" db:"locked_until"`
+		// Whether the lockout is still on.
+		Locked bool `json:"locked" db:"-"`
+		// The time of the database when the row was read.
+		Now time.Time `json:"-" db:"now"`
+	}
+
+	// Event records a login, a failure or a lockout.
+	Event struct {
+		ID        int64     `json:"id" db:"id"`
+		Kind      string    `json:"kind" db:"kind"`
+		Username  string    `json:"username" db:"username"`
+		IP        string    `json:"ip" db:"ip"`
+		Actor     string    `json:"actor" db:"actor"`
+		RequestID string    `json:"requestID" db:"request_id"`
+		CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	}
+)
+
+// New: Instantiate a new lockout service. Fail hard if its tables can't be created.
+func New(config *Config) *Service {
+	if _, err := config.DB.ExecContext(context.Background(), CreateTableStmt); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "lockouts"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	eventRetention := config.EventRetention
+	if eventRetention <= 0 {
+		eventRetention = 90 * 24 * time.Hour
+	}
+
+	return &Service{
+		ctx:            config.Ctx,
+		logger:         config.Logger,
+		db:             config.DB,
+		pathPrefix:     pathPrefix,
+		renderer:       renderer,
+		enforcer:       config.Enforcer,
+		policy:         config.Policy.withDefaults(),
+		eventRetention: eventRetention,
+		expireInterval: config.ExpireInterval,
+	}
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.DelayAfter <= 0 {
+		p.DelayAfter = 3
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = time.Second
+	}
+	if p.MaxDelay <= 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	if p.AccountThreshold <= 0 {
+		p.AccountThreshold = 10
+	}
+	if p.IPThreshold <= 0 {
+		p.IPThreshold = 100
+	}
+	if p.Window <= 0 {
+		p.Window = 15 * time.Minute
+	}
+	if p.LockoutDuration <= 0 {
+		p.LockoutDuration = 15 * time.Minute
+	}
+	return p
+}
+
+// Delay returns how long an attempt on an account which failed failures times in a row must wait after the last
+// failure.
+func (p Policy) Delay(failures int) time.Duration {
+	p = p.withDefaults()
+	if failures < p.DelayAfter {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.DelayAfter; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Wait returns how long an attempt must wait given the failures counted against it, zero if it may proceed.
+func (p Policy) Wait(attempts []*Attempts) time.Duration {
+	p = p.withDefaults()
+
+	var wait time.Duration
+	for _, a := range attempts {
+		if a.LockedUntil != nil && a.LockedUntil.After(a.Now) {
+			wait = maxDuration(wait, a.LockedUntil.Sub(a.Now))
+		}
+
+		if a.Kind == KindAccount && a.FirstFailedAt.Add(p.Window).After(a.Now) {
+			wait = maxDuration(wait, a.LastFailedAt.Add(p.Delay(a.Failures)).Sub(a.Now))
+		}
+	}
+	return wait
+}
+
+// Mount the subRouter of this service to the root router. Lockouts and events are managed with the admin action.
+func (s *Service) Mount(r *mux.Router) {
+	lockouts := access.Static("lockouts")
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.Handle("", s.require(lockouts, s.GetMany)).Methods("GET")
+	subRouter.Handle("/events", s.require(lockouts, s.GetEvents)).Methods("GET")
+	subRouter.Handle("/{kind:account|ip}/{key}", s.require(lockouts, s.Clear)).Methods("DELETE")
+}
+
+func (s *Service) require(resource access.Resource, handler http.HandlerFunc) http.Handler {
+	return access.Require(s.enforcer, access.Admin, resource, handler)
+}
+
+// Check returns how long a login attempt on username from ip must wait, zero if it may proceed now. Attempts which
+// must wait are recorded as throttled, and must be turned away without checking their credentials.
+func (s *Service) Check(ctx context.Context, username, ip string) (time.Duration, error) {
+	username = normalize(username)
+
+	attempts := []*Attempts{}
+	if err := s.db.SelectContext(ctx, &attempts, SelectAttemptsStmt, username, ip); err != nil {
+		return 0, err
+	}
+
+	wait := s.policy.Wait(attempts)
+	if wait > 0 {
+		if err := s.Record(ctx, EventLoginThrottled, username, ip); err != nil {
+			s.logger.Println(err)
+		}
+	}
+	return wait, nil
+}
+
+// Failed counts a failed attempt on username from ip, recording it as an event of kind, and locks the account or the
+// address out once they reach their threshold.
+func (s *Service) Failed(ctx context.Context, kind, username, ip string) error {
+	username = normalize(username)
+
+	events := []string{kind}
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		for _, c := range []struct {
+			kind, key, event string
+			threshold        int
+		}{
+			{KindAccount, username, EventAccountLocked, s.policy.AccountThreshold},
+			{KindIP, ip, EventIPLocked, s.policy.IPThreshold},
+		} {
+			locked, err := s.fail(ctx, tx, c.kind, c.key, c.threshold)
+			if err != nil {
+				return err
+			}
+			if locked {
+				events = append(events, c.event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		if err := s.Record(ctx, event, username, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fail counts a failure against key within tx, reporting whether it locked key out.
+func (s *Service) fail(ctx context.Context, tx *sqlx.Tx, kind, key string, threshold int) (bool, error) {
+	if _, err := tx.ExecContext(ctx, InsertAttemptStmt, kind, key); err != nil {
+		return false, err
+	}
+
+	a := &Attempts{}
+	if err := tx.GetContext(ctx, a, SelectAttemptForUpdateStmt, kind, key); err != nil {
+		return false, err
+	}
+
+	// Failures older than the window start the count over.
+	if a.Failures == 0 || !a.FirstFailedAt.Add(s.policy.Window).After(a.Now) {
+		a.Failures, a.FirstFailedAt = 0, a.Now
+	}
+	a.Failures++
+	a.LastFailedAt = a.Now
+
+	locked := a.Failures >= threshold
+	if locked {
+		until := a.Now.Add(s.policy.LockoutDuration)
+		a.LockedUntil = &until
+	}
+
+	_, err := tx.ExecContext(ctx, UpdateAttemptStmt, kind, key, a.Failures, a.FirstFailedAt, a.LastFailedAt,
+		a.LockedUntil)
+	return locked, err
+}
+
+// Succeeded forgets the failures of an account once it logged in, recording the login. Failures from the address
+// aren't forgotten, or logging in to an account of one's own would clear them.
+func (s *Service) Succeeded(ctx context.Context, username, ip string) error {
+	username = normalize(username)
+
+	if _, err := s.db.ExecContext(ctx, DeleteAttemptStmt, KindAccount, username); err != nil {
+		return err
+	}
+	return s.Record(ctx, EventLoginSucceeded, username, ip)
+}
+
+// Record writes a security event, with the actor and ID of the request in ctx.
+func (s *Service) Record(ctx context.Context, kind, username, ip string) error {
+	_, err := s.db.ExecContext(ctx, InsertEventStmt, kind, normalize(username), ip, reqctx.Actor(ctx),
+		reqctx.RequestID(ctx))
+	return err
+}
+
+// GetMany endpoint returns the accounts and addresses with recent failures, locked out or not, most recent first.
+func (s *Service) GetMany(w http.ResponseWriter, r *http.Request) {
+	attempts := []*Attempts{}
+	if err := s.db.SelectContext(r.Context(), &attempts, SelectManyAttemptsStmt); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	for _, a := range attempts {
+		a.Locked = a.LockedUntil != nil && a.LockedUntil.After(a.Now)
+	}
+
+	s.render(w, r, http.StatusOK, attempts)
+}
+
+// GetEvents endpoint returns the most recent security events, filtered by the username and ip query parameters and
+// at most limit of them, 100 by default.
+func (s *Service) GetEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	limit := defaultEventsLimit
+	if raw := query.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 || n > maxEventsLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxEventsLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events := []*Event{}
+	err := s.db.SelectContext(r.Context(), &events, SelectEventsStmt, normalize(query.Get("username")),
+		query.Get("ip"), limit)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, events)
+}
+
+// Clear endpoint forgets the failures of an account or an address, lifting its lockout, and responds with 204 No
+// Content, or 404 Not Found if it had none. Accounts are named by username.
+func (s *Service) Clear(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	kind, key := vars["kind"], vars["key"]
+	if kind == KindAccount {
+		key = normalize(key)
+	}
+
+	result, err := s.db.ExecContext(r.Context(), DeleteAttemptStmt, kind, key)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "no failures to clear", http.StatusNotFound)
+		return
+	}
+
+	username, ip := key, ""
+	if kind == KindIP {
+		username, ip = "", key
+	}
+	if err := s.Record(r.Context(), EventLockoutCleared, username, ip); err != nil {
+		s.logger.Println(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Expire forgets failures older than the window which no longer lock anything out, and events older than the
+// retention. Returns the number of rows removed.
+func (s *Service) Expire(ctx context.Context) (int64, error) {
+	var removed int64
+	for _, c := range []struct {
+		stmt string
+		age  time.Duration
+	}{
+		{ExpireAttemptsStmt, s.policy.Window},
+		{ExpireEventsStmt, s.eventRetention},
+	} {
+		result, err := s.db.ExecContext(ctx, c.stmt, c.age.Seconds())
+		if err != nil {
+			return removed, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// RunExpirer calls Expire every expire interval until ctx is done. Blocks, so run it in its own goroutine.
+func (s *Service) RunExpirer(ctx context.Context) {
+	if s.expireInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Expire(ctx); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+}
+
+// Name implements users.PersonalData.
+func (s *Service) Name() string {
+	return "security_events"
+}
+
+// Export implements users.PersonalData: the security events of the account of the user, by its current username.
+func (s *Service) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	events := []*Event{}
+	if err := tx.SelectContext(ctx, &events, SelectUserEventsStmt, userID); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Erase implements users.PersonalData: the security events and failures of the account of the user are deleted.
+func (s *Service) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	for _, stmt := range []string{DeleteUserEventsStmt, DeleteUserAttemptsStmt} {
+		if _, err := tx.ExecContext(ctx, stmt, userID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalize returns the key an account is counted under: usernames are matched regardless of case when logging in.
+func normalize(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (s *Service) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,138 @@
+package lockout_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/lockout"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestPolicy_Delay(t *testing.T) {
+	policy := lockout.Policy{DelayAfter: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	require.Equal(t, time.Duration(0), policy.Delay(2))
+	require.Equal(t, time.Second, policy.Delay(3))
+	require.Equal(t, 2*time.Second, policy.Delay(4))
+	require.Equal(t, 8*time.Second, policy.Delay(6))
+	require.Equal(t, 10*time.Second, policy.Delay(7))
+	require.Equal(t, 10*time.Second, policy.Delay(1000))
+}
+
+func TestPolicy_Wait(t *testing.T) {
+	policy := lockout.Policy{DelayAfter: 3, BaseDelay: time.Second, Window: time.Minute}
+	now := time.Now()
+	locked := now.Add(time.Hour)
+
+	// Delays only apply to accounts, and only within the window.
+	require.Equal(t, time.Second, policy.Wait([]*lockout.Attempts{
+		{Kind: lockout.KindAccount, Failures: 3, FirstFailedAt: now, LastFailedAt: now, Now: now},
+		{Kind: lockout.KindIP, Failures: 50, FirstFailedAt: now, LastFailedAt: now, Now: now},
+	}))
+	require.Equal(t, time.Duration(0), policy.Wait([]*lockout.Attempts{
+		{Kind: lockout.KindAccount, Failures: 3, FirstFailedAt: now.Add(-time.Hour), LastFailedAt: now, Now: now},
+	}))
+
+	// Lockouts last their whole duration, the window notwithstanding.
+	require.Equal(t, time.Hour, policy.Wait([]*lockout.Attempts{
+		{Kind: lockout.KindIP, Failures: 1, FirstFailedAt: now.Add(-time.Hour), LastFailedAt: now, LockedUntil: &locked, Now: now},
+	}))
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+
+	service := lockout.New(&lockout.Config{
+		Ctx:    ctx,
+		Logger: log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:     db,
+		Policy: lockout.Policy{DelayAfter: 100, AccountThreshold: 3, IPThreshold: 5},
+	})
+	_, err = db.ExecContext(ctx, "DELETE FROM login_attempts; DELETE FROM security_events;")
+	require.Nil(t, err)
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	send := func(method, target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w
+	}
+
+	wait := func(username, ip string) time.Duration {
+		d, err := service.Check(ctx, username, ip)
+		require.Nil(t, err)
+		return d
+	}
+
+	// Accounts are locked out at their threshold, whatever the case of the username.
+	for i := 0; i < 3; i++ {
+		require.Equal(t, time.Duration(0), wait("fred", "10.0.0.1"))
+		require.Nil(t, service.Failed(ctx, lockout.EventLoginFailed, "Fred", "10.0.0.1"))
+	}
+	require.InDelta(t, float64(15*time.Minute), float64(wait("fred", "10.0.0.2")), float64(time.Second))
+	require.Equal(t, time.Duration(0), wait("barney", "10.0.0.1"))
+
+	// Addresses too, whichever accounts they try.
+	require.Nil(t, service.Failed(ctx, lockout.EventLoginFailed, "barney", "10.0.0.1"))
+	require.Nil(t, service.Failed(ctx, lockout.EventLoginFailed, "wilma", "10.0.0.1"))
+	require.True(t, wait("betty", "10.0.0.1") > 0)
+
+	w := send("GET", "http://localhost:9090/lockouts")
+	require.Equal(t, 200, w.Code)
+	attempts := []*lockout.Attempts{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &attempts))
+	locked := 0
+	for _, a := range attempts {
+		if a.Locked {
+			locked++
+		}
+	}
+	require.Equal(t, 2, locked)
+
+	w = send("GET", "http://localhost:9090/lockouts/events?username=FRED")
+	require.Equal(t, 200, w.Code)
+	events := []*lockout.Event{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &events))
+	kinds := []string{}
+	for _, e := range events {
+		require.Equal(t, "fred", e.Username)
+		kinds = append(kinds, e.Kind)
+	}
+	require.Equal(t, []string{lockout.EventLoginThrottled, lockout.EventAccountLocked, lockout.EventLoginFailed}, kinds[:3])
+
+	// Clearing a lockout lifts it, once.
+	require.Equal(t, 204, send("DELETE", "http://localhost:9090/lockouts/account/Fred").Code)
+	require.Equal(t, 404, send("DELETE", "http://localhost:9090/lockouts/account/fred").Code)
+	require.Equal(t, 204, send("DELETE", "http://localhost:9090/lockouts/ip/10.0.0.1").Code)
+	require.Equal(t, time.Duration(0), wait("fred", "10.0.0.1"))
+
+	// Logging in forgets the failures of the account, not those of the address.
+	require.Nil(t, service.Failed(ctx, lockout.EventLoginFailed, "barney", "10.0.0.3"))
+	require.Nil(t, service.Succeeded(ctx, "barney", "10.0.0.3"))
+	w = send("GET", "http://localhost:9090/lockouts")
+	attempts = []*lockout.Attempts{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &attempts))
+	keys := []string{}
+	for _, a := range attempts {
+		keys = append(keys, a.Kind+":"+a.Key)
+	}
+	require.Contains(t, keys, "ip:10.0.0.3")
+	require.NotContains(t, keys, "account:barney")
+
+	require.Equal(t, 400, send("GET", "http://localhost:9090/lockouts/events?limit=0").Code)
+}
@@ -0,0 +1,112 @@
+package lockout
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		kind TEXT NOT NULL,
+		key TEXT NOT NULL,
+		failures INTEGER NOT NULL DEFAULT 0,
+		first_failed_at timestamp with time zone NOT NULL DEFAULT now(),
+		last_failed_at timestamp with time zone NOT NULL DEFAULT now(),
+		locked_until timestamp with time zone,
+		PRIMARY KEY (kind, key)
+	);
+	CREATE TABLE IF NOT EXISTS security_events (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		username TEXT NOT NULL DEFAULT '',
+		ip TEXT NOT NULL DEFAULT '',
+		actor TEXT NOT NULL DEFAULT '',
+		request_id TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS security_events_username_idx ON security_events (username, created_at);
+	CREATE INDEX IF NOT EXISTS security_events_ip_idx ON security_events (ip, created_at);
+	CREATE INDEX IF NOT EXISTS security_events_created_at_idx ON security_events (created_at);
+	`
+
+	// The failures of an account, $1, and of an address, $2, with the time of the database to compare them with.
+	SelectAttemptsStmt = `
+	SELECT kind, key, failures, first_failed_at, last_failed_at, locked_until, now() AS now
+	FROM login_attempts
+	WHERE (kind = 'account' AND key = $1) OR (kind = 'ip' AND key = $2);
+	`
+
+	// Create the row counting failures, so it can be locked even on the first one.
+	InsertAttemptStmt = `
+	INSERT INTO login_attempts (kind, key)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING;
+	`
+
+	SelectAttemptForUpdateStmt = `
+	SELECT kind, key, failures, first_failed_at, last_failed_at, locked_until, now() AS now
+	FROM login_attempts
+	WHERE kind = $1 AND key = $2
+	FOR UPDATE;
+	`
+
+	UpdateAttemptStmt = `
+	UPDATE login_attempts SET
+		failures = $3,
+		first_failed_at = $4,
+		last_failed_at = $5,
+		locked_until = $6
+	WHERE kind = $1 AND key = $2;
+	`
+
+	DeleteAttemptStmt = `
+	DELETE FROM login_attempts
+	WHERE kind = $1 AND key = $2;
+	`
+
+	SelectManyAttemptsStmt = `
+	SELECT kind, key, failures, first_failed_at, last_failed_at, locked_until, now() AS now
+	FROM login_attempts
+	WHERE failures > 0
+	ORDER BY last_failed_at DESC;
+	`
+
+	InsertEventStmt = `
+	INSERT INTO security_events (kind, username, ip, actor, request_id)
+	VALUES ($1, $2, $3, $4, $5);
+	`
+
+	// The most recent events, of a username if $1 isn't empty and of an address if $2 isn't, at most $3.
+	SelectEventsStmt = `
+	SELECT id, kind, username, ip, actor, request_id, created_at
+	FROM security_events
+	WHERE ($1 = '' OR username = $1) AND ($2 = '' OR ip = $2)
+	ORDER BY id DESC
+	LIMIT $3;
+	`
+
+	// Events about the account of a user, by its current username.
+	SelectUserEventsStmt = `
+	SELECT id, kind, username, ip, actor, request_id, created_at
+	FROM security_events
+	WHERE username = (SELECT lower(username) FROM users WHERE id = $1)
+	ORDER BY id;
+	`
+
+	DeleteUserEventsStmt = `
+	DELETE FROM security_events
+	WHERE username = (SELECT lower(username) FROM users WHERE id = $1);
+	`
+
+	DeleteUserAttemptsStmt = `
+	DELETE FROM login_attempts
+	WHERE kind = 'account' AND key = (SELECT lower(username) FROM users WHERE id = $1);
+	`
+
+	// Forget failures older than the window, $1 seconds, unless they still lock their account or address out.
+	ExpireAttemptsStmt = `
+	DELETE FROM login_attempts
+	WHERE last_failed_at < now() - make_interval(secs => $1) AND (locked_until IS NULL OR locked_until < now());
+	`
+
+	ExpireEventsStmt = `
+	DELETE FROM security_events
+	WHERE created_at < now() - make_interval(secs => $1);
+	`
+)
@@ -0,0 +1,202 @@
+// Package mail sends plain text emails through a pluggable Mailer: SMTP in production, a log of messages in
+// development and memory in tests. Messages are rendered from templates which deployments can override.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ErrMalformedTemplate is returned for templates which don't start with a Subject line followed by a blank line.
+var ErrMalformedTemplate = errors.New("mail: template must start with a Subject: line and a blank line")
+
+type (
+	// Message is a plain text email.
+	Message struct {
+		To      string
+		Subject string
+		Text    string
+	}
+
+	// Mailer sends messages.
+	Mailer interface {
+		Send(ctx context.Context, msg *Message) error
+	}
+
+	// SMTP sends messages through an SMTP server, with STARTTLS whenever the server offers it.
+	SMTP struct {
+		addr string
+		from string
+		auth smtp.Auth
+	}
+
+	// Log writes messages to a writer, such as a file or standard output, instead of sending them.
+	Log struct {
+		mu   sync.Mutex
+		w    io.Writer
+		from string
+	}
+
+	// Memory keeps the messages it is given, for tests.
+	Memory struct {
+		mu   sync.Mutex
+		sent []*Message
+	}
+
+	// Template renders messages. Its text starts with a "Subject: " line, then a blank line and the body, both
+	// text/template templates executed with the same data.
+	Template struct {
+		subject *template.Template
+		body    *template.Template
+	}
+)
+
+// NewSMTP returns a Mailer sending from the from address through the SMTP server at addr, a host:port pair. Username
+// and password are sent with PLAIN authentication when set, which net/smtp only does over TLS or to localhost.
+func NewSMTP(addr, from, username, password string) *SMTP {
+	m := &SMTP{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send implements Mailer. net/smtp doesn't take a context, so ctx is only checked before connecting.
+func (m *SMTP) Send(ctx context.Context, msg *Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+}
+
+// NewLog returns a Mailer writing messages to w, each formatted as it would be sent.
+func NewLog(w io.Writer, from string) *Log {
+	return &Log{w: w, from: from}
+}
+
+// OpenLog returns a Mailer appending messages to the file at path, created if it doesn't exist.
+func OpenLog(path, from string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewLog(f, from), nil
+}
+
+// Send implements Mailer.
+func (m *Log) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.w.Write(append(format(m.from, msg), '\n'))
+	return err
+}
+
+// Send implements Mailer.
+func (m *Memory) Send(ctx context.Context, msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Sent returns the messages sent so far, oldest first.
+func (m *Memory) Sent() []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]*Message{}, m.sent...)
+}
+
+// Last returns the last message sent to an address, or nil.
+func (m *Memory) Last(to string) *Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i]
+		}
+	}
+	return nil
+}
+
+// ParseTemplate parses the text of a template, see Template.
+func ParseTemplate(name, text string) (*Template, error) {
+	parts := strings.SplitN(strings.Replace(text, "\r\n", "\n", -1), "\n\n", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "Subject: ") || strings.Contains(parts[0], "\n") {
+		return nil, ErrMalformedTemplate
+	}
+
+	subject, err := template.New(name + ".subject").Parse(strings.TrimPrefix(parts[0], "Subject: "))
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := template.New(name).Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Template{subject: subject, body: body}, nil
+}
+
+// LoadTemplate parses the template <name>.tmpl in dir, or fallback if dir is empty or has no such file.
+func LoadTemplate(dir, name, fallback string) (*Template, error) {
+	text := fallback
+	if dir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name+".tmpl"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			text = string(data)
+		}
+	}
+
+	return ParseTemplate(name, text)
+}
+
+// Render executes the template with data into a message to the to address.
+func (t *Template) Render(to string, data interface{}) (*Message, error) {
+	subject := &bytes.Buffer{}
+	if err := t.subject.Execute(subject, data); err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	if err := t.body.Execute(body, data); err != nil {
+		return nil, err
+	}
+
+	// A subject spanning lines would inject headers.
+	return &Message{To: to, Subject: strings.Join(strings.Fields(subject.String()), " "), Text: body.String()}, nil
+}
+
+// format returns msg as the RFC 5322 message sent from the from address.
+func format(from string, msg *Message) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "From: %s\r\n", from)
+	fmt.Fprintf(b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.Replace(strings.Replace(msg.Text, "\r\n", "\n", -1), "\n", "\r\n", -1))
+	return b.Bytes()
+}
@@ -0,0 +1,65 @@
+package mail_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/mail"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemplate_Render(t *testing.T) {
+	tmpl, err := mail.ParseTemplate("reset", "Subject: Hello {{.Name}}\n\nVisit {{.URL}}\n")
+	require.Nil(t, err)
+
+	msg, err := tmpl.Render("fred@example.com", map[string]string{"Name": "Fred\r\nBcc: eve@example.com", "URL": "https://example.com"})
+	require.Nil(t, err)
+	require.Equal(t, "fred@example.com", msg.To)
+	require.Equal(t, "Hello Fred Bcc: eve@example.com", msg.Subject)
+	require.Equal(t, "Visit https://example.com\n", msg.Text)
+
+	_, err = mail.ParseTemplate("reset", "Visit {{.URL}}")
+	require.Equal(t, mail.ErrMalformedTemplate, err)
+}
+
+func TestLoadTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mail")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "verify.tmpl"), []byte("Subject: Custom\n\nBody"), 0600))
+
+	tmpl, err := mail.LoadTemplate(dir, "verify", "Subject: Default\n\nBody")
+	require.Nil(t, err)
+	msg, err := tmpl.Render("a@example.com", nil)
+	require.Nil(t, err)
+	require.Equal(t, "Custom", msg.Subject)
+
+	tmpl, err = mail.LoadTemplate(dir, "reset", "Subject: Default\n\nBody")
+	require.Nil(t, err)
+	msg, err = tmpl.Render("a@example.com", nil)
+	require.Nil(t, err)
+	require.Equal(t, "Default", msg.Subject)
+}
+
+func TestMailers(t *testing.T) {
+	ctx := context.Background()
+	msg := &mail.Message{To: "fred@example.com", Subject: "Hi", Text: "line one\nline two"}
+
+	out := &bytes.Buffer{}
+	require.Nil(t, mail.NewLog(out, "noreply@example.com").Send(ctx, msg))
+	require.Contains(t, out.String(), "From: noreply@example.com\r\n")
+	require.Contains(t, out.String(), "Subject: Hi\r\n")
+	require.True(t, strings.Contains(out.String(), "\r\n\r\nline one\r\nline two"))
+
+	memory := &mail.Memory{}
+	require.Nil(t, memory.Send(ctx, msg))
+	require.Len(t, memory.Sent(), 1)
+	require.Equal(t, msg, memory.Last("fred@example.com"))
+	require.Nil(t, memory.Last("wilma@example.com"))
+}
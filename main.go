@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	// sqlx in a minimal extension to sql/db
@@ -20,8 +22,35 @@ import (
 	"github.com/gorilla/mux"
 	// Simple Ping service
 	"github.com/b3ntly/twelvefactor_databases/ping"
+	// Authenticates machine clients with API keys
+	"github.com/b3ntly/twelvefactor_databases/apikeys"
+	// Roles granting principals permissions on resources
+	"github.com/b3ntly/twelvefactor_databases/rbac"
+	// Signs and verifies access tokens
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	// Delays and locks out clients guessing passwords
+	"github.com/b3ntly/twelvefactor_databases/lockout"
+	// Sends password reset and email verification links
+	"github.com/b3ntly/twelvefactor_databases/mail"
+	// OAuth 2.0 authorization server and OpenID Connect provider
+	"github.com/b3ntly/twelvefactor_databases/oauth"
+	// Password logins, access and refresh tokens
+	"github.com/b3ntly/twelvefactor_databases/auth"
+	// Encrypts personal data before it reaches the database
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	// Replays the responses of retried requests
+	"github.com/b3ntly/twelvefactor_databases/idempotency"
+	// Throttles clients making too many requests
+	"github.com/b3ntly/twelvefactor_databases/ratelimit"
+	// Organizations isolated from one another by row-level security
+	"github.com/b3ntly/twelvefactor_databases/tenancy"
+	// Validates user metadata against a deployment's schema
+	"github.com/b3ntly/twelvefactor_databases/jsonschema"
+	// Request IDs and caller identity shared by every service
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	// Content negotiation shared by every service
+	"github.com/b3ntly/twelvefactor_databases/render"
 	// Users service: GetAll
-	// Authentication service: Register, Login
 	"github.com/b3ntly/twelvefactor_databases/users"
 )
 
@@ -30,6 +59,12 @@ type Service interface {
 	Mount(*mux.Router)
 }
 
+// StreamingService is implemented by services with long-lived routes, such as bulk exports, which must not be bound by
+// REQ_TIMEOUT. Cancellation of those routes is left to the client connection.
+type StreamingService interface {
+	StreamingPaths() []string
+}
+
 // Environment declares variables gathered from our environment using kelseyhightower/envconfig.
 // The goal is to expose as much configuration of your application as possible so knobs can be easily turned
 // by your devops team.
@@ -45,16 +80,145 @@ type Environment struct {
 	DBMaxIdle          int           `envconfig:"DB_MAX_IDLE" default:"2"`
 	PostgresURI        string        `envconfig:"POSTGRES_URI" default:"postgresql://postgres@localhost:5432/postgres?sslmode=disable"`
 	// Expose the users service at this path, defaults to /users.
-	UsersPathPrefix    string        `envconfig:"USERS_PATH" default:"users"`
+	UsersPathPrefix string `envconfig:"USERS_PATH" default:"users"`
 	// The number of users returned by the /users endpoint.
-	SelectManyLimit    int           `envconfig:"USERS_SELECT_LIMIT" default:"10"`
+	SelectManyLimit int `envconfig:"USERS_SELECT_LIMIT" default:"10"`
+	// The number of rows streamed between flushes by the /users/export endpoint.
+	ExportBatchSize int `envconfig:"USERS_EXPORT_BATCH_SIZE" default:"500"`
+	// The largest metadata object, in bytes of JSON, a user may carry.
+	MetadataMaxBytes int `envconfig:"USERS_METADATA_MAX_BYTES" default:"16384"`
+	// Path to a JSON Schema every user metadata object must satisfy, unset to accept any object.
+	MetadataSchemaPath string `envconfig:"USERS_METADATA_SCHEMA"`
+	// How long soft deleted users are kept before being purged for good.
+	PurgeRetention time.Duration `envconfig:"USERS_PURGE_RETENTION" default:"720h"`
+	// How often to look for soft deleted users to purge, 0 disables purging on this replica.
+	PurgeInterval time.Duration `envconfig:"USERS_PURGE_INTERVAL" default:"1h"`
+	// Expose the API keys service at this path.
+	APIKeysPathPrefix string `envconfig:"API_KEYS_PATH" default:"api-keys"`
+	// Expose the authentication service at this path.
+	AuthPathPrefix string `envconfig:"AUTH_PATH" default:"auth"`
+	// Directory of PEM encoded Ed25519 or RSA private keys signing access tokens, named <key id>.pem. Unset to sign with
+	// a key generated at startup, which is only acceptable with a single replica in development.
+	JWTKeysDir string `envconfig:"JWT_KEYS_DIR"`
+	// The ID of the key access tokens are signed with, defaults to the last key by name.
+	JWTSigningKey string `envconfig:"JWT_SIGNING_KEY"`
+	// The iss and aud claims of access tokens.
+	JWTIssuer   string `envconfig:"JWT_ISSUER" default:"twelvefactor"`
+	JWTAudience string `envconfig:"JWT_AUDIENCE" default:"twelvefactor"`
+	// How long access tokens are valid. They can't be revoked, so keep it short.
+	AccessTokenTTL time.Duration `envconfig:"JWT_ACCESS_TTL" default:"15m"`
+	// How long refresh tokens are valid, extended by every refresh.
+	RefreshTokenTTL time.Duration `envconfig:"REFRESH_TOKEN_TTL" default:"720h"`
+	// How long a browser session lasts without being used, and at most however much it is used.
+	SessionIdleTimeout time.Duration `envconfig:"SESSION_IDLE_TIMEOUT" default:"30m"`
+	SessionMaxAge      time.Duration `envconfig:"SESSION_MAX_AGE" default:"12h"`
+	// Only send session cookies over HTTPS. Turn off for development without TLS, never in production.
+	SessionCookieSecure bool `envconfig:"SESSION_COOKIE_SECURE" default:"true"`
+	// How often to remove expired refresh tokens and sessions, 0 disables removal on this replica.
+	RefreshTokenExpireInterval time.Duration `envconfig:"REFRESH_TOKEN_EXPIRE_INTERVAL" default:"1h"`
+	// PBKDF2 iterations of new password hashes.
+	PasswordIterations int `envconfig:"PASSWORD_ITERATIONS" default:"600000"`
+	// How long password reset and email verification links are valid.
+	PasswordResetTTL     time.Duration `envconfig:"PASSWORD_RESET_TTL" default:"1h"`
+	EmailVerificationTTL time.Duration `envconfig:"EMAIL_VERIFICATION_TTL" default:"24h"`
+	// The URL of the application links sent by email lead to.
+	PublicURL string `envconfig:"PUBLIC_URL" default:"http://localhost:9090"`
+	// How email is sent: log to write messages to MAIL_FILE, or standard output when unset, smtp to send them.
+	MailBackend string `envconfig:"MAIL_BACKEND" default:"log"`
+	MailFile    string `envconfig:"MAIL_FILE"`
+	MailFrom    string `envconfig:"MAIL_FROM" default:"noreply@localhost"`
+	// Directory of templates overriding the default messages, named <template>.tmpl.
+	MailTemplatesDir string `envconfig:"MAIL_TEMPLATES_DIR"`
+	// The SMTP server as host:port, and the credentials to authenticate with when set.
+	SMTPAddr     string `envconfig:"SMTP_ADDR" default:"localhost:25"`
+	SMTPUsername string `envconfig:"SMTP_USERNAME"`
+	SMTPPassword string `envconfig:"SMTP_PASSWORD"`
+	// Expose the lockouts service at this path.
+	LockoutsPathPrefix string `envconfig:"LOCKOUTS_PATH" default:"lockouts"`
+	// Failed logins of an account after which every attempt waits, twice as long after every failure, up to the max.
+	LoginDelayAfter int           `envconfig:"LOGIN_DELAY_AFTER" default:"3"`
+	LoginBaseDelay  time.Duration `envconfig:"LOGIN_BASE_DELAY" default:"1s"`
+	LoginMaxDelay   time.Duration `envconfig:"LOGIN_MAX_DELAY" default:"30s"`
+	// Failed logins within the window locking an account, or an address, out for the lockout duration.
+	LockoutAccountThreshold int           `envconfig:"LOCKOUT_ACCOUNT_THRESHOLD" default:"10"`
+	LockoutIPThreshold      int           `envconfig:"LOCKOUT_IP_THRESHOLD" default:"100"`
+	LockoutWindow           time.Duration `envconfig:"LOCKOUT_WINDOW" default:"15m"`
+	LockoutDuration         time.Duration `envconfig:"LOCKOUT_DURATION" default:"15m"`
+	// How long security events are kept.
+	SecurityEventRetention time.Duration `envconfig:"SECURITY_EVENT_RETENTION" default:"2160h"`
+	// How often to forget old failed logins and security events, 0 disables removal on this replica.
+	LockoutExpireInterval time.Duration `envconfig:"LOCKOUT_EXPIRE_INTERVAL" default:"1h"`
+	// Expose the OAuth authorization server at this path.
+	OAuthPathPrefix string `envconfig:"OAUTH_PATH" default:"oauth"`
+	// The iss claim of ID tokens and the base URL of the endpoints the server advertises, PUBLIC_URL when unset.
+	OAuthIssuer string `envconfig:"OAUTH_ISSUER"`
+	// How long OAuth access tokens are valid, and refresh tokens, extended by every refresh.
+	OAuthAccessTTL  time.Duration `envconfig:"OAUTH_ACCESS_TTL" default:"1h"`
+	OAuthRefreshTTL time.Duration `envconfig:"OAUTH_REFRESH_TTL" default:"720h"`
+	// How often to remove expired codes and tokens, 0 disables removal on this replica.
+	OAuthExpireInterval time.Duration `envconfig:"OAUTH_EXPIRE_INTERVAL" default:"1h"`
+	// Host several organizations, isolating the users of each. Row mode requires a database user allowed to create
+	// roles.
+	TenancyEnabled bool `envconfig:"TENANCY_ENABLED" default:"false"`
+	// How organizations are isolated: "row" shares the tables with row-level security, "schema" gives each its own
+	// schema of migrated tables.
+	TenancyMode string `envconfig:"TENANCY_MODE" default:"row"`
+	// Expose the organizations service at this path.
+	OrganizationsPathPrefix string `envconfig:"ORGANIZATIONS_PATH" default:"organizations"`
+	// The domain organizations have subdomains of, and the header naming the organization of a request otherwise.
+	TenantDomain string `envconfig:"TENANT_DOMAIN"`
+	TenantHeader string `envconfig:"TENANT_HEADER" default:"X-Tenant"`
+	// Expose the roles service at this path.
+	RBACPathPrefix string `envconfig:"RBAC_PATH" default:"rbac"`
+	// Answer requests to the routes reading and writing users which neither the scopes nor the roles of their principal
+	// allow with 401 or 403. Off by default so deployments can issue keys and assign roles before enforcing them, every
+	// other route is always guarded.
+	AuthRequired bool `envconfig:"AUTH_REQUIRED" default:"false"`
+	// Header set by a trusted proxy naming the caller, recorded in audit trails. Leave unset unless every request passes
+	// through a proxy which overwrites it, otherwise clients can claim to be anyone.
+	ActorHeader string `envconfig:"ACTOR_HEADER"`
+	// Reject writes to a user without an If-Match header carrying its current ETag.
+	RequireIfMatch bool `envconfig:"USERS_REQUIRE_IF_MATCH" default:"false"`
+	// Cache-Control of the /users list. The default lets clients cache lists but revalidate them on every use, which is
+	// answered with a 304 whenever no user has changed.
+	ListCacheControl string `envconfig:"USERS_LIST_CACHE_CONTROL" default:"private, no-cache"`
+	// How long responses to requests carrying an Idempotency-Key are replayed to retries.
+	IdempotencyTTL time.Duration `envconfig:"IDEMPOTENCY_TTL" default:"24h"`
+	// How long a request may hold an idempotency key before the key may be claimed again.
+	IdempotencyLease time.Duration `envconfig:"IDEMPOTENCY_LEASE" default:"1m"`
+	// How often to remove expired idempotency keys, 0 disables removal on this replica.
+	IdempotencyExpireInterval time.Duration `envconfig:"IDEMPOTENCY_EXPIRE_INTERVAL" default:"1h"`
+	// Requests allowed per client, see ratelimit.ParseRules. Empty disables rate limiting.
+	RateLimits string `envconfig:"RATE_LIMITS" default:"/=50/s:100"`
+	// Where rate limit buckets are kept: memory limits each replica on its own, postgres limits all of them together.
+	RateLimitBackend string `envconfig:"RATE_LIMIT_BACKEND" default:"memory"`
+	// How often idle rate limit buckets are forgotten.
+	RateLimitCleanupInterval time.Duration `envconfig:"RATE_LIMIT_CLEANUP_INTERVAL" default:"10m"`
+	// Keys encrypting personal data as comma separated id:base64 pairs, or a file of them one per line. Unset to store
+	// personal data in plaintext, which is only acceptable in development.
+	PIIKeys     string `envconfig:"PII_KEYS"`
+	PIIKeysFile string `envconfig:"PII_KEYS_FILE"`
+	// The ID of the key new values are encrypted with, defaults to the last key listed.
+	PIIPrimaryKey string `envconfig:"PII_PRIMARY_KEY"`
+	// Base64 key wrapping the PII keys, when set the PII keys are expected to be wrapped with it.
+	PIIMasterKey string `envconfig:"PII_MASTER_KEY"`
+	// Base64 key of the blind indexes used to look up encrypted values, required with PII keys. Never rotate it.
+	PIIIndexKey string `envconfig:"PII_INDEX_KEY"`
+	// The number of users re-encrypted per transaction by the rotate-keys command.
+	PIIRotateBatchSize int `envconfig:"PII_ROTATE_BATCH_SIZE" default:"500"`
 }
 
 // Here we define a middleware that injects a context with a timeout.
-// If that timeout is exceeded the request returns a error code indicating timeout.
-func injectContextWithTimeout(ctx context.Context, reqTimeout time.Duration, next http.Handler) http.Handler {
+// If that timeout is exceeded the request returns a error code indicating timeout. The timeout is derived from the
+// request context so a client disconnecting still cancels the request. Paths in untimed are passed through unchanged.
+func injectContextWithTimeout(reqTimeout time.Duration, untimed map[string]bool, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, reqTimeout)
+		if untimed[filepath.Clean(r.URL.Path)] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctxWithTimeout, cancel := context.WithTimeout(r.Context(), reqTimeout)
 
 		// Defer cancel to prevent context leaking.
 		defer cancel()
@@ -93,6 +257,163 @@ func buildServer(env *Environment, mux http.Handler) *http.Server {
 	}
 }
 
+// Return the keyring encrypting personal data, or nil if no keys are configured.
+func loadKeyring(env *Environment) (*fieldcrypt.Keyring, error) {
+	if env.PIIKeys == "" && env.PIIKeysFile == "" {
+		return nil, nil
+	}
+
+	var master []byte
+	if env.PIIMasterKey != "" {
+		var err error
+		if master, err = base64.StdEncoding.DecodeString(env.PIIMasterKey); err != nil {
+			return nil, fmt.Errorf("PII_MASTER_KEY: %v", err)
+		}
+	}
+
+	var keys map[string][]byte
+	var last string
+	var err error
+	if env.PIIKeysFile != "" {
+		keys, last, err = fieldcrypt.LoadKeys(env.PIIKeysFile, master)
+	} else {
+		keys, last, err = fieldcrypt.ParseKeys(env.PIIKeys, master)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	indexKey, err := base64.StdEncoding.DecodeString(env.PIIIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("PII_INDEX_KEY: %v", err)
+	}
+
+	primary := env.PIIPrimaryKey
+	if primary == "" {
+		primary = last
+	}
+
+	return fieldcrypt.NewKeyring(primary, keys, indexKey)
+}
+
+// Return the keys signing access tokens, or a single key generated for this process if none are configured.
+func loadSigningKeys(env *Environment, logger *log.Logger) (*jwt.KeySet, error) {
+	if env.JWTKeysDir == "" {
+		logger.Println("JWT_KEYS_DIR is unset, signing access tokens with a key which won't outlive this process")
+		key, err := jwt.GenerateKey("ephemeral-" + reqctx.NewRequestID()[:8])
+		if err != nil {
+			return nil, err
+		}
+		return jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	}
+
+	keys, err := jwt.LoadKeys(env.JWTKeysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	signing := env.JWTSigningKey
+	if signing == "" {
+		signing = keys[len(keys)-1].ID
+	}
+
+	return jwt.NewKeySet(signing, keys)
+}
+
+// Return the store of rate limit buckets named by the environment.
+func getRateLimitStore(ctx context.Context, env *Environment, database *sqlx.DB) (ratelimit.Store, error) {
+	switch env.RateLimitBackend {
+	case "memory":
+		return ratelimit.NewMemoryStore(), nil
+	case "postgres":
+		return ratelimit.NewPostgresStore(ctx, database)
+	default:
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND must be memory or postgres, got %q", env.RateLimitBackend)
+	}
+}
+
+// Return the mailer named by the environment.
+func getMailer(env *Environment) (mail.Mailer, error) {
+	switch env.MailBackend {
+	case "log":
+		if env.MailFile == "" {
+			return mail.NewLog(os.Stdout, env.MailFrom), nil
+		}
+		return mail.OpenLog(env.MailFile, env.MailFrom)
+	case "smtp":
+		return mail.NewSMTP(env.SMTPAddr, env.MailFrom, env.SMTPUsername, env.SMTPPassword), nil
+	default:
+		return nil, fmt.Errorf("MAIL_BACKEND must be log or smtp, got %q", env.MailBackend)
+	}
+}
+
+// Tell whether an admin command manages organizations.
+func isTenantCommand(name string) bool {
+	switch name {
+	case "provision-tenant", "list-tenants", "migrate-tenants", "drop-tenant":
+		return true
+	}
+	return false
+}
+
+// Run the admin command managing organizations in args, failing hard on misuse or errors.
+func runTenantCommand(ctx context.Context, logger *log.Logger, service *tenancy.Service, args []string) {
+	switch {
+	case args[0] == "provision-tenant" && len(args) > 2:
+		org, err := service.Provision(ctx, &tenancy.OrganizationInput{Slug: args[1], Name: args[2]},
+			"system:provision-tenant")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("provisioned %s", org.Slug)
+	case args[0] == "list-tenants":
+		orgs, err := service.List(ctx)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		for _, org := range orgs {
+			fmt.Printf("%s\t%s\t%s\n", org.Slug, org.Name, org.CreatedAt.Format(time.RFC3339))
+		}
+	case args[0] == "migrate-tenants":
+		migrated, err := service.MigrateAll(ctx)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("migrated %d tenants", migrated)
+	case args[0] == "drop-tenant" && len(args) > 1:
+		force := len(args) > 2 && args[2] == "--force"
+		if err := service.Drop(ctx, args[1], force); err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("dropped %s", args[1])
+	default:
+		logger.Fatalf("usage: provision-tenant SLUG NAME | list-tenants | migrate-tenants | drop-tenant SLUG [--force]")
+	}
+}
+
+// Here we define a middleware that tags every request with an ID, reusing the X-Request-ID header of the client or
+// proxy when it looks sane, and echoes it in the response so logs on both sides can be correlated. When actorHeader is
+// set, the caller named by that header is recorded as the actor of the request.
+func injectRequestContext(actorHeader string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 || strings.ContainsAny(id, " \t\r\n") {
+			id = reqctx.NewRequestID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		ctx := reqctx.WithRequestID(r.Context(), id)
+
+		if actorHeader != "" {
+			if actor := r.Header.Get(actorHeader); actor != "" {
+				ctx = reqctx.WithActor(ctx, actor)
+			}
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func main() {
 	// Contexts can be used for request-scoped variables (like user ids) or cancellation (like request timeouts). This will be
 	// the root context for our application.
@@ -107,39 +428,356 @@ func main() {
 		logger.Fatal(err)
 	}
 
+	// Personal data is encrypted with this keyring as it is written and decrypted as it is read, by the services given
+	// it. Without one it is stored in plaintext.
+	keyring, err := loadKeyring(env)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	// Connect with and ping our database client.
 	database, err := getDatabaseConnection(ctx, env)
 	if err != nil {
 		logger.Fatal(err)
 	}
 
+	// Deployments may constrain user metadata with a JSON Schema, a bad schema should stop us from starting.
+	var metadataSchema *jsonschema.Schema
+	if env.MetadataSchemaPath != "" {
+		if metadataSchema, err = jsonschema.Load(env.MetadataSchemaPath); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
 	// This is our root routing component provided by gorilla/mux. All service routes and subrouters will be mounted
 	// to it. Note services are fully capable of overriding each-other if they have identical paths.
 	router := mux.NewRouter()
 
+	// A single renderer is shared so every service speaks the same set of response formats.
+	renderer := render.Default()
+
+	// Routes declare the action they perform and the resource they act on when they are mounted, authorized by roles.
+	// Until authentication is required, the routes reading and writing users are open to anyone.
+	rbacService := rbac.New(&rbac.Config{
+		Ctx:        ctx,
+		Logger:     logger,
+		DB:         database,
+		PathPrefix: env.RBACPathPrefix,
+		Renderer:   renderer,
+	})
+
+	apiKeysService := apikeys.New(&apikeys.Config{
+		Ctx:        ctx,
+		Logger:     logger,
+		DB:         database,
+		PathPrefix: env.APIKeysPathPrefix,
+		Renderer:   renderer,
+		Enforcer:   rbacService,
+	})
+
+	// Organizations share the deployment, each confined to its own users by the database. Memberships reference users,
+	// so their table must exist first.
+	var tenancyService *tenancy.Service
+	var tenantScope func(context.Context, *sqlx.Tx) error
+	if env.TenancyEnabled {
+		if err := users.Migrate(ctx, database); err != nil {
+			logger.Fatal(err)
+		}
+
+		tenancyService = tenancy.New(&tenancy.Config{
+			Ctx:        ctx,
+			Logger:     logger,
+			DB:         database,
+			PathPrefix: env.OrganizationsPathPrefix,
+			Renderer:   renderer,
+			Enforcer:   rbacService,
+			Domain:     env.TenantDomain,
+			Header:     env.TenantHeader,
+			Mode:       env.TenancyMode,
+			Migrate:    users.Migrate,
+		})
+		tenantScope = tenancyService.Scope
+	}
+
+	// In schema mode the tables of other services are only kept in public, for the users of the deployment.
+	shared := func(store users.PersonalData) users.PersonalData {
+		if tenancyService == nil {
+			return store
+		}
+		return tenancyService.Shared(store)
+	}
+
+	usersService := users.New(&users.Config{
+		Ctx:              ctx,
+		Logger:           logger,
+		DB:               database,
+		UsersPathPrefix:  env.UsersPathPrefix,
+		SelectManyLimit:  env.SelectManyLimit,
+		ExportBatchSize:  env.ExportBatchSize,
+		Renderer:         renderer,
+		MetadataMaxBytes: env.MetadataMaxBytes,
+		MetadataSchema:   metadataSchema,
+		PurgeRetention:   env.PurgeRetention,
+		PurgeInterval:    env.PurgeInterval,
+		RequireIfMatch:   env.RequireIfMatch,
+		ListCacheControl: env.ListCacheControl,
+		Enforcer:         rbacService,
+		AllowAnonymous:   !env.AuthRequired,
+		Scope:            tenantScope,
+		Keyring:          keyring,
+	})
+
+	// Failed logins are counted per account and per address, delaying and then locking out whoever guesses passwords.
+	lockoutService := lockout.New(&lockout.Config{
+		Ctx:        ctx,
+		Logger:     logger,
+		DB:         database,
+		PathPrefix: env.LockoutsPathPrefix,
+		Renderer:   renderer,
+		Enforcer:   rbacService,
+		Policy: lockout.Policy{
+			DelayAfter:       env.LoginDelayAfter,
+			BaseDelay:        env.LoginBaseDelay,
+			MaxDelay:         env.LoginMaxDelay,
+			AccountThreshold: env.LockoutAccountThreshold,
+			IPThreshold:      env.LockoutIPThreshold,
+			Window:           env.LockoutWindow,
+			LockoutDuration:  env.LockoutDuration,
+		},
+		EventRetention: env.SecurityEventRetention,
+		ExpireInterval: env.LockoutExpireInterval,
+	})
+	usersService.RegisterPersonalData(shared(lockoutService))
+
+	signingKeys, err := loadSigningKeys(env, logger)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	mailer, err := getMailer(env)
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	// Users log in with their password for access tokens verified by every service, and refresh tokens to renew them.
+	// Browsers log in to sessions kept in the database instead.
+	authService := auth.New(&auth.Config{
+		Ctx:                  ctx,
+		Logger:               logger,
+		DB:                   database,
+		PathPrefix:           env.AuthPathPrefix,
+		Renderer:             renderer,
+		Enforcer:             rbacService,
+		Keys:                 signingKeys,
+		Issuer:               env.JWTIssuer,
+		Audience:             env.JWTAudience,
+		AccessTTL:            env.AccessTokenTTL,
+		RefreshTTL:           env.RefreshTokenTTL,
+		SessionIdleTimeout:   env.SessionIdleTimeout,
+		SessionMaxAge:        env.SessionMaxAge,
+		InsecureCookies:      !env.SessionCookieSecure,
+		ExpireInterval:       env.RefreshTokenExpireInterval,
+		PasswordIterations:   env.PasswordIterations,
+		Mailer:               mailer,
+		PublicURL:            env.PublicURL,
+		TemplatesDir:         env.MailTemplatesDir,
+		PasswordResetTTL:     env.PasswordResetTTL,
+		EmailVerificationTTL: env.EmailVerificationTTL,
+		Lockout:              lockoutService,
+		Roles:                rbacService,
+		Keyring:              keyring,
+	})
+	usersService.RegisterPersonalData(shared(authService))
+
+	oauthIssuer := env.OAuthIssuer
+	if oauthIssuer == "" {
+		oauthIssuer = env.PublicURL
+	}
+
+	// Other applications log their users in through the authorization server, with ID tokens signed by the same keys.
+	oauthService := oauth.New(&oauth.Config{
+		Ctx:            ctx,
+		Logger:         logger,
+		DB:             database,
+		PathPrefix:     env.OAuthPathPrefix,
+		Renderer:       renderer,
+		Enforcer:       rbacService,
+		Keys:           signingKeys,
+		Issuer:         oauthIssuer,
+		AccessTTL:      env.OAuthAccessTTL,
+		RefreshTTL:     env.OAuthRefreshTTL,
+		ExpireInterval: env.OAuthExpireInterval,
+		Keyring:        keyring,
+	})
+	usersService.RegisterPersonalData(shared(oauthService))
+
+	// Once every table exists, confine the users of each organization, along with their history and privacy requests.
+	if tenancyService != nil {
+		if err := tenancyService.Isolate(ctx, "users", "users_history", "users_privacy_requests"); err != nil {
+			logger.Fatal(err)
+		}
+		usersService.RegisterPersonalData(shared(tenancyService))
+	}
+
+	// Admin processes run as one-off commands of the same build: `app rotate-keys` re-encrypts personal data with the
+	// primary key and exits, `app create-api-key NAME SCOPE[,SCOPE]` prints a new API key, scoped `users:read` or
+	// `users:write` since admin only comes from roles, and `app assign-role SUBJECT ROLE` assigns a role, to bootstrap
+	// the first administrators. With tenancy enabled, `app provision-tenant SLUG NAME`, `app list-tenants`, `app
+	// migrate-tenants` and `app drop-tenant SLUG [--force]` manage organizations.
+	if len(os.Args) > 1 && isTenantCommand(os.Args[1]) {
+		if tenancyService == nil {
+			logger.Fatal("tenant commands require TENANCY_ENABLED")
+		}
+		runTenantCommand(ctx, logger, tenancyService, os.Args[1:])
+		return
+	}
+
+	if len(os.Args) > 3 && os.Args[1] == "assign-role" {
+		if err := rbacService.Assign(ctx, os.Args[2], os.Args[3], "system:assign-role"); err != nil {
+			logger.Fatal(err)
+		}
+		return
+	}
+
+	if len(os.Args) > 3 && os.Args[1] == "create-api-key" {
+		name := os.Args[2]
+		key, err := apiKeysService.Issue(ctx, &apikeys.Input{Name: &name, Scopes: strings.Split(os.Args[3], ",")},
+			"system:create-api-key")
+		if err != nil {
+			logger.Fatal(err)
+		}
+		fmt.Println(key.Key)
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rotate-keys" {
+		rotated, err := usersService.RotateKeys(ctx, env.PIIRotateBatchSize)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("re-encrypted %d users", rotated)
+
+		// In schema mode every organization keeps users of its own.
+		if env.TenancyEnabled && env.TenancyMode == tenancy.ModeSchema {
+			err := tenancyService.Each(ctx, func(ctx context.Context) error {
+				rotated, err := usersService.RotateKeys(ctx, env.PIIRotateBatchSize)
+				if rotated > 0 {
+					logger.Printf("re-encrypted %d users in %s", rotated, tenancy.FromContext(ctx).Slug)
+				}
+				return err
+			})
+			if err != nil {
+				logger.Fatal(err)
+			}
+		}
+
+		rotated, err = authService.RotateKeys(ctx)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Printf("re-encrypted %d TOTP secrets", rotated)
+		return
+	}
+
+	// Permanently remove soft deleted users once their retention period is over, in the schema of every organization
+	// too in schema mode.
+	go usersService.RunPurger(ctx)
+	if tenancyService != nil {
+		go tenancyService.RunEach(env.PurgeInterval, "purged users", usersService.Purge)
+	}
+
+	// Remove refresh tokens, sessions and login challenges once they have expired.
+	go authService.RunExpirer(ctx)
+
+	// Forget failed logins once they no longer count, and security events past their retention.
+	go lockoutService.RunExpirer(ctx)
+
+	// Remove authorization codes and OAuth tokens once they have expired.
+	go oauthService.RunExpirer(ctx)
+
 	// Instantiate the service(s) with requisite configurations.
 	services := []Service{
 		ping.New(&ping.Config{
 			PingPath:     env.PingPath,
 			PingResponse: env.PingResponse,
 			Logger:       logger,
+			Renderer:     renderer,
 		}),
 
-		users.New(&users.Config{
-			Ctx:             ctx,
-			Logger:          logger,
-			DB:              database,
-			UsersPathPrefix: env.UsersPathPrefix,
-			SelectManyLimit: env.SelectManyLimit,
-		}),
+		apiKeysService,
+		authService,
+		lockoutService,
+		oauthService,
+		rbacService,
+		usersService,
 	}
+	if tenancyService != nil {
+		services = append(services, tenancyService)
+	}
+
+	// Retried writes carrying an Idempotency-Key are answered with the response to the first attempt. Responses carrying
+	// tokens, keys or secrets are never stored.
+	idempotent := idempotency.New(&idempotency.Config{
+		Ctx:    ctx,
+		Logger: logger,
+		DB:     database,
+		TTL:    env.IdempotencyTTL,
+		Lease:  env.IdempotencyLease,
+		Exclude: []string{
+			filepath.Join("/", env.AuthPathPrefix),
+			filepath.Join("/", env.APIKeysPathPrefix),
+			filepath.Join("/", env.OAuthPathPrefix),
+		},
+		ExpireInterval: env.IdempotencyExpireInterval,
+	})
+	usersService.RegisterPersonalData(shared(idempotent))
+	go idempotent.RunExpirer(ctx)
+
+	// Clients are throttled per route, by actor when they are identified and by address otherwise.
+	rateLimitRules, err := ratelimit.ParseRules(env.RateLimits)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	rateLimitStore, err := getRateLimitStore(ctx, env, database)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	limiter := ratelimit.New(&ratelimit.Config{
+		Ctx:             ctx,
+		Logger:          logger,
+		Store:           rateLimitStore,
+		Rules:           rateLimitRules,
+		CleanupInterval: env.RateLimitCleanupInterval,
+	})
+	go limiter.RunCleaner(ctx)
+
+	// Routes which stream their responses opt out of the request timeout.
+	untimed := map[string]bool{}
 
 	for _, service := range services {
 		service.Mount(router)
+
+		if streaming, ok := service.(StreamingService); ok {
+			for _, path := range streaming.StreamingPaths() {
+				untimed[path] = true
+			}
+		}
 	}
 
 	// instantiate the http.Server with our router
-	server := buildServer(env, injectContextWithTimeout(ctx, env.ReqTimeout, router))
+	handler := injectContextWithTimeout(env.ReqTimeout, untimed, router)
+	handler = idempotent.Wrap(handler)
+	handler = limiter.Wrap(handler)
+	if tenancyService != nil {
+		handler = tenancyService.Resolve(handler)
+	}
+	handler = authService.ProtectCSRF(handler)
+	handler = authService.AuthenticateSession(handler)
+	handler = authService.Authenticate(handler)
+	handler = apiKeysService.Authenticate(handler)
+	handler = oauthService.Authenticate(handler)
+	handler = injectRequestContext(env.ActorHeader, handler)
+	server := buildServer(env, handler)
 
 	// start the server
 	logger.Fatal(server.ListenAndServe())
@@ -0,0 +1,316 @@
+package oauth
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type (
+	// ConsentRequest answers an authorization request the user hasn't consented to yet, for the page asking them.
+	ConsentRequest struct {
+		ClientID   string   `json:"clientId"`
+		ClientName string   `json:"clientName"`
+		Scopes     []string `json:"scopes"`
+	}
+
+	// ApproveInput is the body accepted by the Approve endpoint.
+	ApproveInput struct {
+		Approve bool `json:"approve"`
+	}
+
+	// Redirect answers the Approve endpoint with where to send the browser.
+	Redirect struct {
+		RedirectTo string `json:"redirectTo"`
+	}
+
+	// Consent records the scopes a user let a client act on their behalf with.
+	Consent struct {
+		ClientID   string         `json:"clientId" db:"client_id"`
+		ClientName string         `json:"clientName" db:"client_name"`
+		Scopes     pq.StringArray `json:"scopes" db:"scopes"`
+		CreatedAt  time.Time      `json:"createdAt" db:"created_at"`
+		UpdatedAt  time.Time      `json:"updatedAt" db:"updated_at"`
+	}
+
+	// authorization is a validated authorization request.
+	authorization struct {
+		client        *Client
+		redirectURI   string
+		state         string
+		scopes        []string
+		codeChallenge string
+		nonce         string
+		prompt        string
+		issuer        string
+	}
+)
+
+// Authorize endpoint starts the authorization code grant for the user making the request, who logged in with a
+// session or an access token of the authentication service. Requests naming an unknown client or a redirect URI it
+// wasn't registered with are answered with 400 Bad Request, and anonymous ones with 401 Unauthorized; other errors are
+// sent back to the redirect URI. Once the user consented to every scope asked for, or if the client is first party,
+// the browser is redirected with a code. Otherwise the endpoint responds with 200 OK and a ConsentRequest, for a page to
+// ask the user and post the answer to Approve.
+func (s *Service) Authorize(w http.ResponseWriter, r *http.Request) {
+	auth, ok := s.authorization(w, r)
+	if !ok {
+		return
+	}
+
+	id, ok := userID(r)
+	if !ok {
+		if auth.prompt == "none" {
+			http.Redirect(w, r, auth.errorURI("login_required", "the user isn't logged in"), http.StatusFound)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		http.Error(w, "log in to authorize "+auth.client.Name, http.StatusUnauthorized)
+		return
+	}
+
+	consented := auth.client.FirstParty
+	if !consented && auth.prompt != "consent" {
+		var scopes pq.StringArray
+		err := s.db.GetContext(r.Context(), &scopes, SelectConsentStmt, id, auth.client.ID)
+		if err != nil && err != sql.ErrNoRows {
+			s.writeError(w, err)
+			return
+		}
+		consented = err == nil && subset(auth.scopes, scopes)
+	}
+
+	if !consented {
+		if auth.prompt == "none" {
+			http.Redirect(w, r, auth.errorURI("consent_required", "the user hasn't consented"), http.StatusFound)
+			return
+		}
+		s.render(w, r, http.StatusOK, &ConsentRequest{
+			ClientID:   auth.client.ID,
+			ClientName: auth.client.Name,
+			Scopes:     auth.scopes,
+		})
+		return
+	}
+
+	redirect, err := s.grant(r, id, auth)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// Approve endpoint records the answer of the user making the request to the authorization request in its query
+// string, as Authorize validates it. It responds with 200 OK and where to redirect the browser: with a code if the user
+// approved, their consent being recorded, or with an access_denied error otherwise.
+func (s *Service) Approve(w http.ResponseWriter, r *http.Request) {
+	input := &ApproveInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	auth, ok := s.authorization(w, r)
+	if !ok {
+		return
+	}
+
+	id, ok := userID(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		http.Error(w, "log in to authorize "+auth.client.Name, http.StatusUnauthorized)
+		return
+	}
+
+	if !input.Approve {
+		s.render(w, r, http.StatusOK, &Redirect{RedirectTo: auth.errorURI("access_denied", "the user declined")})
+		return
+	}
+
+	var scopes pq.StringArray
+	err := s.db.GetContext(r.Context(), &scopes, SelectConsentStmt, id, auth.client.ID)
+	if err != nil && err != sql.ErrNoRows {
+		s.writeError(w, err)
+		return
+	}
+
+	if _, err := s.db.ExecContext(r.Context(), UpsertConsentStmt, id, auth.client.ID,
+		union(scopes, auth.scopes)); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	redirect, err := s.grant(r, id, auth)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, &Redirect{RedirectTo: redirect})
+}
+
+// authorization validates the authorization request in the query string. Otherwise it answers the request and returns
+// false: errors the client must not be redirected for are answered with 400 Bad Request, the others are redirected.
+func (s *Service) authorization(w http.ResponseWriter, r *http.Request) (*authorization, bool) {
+	query := r.URL.Query()
+
+	client, err := s.client(r.Context(), query.Get("client_id"))
+	if err == sql.ErrNoRows {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request", Description: "unknown client_id"})
+		return nil, false
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return nil, false
+	}
+
+	auth := &authorization{
+		client:        client,
+		redirectURI:   query.Get("redirect_uri"),
+		state:         query.Get("state"),
+		scopes:        scopeList(query.Get("scope")),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		prompt:        query.Get("prompt"),
+		issuer:        s.issuer,
+	}
+
+	// Redirect URIs must match one registered exactly, or codes could be sent anywhere.
+	if !contains(client.RedirectURIs, auth.redirectURI) {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request",
+			Description: "redirect_uri isn't registered for the client"})
+		return nil, false
+	}
+
+	if len(auth.scopes) == 0 {
+		auth.scopes = scopeList(strings.Join(client.Scopes, " "))
+	}
+
+	var code, description string
+	switch {
+	case query.Get("response_type") != "code":
+		code, description = "unsupported_response_type", "response_type must be code"
+	case !client.hasGrant(GrantAuthorizationCode):
+		code, description = "unauthorized_client", "the client can't use the authorization_code grant"
+	case auth.codeChallenge == "" || query.Get("code_challenge_method") != "S256":
+		code, description = "invalid_request", "code_challenge with code_challenge_method S256 is required"
+	case !subset(auth.scopes, client.Scopes):
+		code, description = "invalid_scope", "the client can't ask for these scopes"
+	}
+	if code != "" {
+		if r.Method == "GET" {
+			http.Redirect(w, r, auth.errorURI(code, description), http.StatusFound)
+		} else {
+			s.render(w, r, http.StatusOK, &Redirect{RedirectTo: auth.errorURI(code, description)})
+		}
+		return nil, false
+	}
+
+	return auth, true
+}
+
+// grant issues a code for an authorization request of a user, returning the redirect URI carrying it.
+func (s *Service) grant(r *http.Request, userID int64, auth *authorization) (string, error) {
+	code := CodePrefix + randomString(32)
+
+	multiFactor := false
+	if p := access.FromContext(r.Context()); p != nil {
+		multiFactor = p.MultiFactor
+	}
+
+	_, err := s.db.ExecContext(r.Context(), InsertCodeStmt, hashSecret(code), randomString(16), auth.client.ID, userID,
+		auth.redirectURI, strings.Join(auth.scopes, " "), auth.codeChallenge, auth.nonce, codeTTL.Seconds(),
+		multiFactor)
+	if err != nil {
+		return "", err
+	}
+
+	return auth.redirect(url.Values{"code": {code}}), nil
+}
+
+// redirect returns the redirect URI of the request with params, the state and the issuer, as RFC 9207 advises, added
+// to its query.
+func (a *authorization) redirect(params url.Values) string {
+	u, _ := url.Parse(a.redirectURI)
+	query := u.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if a.state != "" {
+		query.Set("state", a.state)
+	}
+	if a.issuer != "" {
+		query.Set("iss", a.issuer)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (a *authorization) errorURI(code, description string) string {
+	return a.redirect(url.Values{"error": {code}, "error_description": {description}})
+}
+
+// GetConsents endpoint returns the clients the user making the request consented to, and to which scopes.
+func (s *Service) GetConsents(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	consents := []*Consent{}
+	if err := s.db.SelectContext(r.Context(), &consents, SelectUserConsentsStmt, id); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, consents)
+}
+
+// RevokeConsent endpoint withdraws the consent of the user making the request to a client, revoking every token the
+// client holds on their behalf, and responds with 204 No Content, or 404 Not Found if there was no consent.
+func (s *Service) RevokeConsent(w http.ResponseWriter, r *http.Request) {
+	id, ok := userID(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	clientID := mux.Vars(r)["client"]
+
+	found := false
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(r.Context(), DeleteConsentStmt, id, clientID)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		found = n > 0
+
+		_, err = tx.ExecContext(r.Context(), RevokeUserClientTokensStmt, id, clientID)
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if !found {
+		http.Error(w, "no consent to revoke", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,238 @@
+package oauth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+type (
+	// Client is an application registered to obtain tokens.
+	Client struct {
+		ID   string `json:"id" db:"id"`
+		Name string `json:"name" db:"name"`
+		// Confidential clients authenticate with their secret, public ones such as browser and mobile applications
+		// have none and rely on PKCE alone.
+		Public       bool           `json:"public" db:"-"`
+		SecretHash   *string        `json:"-" db:"secret_hash"`
+		RedirectURIs pq.StringArray `json:"redirectUris" db:"redirect_uris"`
+		GrantTypes   pq.StringArray `json:"grantTypes" db:"grant_types"`
+		Scopes       pq.StringArray `json:"scopes" db:"scopes"`
+		// First party clients are trusted by users without asking for their consent.
+		FirstParty bool      `json:"firstParty" db:"first_party"`
+		CreatedBy  string    `json:"createdBy" db:"created_by"`
+		CreatedAt  time.Time `json:"createdAt" db:"created_at"`
+		// The secret of a confidential client, only returned when it is registered.
+		Secret string `json:"secret,omitempty" db:"-"`
+	}
+
+	// ClientInput is the body accepted by the CreateClient endpoint.
+	ClientInput struct {
+		Name         string   `json:"name"`
+		Public       bool     `json:"public"`
+		RedirectURIs []string `json:"redirectUris"`
+		// Defaults to authorization_code and refresh_token.
+		GrantTypes []string `json:"grantTypes"`
+		Scopes     []string `json:"scopes"`
+		FirstParty bool     `json:"firstParty"`
+	}
+
+	// ValidationError maps the fields of a ClientInput to what is wrong with them.
+	ValidationError map[string]string
+)
+
+// Error implements error.
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, problem := range e {
+		fields = append(fields, field+": "+problem)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+// Register creates a client, returned with its secret unless it is public. The secret is not stored and can't be
+// recovered. createdBy names the actor registering it. Invalid inputs are reported with a ValidationError.
+func (s *Service) Register(ctx context.Context, input *ClientInput, createdBy string) (*Client, error) {
+	if len(input.GrantTypes) == 0 {
+		input.GrantTypes = []string{GrantAuthorizationCode, GrantRefreshToken}
+	}
+	if problems := input.validate(); len(problems) > 0 {
+		return nil, problems
+	}
+
+	var secret string
+	var secretHash *string
+	if !input.Public {
+		secret = ClientSecretPrefix + randomString(32)
+		hash := hashSecret(secret)
+		secretHash = &hash
+	}
+
+	client := &Client{}
+	err := s.db.GetContext(ctx, client, InsertClientStmt, randomString(16), strings.TrimSpace(input.Name), secretHash,
+		pq.StringArray(input.RedirectURIs), pq.StringArray(input.GrantTypes), union(input.Scopes, nil),
+		input.FirstParty, createdBy)
+	if err != nil {
+		return nil, err
+	}
+
+	client.Public = client.SecretHash == nil
+	client.Secret = secret
+	return client, nil
+}
+
+// CreateClient endpoint registers a client, responding with 201 Created and the client, its secret included.
+func (s *Service) CreateClient(w http.ResponseWriter, r *http.Request) {
+	input := &ClientInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	client, err := s.Register(r.Context(), input, reqctx.Actor(r.Context()))
+	if problems, ok := err.(ValidationError); ok {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusCreated, client)
+}
+
+// GetClients endpoint returns every client, oldest first, without their secrets.
+func (s *Service) GetClients(w http.ResponseWriter, r *http.Request) {
+	clients := []*Client{}
+	if err := s.db.SelectContext(r.Context(), &clients, SelectManyClientsStmt); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	for _, client := range clients {
+		client.Public = client.SecretHash == nil
+	}
+
+	s.render(w, r, http.StatusOK, clients)
+}
+
+// GetClient endpoint returns a client without its secret.
+func (s *Service) GetClient(w http.ResponseWriter, r *http.Request) {
+	client, err := s.client(r.Context(), mux.Vars(r)["client"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, client)
+}
+
+// DeleteClient endpoint removes a client along with the consents given to it and the tokens it was issued, responding
+// with 204 No Content.
+func (s *Service) DeleteClient(w http.ResponseWriter, r *http.Request) {
+	result, err := s.db.ExecContext(r.Context(), DeleteClientStmt, mux.Vars(r)["client"])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "no such client", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// client returns the client registered under id, or sql.ErrNoRows.
+func (s *Service) client(ctx context.Context, id string) (*Client, error) {
+	client := &Client{}
+	if err := s.db.GetContext(ctx, client, SelectClientStmt, id); err != nil {
+		return nil, err
+	}
+	client.Public = client.SecretHash == nil
+	return client, nil
+}
+
+// hasGrant reports whether the client was registered for grantType.
+func (c *Client) hasGrant(grantType string) bool {
+	return contains(c.GrantTypes, grantType)
+}
+
+func (in *ClientInput) validate() ValidationError {
+	problems := ValidationError{}
+
+	if strings.TrimSpace(in.Name) == "" {
+		problems["name"] = "must not be empty"
+	}
+
+	for _, grantType := range in.GrantTypes {
+		switch grantType {
+		case GrantAuthorizationCode, GrantRefreshToken:
+		case GrantClientCredentials:
+			if in.Public {
+				problems["grantTypes"] = "public clients can't use the client_credentials grant"
+			}
+		default:
+			problems["grantTypes"] = "unknown grant type " + grantType
+		}
+	}
+
+	hasCode := contains(in.GrantTypes, GrantAuthorizationCode)
+	if contains(in.GrantTypes, GrantRefreshToken) && !hasCode {
+		problems["grantTypes"] = "refresh_token requires authorization_code"
+	}
+
+	if hasCode && len(in.RedirectURIs) == 0 {
+		problems["redirectUris"] = "must list at least one URI to use the authorization_code grant"
+	}
+	for _, uri := range in.RedirectURIs {
+		if problem := validateRedirectURI(uri); problem != "" {
+			problems["redirectUris"] = uri + " " + problem
+		}
+	}
+
+	for _, scope := range in.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n\"\\") {
+			problems["scopes"] = "invalid scope " + scope
+		}
+	}
+
+	return problems
+}
+
+// validateRedirectURI describes what is wrong with a redirect URI, or returns "". Codes are only sent over HTTPS,
+// or over HTTP to the loopback interface for native applications.
+func validateRedirectURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return "must be an absolute URL"
+	}
+
+	if u.Fragment != "" {
+		return "must not have a fragment"
+	}
+
+	switch u.Scheme {
+	case "https":
+		return ""
+	case "http":
+		if host := u.Hostname(); host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return ""
+		}
+	}
+	return "must use https, or http to localhost"
+}
@@ -0,0 +1,458 @@
+// Package oauth is an OAuth 2.0 authorization server letting other applications log their users in with this service.
+// Clients registered by administrators obtain codes with the authorization code grant, PKCE required, once users
+// consent to the scopes they ask for, and exchange them for tokens; confidential clients may also obtain tokens of
+// their own with the client credentials grant. Access and refresh tokens are opaque and stored hashed, so they can be
+// introspected and revoked, while ID tokens are JWTs signed with the keys of the authentication service. The OpenID
+// Connect discovery document and userinfo endpoint describe users from the users table.
+//
+// Access tokens issued here are meant for the clients and the resource servers which introspect them, not for the API
+// of this service: requests presenting them get no principal, so the scopes a client was registered with never stand
+// in for the roles of a user.
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Prefixes of the secrets handed out by the server, which are stored as their hash.
+const (
+	ClientSecretPrefix = "tfcs_"
+	CodePrefix         = "tfac_"
+	AccessTokenPrefix  = "tfat_"
+	RefreshTokenPrefix = "tfrt_"
+)
+
+// Grant types clients are registered for.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// OpenID Connect scopes, granted on behalf of a user only.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// Kinds of stored tokens.
+const (
+	kindAccess  = "access"
+	kindRefresh = "refresh"
+)
+
+// How long authorization codes are valid, as short as RFC 6749 recommends since they are exchanged immediately.
+const codeTTL = time.Minute
+
+// Largest request body accepted by the endpoints of this service.
+const maxBodyBytes = 1 << 16
+
+var errInvalidGrant = &Error{Code: "invalid_grant", Description: "invalid, expired or revoked grant",
+	status: http.StatusBadRequest}
+
+type (
+	// Config for the authorization server.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /oauth.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// Authorizes requests against the action and resource each route declares, nil lets every request through.
+		Enforcer access.Enforcer
+		// Signs ID tokens, and is published at /.well-known/jwks.json by the authentication service.
+		Keys *jwt.KeySet
+		// The URL the server is reached at, the iss claim of ID tokens and the base of the endpoints it advertises.
+		Issuer string
+		// How long access tokens are valid. Defaults to 1 hour.
+		AccessTTL time.Duration
+		// How long refresh tokens are valid, renewed by every refresh. Defaults to 30 days.
+		RefreshTTL time.Duration
+		// How often RunExpirer removes expired codes and tokens, zero or less disables removal.
+		ExpireInterval time.Duration
+		// Decrypts the emails of users served by userinfo, see users.Config.
+		Keyring *fieldcrypt.Keyring
+	}
+
+	// Service: OAuth 2.0 authorization server.
+	Service struct {
+		ctx            context.Context
+		logger         *log.Logger
+		db             *sqlx.DB
+		pathPrefix     string
+		renderer       *render.Renderer
+		enforcer       access.Enforcer
+		keys           *jwt.KeySet
+		issuer         string
+		accessTTL      time.Duration
+		refreshTTL     time.Duration
+		expireInterval time.Duration
+		keyring        *fieldcrypt.Keyring
+	}
+
+	// Token is an access or refresh token, as stored.
+	Token struct {
+		ID          int64      `json:"-" db:"id"`
+		Kind        string     `json:"kind" db:"kind"`
+		GrantID     string     `json:"-" db:"grant_id"`
+		ClientID    string     `json:"clientId" db:"client_id"`
+		UserID      *int64     `json:"-" db:"user_id"`
+		Scope       string     `json:"scope" db:"scope"`
+		MultiFactor bool       `json:"-" db:"multi_factor"`
+		CreatedAt   time.Time  `json:"createdAt" db:"created_at"`
+		ExpiresAt   time.Time  `json:"expiresAt" db:"expires_at"`
+		Expired     bool       `json:"-" db:"expired"`
+		UsedAt      *time.Time `json:"-" db:"used_at"`
+		RevokedAt   *time.Time `json:"-" db:"revoked_at"`
+	}
+
+	// Error is an OAuth error response, as RFC 6749 defines them.
+	Error struct {
+		Code        string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+		status      int
+	}
+
+	// GrantsArchive is what the server stores about a user, as returned to an access request.
+	GrantsArchive struct {
+		Consents []*Consent `json:"consents"`
+		Tokens   []*Token   `json:"tokens"`
+	}
+)
+
+type key int
+
+const tokenKey key = 0
+
+// Error implements error.
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// New: Instantiate a new authorization server. Fail hard if its tables can't be created, which requires the users table
+// and the email verifications of the authentication service.
+func New(config *Config) *Service {
+	if _, err := config.DB.ExecContext(context.Background(), CreateTableStmt); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "oauth"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	accessTTL := config.AccessTTL
+	if accessTTL <= 0 {
+		accessTTL = time.Hour
+	}
+
+	refreshTTL := config.RefreshTTL
+	if refreshTTL <= 0 {
+		refreshTTL = 30 * 24 * time.Hour
+	}
+
+	return &Service{
+		ctx:            config.Ctx,
+		logger:         config.Logger,
+		db:             config.DB,
+		pathPrefix:     pathPrefix,
+		renderer:       renderer,
+		enforcer:       config.Enforcer,
+		keys:           config.Keys,
+		issuer:         strings.TrimSuffix(config.Issuer, "/"),
+		accessTTL:      accessTTL,
+		refreshTTL:     refreshTTL,
+		expireInterval: config.ExpireInterval,
+		keyring:        config.Keyring,
+	}
+}
+
+// Mount the subRouter of this service to the root router. The protocol endpoints authenticate clients and users
+// themselves; registering clients takes the admin action, and consents are those of the caller.
+func (s *Service) Mount(r *mux.Router) {
+	clients := access.Static("oauth-clients")
+
+	r.HandleFunc("/.well-known/openid-configuration", s.Discovery).Methods("GET")
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.HandleFunc("/authorize", s.Authorize).Methods("GET")
+	subRouter.HandleFunc("/authorize", s.Approve).Methods("POST")
+	subRouter.HandleFunc("/token", s.Token).Methods("POST")
+	subRouter.HandleFunc("/introspect", s.Introspect).Methods("POST")
+	subRouter.HandleFunc("/revoke", s.Revoke).Methods("POST")
+	subRouter.HandleFunc("/userinfo", s.Userinfo).Methods("GET", "POST")
+	subRouter.HandleFunc("/consents", s.GetConsents).Methods("GET")
+	subRouter.HandleFunc("/consents/{client}", s.RevokeConsent).Methods("DELETE")
+	subRouter.Handle("/clients", access.Require(s.enforcer, access.Admin, clients, s.CreateClient)).Methods("POST")
+	subRouter.Handle("/clients", access.Require(s.enforcer, access.Admin, clients, s.GetClients)).Methods("GET")
+	subRouter.Handle("/clients/{client}", access.Require(s.enforcer, access.Admin, clients, s.GetClient)).Methods("GET")
+	subRouter.Handle("/clients/{client}",
+		access.Require(s.enforcer, access.Admin, clients, s.DeleteClient)).Methods("DELETE")
+}
+
+// Authenticate returns next behind a middleware recognizing the access tokens issued by this server in
+// "Authorization: Bearer" headers, which the userinfo endpoint requires. Valid tokens are attached to the context of
+// the request without making it a principal, invalid ones are answered with 401 Unauthorized, and other requests are
+// passed through as they are. Wrap the other authentication middleware with it: the header is removed from the requests
+// it recognized, so they never see these tokens.
+func (s *Service) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := access.BearerToken(r)
+		if !strings.HasPrefix(token, AccessTokenPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t, err := s.activeToken(r.Context(), token)
+		if err == nil && (t == nil || t.Kind != kindAccess) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+			http.Error(w, "invalid access token", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		r = r.WithContext(context.WithValue(r.Context(), tokenKey, t))
+		r.Header = r.Header.Clone()
+		r.Header.Del("Authorization")
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TokenFromContext returns the access token attached by Authenticate, or nil.
+func TokenFromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey).(*Token)
+	return t
+}
+
+// activeToken returns the stored token if it is still active, nil otherwise.
+func (s *Service) activeToken(ctx context.Context, token string) (*Token, error) {
+	t := &Token{}
+	err := s.db.GetContext(ctx, t, SelectActiveTokenStmt, hashSecret(token), users.StatusActive)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Subject names who a token was issued to, the user it acts for or else the client itself.
+func (t *Token) Subject() string {
+	if t.UserID != nil {
+		return "user:" + strconv.FormatInt(*t.UserID, 10)
+	}
+	return "client:" + t.ClientID
+}
+
+// Expire removes expired codes and tokens. Returns the number of rows removed.
+func (s *Service) Expire(ctx context.Context) (int64, error) {
+	var removed int64
+	for _, stmt := range []string{ExpireCodesStmt, ExpireTokensStmt} {
+		result, err := s.db.ExecContext(ctx, stmt)
+		if err != nil {
+			return removed, err
+		}
+
+		n, err := result.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// RunExpirer calls Expire every expire interval until ctx is done. Blocks, so run it in its own goroutine.
+func (s *Service) RunExpirer(ctx context.Context) {
+	if s.expireInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.expireInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.Expire(ctx); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+}
+
+// Name implements users.PersonalData.
+func (s *Service) Name() string {
+	return "oauth"
+}
+
+// Export implements users.PersonalData: the clients the user consented to and the tokens they hold.
+func (s *Service) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	archive := &GrantsArchive{Consents: []*Consent{}, Tokens: []*Token{}}
+	if err := tx.SelectContext(ctx, &archive.Consents, SelectUserConsentsStmt, userID); err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &archive.Tokens, SelectUserTokensStmt, userID); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// Erase implements users.PersonalData: the consents, codes and tokens of the user are deleted.
+func (s *Service) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	for _, stmt := range []string{DeleteUserTokensStmt, DeleteUserCodesStmt, DeleteUserConsentsStmt} {
+		if _, err := tx.ExecContext(ctx, stmt, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scopeList splits a scope parameter into its scopes, sorted and without duplicates.
+func scopeList(scope string) []string {
+	seen := map[string]bool{}
+	scopes := []string{}
+	for _, s := range strings.Fields(scope) {
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// subset reports whether every scope of scopes is in of.
+func subset(scopes, of []string) bool {
+	for _, scope := range scopes {
+		if !contains(of, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// union returns the scopes of a and b, sorted and without duplicates.
+func union(a, b []string) pq.StringArray {
+	return pq.StringArray(scopeList(strings.Join(a, " ") + " " + strings.Join(b, " ")))
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms, see its documentation.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashSecret returns the hash client secrets, codes and tokens are stored as. They carry 256 bits of entropy, so a fast
+// hash is enough.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// userID returns the ID of the user making the request, false for anonymous requests and other callers.
+func userID(r *http.Request) (int64, bool) {
+	p := access.FromContext(r.Context())
+	if p == nil || !strings.HasPrefix(p.ID, "user:") {
+		return 0, false
+	}
+
+	id, err := strconv.ParseInt(strings.TrimPrefix(p.ID, "user:"), 10, 64)
+	return id, err == nil
+}
+
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// writeJSON answers the protocol endpoints, which always speak JSON and are never cached, as RFC 6749 requires.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeOAuthError answers a protocol request with an OAuth error, or logs err and answers 500 if it isn't one.
+func (s *Service) writeOAuthError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		s.writeError(w, err)
+		return
+	}
+	writeJSON(w, e.status, e)
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,257 @@
+package oauth_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/auth"
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/b3ntly/twelvefactor_databases/oauth"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	key, err := jwt.GenerateKey("test")
+	require.Nil(t, err)
+	keys, err := jwt.NewKeySet(key.ID, []*jwt.Key{key})
+	require.Nil(t, err)
+
+	// The authentication service owns the email verifications userinfo reads.
+	authService := auth.New(&auth.Config{Ctx: ctx, Logger: logger, DB: db, Keys: keys, Issuer: "twelvefactor",
+		Audience: "twelvefactor", PasswordIterations: 1000})
+
+	service := oauth.New(&oauth.Config{
+		Ctx:    ctx,
+		Logger: logger,
+		DB:     db,
+		Keys:   keys,
+		Issuer: "http://localhost:9090",
+	})
+	_, err = db.ExecContext(ctx, `DELETE FROM oauth_clients;`)
+	require.Nil(t, err)
+
+	user := &users.User{}
+	require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, "wilma", "", "Wilma Flintstone", users.StatusActive, ""))
+
+	app, err := service.Register(ctx, &oauth.ClientInput{
+		Name:         "app",
+		Public:       true,
+		RedirectURIs: []string{"http://localhost:3000/callback"},
+		Scopes:       []string{oauth.ScopeOpenID, oauth.ScopeProfile},
+	}, "system:test")
+	require.Nil(t, err)
+	require.Empty(t, app.Secret)
+
+	_, err = service.Register(ctx, &oauth.ClientInput{Name: "app", RedirectURIs: []string{"http://example.com/"}},
+		"system:test")
+	require.IsType(t, oauth.ValidationError{}, err)
+
+	worker, err := service.Register(ctx, &oauth.ClientInput{
+		Name:       "worker",
+		GrantTypes: []string{oauth.GrantClientCredentials},
+		Scopes:     []string{"reports"},
+	}, "system:test")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(worker.Secret, oauth.ClientSecretPrefix))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	// OAuth access tokens never make a principal.
+	var principal *access.Principal
+	router.HandleFunc("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		principal = access.FromContext(r.Context())
+	})
+
+	// Wrapping the access token middleware as main does, which must never see OAuth tokens.
+	handler := service.Authenticate(authService.Authenticate(router))
+	send := func(method, target, body, token string, p *access.Principal) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if strings.Contains(body, "=") {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if p != nil {
+			req = req.WithContext(access.WithPrincipal(req.Context(), p))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	wilma := &access.Principal{ID: "user:" + strconv.FormatInt(user.ID, 10)}
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	authorizeURL := "http://localhost:9090/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {app.ID},
+		"redirect_uri":          {"http://localhost:3000/callback"},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+
+	require.Equal(t, 401, send("GET", authorizeURL, "", "", nil).Code)
+	require.Equal(t, 400, send("GET", strings.Replace(authorizeURL, "3000", "4000", 1), "", "", wilma).Code)
+
+	// The user is asked to consent once, then codes are issued straight away.
+	w := send("GET", authorizeURL, "", "", wilma)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "profile")
+
+	w = send("POST", authorizeURL, `{"approve": false}`, "", wilma)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "access_denied")
+
+	w = send("POST", authorizeURL, `{"approve": true}`, "", wilma)
+	require.Equal(t, 200, w.Code)
+
+	w = send("GET", authorizeURL, "", "", wilma)
+	require.Equal(t, 302, w.Code)
+	redirect, err := url.Parse(w.Header().Get("Location"))
+	require.Nil(t, err)
+	require.Equal(t, "xyz", redirect.Query().Get("state"))
+	code := redirect.Query().Get("code")
+	require.True(t, strings.HasPrefix(code, oauth.CodePrefix))
+
+	exchange := url.Values{
+		"grant_type":    {oauth.GrantAuthorizationCode},
+		"client_id":     {app.ID},
+		"code":          {code},
+		"redirect_uri":  {"http://localhost:3000/callback"},
+		"code_verifier": {verifier},
+	}
+	wrongVerifier := url.Values{}
+	for name, values := range exchange {
+		wrongVerifier[name] = values
+	}
+	wrongVerifier.Set("code_verifier", strings.Repeat("w", 43))
+	w = send("POST", "http://localhost:9090/oauth/token", wrongVerifier.Encode(), "", nil)
+	require.Equal(t, 400, w.Code)
+	require.Contains(t, w.Body.String(), "invalid_grant")
+
+	w = send("POST", "http://localhost:9090/oauth/token", exchange.Encode(), "", nil)
+	require.Equal(t, 200, w.Code)
+	tokens := &oauth.TokenResponse{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), tokens))
+	require.NotEmpty(t, tokens.RefreshToken)
+
+	claims := &oauth.IDClaims{}
+	require.Nil(t, keys.Parse(tokens.IDToken, claims))
+	require.Equal(t, "n-0S6", claims.Nonce)
+	require.Equal(t, app.ID, claims.Audience)
+	require.Equal(t, wilma.ID, claims.Subject)
+
+	w = send("GET", "http://localhost:9090/oauth/userinfo", "", tokens.AccessToken, nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), `"name":"Wilma Flintstone"`)
+	require.NotContains(t, w.Body.String(), "email")
+
+	send("GET", "http://localhost:9090/whoami", "", tokens.AccessToken, nil)
+	require.Nil(t, principal)
+
+	// Codes can only be exchanged once, and replaying one revokes the tokens it was exchanged for.
+	require.Equal(t, 400, send("POST", "http://localhost:9090/oauth/token", exchange.Encode(), "", nil).Code)
+	require.Equal(t, 401, send("GET", "http://localhost:9090/oauth/userinfo", "", tokens.AccessToken, nil).Code)
+
+	w = send("GET", authorizeURL, "", "", wilma)
+	redirect, err = url.Parse(w.Header().Get("Location"))
+	require.Nil(t, err)
+	exchange.Set("code", redirect.Query().Get("code"))
+	w = send("POST", "http://localhost:9090/oauth/token", exchange.Encode(), "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), tokens))
+
+	// Refresh tokens rotate, and replaying one revokes the grant.
+	refresh := url.Values{
+		"grant_type":    {oauth.GrantRefreshToken},
+		"client_id":     {app.ID},
+		"refresh_token": {tokens.RefreshToken},
+	}
+	w = send("POST", "http://localhost:9090/oauth/token", refresh.Encode(), "", nil)
+	require.Equal(t, 200, w.Code)
+	refreshed := &oauth.TokenResponse{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), refreshed))
+	require.NotEqual(t, tokens.RefreshToken, refreshed.RefreshToken)
+
+	require.Equal(t, 400, send("POST", "http://localhost:9090/oauth/token", refresh.Encode(), "", nil).Code)
+	require.Equal(t, 401, send("GET", "http://localhost:9090/oauth/userinfo", "", refreshed.AccessToken, nil).Code)
+
+	// Confidential clients obtain tokens of their own, which they and resource servers introspect.
+	credentials := url.Values{"grant_type": {oauth.GrantClientCredentials}}
+	req := httptest.NewRequest("POST", "http://localhost:9090/oauth/token", strings.NewReader(credentials.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(worker.ID, worker.Secret+"x")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 401, w.Code)
+
+	credentials.Set("client_id", worker.ID)
+	credentials.Set("client_secret", worker.Secret)
+	w = send("POST", "http://localhost:9090/oauth/token", credentials.Encode(), "", nil)
+	require.Equal(t, 200, w.Code)
+	workerTokens := &oauth.TokenResponse{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), workerTokens))
+	require.Empty(t, workerTokens.RefreshToken)
+	require.Equal(t, "reports", workerTokens.Scope)
+
+	// A client token has no user to describe.
+	require.Equal(t, 403, send("GET", "http://localhost:9090/oauth/userinfo", "", workerTokens.AccessToken, nil).Code)
+
+	introspect := url.Values{"client_id": {worker.ID}, "client_secret": {worker.Secret},
+		"token": {workerTokens.AccessToken}}
+	w = send("POST", "http://localhost:9090/oauth/introspect", introspect.Encode(), "", nil)
+	require.Equal(t, 200, w.Code)
+	introspection := &oauth.Introspection{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), introspection))
+	require.True(t, introspection.Active)
+	require.Equal(t, "client:"+worker.ID, introspection.Subject)
+
+	revoke := url.Values{"client_id": {worker.ID}, "client_secret": {worker.Secret}, "token": {workerTokens.AccessToken}}
+	require.Equal(t, 200, send("POST", "http://localhost:9090/oauth/revoke", revoke.Encode(), "", nil).Code)
+	w = send("POST", "http://localhost:9090/oauth/introspect", introspect.Encode(), "", nil)
+	require.Equal(t, `{"active":false}`, strings.TrimSpace(w.Body.String()))
+
+	// Withdrawing consent revokes the tokens the client holds and asks the user again.
+	w = send("GET", "http://localhost:9090/oauth/consents", "", "", wilma)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), app.ID)
+
+	require.Equal(t, 204, send("DELETE", "http://localhost:9090/oauth/consents/"+app.ID, "", "", wilma).Code)
+	require.Equal(t, 404, send("DELETE", "http://localhost:9090/oauth/consents/"+app.ID, "", "", wilma).Code)
+	require.Equal(t, 200, send("GET", authorizeURL, "", "", wilma).Code)
+
+	w = send("GET", "http://localhost:9090/.well-known/openid-configuration", "", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), `"token_endpoint":"http://localhost:9090/oauth/token"`)
+}
@@ -0,0 +1,162 @@
+package oauth
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/jwt"
+	"github.com/b3ntly/twelvefactor_databases/users"
+)
+
+type (
+	// Discovery is the OpenID Provider Metadata served at /.well-known/openid-configuration.
+	Discovery struct {
+		Issuer                            string   `json:"issuer"`
+		AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+		TokenEndpoint                     string   `json:"token_endpoint"`
+		UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+		IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+		RevocationEndpoint                string   `json:"revocation_endpoint"`
+		JWKSURI                           string   `json:"jwks_uri"`
+		ScopesSupported                   []string `json:"scopes_supported"`
+		ResponseTypesSupported            []string `json:"response_types_supported"`
+		GrantTypesSupported               []string `json:"grant_types_supported"`
+		SubjectTypesSupported             []string `json:"subject_types_supported"`
+		IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+		TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+		CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+		ClaimsSupported                   []string `json:"claims_supported"`
+	}
+
+	// IDClaims are the claims of ID tokens.
+	IDClaims struct {
+		jwt.Claims
+		Nonce string `json:"nonce,omitempty"`
+		// The client the token was issued to.
+		AuthorizedParty string `json:"azp,omitempty"`
+	}
+
+	// Userinfo describes the user an access token acts for, with the claims its scopes grant.
+	Userinfo struct {
+		Subject           string `json:"sub"`
+		PreferredUsername string `json:"preferred_username,omitempty"`
+		Name              string `json:"name,omitempty"`
+		Email             string `json:"email,omitempty"`
+		EmailVerified     *bool  `json:"email_verified,omitempty"`
+	}
+
+	userinfo struct {
+		ID            int64  `db:"id"`
+		Username      string `db:"username"`
+		DisplayName   string `db:"display_name"`
+		Email         string `db:"email"`
+		EmailVerified bool   `db:"email_verified"`
+	}
+)
+
+// Discovery endpoint publishes the OpenID Connect metadata of the server. Always JSON, as the specification requires.
+func (s *Service) Discovery(w http.ResponseWriter, r *http.Request) {
+	base := s.issuer + "/" + s.pathPrefix
+
+	algorithms := map[string]bool{}
+	for _, key := range s.keys.JWKS().Keys {
+		algorithms[key.Algorithm] = true
+	}
+	signing := []string{}
+	for algorithm := range algorithms {
+		signing = append(signing, algorithm)
+	}
+	sort.Strings(signing)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(&Discovery{
+		Issuer:                            s.issuer,
+		AuthorizationEndpoint:             base + "/authorize",
+		TokenEndpoint:                     base + "/token",
+		UserinfoEndpoint:                  base + "/userinfo",
+		IntrospectionEndpoint:             base + "/introspect",
+		RevocationEndpoint:                base + "/revoke",
+		JWKSURI:                           s.issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail},
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{GrantAuthorizationCode, GrantRefreshToken, GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  signing,
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+		ClaimsSupported:                   []string{"sub", "preferred_username", "name", "email", "email_verified"},
+	})
+}
+
+// Userinfo endpoint describes the user the access token of the request acts for, which Authenticate must have
+// recognized. The token must grant the openid scope, and the profile and email scopes add their claims. Always JSON.
+func (s *Service) Userinfo(w http.ResponseWriter, r *http.Request) {
+	t := TokenFromContext(r.Context())
+	if t == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	scopes := scopeList(t.Scope)
+	if t.UserID == nil || !contains(scopes, ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="insufficient_scope", scope="openid"`)
+		http.Error(w, "the token doesn't grant the openid scope", http.StatusForbidden)
+		return
+	}
+
+	user := &userinfo{}
+	err := s.db.GetContext(r.Context(), user, SelectUserinfoStmt, *t.UserID, users.StatusActive)
+	if err == sql.ErrNoRows {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+		http.Error(w, "invalid access token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	info := &Userinfo{Subject: t.Subject()}
+	if contains(scopes, ScopeProfile) {
+		info.PreferredUsername, info.Name = user.Username, user.DisplayName
+	}
+	if contains(scopes, ScopeEmail) && user.Email != "" {
+		email, err := s.keyring.Open(user.Email)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+		info.Email, info.EmailVerified = email, &user.EmailVerified
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
+
+// idToken signs an ID token telling client who the user is and how they logged in.
+func (s *Service) idToken(client *Client, userID int64, nonce string, multiFactor bool) (string, error) {
+	methods := []string{"pwd"}
+	if multiFactor {
+		methods = append(methods, "otp", "mfa")
+	}
+
+	now := time.Now()
+	return s.keys.Sign(&IDClaims{
+		Claims: jwt.Claims{
+			Issuer:      s.issuer,
+			Subject:     "user:" + strconv.FormatInt(userID, 10),
+			Audience:    client.ID,
+			IssuedAt:    now.Unix(),
+			ExpiresAt:   now.Add(s.accessTTL).Unix(),
+			ID:          jwt.NewID(),
+			AuthMethods: methods,
+		},
+		Nonce:           nonce,
+		AuthorizedParty: client.ID,
+	})
+}
@@ -0,0 +1,222 @@
+package oauth
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS oauth_clients (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		secret_hash TEXT,
+		redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+		grant_types TEXT[] NOT NULL DEFAULT '{}',
+		scopes TEXT[] NOT NULL DEFAULT '{}',
+		first_party BOOLEAN NOT NULL DEFAULT false,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS oauth_consents (
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+		scopes TEXT[] NOT NULL,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		updated_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, client_id)
+	);
+	CREATE TABLE IF NOT EXISTS oauth_codes (
+		hash TEXT PRIMARY KEY,
+		grant_id TEXT NOT NULL,
+		client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		redirect_uri TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		code_challenge TEXT NOT NULL,
+		nonce TEXT NOT NULL DEFAULT '',
+		multi_factor BOOLEAN NOT NULL DEFAULT false,
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS oauth_codes_expires_at_idx ON oauth_codes (expires_at);
+	CREATE TABLE IF NOT EXISTS oauth_tokens (
+		id BIGSERIAL PRIMARY KEY,
+		hash TEXT NOT NULL UNIQUE,
+		kind TEXT NOT NULL,
+		grant_id TEXT NOT NULL,
+		client_id TEXT NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+		user_id INTEGER REFERENCES users (id) ON DELETE CASCADE,
+		scope TEXT NOT NULL,
+		multi_factor BOOLEAN NOT NULL DEFAULT false,
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		expires_at timestamp with time zone NOT NULL,
+		used_at timestamp with time zone,
+		revoked_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS oauth_tokens_grant_id_idx ON oauth_tokens (grant_id);
+	CREATE INDEX IF NOT EXISTS oauth_tokens_user_id_idx ON oauth_tokens (user_id, client_id);
+	CREATE INDEX IF NOT EXISTS oauth_tokens_expires_at_idx ON oauth_tokens (expires_at);
+	`
+
+	clientColumns = `id, name, secret_hash, redirect_uris, grant_types, scopes, first_party, created_by, created_at`
+
+	InsertClientStmt = `
+	INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, grant_types, scopes, first_party, created_by)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING ` + clientColumns + `;
+	`
+
+	SelectClientStmt = `
+	SELECT ` + clientColumns + `
+	FROM oauth_clients
+	WHERE id = $1;
+	`
+
+	SelectManyClientsStmt = `
+	SELECT ` + clientColumns + `
+	FROM oauth_clients
+	ORDER BY created_at, id;
+	`
+
+	DeleteClientStmt = `
+	DELETE FROM oauth_clients
+	WHERE id = $1;
+	`
+
+	SelectConsentStmt = `
+	SELECT scopes
+	FROM oauth_consents
+	WHERE user_id = $1 AND client_id = $2;
+	`
+
+	UpsertConsentStmt = `
+	INSERT INTO oauth_consents (user_id, client_id, scopes)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, client_id) DO UPDATE SET
+		scopes = EXCLUDED.scopes,
+		updated_at = now();
+	`
+
+	SelectUserConsentsStmt = `
+	SELECT c.client_id, cl.name AS client_name, c.scopes, c.created_at, c.updated_at
+	FROM oauth_consents c
+	JOIN oauth_clients cl ON cl.id = c.client_id
+	WHERE c.user_id = $1
+	ORDER BY c.created_at;
+	`
+
+	DeleteConsentStmt = `
+	DELETE FROM oauth_consents
+	WHERE user_id = $1 AND client_id = $2;
+	`
+
+	// Codes are valid for $9 seconds.
+	InsertCodeStmt = `
+	INSERT INTO oauth_codes (hash, grant_id, client_id, user_id, redirect_uri, scope, code_challenge, nonce, expires_at,
+		multi_factor)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now() + make_interval(secs => $9), $10);
+	`
+
+	SelectCodeForUpdateStmt = `
+	SELECT grant_id, client_id, user_id, redirect_uri, scope, code_challenge, nonce, multi_factor,
+		expires_at < now() AS expired, used_at
+	FROM oauth_codes
+	WHERE hash = $1
+	FOR UPDATE;
+	`
+
+	UseCodeStmt = `
+	UPDATE oauth_codes SET used_at = now()
+	WHERE hash = $1;
+	`
+
+	// Tokens are valid for $8 seconds.
+	InsertTokenStmt = `
+	INSERT INTO oauth_tokens (hash, kind, grant_id, client_id, user_id, scope, multi_factor, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, now() + make_interval(secs => $8));
+	`
+
+	tokenColumns = `t.id, t.kind, t.grant_id, t.client_id, t.user_id, t.scope, t.multi_factor, t.created_at,
+		t.expires_at, t.expires_at < now() AS expired, t.used_at, t.revoked_at`
+
+	SelectTokenForUpdateStmt = `
+	SELECT ` + tokenColumns + `
+	FROM oauth_tokens t
+	WHERE t.hash = $1
+	FOR UPDATE;
+	`
+
+	// A token which is neither expired, used nor revoked, issued to a client or to an active user who wasn't deleted.
+	SelectActiveTokenStmt = `
+	SELECT ` + tokenColumns + `
+	FROM oauth_tokens t
+	WHERE t.hash = $1 AND t.expires_at > now() AND t.used_at IS NULL AND t.revoked_at IS NULL AND (
+		t.user_id IS NULL OR EXISTS (
+			SELECT 1 FROM users u WHERE u.id = t.user_id AND u.status = $2 AND u.deleted_at IS NULL
+		)
+	);
+	`
+
+	UseTokenStmt = `
+	UPDATE oauth_tokens SET used_at = now()
+	WHERE id = $1;
+	`
+
+	RevokeTokenStmt = `
+	UPDATE oauth_tokens SET revoked_at = now()
+	WHERE id = $1 AND revoked_at IS NULL;
+	`
+
+	RevokeGrantStmt = `
+	UPDATE oauth_tokens SET revoked_at = now()
+	WHERE grant_id = $1 AND revoked_at IS NULL;
+	`
+
+	RevokeUserClientTokensStmt = `
+	UPDATE oauth_tokens SET revoked_at = now()
+	WHERE user_id = $1 AND client_id = $2 AND revoked_at IS NULL;
+	`
+
+	// The claims userinfo returns about an active user, whose email is verified if it was since it last changed.
+	SelectUserinfoStmt = `
+	SELECT u.id, u.username, u.display_name, u.email, v.verified_at IS NOT NULL AS email_verified
+	FROM users u
+	LEFT JOIN email_verifications v ON v.user_id = u.id AND v.email_index = u.email_index
+	WHERE u.id = $1 AND u.status = $2 AND u.deleted_at IS NULL;
+	`
+
+	SelectUserStatusStmt = `
+	SELECT status
+	FROM users
+	WHERE id = $1 AND deleted_at IS NULL;
+	`
+
+	// The grants a user holds, by their unrevoked and unexpired tokens.
+	SelectUserTokensStmt = `
+	SELECT ` + tokenColumns + `
+	FROM oauth_tokens t
+	WHERE t.user_id = $1 AND t.revoked_at IS NULL AND t.used_at IS NULL AND t.expires_at > now()
+	ORDER BY t.id;
+	`
+
+	DeleteUserConsentsStmt = `
+	DELETE FROM oauth_consents
+	WHERE user_id = $1;
+	`
+
+	DeleteUserCodesStmt = `
+	DELETE FROM oauth_codes
+	WHERE user_id = $1;
+	`
+
+	DeleteUserTokensStmt = `
+	DELETE FROM oauth_tokens
+	WHERE user_id = $1;
+	`
+
+	ExpireCodesStmt = `
+	DELETE FROM oauth_codes
+	WHERE expires_at < now();
+	`
+
+	ExpireTokensStmt = `
+	DELETE FROM oauth_tokens
+	WHERE expires_at < now();
+	`
+)
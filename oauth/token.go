@@ -0,0 +1,424 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/jmoiron/sqlx"
+)
+
+type (
+	// TokenResponse answers a successful token request, as RFC 6749 and OpenID Connect name its fields.
+	TokenResponse struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		// Lifetime of the access token, in seconds.
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token,omitempty"`
+		Scope        string `json:"scope"`
+		IDToken      string `json:"id_token,omitempty"`
+	}
+
+	// Introspection answers an introspection request, as RFC 7662 names its fields. Only Active is set for tokens which
+	// aren't.
+	Introspection struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+		Issuer    string `json:"iss,omitempty"`
+	}
+
+	// code is an authorization code, as stored.
+	code struct {
+		GrantID       string     `db:"grant_id"`
+		ClientID      string     `db:"client_id"`
+		UserID        int64      `db:"user_id"`
+		RedirectURI   string     `db:"redirect_uri"`
+		Scope         string     `db:"scope"`
+		CodeChallenge string     `db:"code_challenge"`
+		Nonce         string     `db:"nonce"`
+		MultiFactor   bool       `db:"multi_factor"`
+		Expired       bool       `db:"expired"`
+		UsedAt        *time.Time `db:"used_at"`
+	}
+)
+
+// Token endpoint exchanges a grant for tokens: an authorization code along with its PKCE verifier, a refresh token, or
+// the credentials of a confidential client. Requests are form encoded and clients authenticate with HTTP Basic or
+// client_id and client_secret parameters, public clients with client_id alone. Refresh tokens can only be used once:
+// presenting a code or a refresh token twice revokes every token of its grant, since either the client or whoever stole
+// it presents a secret it shouldn't have.
+func (s *Service) Token(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+
+	client, err := s.authenticateClient(w, r)
+	if err != nil {
+		s.writeOAuthError(w, err)
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if grantType != GrantAuthorizationCode && grantType != GrantRefreshToken && grantType != GrantClientCredentials {
+		s.writeOAuthError(w, &Error{Code: "unsupported_grant_type", Description: "unknown grant_type",
+			status: http.StatusBadRequest})
+		return
+	}
+	if !client.hasGrant(grantType) {
+		s.writeOAuthError(w, &Error{Code: "unauthorized_client", Description: "the client can't use " + grantType,
+			status: http.StatusBadRequest})
+		return
+	}
+
+	var tokens *TokenResponse
+	err = s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		switch grantType {
+		case GrantAuthorizationCode:
+			tokens, err = s.exchangeCode(r.Context(), tx, client, r.PostForm)
+		case GrantRefreshToken:
+			tokens, err = s.refresh(r.Context(), tx, client, r.PostForm.Get("refresh_token"), r.PostForm.Get("scope"))
+		case GrantClientCredentials:
+			tokens, err = s.clientCredentials(r.Context(), tx, client, r.PostForm.Get("scope"))
+		}
+		return err
+	})
+	if err != nil {
+		s.writeOAuthError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+// exchangeCode redeems an authorization code issued to client within tx.
+func (s *Service) exchangeCode(ctx context.Context, tx *sqlx.Tx, client *Client, form url.Values) (*TokenResponse, error) {
+	c := &code{}
+	hash := hashSecret(form.Get("code"))
+	err := tx.GetContext(ctx, c, SelectCodeForUpdateStmt, hash)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if c.UsedAt != nil {
+		if _, err := tx.ExecContext(ctx, RevokeGrantStmt, c.GrantID); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidGrant
+	}
+
+	if c.Expired || c.ClientID != client.ID || c.RedirectURI != form.Get("redirect_uri") ||
+		!verifyChallenge(form.Get("code_verifier"), c.CodeChallenge) {
+		return nil, errInvalidGrant
+	}
+
+	if _, err := tx.ExecContext(ctx, UseCodeStmt, hash); err != nil {
+		return nil, err
+	}
+
+	if err := activeUser(ctx, tx, c.UserID); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.issue(ctx, tx, client, c.GrantID, &c.UserID, c.Scope, c.MultiFactor)
+	if err != nil {
+		return nil, err
+	}
+
+	if contains(scopeList(c.Scope), ScopeOpenID) {
+		tokens.IDToken, err = s.idToken(client, c.UserID, c.Nonce, c.MultiFactor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tokens, nil
+}
+
+// refresh exchanges a refresh token issued to client within tx for new tokens of the same grant, narrowed to scope if
+// it isn't empty.
+func (s *Service) refresh(ctx context.Context, tx *sqlx.Tx, client *Client, token, scope string) (*TokenResponse, error) {
+	current := &Token{}
+	err := tx.GetContext(ctx, current, SelectTokenForUpdateStmt, hashSecret(token))
+	if err == sql.ErrNoRows {
+		return nil, errInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if current.Kind != kindRefresh || current.ClientID != client.ID || current.RevokedAt != nil {
+		return nil, errInvalidGrant
+	}
+
+	if current.UsedAt != nil {
+		if _, err := tx.ExecContext(ctx, RevokeGrantStmt, current.GrantID); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidGrant
+	}
+
+	if current.Expired {
+		return nil, errInvalidGrant
+	}
+
+	granted := current.Scope
+	if scope != "" {
+		if !subset(scopeList(scope), scopeList(current.Scope)) {
+			return nil, &Error{Code: "invalid_scope", Description: "scope exceeds the grant", status: http.StatusBadRequest}
+		}
+		granted = strings.Join(scopeList(scope), " ")
+	}
+
+	if _, err := tx.ExecContext(ctx, UseTokenStmt, current.ID); err != nil {
+		return nil, err
+	}
+
+	if current.UserID != nil {
+		if err := activeUser(ctx, tx, *current.UserID); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.issue(ctx, tx, client, current.GrantID, current.UserID, granted, current.MultiFactor)
+}
+
+// clientCredentials issues an access token to client itself within tx, for scope or every scope it was registered with
+// but those which only make sense on behalf of a user.
+func (s *Service) clientCredentials(ctx context.Context, tx *sqlx.Tx, client *Client, scope string) (*TokenResponse, error) {
+	allowed := []string{}
+	for _, s := range client.Scopes {
+		if s != ScopeOpenID && s != ScopeProfile && s != ScopeEmail {
+			allowed = append(allowed, s)
+		}
+	}
+
+	scopes := allowed
+	if scope != "" {
+		scopes = scopeList(scope)
+		if !subset(scopes, allowed) {
+			return nil, &Error{Code: "invalid_scope", Description: "the client can't ask for these scopes",
+				status: http.StatusBadRequest}
+		}
+	}
+
+	return s.issue(ctx, tx, client, randomString(16), nil, strings.Join(scopes, " "), false)
+}
+
+// issue stores an access token of a grant within tx, along with a refresh token if the grant is on behalf of a user
+// and the client may refresh it. Clients acting for themselves ask for a new token with their credentials instead.
+func (s *Service) issue(ctx context.Context, tx *sqlx.Tx, client *Client, grantID string, userID *int64, scope string, multiFactor bool) (*TokenResponse, error) {
+	tokens := &TokenResponse{
+		AccessToken: AccessTokenPrefix + randomString(32),
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.accessTTL.Seconds()),
+		Scope:       scope,
+	}
+
+	_, err := tx.ExecContext(ctx, InsertTokenStmt, hashSecret(tokens.AccessToken), kindAccess, grantID, client.ID,
+		userID, scope, multiFactor, s.accessTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == nil || !client.hasGrant(GrantRefreshToken) {
+		return tokens, nil
+	}
+
+	tokens.RefreshToken = RefreshTokenPrefix + randomString(32)
+	_, err = tx.ExecContext(ctx, InsertTokenStmt, hashSecret(tokens.RefreshToken), kindRefresh, grantID, client.ID,
+		userID, scope, multiFactor, s.refreshTTL.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// Introspect endpoint tells a confidential client whether a token is active, and what it grants, as RFC 7662 defines.
+// Refresh tokens are only described to the client they were issued to.
+func (s *Service) Introspect(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+
+	client, err := s.authenticateClient(w, r)
+	if err == nil && client.Public {
+		err = &Error{Code: "invalid_client", Description: "public clients can't introspect tokens",
+			status: http.StatusUnauthorized}
+	}
+	if err != nil {
+		s.writeOAuthError(w, err)
+		return
+	}
+
+	t, err := s.activeToken(r.Context(), r.PostForm.Get("token"))
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if t == nil || (t.Kind == kindRefresh && t.ClientID != client.ID) {
+		writeJSON(w, http.StatusOK, &Introspection{Active: false})
+		return
+	}
+
+	tokenType := "access_token"
+	if t.Kind == kindRefresh {
+		tokenType = "refresh_token"
+	}
+
+	writeJSON(w, http.StatusOK, &Introspection{
+		Active:    true,
+		Scope:     t.Scope,
+		ClientID:  t.ClientID,
+		Subject:   t.Subject(),
+		TokenType: tokenType,
+		ExpiresAt: t.ExpiresAt.Unix(),
+		IssuedAt:  t.CreatedAt.Unix(),
+		Issuer:    s.issuer,
+	})
+}
+
+// Revoke endpoint revokes a token issued to the client making the request, as RFC 7009 defines, and responds with 200
+// OK whether or not there was such a token. Revoking a refresh token revokes every token of its grant.
+func (s *Service) Revoke(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, &Error{Code: "invalid_request", Description: "malformed form body"})
+		return
+	}
+
+	client, err := s.authenticateClient(w, r)
+	if err != nil {
+		s.writeOAuthError(w, err)
+		return
+	}
+
+	err = s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		t := &Token{}
+		err := tx.GetContext(r.Context(), t, SelectTokenForUpdateStmt, hashSecret(r.PostForm.Get("token")))
+		if err == sql.ErrNoRows || (err == nil && t.ClientID != client.ID) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if t.Kind == kindRefresh {
+			_, err = tx.ExecContext(r.Context(), RevokeGrantStmt, t.GrantID)
+		} else {
+			_, err = tx.ExecContext(r.Context(), RevokeTokenStmt, t.ID)
+		}
+		return err
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// authenticateClient returns the client making a token, introspection or revocation request, authenticated with HTTP
+// Basic or the client_id and client_secret parameters. Public clients only name themselves.
+func (s *Service) authenticateClient(w http.ResponseWriter, r *http.Request) (*Client, error) {
+	id, secret, basic := r.BasicAuth()
+	if !basic {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	invalid := &Error{Code: "invalid_client", Description: "client authentication failed", status: http.StatusUnauthorized}
+	if basic {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	if id == "" {
+		return nil, invalid
+	}
+
+	client, err := s.client(r.Context(), id)
+	if err == sql.ErrNoRows {
+		return nil, invalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, invalid
+		}
+		return client, nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(*client.SecretHash)) != 1 {
+		return nil, invalid
+	}
+	return client, nil
+}
+
+// activeUser returns errInvalidGrant unless the user is active and wasn't deleted, within tx.
+func activeUser(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	var status string
+	err := tx.GetContext(ctx, &status, SelectUserStatusStmt, userID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if status != users.StatusActive {
+		return errInvalidGrant
+	}
+	return nil
+}
+
+// verifyChallenge reports whether the PKCE verifier hashes to the S256 challenge, as RFC 7636 defines it.
+func verifyChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
+
+// inTx runs fn in a transaction, committed if fn succeeds or returns errInvalidGrant, which may follow a revocation
+// that must stick.
+func (s *Service) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(tx)
+	if err != nil && err != errInvalidGrant {
+		return err
+	}
+
+	if commitErr := tx.Commit(); commitErr != nil {
+		return commitErr
+	}
+
+	return err
+}
@@ -2,7 +2,7 @@ package ping
 
 import (
 	"context"
-	"encoding/json"
+	"github.com/b3ntly/twelvefactor_databases/render"
 	"github.com/gorilla/mux"
 	"log"
 	"net/http"
@@ -16,6 +16,8 @@ type (
 		PingPath     string
 		PingResponse string
 		Logger       *log.Logger
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
 	}
 
 	Service struct {
@@ -24,13 +26,19 @@ type (
 		pingPath     string
 		pingResponse string
 		logger       *log.Logger
+		renderer     *render.Renderer
 	}
 )
 
 // New: inject dependencies via an explicit constructor. Though sometimes people will read environmental variables or
 // initialize defaults here I prefer to do so explicitly within the program entry-point.
 func New(config *Config) *Service {
-	return &Service{ctx: config.Ctx, pingPath: filepath.Join("/", config.PingPath), pingResponse: config.PingResponse, logger: config.Logger}
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	return &Service{ctx: config.Ctx, pingPath: filepath.Join("/", config.PingPath), pingResponse: config.PingResponse, logger: config.Logger, renderer: renderer}
 }
 
 //
@@ -39,15 +47,12 @@ func (s *Service) Mount(r *mux.Router) {
 }
 
 func (s *Service) ping(w http.ResponseWriter, r *http.Request) {
-	response, err := json.Marshal(s.pingResponse)
+	err := s.renderer.Render(w, r, s.pingResponse)
 
-	if err != nil {
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
 		s.writeError(w, err)
-		return
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
 }
 
 // logic for logging and writing an error, log your errors!
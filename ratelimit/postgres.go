@@ -0,0 +1,42 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// PostgresStore keeps buckets in a Postgres table so limits hold across every replica sharing the database.
+type PostgresStore struct {
+	db *sqlx.DB
+}
+
+// NewPostgresStore returns a PostgresStore, creating its table if it doesn't exist.
+func NewPostgresStore(ctx context.Context, db *sqlx.DB) (*PostgresStore, error) {
+	if _, err := db.ExecContext(ctx, CreateTableStmt); err != nil {
+		return nil, err
+	}
+
+	return &PostgresStore{db: db}, nil
+}
+
+// Take implements Store.
+func (p *PostgresStore) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	row := struct {
+		Tokens  float64 `db:"tokens"`
+		Allowed bool    `db:"allowed"`
+	}{}
+
+	if err := p.db.GetContext(ctx, &row, TakeStmt, key, limit.Burst, limit.Rate); err != nil {
+		return Result{}, err
+	}
+
+	return limit.result(row.Tokens, row.Allowed), nil
+}
+
+// Cleanup implements Store.
+func (p *PostgresStore) Cleanup(ctx context.Context, idle time.Duration) error {
+	_, err := p.db.ExecContext(ctx, CleanupStmt, idle.Seconds())
+	return err
+}
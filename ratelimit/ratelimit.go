@@ -0,0 +1,300 @@
+// Package ratelimit throttles clients with token buckets. Every client gets a bucket per rule, holding up to the burst
+// of the rule and refilled at its rate; each request takes a token and requests finding the bucket empty are answered
+// with 429 Too Many Requests. Buckets live in a Store, in memory for a single replica or in Postgres so every replica
+// shares them.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+)
+
+type (
+	// Limit of a token bucket.
+	Limit struct {
+		// Tokens added per second.
+		Rate float64
+		// The most tokens a bucket holds, the largest burst of requests allowed at once.
+		Burst int
+	}
+
+	// Rule limits the requests of each client to paths under Prefix, made with Method or any method if empty.
+	Rule struct {
+		Method string
+		Prefix string
+		Limit  Limit
+	}
+
+	// Result of taking a token from a bucket.
+	Result struct {
+		Allowed   bool
+		Remaining int
+		// How long until the bucket is full again.
+		Reset time.Duration
+		// How long until a token is available, when not Allowed.
+		RetryAfter time.Duration
+	}
+
+	// Store holds token buckets.
+	Store interface {
+		// Take refills the bucket named key according to limit and takes a token from it if there is one.
+		Take(ctx context.Context, key string, limit Limit) (Result, error)
+		// Cleanup forgets buckets untouched for longer than idle.
+		Cleanup(ctx context.Context, idle time.Duration) error
+	}
+
+	// Config for the rate limiting middleware.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		Store  Store
+		Rules  []Rule
+		// How often RunCleaner forgets idle buckets, zero or less disables cleaning.
+		CleanupInterval time.Duration
+	}
+
+	// Middleware rate limits requests according to its rules.
+	Middleware struct {
+		ctx             context.Context
+		logger          *log.Logger
+		store           Store
+		rules           []Rule
+		cleanupInterval time.Duration
+	}
+)
+
+// New: Instantiate the middleware. Rules are matched most specific first whatever their order.
+func New(config *Config) *Middleware {
+	rules := append([]Rule(nil), config.Rules...)
+	sort.SliceStable(rules, func(i, j int) bool {
+		if len(rules[i].Prefix) != len(rules[j].Prefix) {
+			return len(rules[i].Prefix) > len(rules[j].Prefix)
+		}
+		return rules[i].Method != "" && rules[j].Method == ""
+	})
+
+	return &Middleware{
+		ctx:             config.Ctx,
+		logger:          config.Logger,
+		store:           config.Store,
+		rules:           rules,
+		cleanupInterval: config.CleanupInterval,
+	}
+}
+
+// Wrap returns next guarded by the rules of the middleware. Requests matching no rule aren't limited. Responses to
+// limited requests carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers, and Retry-After when they are
+// rejected. Requests are let through if the store fails, so an outage of the store doesn't take the service down.
+func (m *Middleware) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rule, ok := m.match(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := rule.String() + " " + clientKey(r)
+		result, err := m.store.Take(r.Context(), key, rule.Limit)
+		if err != nil {
+			m.logger.Println(err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(result.Reset)))
+
+		if !result.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(seconds(result.RetryAfter)))
+			http.Error(w, "rate limit exceeded, retry later", http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// match returns the most specific rule applying to r.
+func (m *Middleware) match(r *http.Request) (Rule, bool) {
+	for _, rule := range m.rules {
+		if rule.Method != "" && rule.Method != r.Method {
+			continue
+		}
+		if rule.Prefix == "/" || r.URL.Path == rule.Prefix || strings.HasPrefix(r.URL.Path, rule.Prefix+"/") {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+// RunCleaner forgets idle buckets every cleanup interval until ctx is done. Blocks, so run it in its own goroutine. A
+// bucket is only forgotten once it would have refilled completely, so forgetting it changes nothing.
+func (m *Middleware) RunCleaner(ctx context.Context) {
+	if m.cleanupInterval <= 0 {
+		return
+	}
+
+	idle := time.Duration(0)
+	for _, rule := range m.rules {
+		if full := rule.Limit.fillTime(0); full > idle {
+			idle = full
+		}
+	}
+
+	ticker := time.NewTicker(m.cleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.store.Cleanup(ctx, idle); err != nil {
+				m.logger.Println(err)
+			}
+		}
+	}
+}
+
+// clientKey identifies the client making a request: its actor when it is known, its address otherwise.
+func clientKey(r *http.Request) string {
+	if actor := reqctx.Actor(r.Context()); actor != "" {
+		return "actor:" + actor
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// String formats a rule as ParseRules reads it, which also names its buckets.
+func (rule Rule) String() string {
+	prefix := rule.Prefix
+	if rule.Method != "" {
+		prefix = rule.Method + " " + prefix
+	}
+	return fmt.Sprintf("%s=%g/s:%d", prefix, rule.Limit.Rate, rule.Limit.Burst)
+}
+
+// fillTime returns how long a bucket holding tokens takes to fill up.
+func (l Limit) fillTime(tokens float64) time.Duration {
+	return time.Duration((float64(l.Burst) - tokens) / l.Rate * float64(time.Second))
+}
+
+// result describes a bucket holding tokens after a request was, or wasn't, allowed.
+func (l Limit) result(tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:   allowed,
+		Remaining: int(math.Max(0, math.Floor(tokens))),
+		Reset:     l.fillTime(tokens),
+	}
+
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / l.Rate * float64(time.Second))
+	}
+
+	return result
+}
+
+// seconds rounds d up to whole seconds, as headers express it.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// ParseRules reads rules written as "[METHOD ]PREFIX=N/UNIT[:BURST]", separated by commas, where UNIT is s, m or h and
+// BURST defaults to N. For example "POST /users=10/m, /=50/s:100" allows each client 10 user creations a minute and
+// 50 requests a second in bursts of up to 100 to any other route.
+func ParseRules(spec string) ([]Rule, error) {
+	rules := []Rule{}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("ratelimit: rule %q must be written as [METHOD ]PREFIX=N/UNIT[:BURST]", entry)
+		}
+
+		rule := Rule{}
+		route := strings.Fields(parts[0])
+		switch len(route) {
+		case 1:
+			rule.Prefix = route[0]
+		case 2:
+			rule.Method, rule.Prefix = strings.ToUpper(route[0]), route[1]
+		default:
+			return nil, fmt.Errorf("ratelimit: rule %q has an invalid route", entry)
+		}
+
+		if !strings.HasPrefix(rule.Prefix, "/") {
+			return nil, fmt.Errorf("ratelimit: rule %q must start its prefix with /", entry)
+		}
+		if rule.Prefix != "/" {
+			rule.Prefix = strings.TrimSuffix(rule.Prefix, "/")
+		}
+
+		limit, err := parseLimit(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("ratelimit: rule %q: %v", entry, err)
+		}
+		rule.Limit = limit
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+func parseLimit(s string) (Limit, error) {
+	burst := ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		s, burst = s[:i], s[i+1:]
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return Limit{}, fmt.Errorf("limit must be written as N/UNIT")
+	}
+
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("limit must be a positive number of requests")
+	}
+
+	var unit time.Duration
+	switch parts[1] {
+	case "s":
+		unit = time.Second
+	case "m":
+		unit = time.Minute
+	case "h":
+		unit = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("unit must be s, m or h")
+	}
+
+	limit := Limit{Rate: float64(n) / unit.Seconds(), Burst: n}
+	if burst != "" {
+		if limit.Burst, err = strconv.Atoi(burst); err != nil || limit.Burst <= 0 {
+			return Limit{}, fmt.Errorf("burst must be a positive number of requests")
+		}
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,102 @@
+package ratelimit_test
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/ratelimit"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ratelimit.ParseRules("POST /users/=10/m, /=50/s:100")
+	require.Nil(t, err)
+	require.Equal(t, []ratelimit.Rule{
+		{Method: "POST", Prefix: "/users", Limit: ratelimit.Limit{Rate: 10.0 / 60, Burst: 10}},
+		{Prefix: "/", Limit: ratelimit.Limit{Rate: 50, Burst: 100}},
+	}, rules)
+
+	rules, err = ratelimit.ParseRules("")
+	require.Nil(t, err)
+	require.Empty(t, rules)
+
+	for _, spec := range []string{"/users", "users=1/s", "/users=1/d", "/users=0/s", "/users=1/s:0", "GET POST /=1/s"} {
+		_, err := ratelimit.ParseRules(spec)
+		require.NotNil(t, err, spec)
+	}
+}
+
+func TestMemoryStore_Take(t *testing.T) {
+	store := ratelimit.NewMemoryStore()
+	limit := ratelimit.Limit{Rate: 1.0 / 3600, Burst: 2}
+
+	result, err := store.Take(context.Background(), "fred", limit)
+	require.Nil(t, err)
+	require.True(t, result.Allowed)
+	require.Equal(t, 1, result.Remaining)
+
+	result, _ = store.Take(context.Background(), "fred", limit)
+	require.True(t, result.Allowed)
+	require.Equal(t, 0, result.Remaining)
+
+	result, _ = store.Take(context.Background(), "fred", limit)
+	require.False(t, result.Allowed)
+	require.True(t, result.RetryAfter > 59*time.Minute)
+
+	// Buckets are per key.
+	result, _ = store.Take(context.Background(), "wilma", limit)
+	require.True(t, result.Allowed)
+}
+
+func TestMiddleware_Wrap(t *testing.T) {
+	rules, err := ratelimit.ParseRules("POST /users=1/h, /users=2/h")
+	require.Nil(t, err)
+
+	limiter := ratelimit.New(&ratelimit.Config{
+		Ctx:    context.Background(),
+		Logger: log.New(os.Stdout, "logger: ", log.Lshortfile),
+		Store:  ratelimit.NewMemoryStore(),
+		Rules:  rules,
+	})
+
+	handler := limiter.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(method, target, actor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		if actor != "" {
+			req = req.WithContext(reqctx.WithActor(req.Context(), actor))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("GET", "http://localhost:9090/users/1", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "2", w.Header().Get("RateLimit-Limit"))
+	require.Equal(t, "1", w.Header().Get("RateLimit-Remaining"))
+
+	require.Equal(t, 200, send("GET", "http://localhost:9090/users", "").Code)
+
+	w = send("GET", "http://localhost:9090/users", "")
+	require.Equal(t, 429, w.Code)
+	require.NotEmpty(t, w.Header().Get("Retry-After"))
+
+	// The more specific rule has a bucket of its own, and identified clients are limited on their own.
+	require.Equal(t, 200, send("POST", "http://localhost:9090/users", "").Code)
+	require.Equal(t, 429, send("POST", "http://localhost:9090/users", "").Code)
+	require.Equal(t, 200, send("POST", "http://localhost:9090/users", "user:1").Code)
+
+	// Routes matching no rule aren't limited.
+	w = send("GET", "http://localhost:9090/ping", "")
+	require.Equal(t, 200, w.Code)
+	require.Empty(t, w.Header().Get("RateLimit-Limit"))
+}
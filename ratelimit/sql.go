@@ -0,0 +1,35 @@
+package ratelimit
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS rate_limits (
+		key TEXT PRIMARY KEY,
+		tokens DOUBLE PRECISION NOT NULL,
+		allowed BOOLEAN NOT NULL,
+		updated_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	`
+
+	// Refill the bucket $1 at $3 tokens a second up to $2 and take a token if there is one, in a single statement so
+	// concurrent requests from every replica are serialized by the row lock. New buckets start full. The refill is
+	// computed from the old row in each assignment, an upsert can't name it once. now() is the start of the transaction,
+	// which may precede the last update when it waited for the row lock, so the elapsed time is clamped at zero and
+	// updated_at never moves back.
+	TakeStmt = `
+	INSERT INTO rate_limits AS bucket
+		(key, tokens, allowed)
+	VALUES
+		($1, $2::float8 - 1, true)
+	ON CONFLICT (key) DO UPDATE SET
+		allowed = least($2::float8, bucket.tokens + greatest(0, extract(epoch FROM now() - bucket.updated_at)) * $3::float8) >= 1,
+		tokens = least($2::float8, bucket.tokens + greatest(0, extract(epoch FROM now() - bucket.updated_at)) * $3::float8)
+			- (least($2::float8, bucket.tokens + greatest(0, extract(epoch FROM now() - bucket.updated_at)) * $3::float8) >= 1)::int,
+		updated_at = greatest(bucket.updated_at, now())
+	RETURNING tokens, allowed;
+	`
+
+	CleanupStmt = `
+	DELETE FROM rate_limits
+	WHERE updated_at < now() - make_interval(secs => $1);
+	`
+)
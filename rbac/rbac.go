@@ -0,0 +1,377 @@
+// Package rbac authorizes requests with roles. A role grants permissions, each allowing an action on the resources
+// matching a pattern, and subjects, the IDs of principals such as "user:42" or "key:ab12cd34", are assigned roles.
+// Requests are denied unless a role of their principal, or a scope of the credentials it presented, allows them. Roles
+// may require a second factor, granting nothing to principals which logged in with a password alone. The admin action
+// is only ever granted by roles: credentials scoped admin grant no more than any other through this package.
+package rbac
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Any matches every action, or every resource.
+const Any = "*"
+
+// Largest request body accepted by the write endpoints.
+const maxBodyBytes = 1 << 16
+
+type (
+	// Config for the RBAC service.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /rbac.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+	}
+
+	// Service: roles, and the access.Enforcer applying them. Its own routes are always guarded by it, whether or not
+	// other services enforce it.
+	Service struct {
+		ctx        context.Context
+		logger     *log.Logger
+		db         *sqlx.DB
+		pathPrefix string
+		renderer   *render.Renderer
+	}
+
+	// Permission allows Action, or any action if Any, on the resources matching Resource. Resource is a resource name,
+	// Any, a collection followed by /* matching its members, and may contain {user} standing for the ID of a subject
+	// which is a user, so a permission can be limited to the user's own resources.
+	Permission struct {
+		Action   string `json:"action" db:"action"`
+		Resource string `json:"resource" db:"resource"`
+	}
+
+	// Role is a named set of permissions.
+	Role struct {
+		Name        string `json:"name" db:"name"`
+		Description string `json:"description" db:"description"`
+		// Whether the role only grants its permissions to principals which proved a second factor.
+		RequireMultiFactor bool         `json:"requireMultiFactor" db:"require_multi_factor"`
+		Permissions        []Permission `json:"permissions" db:"-"`
+	}
+
+	// RoleInput is the body accepted by the endpoint creating or replacing a role.
+	RoleInput struct {
+		Description        string       `json:"description"`
+		RequireMultiFactor bool         `json:"requireMultiFactor"`
+		Permissions        []Permission `json:"permissions"`
+	}
+)
+
+// New: Instantiate a new RBAC service. Fail hard if its tables can't be created.
+func New(config *Config) *Service {
+	for _, stmt := range []string{CreateTableStmt, SeedStmt} {
+		if _, err := config.DB.ExecContext(context.Background(), stmt); err != nil {
+			config.Logger.Fatal(err)
+		}
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "rbac"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	return &Service{
+		ctx:        config.Ctx,
+		logger:     config.Logger,
+		db:         config.DB,
+		pathPrefix: pathPrefix,
+		renderer:   renderer,
+	}
+}
+
+// Mount the subRouter of this service to the root router. Managing roles requires the admin action.
+func (s *Service) Mount(r *mux.Router) {
+	roles, role, subject := access.Static("roles"), access.Var("roles", "role"), access.Var("subjects", "subject")
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.Handle("/roles", s.require(roles, s.GetRoles)).Methods("GET")
+	subRouter.Handle("/roles/{role:[a-z0-9_-]+}", s.require(role, s.PutRole)).Methods("PUT")
+	subRouter.Handle("/roles/{role:[a-z0-9_-]+}", s.require(role, s.DeleteRole)).Methods("DELETE")
+	subRouter.Handle("/subjects/{subject}/roles", s.require(subject, s.GetSubjectRoles)).Methods("GET")
+	subRouter.Handle("/subjects/{subject}/roles/{role}", s.require(subject, s.AssignRole)).Methods("PUT")
+	subRouter.Handle("/subjects/{subject}/roles/{role}", s.require(subject, s.UnassignRole)).Methods("DELETE")
+}
+
+// require guards a route acting on resource with the service itself.
+func (s *Service) require(resource access.Resource, handler http.HandlerFunc) http.Handler {
+	return access.Require(s, access.Admin, resource, handler)
+}
+
+// Authorize implements access.Enforcer: the principal of the request may perform action on resource if a scope of its
+// credentials names action, other than admin, or one of its roles allows it. Roles requiring a second factor only count if the
+// principal proved one. Everything else is denied.
+func (s *Service) Authorize(r *http.Request, action, resource string) error {
+	p := access.FromContext(r.Context())
+	if p == nil {
+		return access.ErrUnauthenticated
+	}
+
+	if action != access.Admin && p.HasExactScope(action) {
+		return nil
+	}
+
+	permissions := []Permission{}
+	if err := s.db.SelectContext(r.Context(), &permissions, SelectSubjectPermissionsStmt, p.ID, p.MultiFactor); err != nil {
+		s.logger.Println(err)
+		return err
+	}
+
+	for _, permission := range permissions {
+		if permission.Allows(p.ID, action, resource) {
+			return nil
+		}
+	}
+
+	return access.ErrForbidden
+}
+
+// Allows reports whether the permission lets subject perform action on resource.
+func (p Permission) Allows(subject, action, resource string) bool {
+	if p.Action != Any && p.Action != action {
+		return false
+	}
+
+	pattern := p.Resource
+	if strings.Contains(pattern, "{user}") {
+		if !strings.HasPrefix(subject, "user:") {
+			return false
+		}
+		pattern = strings.Replace(pattern, "{user}", strings.TrimPrefix(subject, "user:"), -1)
+	}
+
+	switch {
+	case pattern == Any:
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		collection := strings.TrimSuffix(pattern, "*")
+		return strings.HasPrefix(resource, collection) && len(resource) > len(collection)
+	default:
+		return pattern == resource
+	}
+}
+
+// Assign gives subject role, recording the actor assigning it. Assigning a role twice changes nothing.
+func (s *Service) Assign(ctx context.Context, subject, role, createdBy string) error {
+	_, err := s.db.ExecContext(ctx, AssignRoleStmt, subject, role, createdBy)
+	return err
+}
+
+// Outranks reports whether subject holds a role requiring a second factor which than doesn't hold, in which case than
+// mustn't be allowed to take over the credentials of subject.
+func (s *Service) Outranks(ctx context.Context, subject, than string) (bool, error) {
+	var outranks bool
+	err := s.db.GetContext(ctx, &outranks, OutranksStmt, subject, than)
+	return outranks, err
+}
+
+// GetRoles endpoint returns every role with its permissions.
+func (s *Service) GetRoles(w http.ResponseWriter, r *http.Request) {
+	roles := []*Role{}
+	if err := s.db.SelectContext(r.Context(), &roles, SelectRolesStmt); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	permissions := []struct {
+		Role string `db:"role"`
+		Permission
+	}{}
+	if err := s.db.SelectContext(r.Context(), &permissions, SelectPermissionsStmt); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	byName := map[string]*Role{}
+	for _, role := range roles {
+		role.Permissions = []Permission{}
+		byName[role.Name] = role
+	}
+	for _, permission := range permissions {
+		if role, ok := byName[permission.Role]; ok {
+			role.Permissions = append(role.Permissions, permission.Permission)
+		}
+	}
+
+	s.render(w, r, http.StatusOK, roles)
+}
+
+// PutRole endpoint creates a role, or replaces the description and permissions of an existing one, responding with the
+// role.
+func (s *Service) PutRole(w http.ResponseWriter, r *http.Request) {
+	input := &RoleInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if problems := input.validate(); len(problems) > 0 {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
+	role := &Role{
+		Name:               mux.Vars(r)["role"],
+		Description:        input.Description,
+		RequireMultiFactor: input.RequireMultiFactor,
+		Permissions:        input.Permissions,
+	}
+	if role.Permissions == nil {
+		role.Permissions = []Permission{}
+	}
+
+	tx, err := s.db.BeginTxx(r.Context(), nil)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(r.Context(), UpsertRoleStmt, role.Name, role.Description,
+		role.RequireMultiFactor); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if _, err := tx.ExecContext(r.Context(), DeleteRolePermissionsStmt, role.Name); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	for _, permission := range role.Permissions {
+		_, err := tx.ExecContext(r.Context(), InsertRolePermissionStmt, role.Name, permission.Action, permission.Resource)
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, role)
+}
+
+// DeleteRole endpoint deletes a role, taking it away from every subject it was assigned to.
+func (s *Service) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	s.execOne(w, r, "no such role", DeleteRoleStmt, mux.Vars(r)["role"])
+}
+
+// GetSubjectRoles endpoint returns the names of the roles assigned to a subject.
+func (s *Service) GetSubjectRoles(w http.ResponseWriter, r *http.Request) {
+	roles := []string{}
+	if err := s.db.SelectContext(r.Context(), &roles, SelectSubjectRolesStmt, mux.Vars(r)["subject"]); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, roles)
+}
+
+// AssignRole endpoint assigns a role to a subject, responding with 204 No Content.
+func (s *Service) AssignRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	err := s.Assign(r.Context(), vars["subject"], vars["role"], reqctx.Actor(r.Context()))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "no such role", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnassignRole endpoint takes a role away from a subject, responding with 204 No Content.
+func (s *Service) UnassignRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	s.execOne(w, r, "the role isn't assigned to the subject", UnassignRoleStmt, vars["subject"], vars["role"])
+}
+
+// execOne runs a statement expected to affect a single row, responding with 204 No Content if it did and 404 Not Found
+// with notFound otherwise.
+func (s *Service) execOne(w http.ResponseWriter, r *http.Request, notFound, stmt string, args ...interface{}) {
+	result, err := s.db.ExecContext(r.Context(), stmt, args...)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		s.writeError(w, err)
+		return
+	} else if n == 0 {
+		http.Error(w, notFound, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validate checks a role, keyed by field.
+func (in *RoleInput) validate() map[string]string {
+	problems := map[string]string{}
+
+	for _, permission := range in.Permissions {
+		if permission.Action != Any && !access.Known(permission.Action) {
+			problems["permissions"] = "unknown action " + permission.Action
+		}
+		if permission.Resource == "" {
+			problems["permissions"] = "resource must not be empty, use * for every resource"
+		}
+	}
+
+	return problems
+}
+
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
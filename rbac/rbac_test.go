@@ -0,0 +1,148 @@
+package rbac_test
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/rbac"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestPermission_Allows(t *testing.T) {
+	cases := []struct {
+		permission rbac.Permission
+		subject    string
+		action     string
+		resource   string
+		allowed    bool
+	}{
+		{rbac.Permission{Action: "*", Resource: "*"}, "key:1", access.Admin, "users/1", true},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users"}, "key:1", access.UsersRead, "users", true},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users"}, "key:1", access.UsersWrite, "users", false},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users"}, "key:1", access.UsersRead, "users/1", false},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users/*"}, "key:1", access.UsersRead, "users/1", true},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users/*"}, "key:1", access.UsersRead, "users", false},
+		{rbac.Permission{Action: access.UsersRead, Resource: "users/*"}, "key:1", access.UsersRead, "usersx/1", false},
+		{rbac.Permission{Action: access.UsersWrite, Resource: "users/{user}"}, "user:7", access.UsersWrite, "users/7", true},
+		{rbac.Permission{Action: access.UsersWrite, Resource: "users/{user}"}, "user:7", access.UsersWrite, "users/70", false},
+		{rbac.Permission{Action: access.UsersWrite, Resource: "users/{user}"}, "key:7", access.UsersWrite, "users/7", false},
+	}
+
+	for _, c := range cases {
+		require.Equal(t, c.allowed, c.permission.Allows(c.subject, c.action, c.resource), "%+v", c)
+	}
+}
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+
+	service := rbac.New(&rbac.Config{
+		Ctx:    ctx,
+		Logger: log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:     db,
+	})
+
+	_, err = db.ExecContext(ctx, "DELETE FROM roles WHERE name = 'auditor'; DELETE FROM role_assignments WHERE subject LIKE 'test:%'")
+	require.Nil(t, err)
+	require.Nil(t, service.Assign(ctx, "test:root", "admin", "system:test"))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+
+	// A route of another service, guarded by the roles of the service.
+	router.Handle("/reports/{id}", access.Require(service, access.UsersRead, access.Var("reports", "id"),
+		func(w http.ResponseWriter, r *http.Request) {}))
+
+	send := func(method, target, body, subject string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if subject != "" {
+			req = req.WithContext(access.WithPrincipal(req.Context(), &access.Principal{ID: subject, MultiFactor: true}))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// Deny by default.
+	require.Equal(t, 401, send("GET", "http://localhost:9090/rbac/roles", "", "").Code)
+	require.Equal(t, 403, send("GET", "http://localhost:9090/rbac/roles", "", "test:nobody").Code)
+	require.Equal(t, 403, send("GET", "http://localhost:9090/reports/1", "", "test:nobody").Code)
+
+	// The admin role requires a second factor.
+	req := httptest.NewRequest("GET", "http://localhost:9090/rbac/roles", nil)
+	req = req.WithContext(access.WithPrincipal(req.Context(), &access.Principal{ID: "test:root"}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 403, w.Code)
+
+	w = send("PUT", "http://localhost:9090/rbac/roles/auditor",
+		`{"description": "Reads reports", "permissions": [{"action": "users:read", "resource": "reports/*"}]}`, "test:root")
+	require.Equal(t, 200, w.Code)
+
+	require.Equal(t, 422, send("PUT", "http://localhost:9090/rbac/roles/auditor",
+		`{"permissions": [{"action": "reports:burn", "resource": "*"}]}`, "test:root").Code)
+
+	w = send("GET", "http://localhost:9090/rbac/roles", "", "test:root")
+	require.Equal(t, 200, w.Code)
+	roles := []*rbac.Role{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &roles))
+	names := map[string]*rbac.Role{}
+	for _, role := range roles {
+		names[role.Name] = role
+	}
+	require.Contains(t, names, "admin")
+	require.True(t, names["admin"].RequireMultiFactor)
+	require.Equal(t, []rbac.Permission{{Action: "users:read", Resource: "reports/*"}}, names["auditor"].Permissions)
+
+	require.Equal(t, 204, send("PUT", "http://localhost:9090/rbac/subjects/test:alice/roles/auditor", "", "test:root").Code)
+	require.Equal(t, 404, send("PUT", "http://localhost:9090/rbac/subjects/test:alice/roles/nope", "", "test:root").Code)
+	require.Equal(t, `["auditor"]`, strings.TrimSpace(send("GET", "http://localhost:9090/rbac/subjects/test:alice/roles", "", "test:root").Body.String()))
+
+	require.Equal(t, 200, send("GET", "http://localhost:9090/reports/1", "", "test:alice").Code)
+	require.Equal(t, 403, send("GET", "http://localhost:9090/rbac/roles", "", "test:alice").Code)
+
+	// Only roles requiring a second factor rank above others.
+	outranks, err := service.Outranks(ctx, "test:root", "test:alice")
+	require.Nil(t, err)
+	require.True(t, outranks)
+	outranks, err = service.Outranks(ctx, "test:alice", "test:root")
+	require.Nil(t, err)
+	require.False(t, outranks)
+
+	// Scopes of the credentials presented grant their actions without any role.
+	req = httptest.NewRequest("GET", "http://localhost:9090/reports/1", nil)
+	req = req.WithContext(access.WithPrincipal(req.Context(), &access.Principal{ID: "key:1", Scopes: []string{access.UsersRead}}))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	// An admin scope grants nothing without a role, and never skips the second factor the admin role requires.
+	for _, target := range []string{"http://localhost:9090/reports/1", "http://localhost:9090/rbac/roles"} {
+		req = httptest.NewRequest("GET", target, nil)
+		req = req.WithContext(access.WithPrincipal(req.Context(), &access.Principal{ID: "test:root", Scopes: []string{access.Admin}}))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 403, w.Code)
+	}
+
+	require.Equal(t, 204, send("DELETE", "http://localhost:9090/rbac/subjects/test:alice/roles/auditor", "", "test:root").Code)
+	require.Equal(t, 403, send("GET", "http://localhost:9090/reports/1", "", "test:alice").Code)
+
+	require.Equal(t, 204, send("DELETE", "http://localhost:9090/rbac/roles/auditor", "", "test:root").Code)
+	require.Equal(t, 404, send("DELETE", "http://localhost:9090/rbac/roles/auditor", "", "test:root").Code)
+}
@@ -0,0 +1,128 @@
+package rbac
+
+const (
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS roles (
+		name TEXT PRIMARY KEY,
+		description TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+		action TEXT NOT NULL,
+		resource TEXT NOT NULL,
+		PRIMARY KEY (role, action, resource)
+	);
+	CREATE TABLE IF NOT EXISTS role_assignments (
+		subject TEXT NOT NULL,
+		role TEXT NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (subject, role)
+	);
+	ALTER TABLE roles ADD COLUMN IF NOT EXISTS require_multi_factor BOOLEAN NOT NULL DEFAULT false;
+	`
+
+	// Create the default roles the first time the tables are created, so roles an administrator deleted stay deleted.
+	SeedStmt = `
+	WITH seeded AS (
+		INSERT INTO roles (name, description, require_multi_factor)
+		SELECT name, description, require_multi_factor FROM (VALUES
+			('admin', 'Every action on every resource', true),
+			('editor', 'Read and change every user', false),
+			('reader', 'Read every user', false),
+			('member', 'Read and change their own user', false)
+		) AS v (name, description, require_multi_factor)
+		WHERE NOT EXISTS (SELECT 1 FROM roles)
+		RETURNING name
+	)
+	INSERT INTO role_permissions (role, action, resource)
+	SELECT v.role, v.action, v.resource FROM (VALUES
+		('admin', '*', '*'),
+		('editor', 'users:read', 'users'),
+		('editor', 'users:read', 'users/*'),
+		('editor', 'users:write', 'users'),
+		('editor', 'users:write', 'users/*'),
+		('reader', 'users:read', 'users'),
+		('reader', 'users:read', 'users/*'),
+		('member', 'users:read', 'users/{user}'),
+		('member', 'users:write', 'users/{user}')
+	) AS v (role, action, resource)
+	JOIN seeded ON seeded.name = v.role;
+	`
+
+	// Every permission granted to a subject through its roles, leaving out roles requiring a second factor unless $2.
+	SelectSubjectPermissionsStmt = `
+	SELECT DISTINCT p.action, p.resource
+	FROM role_assignments a
+	JOIN roles r ON r.name = a.role
+	JOIN role_permissions p ON p.role = a.role
+	WHERE a.subject = $1 AND (NOT r.require_multi_factor OR $2);
+	`
+
+	SelectRolesStmt = `
+	SELECT name, description, require_multi_factor
+	FROM roles
+	ORDER BY name;
+	`
+
+	SelectPermissionsStmt = `
+	SELECT role, action, resource
+	FROM role_permissions
+	ORDER BY role, action, resource;
+	`
+
+	UpsertRoleStmt = `
+	INSERT INTO roles (name, description, require_multi_factor)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (name) DO UPDATE SET
+		description = EXCLUDED.description,
+		require_multi_factor = EXCLUDED.require_multi_factor;
+	`
+
+	DeleteRolePermissionsStmt = `
+	DELETE FROM role_permissions
+	WHERE role = $1;
+	`
+
+	InsertRolePermissionStmt = `
+	INSERT INTO role_permissions (role, action, resource)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING;
+	`
+
+	DeleteRoleStmt = `
+	DELETE FROM roles
+	WHERE name = $1;
+	`
+
+	SelectSubjectRolesStmt = `
+	SELECT role
+	FROM role_assignments
+	WHERE subject = $1
+	ORDER BY role;
+	`
+
+	// Whether the subject $1 holds a role requiring a second factor which the subject $2 doesn't hold.
+	OutranksStmt = `
+	SELECT EXISTS (
+		SELECT 1
+		FROM role_assignments a
+		JOIN roles r ON r.name = a.role
+		WHERE a.subject = $1 AND r.require_multi_factor AND NOT EXISTS (
+			SELECT 1 FROM role_assignments b WHERE b.subject = $2 AND b.role = a.role
+		)
+	);
+	`
+
+	AssignRoleStmt = `
+	INSERT INTO role_assignments (subject, role, created_by)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING;
+	`
+
+	UnassignRoleStmt = `
+	DELETE FROM role_assignments
+	WHERE subject = $1 AND role = $2;
+	`
+)
@@ -0,0 +1,261 @@
+package render
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+type (
+	// JSON encodes values with encoding/json.
+	JSON struct{}
+
+	// PrettyJSON encodes values with encoding/json indented by two spaces, chosen by "application/json; pretty=true".
+	PrettyJSON struct{}
+
+	// CSV encodes a struct, a slice of structs or a scalar as comma-separated values. Columns are named after the csv
+	// tag of each exported field, falling back to the json tag and then the field name. A tag of "-" skips the field.
+	CSV struct{}
+
+	// XML encodes values with encoding/xml inside a <response> root element.
+	XML struct{}
+)
+
+func (JSON) MediaType() string         { return "application/json" }
+func (JSON) Params() map[string]string { return nil }
+func (JSON) ContentType() string       { return "application/json" }
+
+func (JSON) Encode(w *bytes.Buffer, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+func (PrettyJSON) MediaType() string         { return "application/json" }
+func (PrettyJSON) Params() map[string]string { return map[string]string{"pretty": "true"} }
+func (PrettyJSON) ContentType() string       { return "application/json" }
+
+func (PrettyJSON) Encode(w *bytes.Buffer, v interface{}) error {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(body)
+	return err
+}
+
+func (CSV) MediaType() string         { return "text/csv" }
+func (CSV) Params() map[string]string { return nil }
+func (CSV) ContentType() string       { return "text/csv; charset=utf-8" }
+
+func (CSV) Encode(w *bytes.Buffer, v interface{}) error {
+	writer := csv.NewWriter(w)
+	value := indirect(reflect.ValueOf(v))
+
+	var rows []reflect.Value
+	switch {
+	case !value.IsValid():
+	case value.Kind() == reflect.Slice || value.Kind() == reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			rows = append(rows, indirect(value.Index(i)))
+		}
+	default:
+		rows = []reflect.Value{value}
+	}
+
+	// Slices of structs get a header row derived from the element type, even when empty.
+	var elem reflect.Type
+	if value.IsValid() {
+		elem = value.Type()
+		if value.Kind() == reflect.Slice || value.Kind() == reflect.Array {
+			elem = elem.Elem()
+		}
+		for elem.Kind() == reflect.Ptr {
+			elem = elem.Elem()
+		}
+	}
+
+	if elem != nil && elem.Kind() == reflect.Struct && !isScalarStruct(elem) {
+		fields := csvFields(elem)
+
+		header := make([]string, len(fields))
+		for i, field := range fields {
+			header[i] = field.name
+		}
+		if err := writer.Write(header); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			record := make([]string, len(fields))
+			if row.IsValid() {
+				for i, field := range fields {
+					record[i] = formatCell(row.FieldByIndex(field.index))
+				}
+			}
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, row := range rows {
+			if err := writer.Write([]string{formatCell(row)}); err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func (XML) MediaType() string         { return "application/xml" }
+func (XML) Params() map[string]string { return nil }
+func (XML) ContentType() string       { return "application/xml; charset=utf-8" }
+
+func (XML) Encode(w *bytes.Buffer, v interface{}) error {
+	w.WriteString(xml.Header)
+	encoder := xml.NewEncoder(w)
+	root := xml.StartElement{Name: xml.Name{Local: "response"}}
+
+	value := indirect(reflect.ValueOf(v))
+	if !value.IsValid() || (value.Kind() != reflect.Slice && value.Kind() != reflect.Array) || value.Type().Elem().Kind() == reflect.Uint8 {
+		if err := encoder.EncodeElement(v, root); err != nil {
+			return err
+		}
+		return encoder.Flush()
+	}
+
+	// encoding/xml writes slices as sibling elements without a common parent, which is not a document.
+	if err := encoder.EncodeToken(root); err != nil {
+		return err
+	}
+	for i := 0; i < value.Len(); i++ {
+		if err := encoder.Encode(value.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	if err := encoder.EncodeToken(root.End()); err != nil {
+		return err
+	}
+
+	return encoder.Flush()
+}
+
+type csvField struct {
+	name  string
+	index []int
+}
+
+// csvFields lists the columns of a struct type, flattening untagged embedded structs as encoding/json does.
+func csvFields(t reflect.Type) []csvField {
+	fields := []csvField{}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		if isFlattened(field) {
+			for _, embedded := range csvFields(field.Type) {
+				embedded.index = append([]int{i}, embedded.index...)
+				fields = append(fields, embedded)
+			}
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := tagName(field, "csv")
+		if name == "-" {
+			continue
+		}
+
+		fields = append(fields, csvField{name: name, index: field.Index})
+	}
+
+	return fields
+}
+
+// isFlattened reports whether the fields of an embedded struct are promoted into the fields of its parent.
+func isFlattened(field reflect.StructField) bool {
+	return field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == ""
+}
+
+// tagName returns the name given to field by the tag key, then its json tag, then the field name itself.
+func tagName(field reflect.StructField, key string) string {
+	for _, k := range []string{key, "json"} {
+		if tag, ok := field.Tag.Lookup(k); ok {
+			if name := strings.Split(tag, ",")[0]; name != "" {
+				return name
+			}
+		}
+	}
+
+	return field.Name
+}
+
+// isScalarStruct reports whether structs of type t render as a single value, like time.Time.
+func isScalarStruct(t reflect.Type) bool {
+	return t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType)
+}
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+func formatCell(v reflect.Value) string {
+	v = indirect(v)
+	if !v.IsValid() {
+		return ""
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case []byte:
+		return string(value)
+	case encoding.TextMarshaler:
+		text, err := value.MarshalText()
+		if err != nil {
+			return ""
+		}
+		return string(text)
+	case json.Marshaler:
+		text, err := value.MarshalJSON()
+		if err != nil {
+			return ""
+		}
+		return string(text)
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String {
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = v.Index(i).String()
+		}
+		return strings.Join(items, ";")
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// indirect follows pointers and interfaces until it reaches a concrete value, or the zero Value for nil.
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
@@ -0,0 +1,305 @@
+package render
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MessagePack encodes values in the MessagePack format (https://msgpack.org). Struct fields are named after their
+// msgpack tag, falling back to the json tag, and honor omitempty. Times are encoded as RFC 3339 strings and values
+// implementing json.Marshaler, such as raw JSON columns, are encoded as the value their JSON describes.
+type MessagePack struct{}
+
+func (MessagePack) MediaType() string         { return "application/msgpack" }
+func (MessagePack) Params() map[string]string { return nil }
+func (MessagePack) ContentType() string       { return "application/msgpack" }
+
+func (MessagePack) Encode(w *bytes.Buffer, v interface{}) error {
+	return encodeMsgpack(w, reflect.ValueOf(v))
+}
+
+var jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+func encodeMsgpack(w *bytes.Buffer, v reflect.Value) error {
+	v = indirect(v)
+	if !v.IsValid() {
+		w.WriteByte(0xc0)
+		return nil
+	}
+
+	switch value := v.Interface().(type) {
+	case time.Time:
+		writeMsgpackString(w, value.Format(time.RFC3339Nano))
+		return nil
+	case []byte:
+		writeMsgpackBinary(w, value)
+		return nil
+	}
+
+	if v.Type().Implements(jsonMarshalerType) {
+		return encodeMsgpackJSON(w, v.Interface().(json.Marshaler))
+	}
+
+	if v.Kind() != reflect.String && v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		writeMsgpackString(w, string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(w, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		writeMsgpackUint(w, v.Uint())
+	case reflect.Float32:
+		w.WriteByte(0xca)
+		binary.Write(w, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		w.WriteByte(0xcb)
+		binary.Write(w, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		writeMsgpackString(w, v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeMsgpackBinary(w, v.Bytes())
+			return nil
+		}
+		writeMsgpackHeader(w, v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeMsgpack(w, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		// Sort keys so identical maps always encode to identical bytes.
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface()) })
+		writeMsgpackHeader(w, len(keys), 0x80, 0xde, 0xdf)
+		for _, key := range keys {
+			if err := encodeMsgpack(w, key); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(w, v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		return encodeMsgpackStruct(w, v)
+	default:
+		return fmt.Errorf("render: cannot encode %s as msgpack", v.Type())
+	}
+
+	return nil
+}
+
+type msgpackEntry struct {
+	name  string
+	value reflect.Value
+}
+
+func encodeMsgpackStruct(w *bytes.Buffer, v reflect.Value) error {
+	entries := msgpackEntries(v)
+
+	writeMsgpackHeader(w, len(entries), 0x80, 0xde, 0xdf)
+	for _, e := range entries {
+		writeMsgpackString(w, e.name)
+		if err := encodeMsgpack(w, e.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// msgpackEntries lists the encoded fields of a struct, flattening untagged embedded structs as encoding/json does.
+func msgpackEntries(v reflect.Value) []msgpackEntry {
+	entries := []msgpackEntry{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+
+		if isFlattened(field) {
+			entries = append(entries, msgpackEntries(v.Field(i))...)
+			continue
+		}
+
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := tagName(field, "msgpack")
+		if name == "-" {
+			continue
+		}
+
+		tag := field.Tag.Get("msgpack")
+		if tag == "" {
+			tag = field.Tag.Get("json")
+		}
+		if strings.Contains(tag, ",omitempty") && isEmptyValue(v.Field(i)) {
+			continue
+		}
+
+		entries = append(entries, msgpackEntry{name: name, value: v.Field(i)})
+	}
+
+	return entries
+}
+
+// encodeMsgpackJSON encodes the value described by a JSON document, so raw JSON fields keep their structure.
+func encodeMsgpackJSON(w *bytes.Buffer, m json.Marshaler) error {
+	raw, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&decoded); err != nil {
+		return err
+	}
+
+	return encodeMsgpack(w, reflect.ValueOf(normalizeJSONNumbers(decoded)))
+}
+
+// normalizeJSONNumbers replaces json.Number with int64 or float64 so integers stay integers.
+func normalizeJSONNumbers(v interface{}) interface{} {
+	switch value := v.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		for i := range value {
+			value[i] = normalizeJSONNumbers(value[i])
+		}
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = normalizeJSONNumbers(value[k])
+		}
+	}
+	return v
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func writeMsgpackInt(w *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(w, uint64(i))
+	case i >= -32:
+		w.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		w.WriteByte(0xd0)
+		w.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		w.WriteByte(0xd1)
+		binary.Write(w, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		w.WriteByte(0xd2)
+		binary.Write(w, binary.BigEndian, int32(i))
+	default:
+		w.WriteByte(0xd3)
+		binary.Write(w, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackUint(w *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		w.WriteByte(0xcc)
+		w.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		binary.Write(w, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		w.WriteByte(0xce)
+		binary.Write(w, binary.BigEndian, uint32(u))
+	default:
+		w.WriteByte(0xcf)
+		binary.Write(w, binary.BigEndian, u)
+	}
+}
+
+func writeMsgpackString(w *bytes.Buffer, s string) {
+	switch n := len(s); {
+	case n <= 31:
+		w.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		w.WriteByte(0xd9)
+		w.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(0xda)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(0xdb)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+	w.WriteString(s)
+}
+
+func writeMsgpackBinary(w *bytes.Buffer, b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		w.WriteByte(0xc4)
+		w.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(0xc5)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(0xc6)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+	w.Write(b)
+}
+
+// writeMsgpackHeader writes the length prefix of an array or map, fix is the fixarray/fixmap marker.
+func writeMsgpackHeader(w *bytes.Buffer, n int, fix, marker16, marker32 byte) {
+	switch {
+	case n <= 15:
+		w.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(marker16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(marker32)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
@@ -0,0 +1,249 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrNotAcceptable is returned by Render after it has answered the request with 406 Not Acceptable.
+var ErrNotAcceptable = errors.New("render: no acceptable encoder")
+
+type (
+	// Encoder serializes a value in a single wire format.
+	Encoder interface {
+		// MediaType is the type/subtype matched against the Accept header, e.g. application/json.
+		MediaType() string
+		// Params must all be present in an Accept clause for this encoder to be chosen, may be nil.
+		Params() map[string]string
+		// ContentType is written to the Content-Type header of the response.
+		ContentType() string
+		Encode(w *bytes.Buffer, v interface{}) error
+	}
+
+	// Renderer picks an Encoder from the Accept header of each request. Encoders registered first take precedence
+	// when a client accepts several of them equally, the first is also used when the client expresses no preference.
+	Renderer struct {
+		encoders []Encoder
+	}
+
+	// A single clause of an Accept header.
+	acceptClause struct {
+		mediaType string
+		params    map[string]string
+		q         float64
+	}
+)
+
+// New: instantiate a Renderer offering the given encoders in order of preference.
+func New(encoders ...Encoder) *Renderer {
+	return &Renderer{encoders: encoders}
+}
+
+// Default returns a Renderer offering JSON, pretty JSON, CSV, MessagePack and XML, preferring JSON. Pretty JSON is
+// requested with "Accept: application/json; pretty=true".
+func Default() *Renderer {
+	return New(JSON{}, PrettyJSON{}, CSV{}, MessagePack{}, XML{})
+}
+
+// Render encodes v with the encoder negotiated for req and writes it with a 200 status.
+func (rn *Renderer) Render(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	return rn.RenderStatus(w, req, http.StatusOK, v)
+}
+
+// RenderStatus encodes v with the encoder negotiated for req and writes it with the given status. If no encoder is
+// acceptable a 406 listing the supported types is written and ErrNotAcceptable returned. Encoding errors are returned
+// before anything is written so the caller is still free to send an error response.
+func (rn *Renderer) RenderStatus(w http.ResponseWriter, req *http.Request, status int, v interface{}) error {
+	encoder, ok := rn.Negotiate(req)
+	if !ok {
+		http.Error(w, "supported types: "+strings.Join(rn.MediaTypes(), ", "), http.StatusNotAcceptable)
+		return ErrNotAcceptable
+	}
+
+	buf := &bytes.Buffer{}
+	if err := encoder.Encode(buf, v); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", encoder.ContentType())
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Negotiate returns the encoder best matching the Accept header of req.
+func (rn *Renderer) Negotiate(req *http.Request) (Encoder, bool) {
+	if len(rn.encoders) == 0 {
+		return nil, false
+	}
+
+	clauses, excluded := parseAccept(req.Header.Get("Accept"))
+	if len(clauses) == 0 && len(excluded) == 0 {
+		return rn.encoders[0], true
+	}
+
+	for _, clause := range clauses {
+		// Among matching encoders prefer the one requiring the most parameters, so "application/json; pretty=true"
+		// selects pretty JSON over plain JSON.
+		var best Encoder
+		for _, encoder := range rn.encoders {
+			if !clause.matches(encoder.MediaType(), encoder.Params()) ||
+				excludes(excluded, clause, encoder.MediaType(), encoder.Params()) {
+				continue
+			}
+
+			if best == nil || len(encoder.Params()) > len(best.Params()) {
+				best = encoder
+			}
+		}
+
+		if best != nil {
+			return best, true
+		}
+	}
+
+	return nil, false
+}
+
+// MediaTypes lists the distinct media types offered by this renderer.
+func (rn *Renderer) MediaTypes() []string {
+	seen := map[string]bool{}
+	types := []string{}
+
+	for _, encoder := range rn.encoders {
+		if !seen[encoder.MediaType()] {
+			seen[encoder.MediaType()] = true
+			types = append(types, encoder.MediaType())
+		}
+	}
+
+	return types
+}
+
+// Negotiate returns whichever of offers best matches the Accept header of req, the first offer when the header is
+// absent. Useful for handlers which stream their own formats rather than encoding a single value.
+func Negotiate(req *http.Request, offers ...string) (string, bool) {
+	if len(offers) == 0 {
+		return "", false
+	}
+
+	clauses, excluded := parseAccept(req.Header.Get("Accept"))
+	if len(clauses) == 0 && len(excluded) == 0 {
+		return offers[0], true
+	}
+
+	for _, clause := range clauses {
+		for _, offer := range offers {
+			if clause.matches(offer, nil) && !excludes(excluded, clause, offer, nil) {
+				return offer, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// parseAccept splits an Accept header into clauses ordered by descending quality, dropping malformed clauses. Clauses of
+// equal quality keep header order, with more specific media types first. Clauses with q=0 are returned apart: they
+// exclude the types they match rather than accept them.
+func parseAccept(header string) ([]acceptClause, []acceptClause) {
+	clauses, excluded := []acceptClause{}, []acceptClause{}
+
+	for _, part := range strings.Split(header, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if raw, ok := params["q"]; ok {
+			delete(params, "q")
+			if q, err = strconv.ParseFloat(raw, 64); err != nil {
+				continue
+			}
+		}
+
+		if q <= 0 {
+			excluded = append(excluded, acceptClause{mediaType: mediaType, params: params})
+			continue
+		}
+
+		clauses = append(clauses, acceptClause{mediaType: mediaType, params: params, q: q})
+	}
+
+	sort.SliceStable(clauses, func(i, j int) bool {
+		if clauses[i].q != clauses[j].q {
+			return clauses[i].q > clauses[j].q
+		}
+		return specificity(clauses[i].mediaType) > specificity(clauses[j].mediaType)
+	})
+
+	return clauses, excluded
+}
+
+// excludes reports whether a q=0 clause rules out mediaType with params for the accepting clause. Only exclusions at
+// least as specific as the accepting clause apply, so "text/*;q=0, text/csv" still accepts CSV while
+// "application/json;q=0, */*" accepts anything but JSON.
+func excludes(excluded []acceptClause, clause acceptClause, mediaType string, params map[string]string) bool {
+	for _, exclusion := range excluded {
+		if specificity(exclusion.mediaType) < specificity(clause.mediaType) || !exclusion.matchesType(mediaType) {
+			continue
+		}
+
+		covered := true
+		for key, value := range exclusion.params {
+			if params[key] != value {
+				covered = false
+			}
+		}
+		if covered {
+			return true
+		}
+	}
+	return false
+}
+
+func specificity(mediaType string) int {
+	switch {
+	case mediaType == "*/*":
+		return 0
+	case strings.HasSuffix(mediaType, "/*"):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// matches reports whether the clause accepts mediaType and carries every one of params.
+func (c acceptClause) matches(mediaType string, params map[string]string) bool {
+	for key, value := range params {
+		if c.params[key] != value {
+			return false
+		}
+	}
+
+	return c.matchesType(mediaType)
+}
+
+// matchesType reports whether the media range of the clause includes mediaType.
+func (c acceptClause) matchesType(mediaType string) bool {
+	switch {
+	case c.mediaType == "*/*":
+		return true
+	case strings.HasSuffix(c.mediaType, "/*"):
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(c.mediaType, "*"))
+	default:
+		return c.mediaType == mediaType
+	}
+}
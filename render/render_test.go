@@ -0,0 +1,155 @@
+package render_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/stretchr/testify/require"
+)
+
+type row struct {
+	ID        int64     `json:"ID"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"createdAt"`
+	secret    string
+}
+
+var rows = []*row{
+	{ID: 1, Username: "fred", CreatedAt: time.Date(2017, 7, 9, 12, 0, 0, 0, time.UTC)},
+	{ID: 2, Username: "wilma", CreatedAt: time.Date(2017, 7, 10, 12, 0, 0, 0, time.UTC)},
+}
+
+// Render rows with the given Accept header and return the status, content type and body.
+func renderWithAccept(accept string, v interface{}) (int, string, string) {
+	req := httptest.NewRequest("GET", "http://localhost:9090/", nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	render.Default().Render(w, req, v)
+	return w.Code, w.Header().Get("Content-Type"), w.Body.String()
+}
+
+func TestRenderer_Negotiate(t *testing.T) {
+	cases := []struct {
+		accept      string
+		contentType string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/json", "application/json"},
+		{"text/csv", "text/csv; charset=utf-8"},
+		{"text/*", "text/csv; charset=utf-8"},
+		{"application/msgpack", "application/msgpack"},
+		{"application/xml", "application/xml; charset=utf-8"},
+		{"application/json;q=0.5, application/xml", "application/xml; charset=utf-8"},
+		{"image/png, */*;q=0.1", "application/json"},
+		{"application/json;q=0, */*", "text/csv; charset=utf-8"},
+		{"application/json;pretty=true;q=0, */*", "application/json"},
+		{"text/*;q=0, text/csv", "text/csv; charset=utf-8"},
+	}
+
+	for _, c := range cases {
+		code, contentType, _ := renderWithAccept(c.accept, rows)
+		require.Equal(t, 200, code, c.accept)
+		require.Equal(t, c.contentType, contentType, c.accept)
+	}
+}
+
+func TestRenderer_NotAcceptable(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:9090/", nil)
+	req.Header.Set("Accept", "image/png, application/json;q=0")
+	w := httptest.NewRecorder()
+
+	err := render.Default().Render(w, req, rows)
+	require.Equal(t, render.ErrNotAcceptable, err)
+	require.Equal(t, 406, w.Code)
+
+	code, _, _ := renderWithAccept("*/*;q=0", rows)
+	require.Equal(t, 406, code)
+}
+
+func TestRenderer_PrettyJSON(t *testing.T) {
+	_, _, compact := renderWithAccept("application/json", rows)
+	_, _, pretty := renderWithAccept("application/json; pretty=true", rows)
+
+	require.NotContains(t, compact, "\n")
+	require.Contains(t, pretty, "\n  {")
+}
+
+func TestCSV_Encode(t *testing.T) {
+	_, _, body := renderWithAccept("text/csv", rows)
+
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	require.Equal(t, []string{
+		"ID,username,createdAt",
+		"1,fred,2017-07-09T12:00:00Z",
+		"2,wilma,2017-07-10T12:00:00Z",
+	}, lines)
+
+	_, _, body = renderWithAccept("text/csv", "PONG")
+	require.Equal(t, "PONG\n", body)
+
+	// Embedded structs are flattened as they are by encoding/json.
+	scored := []struct {
+		row
+		Score float64 `json:"score"`
+	}{{row: *rows[0], Score: 0.5}}
+
+	_, _, body = renderWithAccept("text/csv", scored)
+	require.Equal(t, "ID,username,createdAt,score\n1,fred,2017-07-09T12:00:00Z,0.5\n", body)
+}
+
+func TestXML_Encode(t *testing.T) {
+	_, _, body := renderWithAccept("application/xml", rows)
+
+	decoded := struct {
+		Rows []row `xml:"row"`
+	}{}
+	require.Nil(t, xml.Unmarshal([]byte(body), &decoded))
+	require.Equal(t, 2, len(decoded.Rows))
+	require.Equal(t, "wilma", decoded.Rows[1].Username)
+}
+
+func TestMessagePack_Encode(t *testing.T) {
+	cases := []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{7, []byte{0x07}},
+		{-1, []byte{0xff}},
+		{300, []byte{0xcd, 0x01, 0x2c}},
+		{-200, []byte{0xd1, 0xff, 0x38}},
+		{"PONG", []byte{0xa4, 'P', 'O', 'N', 'G'}},
+		{[]int{1, 2}, []byte{0x92, 0x01, 0x02}},
+		{map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{struct {
+			ID   int64  `json:"id"`
+			Skip string `json:"skip,omitempty"`
+		}{ID: 1}, []byte{0x81, 0xa2, 'i', 'd', 0x01}},
+	}
+
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		require.Nil(t, render.MessagePack{}.Encode(buf, c.value))
+		require.Equal(t, c.expected, buf.Bytes(), "%#v", c.value)
+	}
+}
+
+func BenchmarkRenderer_Render(b *testing.B) {
+	renderer := render.Default()
+	req := httptest.NewRequest("GET", "http://localhost:9090/", nil)
+
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		renderer.Render(w, req, rows)
+	}
+}
@@ -0,0 +1,60 @@
+// Package reqctx carries request-scoped values, such as the request ID and the identity of the caller, through a
+// context.Context so every service can attribute its work without depending on how it was authenticated.
+package reqctx
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+type key int
+
+const (
+	actorKey key = iota
+	requestIDKey
+	tenantKey
+)
+
+// WithActor returns a copy of ctx identifying who is making the request, e.g. "user:42" or "key:ab12cd".
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey, actor)
+}
+
+// Actor returns the identity stored by WithActor, or "" for anonymous requests.
+func Actor(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey).(string)
+	return actor
+}
+
+// WithRequestID returns a copy of ctx carrying the ID of the request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the ID stored by WithRequestID, or "" outside of a request.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithTenant returns a copy of ctx carrying the slug of the organization the request is made in.
+func WithTenant(ctx context.Context, slug string) context.Context {
+	return context.WithValue(ctx, tenantKey, slug)
+}
+
+// Tenant returns the slug stored by WithTenant, or "" outside of a tenant.
+func Tenant(ctx context.Context) string {
+	slug, _ := ctx.Value(tenantKey).(string)
+	return slug
+}
+
+// NewRequestID returns a random 128 bit identifier, hex encoded.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms, see its documentation.
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
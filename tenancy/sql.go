@@ -0,0 +1,174 @@
+package tenancy
+
+const (
+	// The role requests of a tenant run as, which the isolation policies apply to. It can't log in: the application
+	// switches to it within its transactions, and owns the tables otherwise, bypassing the policies for work done on
+	// behalf of no tenant.
+	CreateRoleStmt = `
+	DO $$
+	BEGIN
+		CREATE ROLE ` + Role + ` NOLOGIN;
+	EXCEPTION WHEN duplicate_object THEN NULL;
+	END
+	$$;
+	GRANT ` + Role + ` TO CURRENT_USER;
+	`
+
+	CreateTableStmt = `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id BIGSERIAL PRIMARY KEY,
+		slug TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS memberships (
+		organization_id BIGINT NOT NULL REFERENCES organizations (id) ON DELETE CASCADE,
+		user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+		role TEXT NOT NULL,
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at timestamp with time zone NOT NULL DEFAULT now(),
+		PRIMARY KEY (organization_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS memberships_user_id_idx ON memberships (user_id);
+	`
+
+	// IsolateStmt confines the rows of the table named by %[1]s to the tenant set by ScopeStmt, for the tenant role.
+	// Rows are stamped with the tenant they were written in, and organizations can't be deleted while they hold rows
+	// unless Drop is forced to delete those first.
+	IsolateStmt = `
+	ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS tenant_id BIGINT
+		DEFAULT NULLIF(current_setting('app.tenant_id', true), '')::bigint REFERENCES organizations (id);
+	CREATE INDEX IF NOT EXISTS %[1]s_tenant_id_idx ON %[1]s (tenant_id);
+	ALTER TABLE %[1]s ENABLE ROW LEVEL SECURITY;
+	DO $$
+	BEGIN
+		IF NOT EXISTS (
+			SELECT 1 FROM pg_policies
+			WHERE schemaname = current_schema() AND tablename = '%[1]s' AND policyname = 'tenant_isolation'
+		) THEN
+			CREATE POLICY tenant_isolation ON %[1]s TO ` + Role + `
+				USING (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint)
+				WITH CHECK (tenant_id = NULLIF(current_setting('app.tenant_id', true), '')::bigint);
+		END IF;
+	END
+	$$;
+	`
+
+	// The tenant role reaches every table the application does, the policies alone tell its rows apart.
+	GrantStmt = `
+	GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA public TO ` + Role + `;
+	GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO ` + Role + `;
+	`
+
+	// Schema statements take the quoted name of the schema of a tenant in %[1]s. Migrations run under a lock per
+	// schema, so replicas starting together don't race, and find extensions such as pg_trgm in public.
+	CreateSchemaStmt = `
+	SELECT pg_advisory_xact_lock(hashtext('tenancy:%[1]s'));
+	CREATE SCHEMA IF NOT EXISTS %[1]s;
+	SET LOCAL search_path TO %[1]s, public;
+	`
+
+	// StampStmt sets the tenant rows written by the rest of a transaction are stamped with to the ID in %d, without
+	// switching to the tenant role.
+	StampStmt = `
+	SET LOCAL app.tenant_id = '%d';
+	`
+
+	// DeleteTenantRowsStmt deletes the rows of the tenant with the ID in $1 from the isolated table named by %[1]s.
+	DeleteTenantRowsStmt = `
+	DELETE FROM %[1]s
+	WHERE tenant_id = $1;
+	`
+
+	DropSchemaStmt = `
+	DROP SCHEMA IF EXISTS %[1]s CASCADE;
+	`
+
+	SchemaHoldsUsersStmt = `
+	SELECT EXISTS (SELECT 1 FROM %[1]s.users);
+	`
+
+	// SearchPathStmt points the rest of a transaction at the schema of a tenant, public only providing extensions.
+	SearchPathStmt = `
+	SET LOCAL search_path TO %[1]s, public;
+	`
+
+	// ScopeStmt confines the rest of a transaction to the tenant with the ID in %s, or to no tenant at all if it is
+	// empty. SET LOCAL can't take parameters, so the ID is formatted in.
+	ScopeStmt = `
+	SET LOCAL ROLE ` + Role + `;
+	SET LOCAL app.tenant_id = '%s';
+	`
+
+	organizationColumns = `id, slug, name, created_by, created_at`
+
+	InsertOrganizationStmt = `
+	INSERT INTO organizations (slug, name, created_by)
+	VALUES ($1, $2, $3)
+	RETURNING ` + organizationColumns + `;
+	`
+
+	SelectOrganizationStmt = `
+	SELECT ` + organizationColumns + `
+	FROM organizations
+	WHERE slug = $1;
+	`
+
+	SelectManyOrganizationsStmt = `
+	SELECT ` + organizationColumns + `
+	FROM organizations
+	ORDER BY slug;
+	`
+
+	DeleteOrganizationStmt = `
+	DELETE FROM organizations
+	WHERE slug = $1
+	RETURNING ` + organizationColumns + `;
+	`
+
+	SelectMembershipStmt = `
+	SELECT role
+	FROM memberships
+	WHERE organization_id = $1 AND user_id = $2;
+	`
+
+	SelectMemberRoleStmt = `
+	SELECT m.role
+	FROM memberships m
+	JOIN organizations o ON o.id = m.organization_id
+	WHERE o.slug = $1 AND m.user_id = $2;
+	`
+
+	SelectMembersStmt = `
+	SELECT m.user_id, o.slug AS organization, m.role, m.created_by, m.created_at
+	FROM memberships m
+	JOIN organizations o ON o.id = m.organization_id
+	WHERE o.slug = $1
+	ORDER BY m.created_at, m.user_id;
+	`
+
+	UpsertMembershipStmt = `
+	INSERT INTO memberships (organization_id, user_id, role, created_by)
+	SELECT id, $2, $3, $4
+	FROM organizations
+	WHERE slug = $1
+	ON CONFLICT (organization_id, user_id) DO UPDATE SET
+		role = EXCLUDED.role
+	RETURNING user_id, $1::text AS organization, role, created_by, created_at;
+	`
+
+	DeleteMembershipStmt = `
+	DELETE FROM memberships m
+	USING organizations o
+	WHERE o.id = m.organization_id AND o.slug = $1 AND m.user_id = $2;
+	`
+
+	SelectUserMembershipsStmt = `
+	SELECT m.user_id, o.slug AS organization, m.role, m.created_by, m.created_at
+	FROM memberships m
+	JOIN organizations o ON o.id = m.organization_id
+	WHERE m.user_id = $1
+	ORDER BY o.slug;
+	`
+)
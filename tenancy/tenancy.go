@@ -0,0 +1,884 @@
+// Package tenancy hosts several organizations on one deployment. Every request is made in at most one organization, its
+// tenant, named by the subdomain it was sent to, a header, or the tenant its access token was issued in, and users may
+// only act in the organizations they are members of. Isolation is enforced by Postgres itself: tables holding the data
+// of tenants carry row-level security policies, and the transactions of a request switch to a role those policies
+// apply to with the tenant set by SET LOCAL app.tenant_id, so a query can't see or write the rows of another tenant
+// whatever it says.
+//
+// In schema mode each organization gets a schema of its own instead, holding its copy of the tables of tenants. They
+// are created and migrated when the organization is provisioned, migrated again whenever the service starts, and the
+// transactions of a request set their search_path to the schema of its tenant.
+package tenancy
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/render"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Role is the database role the transactions of a request switch to, which the isolation policies apply to.
+const Role = "twelvefactor_tenant"
+
+// Modes separating the data of organizations.
+const (
+	// ModeRow keeps every organization in the same tables, telling their rows apart with row-level security.
+	ModeRow = "row"
+	// ModeSchema gives every organization a schema of its own.
+	ModeSchema = "schema"
+)
+
+// Roles of members within their organization. Members read their organization and its members, admins manage its
+// members as well, and only owners make or unmake owners.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+)
+
+// Largest request body accepted by the write endpoints.
+const maxBodyBytes = 1 << 16
+
+// Slugs are DNS labels, so every organization can have a subdomain, short enough for the name of their schema to fit
+// the 63 bytes Postgres truncates identifiers to.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,54}[a-z0-9])?$`)
+
+var (
+	// ErrHoldsData is returned by Drop for organizations which still hold users.
+	ErrHoldsData = errors.New("the organization still holds data")
+	// ErrOwnersOnly is returned when a member who isn't an owner grants or revokes the owner role.
+	ErrOwnersOnly = errors.New("only owners may grant or revoke the owner role")
+)
+
+type (
+	// Config for the tenancy service.
+	Config struct {
+		Ctx    context.Context
+		Logger *log.Logger
+		DB     *sqlx.DB
+		// The path prefix to expose the subrouter provided by this service, defaults to /organizations.
+		PathPrefix string
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// Authorizes requests against the action and resource each route declares, nil lets every request through.
+		Enforcer access.Enforcer
+		// The domain organizations have subdomains of, such that requests to acme.example.com are made in the acme
+		// organization when it is example.com. Unset to only resolve tenants from headers and tokens.
+		Domain string
+		// The header naming the organization of a request, defaults to X-Tenant.
+		Header string
+		// How the data of organizations is separated, ModeRow or ModeSchema. Defaults to ModeRow.
+		Mode string
+		// Creates and migrates the tables of a tenant in schema mode, such as users.Migrate. Run with the search_path
+		// set to the schema of the tenant.
+		Migrate func(ctx context.Context, db sqlx.ExecerContext) error
+	}
+
+	// Service: organizations, their members, and the isolation of their data.
+	Service struct {
+		ctx        context.Context
+		logger     *log.Logger
+		db         *sqlx.DB
+		pathPrefix string
+		renderer   *render.Renderer
+		enforcer   access.Enforcer
+		domain     string
+		header     string
+		mode       string
+		migrate    func(ctx context.Context, db sqlx.ExecerContext) error
+		isolated   []string
+	}
+
+	// Organization is a tenant of the deployment.
+	Organization struct {
+		ID        int64     `json:"id" db:"id"`
+		Slug      string    `json:"slug" db:"slug"`
+		Name      string    `json:"name" db:"name"`
+		CreatedBy string    `json:"createdBy" db:"created_by"`
+		CreatedAt time.Time `json:"createdAt" db:"created_at"`
+	}
+
+	// OrganizationInput is the body accepted by the endpoint creating an organization.
+	OrganizationInput struct {
+		Slug string `json:"slug"`
+		Name string `json:"name"`
+	}
+
+	// Membership lets a user act in an organization.
+	Membership struct {
+		UserID       int64     `json:"userId" db:"user_id"`
+		Organization string    `json:"organization" db:"organization"`
+		Role         string    `json:"role" db:"role"`
+		CreatedBy    string    `json:"createdBy" db:"created_by"`
+		CreatedAt    time.Time `json:"createdAt" db:"created_at"`
+	}
+
+	// MembershipInput is the body accepted by the endpoint adding a member.
+	MembershipInput struct {
+		Role string `json:"role"`
+	}
+
+	// ValidationError maps the fields of an input to what is wrong with them.
+	ValidationError map[string]string
+
+	// scope records that a request was resolved, and in which organization if any.
+	scope struct {
+		organization *Organization
+	}
+
+	// sharedStore is a store of personal data kept in the shared tables.
+	sharedStore struct {
+		users.PersonalData
+	}
+)
+
+type key int
+
+const (
+	scopeKey key = iota
+	roleKey
+)
+
+// Error implements error.
+func (e ValidationError) Error() string {
+	fields := make([]string, 0, len(e))
+	for field, problem := range e {
+		fields = append(fields, field+": "+problem)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, ", ")
+}
+
+// New: Instantiate a new tenancy service. Fail hard if its tables can't be created, which requires the users table, or
+// the schemas of tenants migrated in schema mode. Row mode creates the tenant role and requires a database user allowed
+// to create roles.
+func New(config *Config) *Service {
+	mode := config.Mode
+	if mode == "" {
+		mode = ModeRow
+	}
+	if mode != ModeRow && mode != ModeSchema {
+		config.Logger.Fatalf("unknown tenancy mode %q", mode)
+	}
+	if mode == ModeSchema && config.Migrate == nil {
+		config.Logger.Fatal("schema mode requires migrations for the schemas of tenants")
+	}
+
+	stmts := []string{CreateTableStmt}
+	if mode == ModeRow {
+		stmts = []string{CreateRoleStmt, CreateTableStmt}
+	}
+	for _, stmt := range stmts {
+		if _, err := config.DB.ExecContext(context.Background(), stmt); err != nil {
+			config.Logger.Fatal(err)
+		}
+	}
+
+	pathPrefix := config.PathPrefix
+	if pathPrefix == "" {
+		pathPrefix = "organizations"
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	header := config.Header
+	if header == "" {
+		header = "X-Tenant"
+	}
+
+	s := &Service{
+		ctx:        config.Ctx,
+		logger:     config.Logger,
+		db:         config.DB,
+		pathPrefix: pathPrefix,
+		renderer:   renderer,
+		enforcer:   config.Enforcer,
+		domain:     strings.ToLower(strings.Trim(config.Domain, ".")),
+		header:     header,
+		mode:       mode,
+		migrate:    config.Migrate,
+	}
+
+	if _, err := s.MigrateAll(context.Background()); err != nil {
+		config.Logger.Fatal(err)
+	}
+
+	return s
+}
+
+// Schema returns the name of the schema of the organization with slug in schema mode.
+func Schema(slug string) string {
+	return "tenant_" + strings.Replace(slug, "-", "_", -1)
+}
+
+// Provision creates an organization, along with its schema and tables in schema mode. createdBy names the actor
+// creating it. Invalid inputs are reported with a ValidationError.
+func (s *Service) Provision(ctx context.Context, input *OrganizationInput, createdBy string) (*Organization, error) {
+	if problems := input.validate(); len(problems) > 0 {
+		return nil, problems
+	}
+
+	org := &Organization{}
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, org, InsertOrganizationStmt, input.Slug, strings.TrimSpace(input.Name), createdBy)
+		if err != nil || s.mode != ModeSchema {
+			return err
+		}
+		return s.migrateSchema(ctx, tx, org.Slug)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return org, nil
+}
+
+// List returns every organization, by slug.
+func (s *Service) List(ctx context.Context) ([]*Organization, error) {
+	orgs := []*Organization{}
+	if err := s.db.SelectContext(ctx, &orgs, SelectManyOrganizationsStmt); err != nil {
+		return nil, err
+	}
+	return orgs, nil
+}
+
+// MigrateAll applies the migrations to the schema of every organization in schema mode, one transaction each, and
+// returns how many were migrated. It does nothing in row mode, where the tables are shared.
+func (s *Service) MigrateAll(ctx context.Context) (int, error) {
+	if s.mode != ModeSchema {
+		return 0, nil
+	}
+
+	orgs, err := s.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, org := range orgs {
+		if err := s.inTx(ctx, func(tx *sqlx.Tx) error { return s.migrateSchema(ctx, tx, org.Slug) }); err != nil {
+			return i, fmt.Errorf("migrating %s: %v", org.Slug, err)
+		}
+	}
+
+	return len(orgs), nil
+}
+
+// Drop deletes an organization along with its memberships, and its schema in schema mode. Unless force is set, it
+// fails with ErrHoldsData while the organization still holds users. When forced in row mode, its rows are deleted from
+// every table given to Isolate first. Returns sql.ErrNoRows if there is no such organization.
+func (s *Service) Drop(ctx context.Context, slug string, force bool) error {
+	return s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if force && s.mode == ModeRow {
+			if err := s.deleteRows(ctx, tx, slug); err != nil {
+				return err
+			}
+		}
+
+		org := &Organization{}
+		err := tx.GetContext(ctx, org, DeleteOrganizationStmt, slug)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			return ErrHoldsData
+		}
+		if err != nil || s.mode != ModeSchema {
+			return err
+		}
+
+		schema := pq.QuoteIdentifier(Schema(slug))
+		if !force {
+			var holdsUsers bool
+			if err := tx.GetContext(ctx, &holdsUsers, fmt.Sprintf(SchemaHoldsUsersStmt, schema)); err != nil {
+				return err
+			}
+			if holdsUsers {
+				return ErrHoldsData
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(DropSchemaStmt, schema))
+		return err
+	})
+}
+
+// deleteRows deletes the rows the organization with slug holds in the isolated tables, within tx, in the order they
+// were isolated. Rows written meanwhile, such as history recorded by triggers, are stamped with the organization too.
+func (s *Service) deleteRows(ctx context.Context, tx *sqlx.Tx, slug string) error {
+	org := &Organization{}
+	if err := tx.GetContext(ctx, org, SelectOrganizationStmt, slug); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(StampStmt, org.ID)); err != nil {
+		return err
+	}
+
+	for _, table := range s.isolated {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(DeleteTenantRowsStmt, table), org.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RunEach calls fn in the context of every organization, every interval, until the context of the service is done.
+// It runs jobs such as purging users, which only see the schema of one tenant at a time, in schema mode, and does
+// nothing in row mode, where they see every tenant at once. Zero or less disables it.
+func (s *Service) RunEach(interval time.Duration, name string, fn func(context.Context) (int64, error)) {
+	if s.mode != ModeSchema || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Each(s.ctx, func(ctx context.Context) error {
+				n, err := fn(ctx)
+				if n > 0 {
+					s.logger.Printf("%s: %d in %s", name, n, FromContext(ctx).Slug)
+				}
+				return err
+			}); err != nil {
+				s.logger.Println(err)
+			}
+		}
+	}
+}
+
+// Each calls fn with a copy of ctx made in every organization in turn, so the transactions it confines with Scope
+// see the data of that tenant. It stops at the first error.
+func (s *Service) Each(ctx context.Context, fn func(context.Context) error) error {
+	orgs, err := s.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, org := range orgs {
+		tenantCtx := reqctx.WithTenant(context.WithValue(ctx, scopeKey, &scope{organization: org}), org.Slug)
+		if err := fn(tenantCtx); err != nil {
+			return fmt.Errorf("%s: %v", org.Slug, err)
+		}
+	}
+
+	return nil
+}
+
+// Shared wraps a store of personal data kept in the shared tables. In schema mode the users of an organization are
+// rows of its own schema and own nothing there, so their privacy requests skip it rather than reach the data of the
+// deployment's user with the same ID.
+func (s *Service) Shared(store users.PersonalData) users.PersonalData {
+	if s.mode != ModeSchema {
+		return store
+	}
+	return &sharedStore{PersonalData: store}
+}
+
+// Export implements users.PersonalData.
+func (st *sharedStore) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	if FromContext(ctx) != nil {
+		return nil, nil
+	}
+	return st.PersonalData.Export(ctx, tx, userID)
+}
+
+// Erase implements users.PersonalData.
+func (st *sharedStore) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	if FromContext(ctx) != nil {
+		return nil
+	}
+	return st.PersonalData.Erase(ctx, tx, userID)
+}
+
+// migrateSchema creates the schema of the organization with slug if needed and applies the migrations to it, within tx.
+func (s *Service) migrateSchema(ctx context.Context, tx *sqlx.Tx, slug string) error {
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(CreateSchemaStmt, pq.QuoteIdentifier(Schema(slug)))); err != nil {
+		return err
+	}
+	return s.migrate(ctx, tx)
+}
+
+// inTx runs fn in a transaction, committing if it returns nil and rolling back otherwise.
+func (s *Service) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Isolate confines the rows of tables to the tenant of the request for the tenant role, adding the tenant_id column
+// stamping them and a row-level security policy, and lets the role reach every table. Call it once every table exists,
+// with the tables holding the data of tenants; rows written before carry no tenant and are only seen outside of one.
+// Table names are formatted into statements and must not come from input. Drop deletes the rows of an organization
+// from them in the same order, so list tables written by the triggers of others after them. It does nothing in schema
+// mode.
+func (s *Service) Isolate(ctx context.Context, tables ...string) error {
+	if s.mode != ModeRow {
+		return nil
+	}
+
+	for _, table := range tables {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(IsolateStmt, table)); err != nil {
+			return err
+		}
+		s.isolated = append(s.isolated, table)
+	}
+
+	_, err := s.db.ExecContext(ctx, GrantStmt)
+	return err
+}
+
+// Mount the subRouter of this service to the root router. Managing organizations and their members takes the admin
+// action, though members may read their organization and its admins and owners manage its members.
+func (s *Service) Mount(r *mux.Router) {
+	organizations, organization := access.Static("organizations"), access.Var("organizations", "organization")
+	anyone, managers := []string{RoleOwner, RoleAdmin, RoleMember}, []string{RoleOwner, RoleAdmin}
+
+	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
+	subRouter.Handle("", s.require(organizations, s.Create)).Methods("POST")
+	subRouter.Handle("", s.require(organizations, s.Get)).Methods("GET")
+	subRouter.Handle("/{organization}", s.admit(organization, s.GetOne, anyone...)).Methods("GET")
+	subRouter.Handle("/{organization}", s.require(organization, s.Delete)).Methods("DELETE")
+	subRouter.Handle("/{organization}/members", s.admit(organization, s.GetMembers, anyone...)).Methods("GET")
+	subRouter.Handle("/{organization}/members/{user:[0-9]+}",
+		s.admit(organization, s.PutMember, managers...)).Methods("PUT")
+	subRouter.Handle("/{organization}/members/{user:[0-9]+}",
+		s.admit(organization, s.DeleteMember, managers...)).Methods("DELETE")
+}
+
+// require guards a route acting on resource with the enforcer of the service.
+func (s *Service) require(resource access.Resource, handler http.HandlerFunc) http.Handler {
+	return access.Require(s.enforcer, access.Admin, resource, handler)
+}
+
+// admit guards a route acting on the organization in its path like require, also letting through the users who are
+// members of it with one of roles. Their role is stored in the context of the request for the handler to check.
+func (s *Service) admit(resource access.Resource, handler http.HandlerFunc, roles ...string) http.Handler {
+	guarded := s.require(resource, handler)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := access.FromContext(r.Context())
+		if p == nil || !strings.HasPrefix(p.ID, "user:") {
+			guarded.ServeHTTP(w, r)
+			return
+		}
+
+		role, err := s.memberRole(r.Context(), mux.Vars(r)["organization"], strings.TrimPrefix(p.ID, "user:"))
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				handler(w, r.WithContext(context.WithValue(r.Context(), roleKey, role)))
+				return
+			}
+		}
+
+		guarded.ServeHTTP(w, r)
+	})
+}
+
+// memberRole returns the role of the user with userID in the organization with slug, or "" if they aren't a member.
+func (s *Service) memberRole(ctx context.Context, slug, userID string) (string, error) {
+	var role string
+	err := s.db.GetContext(ctx, &role, SelectMemberRoleStmt, slug, userID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// checkOwnership returns ErrOwnersOnly if the request was let through for a member who isn't an owner, and either the
+// membership of userID or the role it gets is owner.
+func (s *Service) checkOwnership(r *http.Request, userID, role string) error {
+	if caller, _ := r.Context().Value(roleKey).(string); caller == "" || caller == RoleOwner {
+		return nil
+	}
+
+	if role == RoleOwner {
+		return ErrOwnersOnly
+	}
+
+	current, err := s.memberRole(r.Context(), mux.Vars(r)["organization"], userID)
+	if err != nil {
+		return err
+	}
+	if current == RoleOwner {
+		return ErrOwnersOnly
+	}
+
+	return nil
+}
+
+// Resolve returns next behind a middleware resolving the tenant of every request: the subdomain of the configured
+// domain it was sent to, else the organization named by the header, else the one its access token was issued in.
+// Requests naming an unknown organization are answered with 404 Not Found, and those made outside the tenant of their
+// token, or by a user who isn't a member, with 403 Forbidden. API keys belong to the deployment and may act in any
+// tenant. Requests naming none are made outside of every tenant, where isolated tables look empty. Wrap it with the
+// authentication middleware, so it knows who is making the request.
+func (s *Service) Resolve(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", s.header)
+
+		slug := s.subdomain(r.Host)
+		if slug == "" {
+			slug = r.Header.Get(s.header)
+		}
+
+		p := access.FromContext(r.Context())
+		if p != nil && p.Tenant != "" {
+			if slug == "" {
+				slug = p.Tenant
+			} else if slug != p.Tenant {
+				http.Error(w, "the credentials were issued in another organization", http.StatusForbidden)
+				return
+			}
+		}
+
+		if slug == "" {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), scopeKey, &scope{})))
+			return
+		}
+
+		org := &Organization{}
+		err := s.db.GetContext(r.Context(), org, SelectOrganizationStmt, slug)
+		if err == sql.ErrNoRows {
+			http.Error(w, "no such organization", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			s.writeError(w, err)
+			return
+		}
+
+		if p != nil && strings.HasPrefix(p.ID, "user:") {
+			var role string
+			err := s.db.GetContext(r.Context(), &role, SelectMembershipStmt, org.ID, strings.TrimPrefix(p.ID, "user:"))
+			if err == sql.ErrNoRows {
+				http.Error(w, "not a member of this organization", http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), scopeKey, &scope{organization: org})
+		ctx = reqctx.WithTenant(ctx, org.Slug)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// FromContext returns the organization a request resolved by Resolve is made in, or nil.
+func FromContext(ctx context.Context) *Organization {
+	if sc, ok := ctx.Value(scopeKey).(*scope); ok {
+		return sc.organization
+	}
+	return nil
+}
+
+// Scope confines the rest of tx to the tenant of the request ctx belongs to. In row mode it switches to the tenant
+// role, and requests made outside of every tenant are confined to no tenant, so they see none of the isolated rows. In
+// schema mode it sets the search_path to the schema of the tenant, and requests made outside of every tenant see the
+// tables of the deployment in public. Work done outside of a request, such as background jobs, is left as it is.
+func (s *Service) Scope(ctx context.Context, tx *sqlx.Tx) error {
+	sc, ok := ctx.Value(scopeKey).(*scope)
+	if !ok {
+		return nil
+	}
+
+	if s.mode == ModeSchema {
+		if sc.organization == nil {
+			return nil
+		}
+		_, err := tx.ExecContext(ctx, fmt.Sprintf(SearchPathStmt, pq.QuoteIdentifier(Schema(sc.organization.Slug))))
+		return err
+	}
+
+	tenantID := ""
+	if sc.organization != nil {
+		tenantID = strconv.FormatInt(sc.organization.ID, 10)
+	}
+
+	_, err := tx.ExecContext(ctx, fmt.Sprintf(ScopeStmt, tenantID))
+	return err
+}
+
+// subdomain returns the label host has below the configured domain, or "".
+func (s *Service) subdomain(host string) string {
+	if s.domain == "" {
+		return ""
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	label := strings.TrimSuffix(strings.ToLower(host), "."+s.domain)
+	if label == host || strings.Contains(label, ".") {
+		return ""
+	}
+	return label
+}
+
+// Create endpoint provisions an organization, responding with 201 Created and the organization.
+func (s *Service) Create(w http.ResponseWriter, r *http.Request) {
+	input := &OrganizationInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	org, err := s.Provision(r.Context(), input, reqctx.Actor(r.Context()))
+	if problems, ok := err.(ValidationError); ok {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		http.Error(w, "slug is already taken", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", filepath.Join("/", s.pathPrefix, org.Slug))
+	s.render(w, r, http.StatusCreated, org)
+}
+
+// Get endpoint returns every organization, by slug.
+func (s *Service) Get(w http.ResponseWriter, r *http.Request) {
+	orgs, err := s.List(r.Context())
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, orgs)
+}
+
+// GetOne endpoint returns an organization by slug.
+func (s *Service) GetOne(w http.ResponseWriter, r *http.Request) {
+	org := &Organization{}
+	err := s.db.GetContext(r.Context(), org, SelectOrganizationStmt, mux.Vars(r)["organization"])
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such organization", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, org)
+}
+
+// Delete endpoint deletes an organization along with its memberships, and its schema in schema mode, responding with
+// 204 No Content, or 409 Conflict while it still holds users.
+func (s *Service) Delete(w http.ResponseWriter, r *http.Request) {
+	err := s.Drop(r.Context(), mux.Vars(r)["organization"], false)
+	if err == ErrHoldsData {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such organization", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMembers endpoint returns the members of an organization, oldest first.
+func (s *Service) GetMembers(w http.ResponseWriter, r *http.Request) {
+	members := []*Membership{}
+	if err := s.db.SelectContext(r.Context(), &members, SelectMembersStmt, mux.Vars(r)["organization"]); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, members)
+}
+
+// PutMember endpoint makes a user a member of an organization with a role, or changes their role, responding with the
+// membership. Unknown organizations and users are answered with 404 Not Found, admins granting or revoking the owner
+// role with 403 Forbidden.
+func (s *Service) PutMember(w http.ResponseWriter, r *http.Request) {
+	input := &MembershipInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if problems := input.validate(); len(problems) > 0 {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
+	vars := mux.Vars(r)
+	if !s.checkOwnershipOrFail(w, r, vars["user"], input.Role) {
+		return
+	}
+
+	membership := &Membership{}
+	err := s.db.GetContext(r.Context(), membership, UpsertMembershipStmt, vars["organization"], vars["user"], input.Role,
+		reqctx.Actor(r.Context()))
+	if err == sql.ErrNoRows {
+		http.Error(w, "no such organization", http.StatusNotFound)
+		return
+	}
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		http.Error(w, "no such user", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, membership)
+}
+
+// DeleteMember endpoint removes a user from an organization, responding with 204 No Content, or 403 Forbidden to admins
+// removing an owner.
+func (s *Service) DeleteMember(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !s.checkOwnershipOrFail(w, r, vars["user"], "") {
+		return
+	}
+
+	result, err := s.db.ExecContext(r.Context(), DeleteMembershipStmt, vars["organization"], vars["user"])
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		http.Error(w, "no such membership", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Name implements users.PersonalData.
+func (s *Service) Name() string {
+	return "memberships"
+}
+
+// Export implements users.PersonalData: the organizations a user is a member of.
+func (s *Service) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	memberships := []*Membership{}
+	if err := tx.SelectContext(ctx, &memberships, SelectUserMembershipsStmt, userID); err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// Erase implements users.PersonalData. Memberships are deleted along with the user.
+func (s *Service) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	return nil
+}
+
+func (in *OrganizationInput) validate() ValidationError {
+	problems := ValidationError{}
+
+	if !slugPattern.MatchString(in.Slug) {
+		problems["slug"] = "must be lower case letters, digits and dashes, at most 56 characters"
+	}
+
+	if strings.TrimSpace(in.Name) == "" {
+		problems["name"] = "must not be empty"
+	}
+
+	return problems
+}
+
+func (in *MembershipInput) validate() ValidationError {
+	problems := ValidationError{}
+
+	switch in.Role {
+	case RoleOwner, RoleAdmin, RoleMember:
+	default:
+		problems["role"] = "must be owner, admin or member"
+	}
+
+	return problems
+}
+
+// checkOwnershipOrFail answers the request with 403 Forbidden if checkOwnership fails, and reports whether it passed.
+func (s *Service) checkOwnershipOrFail(w http.ResponseWriter, r *http.Request, userID, role string) bool {
+	switch err := s.checkOwnership(r, userID, role); err {
+	case nil:
+		return true
+	case ErrOwnersOnly:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		s.writeError(w, err)
+	}
+	return false
+}
+
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// logic for logging and writing an error, log your errors!
+func (s *Service) writeError(w http.ResponseWriter, err error) {
+	s.logger.Println(err)
+	http.Error(w, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,286 @@
+package tenancy_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/tenancy"
+	"github.com/b3ntly/twelvefactor_databases/users"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/require"
+)
+
+const postgresURI = "postgresql://postgres@localhost:5432/postgres?sslmode=disable"
+
+func TestService(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, users.DeleteManyStmt)
+	require.Nil(t, err)
+
+	service := tenancy.New(&tenancy.Config{Ctx: ctx, Logger: logger, DB: db, Domain: "example.com"})
+	_, err = db.ExecContext(ctx, `DELETE FROM organizations;`)
+	require.Nil(t, err)
+
+	usersService := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          logger,
+		DB:              db,
+		UsersPathPrefix: "users",
+		SelectManyLimit: 10,
+		Scope:           service.Scope,
+	})
+	require.Nil(t, service.Isolate(ctx, "users", "users_history", "users_privacy_requests"))
+
+	router := mux.NewRouter()
+	service.Mount(router)
+	usersService.Mount(router)
+
+	handler := service.Resolve(router)
+	send := func(method, target, body, tenant string, p *access.Principal) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		if p != nil {
+			req = req.WithContext(access.WithPrincipal(req.Context(), p))
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	require.Equal(t, 422, send("POST", "http://localhost:9090/organizations", `{"slug": "Acme!", "name": "Acme"}`, "",
+		nil).Code)
+	for _, slug := range []string{"acme", "globex"} {
+		body := fmt.Sprintf(`{"slug": %q, "name": %q}`, slug, slug)
+		require.Equal(t, 201, send("POST", "http://localhost:9090/organizations", body, "", nil).Code)
+	}
+	require.Equal(t, 409, send("POST", "http://localhost:9090/organizations", `{"slug": "acme", "name": "Acme"}`, "",
+		nil).Code)
+
+	create := func(username, tenant string) *users.User {
+		w := send("POST", "http://localhost:9090/users", fmt.Sprintf(`{"username": %q}`, username), tenant, nil)
+		require.Equal(t, 201, w.Code)
+		user := &users.User{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), user))
+		return user
+	}
+	wile := create("wile", "acme")
+	hank := create("hank", "globex")
+
+	// Each tenant only sees its own users, whether listing them or asking for another tenant's by ID.
+	w := send("GET", "http://localhost:9090/users", "", "acme", nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "wile")
+	require.NotContains(t, w.Body.String(), "hank")
+
+	hankURL := fmt.Sprintf("http://localhost:9090/users/%d", hank.ID)
+	require.Equal(t, 200, send("GET", hankURL, "", "globex", nil).Code)
+	require.Equal(t, 404, send("GET", hankURL, "", "acme", nil).Code)
+	require.Equal(t, 404, send("PATCH", hankURL, `{"displayName": "Hacked"}`, "acme", nil).Code)
+	require.Equal(t, 404, send("DELETE", hankURL, "", "acme", nil).Code)
+	w = send("GET", hankURL+"/history", "", "acme", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "[]", strings.TrimSpace(w.Body.String()))
+
+	// Subdomains name tenants too, and requests outside of every tenant see none of their rows.
+	req := httptest.NewRequest("GET", fmt.Sprintf("http://globex.example.com/users/%d", hank.ID), nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	require.Equal(t, 200, w.Code)
+
+	w = send("GET", "http://localhost:9090/users", "", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "[]", strings.TrimSpace(w.Body.String()))
+	require.Equal(t, 404, send("GET", "http://localhost:9090/users", "", "initech", nil).Code)
+
+	// The database enforces the isolation, whatever the queries say.
+	tx, err := db.BeginTxx(ctx, nil)
+	require.Nil(t, err)
+	defer tx.Rollback()
+	acme := &tenancy.Organization{}
+	require.Nil(t, tx.GetContext(ctx, acme, tenancy.SelectOrganizationStmt, "acme"))
+	_, err = tx.ExecContext(ctx, fmt.Sprintf(tenancy.ScopeStmt, fmt.Sprint(acme.ID)))
+	require.Nil(t, err)
+	var count int
+	require.Nil(t, tx.GetContext(ctx, &count, `SELECT count(*) FROM users WHERE id = $1;`, hank.ID))
+	require.Equal(t, 0, count)
+	_, err = tx.ExecContext(ctx, `UPDATE users SET tenant_id = tenant_id + 1 WHERE id = $1;`, wile.ID)
+	require.NotNil(t, err)
+	require.Nil(t, tx.Rollback())
+
+	// Users act in the organizations they are members of, and tokens in the tenant they were issued in.
+	wileURL := fmt.Sprintf("http://localhost:9090/users/%d", wile.ID)
+	principal := &access.Principal{ID: fmt.Sprintf("user:%d", wile.ID)}
+	require.Equal(t, 403, send("GET", wileURL, "", "acme", principal).Code)
+
+	w = send("PUT", fmt.Sprintf("http://localhost:9090/organizations/acme/members/%d", wile.ID), `{"role": "owner"}`, "",
+		nil)
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, 200, send("GET", wileURL, "", "acme", principal).Code)
+	require.Equal(t, 403, send("GET", hankURL, "", "globex", principal).Code)
+
+	principal.Tenant = "acme"
+	require.Equal(t, 200, send("GET", wileURL, "", "", principal).Code)
+	require.Equal(t, 403, send("GET", hankURL, "", "globex", principal).Code)
+
+	w = send("GET", "http://localhost:9090/organizations/acme/members", "", "", nil)
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), `"role":"owner"`)
+
+	// Members read their organization, admins manage its members, and only owners make or unmake owners.
+	guarded := mux.NewRouter()
+	tenancy.New(&tenancy.Config{Ctx: ctx, Logger: logger, DB: db, Enforcer: access.Scopes{}}).Mount(guarded)
+	sendAs := func(method, target, body string, p *access.Principal) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(access.WithPrincipal(req.Context(), p))
+		w := httptest.NewRecorder()
+		guarded.ServeHTTP(w, req)
+		return w.Code
+	}
+	hankPrincipal := &access.Principal{ID: fmt.Sprintf("user:%d", hank.ID)}
+	wileMember := fmt.Sprintf("http://localhost:9090/organizations/acme/members/%d", wile.ID)
+	hankMember := fmt.Sprintf("http://localhost:9090/organizations/acme/members/%d", hank.ID)
+
+	require.Equal(t, 403, sendAs("GET", "http://localhost:9090/organizations/acme/members", "", hankPrincipal))
+	require.Equal(t, 200, sendAs("PUT", hankMember, `{"role": "admin"}`, principal))
+	require.Equal(t, 200, sendAs("GET", "http://localhost:9090/organizations/acme/members", "", hankPrincipal))
+	require.Equal(t, 403, sendAs("PUT", wileMember, `{"role": "member"}`, hankPrincipal))
+	require.Equal(t, 403, sendAs("PUT", hankMember, `{"role": "owner"}`, hankPrincipal))
+	require.Equal(t, 403, sendAs("DELETE", wileMember, "", hankPrincipal))
+	require.Equal(t, 200, sendAs("PUT", hankMember, `{"role": "member"}`, hankPrincipal))
+	require.Equal(t, 403, sendAs("DELETE", hankMember, "", hankPrincipal))
+	require.Equal(t, 200, sendAs("GET", "http://localhost:9090/organizations/acme", "", hankPrincipal))
+	require.Equal(t, 403, sendAs("GET", "http://localhost:9090/organizations/globex", "", hankPrincipal))
+	require.Equal(t, 403, sendAs("DELETE", "http://localhost:9090/organizations/acme", "", principal))
+
+	// Organizations holding data can't be deleted, unless forced to delete it too.
+	require.Equal(t, 409, send("DELETE", "http://localhost:9090/organizations/globex", "", "", nil).Code)
+	require.Nil(t, service.Drop(ctx, "globex", true))
+	require.Nil(t, db.GetContext(ctx, &count, `SELECT count(*) FROM users WHERE id = $1;`, hank.ID))
+	require.Equal(t, 0, count)
+	require.Nil(t, db.GetContext(ctx, &count, `SELECT count(*) FROM users_history WHERE user_id = $1;`, hank.ID))
+	require.Equal(t, 0, count)
+	require.Equal(t, 404, send("DELETE", "http://localhost:9090/organizations/globex", "", "", nil).Code)
+}
+
+func TestService_SchemaMode(t *testing.T) {
+	ctx := context.Background()
+	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
+
+	db, err := sqlx.ConnectContext(ctx, "postgres", postgresURI)
+	require.Nil(t, err)
+	require.Nil(t, users.Migrate(ctx, db))
+	_, err = db.ExecContext(ctx, `
+	DROP SCHEMA IF EXISTS tenant_umbrella CASCADE;
+	DROP SCHEMA IF EXISTS tenant_cyber_dyne CASCADE;
+	DELETE FROM organizations WHERE slug IN ('umbrella', 'cyber-dyne');
+	`)
+	require.Nil(t, err)
+
+	service := tenancy.New(&tenancy.Config{Ctx: ctx, Logger: logger, DB: db, Mode: tenancy.ModeSchema,
+		Migrate: users.Migrate})
+	usersService := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          logger,
+		DB:              db,
+		UsersPathPrefix: "users",
+		SelectManyLimit: 10,
+		Scope:           service.Scope,
+	})
+
+	_, err = service.Provision(ctx, &tenancy.OrganizationInput{Slug: "-", Name: "Nobody"}, "system:test")
+	require.IsType(t, tenancy.ValidationError{}, err)
+	// Longer slugs would make schema names Postgres truncates.
+	_, err = service.Provision(ctx, &tenancy.OrganizationInput{Slug: strings.Repeat("a", 57), Name: "Long"}, "system:test")
+	require.IsType(t, tenancy.ValidationError{}, err)
+	require.True(t, len(tenancy.Schema(strings.Repeat("a", 56))) <= 63)
+	_, err = service.Provision(ctx, &tenancy.OrganizationInput{Slug: "umbrella", Name: "Umbrella"}, "system:test")
+	require.Nil(t, err)
+
+	router := mux.NewRouter()
+	service.Mount(router)
+	usersService.Mount(router)
+
+	handler := service.Resolve(router)
+	send := func(method, target, body, tenant string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set("X-Tenant", tenant)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Organizations provisioned over the API get a schema too, named after their slug.
+	w := send("POST", "http://localhost:9090/organizations", `{"slug": "cyber-dyne", "name": "Cyberdyne"}`, "")
+	require.Equal(t, 201, w.Code)
+	var schemas int
+	require.Nil(t, db.GetContext(ctx, &schemas, `SELECT count(*) FROM information_schema.schemata
+		WHERE schema_name IN ('tenant_umbrella', 'tenant_cyber_dyne');`))
+	require.Equal(t, 2, schemas)
+
+	create := func(username, tenant string) *users.User {
+		w := send("POST", "http://localhost:9090/users", fmt.Sprintf(`{"username": %q}`, username), tenant)
+		require.Equal(t, 201, w.Code)
+		user := &users.User{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), user))
+		return user
+	}
+
+	// Every schema has tables of its own, so the same username can be taken once in each.
+	create("alice", "umbrella")
+	create("alice", "cyber-dyne")
+	miles := create("miles", "cyber-dyne")
+
+	w = send("GET", "http://localhost:9090/users", "", "umbrella")
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "alice")
+	require.NotContains(t, w.Body.String(), "miles")
+
+	milesURL := fmt.Sprintf("http://localhost:9090/users/%d", miles.ID)
+	require.Equal(t, 200, send("GET", milesURL, "", "cyber-dyne").Code)
+	require.Equal(t, 404, send("GET", milesURL, "", "umbrella").Code)
+
+	// Requests outside of every tenant see the users of the deployment, in public.
+	w = send("GET", "http://localhost:9090/users", "", "")
+	require.Equal(t, 200, w.Code)
+	require.NotContains(t, w.Body.String(), "miles")
+
+	// Migrations are applied to every schema again, whenever asked.
+	migrated, err := service.MigrateAll(ctx)
+	require.Nil(t, err)
+	require.True(t, migrated >= 2)
+
+	orgs, err := service.List(ctx)
+	require.Nil(t, err)
+	slugs := []string{}
+	for _, org := range orgs {
+		slugs = append(slugs, org.Slug)
+	}
+	require.Contains(t, slugs, "cyber-dyne")
+
+	// Organizations holding users are only dropped when forced, along with their schema.
+	require.Equal(t, 409, send("DELETE", "http://localhost:9090/organizations/umbrella", "", "").Code)
+	require.Equal(t, tenancy.ErrHoldsData, service.Drop(ctx, "cyber-dyne", false))
+	require.Nil(t, service.Drop(ctx, "cyber-dyne", true))
+	require.Equal(t, 404, send("DELETE", "http://localhost:9090/organizations/cyber-dyne", "", "").Code)
+	require.Nil(t, db.GetContext(ctx, &schemas, `SELECT count(*) FROM information_schema.schemata
+		WHERE schema_name = 'tenant_cyber_dyne';`))
+	require.Equal(t, 0, schemas)
+}
@@ -0,0 +1,112 @@
+// Package totp implements time-based one-time passwords as RFC 6238 defines them, with the parameters every
+// authenticator app supports: HMAC-SHA1, 6 digits and a 30 second period.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Digits of a code.
+	Digits = 6
+	// Period during which a code is valid.
+	Period = 30 * time.Second
+	// SecretSize is the length in bytes of generated secrets, the 160 bits RFC 4226 recommends.
+	SecretSize = 20
+)
+
+// ErrMalformedSecret is returned for secrets which aren't base32 encoded.
+var ErrMalformedSecret = errors.New("totp: malformed secret")
+
+// Secrets are exchanged base32 encoded without padding, as authenticator apps expect them.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded.
+func GenerateSecret() (string, error) {
+	secret := make([]byte, SecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(secret), nil
+}
+
+// Counter returns the number of periods elapsed at t, which codes are derived from.
+func Counter(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of a base32 encoded secret at counter.
+func Code(secret string, counter int64) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, RFC 4226 section 5.3.
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", Digits, value%1000000), nil
+}
+
+// Verify checks code against the codes of a base32 encoded secret at t and the skew periods before and after it, to
+// allow for clocks drifting and codes typed as they change. Returns the counter of the matching code, which must be
+// recorded and required to increase so a code is never accepted twice.
+func Verify(secret, code string, t time.Time, skew int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != Digits {
+		return 0, false
+	}
+
+	now := Counter(t)
+	for counter := now - skew; counter <= now+skew; counter++ {
+		expected, err := Code(secret, counter)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth URI authenticator apps enroll a secret from, usually shown as a QR code. The
+// account is labelled by issuer and account name.
+func ProvisioningURI(issuer, account, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(Digits))
+	query.Set("period", fmt.Sprint(int(Period/time.Second)))
+
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	key, err := encoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil || len(key) == 0 {
+		return nil, ErrMalformedSecret
+	}
+	return key, nil
+}
@@ -0,0 +1,70 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/totp"
+	"github.com/stretchr/testify/require"
+)
+
+// The SHA1 test vectors of RFC 6238 appendix B, truncated to 6 digits.
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	for unix, expected := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	} {
+		code, err := totp.Code(secret, totp.Counter(time.Unix(unix, 0)))
+		require.Nil(t, err)
+		require.Equal(t, expected, code, "at %d", unix)
+	}
+
+	_, err := totp.Code("not base32!", 1)
+	require.Equal(t, totp.ErrMalformedSecret, err)
+}
+
+func TestVerify(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.Nil(t, err)
+
+	now := time.Unix(1700000000, 0)
+	code, err := totp.Code(secret, totp.Counter(now))
+	require.Nil(t, err)
+
+	counter, ok := totp.Verify(secret, code, now, 1)
+	require.True(t, ok)
+	require.Equal(t, totp.Counter(now), counter)
+
+	// Within the skew, and not beyond.
+	_, ok = totp.Verify(secret, code, now.Add(totp.Period), 1)
+	require.True(t, ok)
+	_, ok = totp.Verify(secret, code, now.Add(-totp.Period), 1)
+	require.True(t, ok)
+	_, ok = totp.Verify(secret, code, now.Add(2*totp.Period), 1)
+	require.False(t, ok)
+
+	_, ok = totp.Verify(secret, code[:3]+" "+code[3:], now, 0)
+	require.True(t, ok)
+	_, ok = totp.Verify(secret, "12345", now, 1)
+	require.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri, err := url.Parse(totp.ProvisioningURI("Twelve Factor", "fred", "JBSWY3DPEHPK3PXP"))
+	require.Nil(t, err)
+
+	require.Equal(t, "otpauth", uri.Scheme)
+	require.Equal(t, "totp", uri.Host)
+	require.Equal(t, "/Twelve Factor:fred", uri.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", uri.Query().Get("secret"))
+	require.Equal(t, "Twelve Factor", uri.Query().Get("issuer"))
+	require.Equal(t, "6", uri.Query().Get("digits"))
+}
@@ -0,0 +1,207 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The most operations a single batch may hold.
+const maxBatchOperations = 1000
+
+// Modes of a batch.
+const (
+	// Every operation is applied or none is.
+	BatchAtomic = "atomic"
+	// Operations which fail are skipped and the others applied.
+	BatchBestEffort = "best_effort"
+)
+
+// Operations of a batch.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+type (
+	// BatchInput is the body accepted by the batch endpoint.
+	BatchInput struct {
+		// BatchAtomic or BatchBestEffort, defaults to BatchAtomic.
+		Mode       string            `json:"mode"`
+		Operations []*BatchOperation `json:"operations"`
+	}
+
+	// BatchOperation creates, updates or deletes a single user. ID and IfMatch play the part of the path and header of
+	// the equivalent request.
+	BatchOperation struct {
+		Op      string     `json:"op"`
+		ID      int64      `json:"id,omitempty"`
+		IfMatch string     `json:"ifMatch,omitempty"`
+		User    *UserInput `json:"user,omitempty"`
+	}
+
+	// BatchResult reports the outcome of an operation with the status code its equivalent request would have had.
+	BatchResult struct {
+		Status   int             `json:"status"`
+		User     *User           `json:"user,omitempty"`
+		Error    string          `json:"error,omitempty"`
+		Problems ValidationError `json:"problems,omitempty"`
+	}
+)
+
+// Batch endpoint applies many create, update and delete operations in one transaction, responding with 207 Multi-Status
+// and a result per operation, in order. In atomic mode the first failure rolls every operation back, and the others
+// are reported as 424 Failed Dependency. In best effort mode each failure only undoes its own operation.
+func (s *Service) Batch(w http.ResponseWriter, r *http.Request) {
+	input := &BatchInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	if input.Mode == "" {
+		input.Mode = BatchAtomic
+	}
+
+	if problems := input.validate(); len(problems) > 0 {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
+	ctx := r.Context()
+	results := make([]*BatchResult, len(input.Operations))
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	for i, op := range input.Operations {
+		if input.Mode == BatchBestEffort {
+			if _, err := tx.ExecContext(ctx, SavepointStmt); err != nil {
+				s.writeError(w, err)
+				return
+			}
+		}
+
+		result, err := s.applyOperation(ctx, tx, op)
+		if err != nil {
+			// Anything the client isn't at fault for fails the whole batch.
+			if status, _ := errorStatus(err); status == http.StatusInternalServerError {
+				s.writeError(w, err)
+				return
+			}
+			result = failedResult(err)
+		}
+		results[i] = result
+
+		if input.Mode == BatchAtomic {
+			if err != nil {
+				s.render(w, r, http.StatusMultiStatus, rolledBack(results, i))
+				return
+			}
+			continue
+		}
+
+		stmt := ReleaseSavepointStmt
+		if err != nil {
+			stmt = RollbackSavepointStmt
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	s.render(w, r, http.StatusMultiStatus, results)
+}
+
+// applyOperation applies a single operation of a batch within tx.
+func (s *Service) applyOperation(ctx context.Context, tx *sqlx.Tx, op *BatchOperation) (*BatchResult, error) {
+	id := strconv.FormatInt(op.ID, 10)
+
+	switch op.Op {
+	case OpCreate:
+		user, err := s.createUser(ctx, tx, op.User)
+		if err != nil {
+			return nil, err
+		}
+		return &BatchResult{Status: http.StatusCreated, User: user}, nil
+
+	case OpUpdate:
+		user, err := s.updateUser(ctx, tx, id, op.IfMatch, op.User)
+		if err != nil {
+			return nil, err
+		}
+		return &BatchResult{Status: http.StatusOK, User: user}, nil
+
+	default:
+		if err := s.deleteUser(ctx, tx, id, op.IfMatch); err != nil {
+			return nil, err
+		}
+		return &BatchResult{Status: http.StatusNoContent}, nil
+	}
+}
+
+// rolledBack reports every operation of an atomic batch but the one which failed as not applied.
+func rolledBack(results []*BatchResult, failed int) []*BatchResult {
+	for i := range results {
+		if i != failed {
+			results[i] = &BatchResult{
+				Status: http.StatusFailedDependency,
+				Error:  fmt.Sprintf("not applied: operation %d failed", failed),
+			}
+		}
+	}
+	return results
+}
+
+// failedResult reports an operation which failed with err, a client error.
+func failedResult(err error) *BatchResult {
+	if problems, ok := err.(ValidationError); ok {
+		return &BatchResult{Status: http.StatusUnprocessableEntity, Problems: problems}
+	}
+
+	status, message := errorStatus(err)
+	return &BatchResult{Status: status, Error: message}
+}
+
+// validate checks the shape of a batch before any operation runs, keyed like a ValidationError.
+func (in *BatchInput) validate() ValidationError {
+	problems := ValidationError{}
+
+	if in.Mode != BatchAtomic && in.Mode != BatchBestEffort {
+		problems["mode"] = "must be atomic or best_effort"
+	}
+
+	if len(in.Operations) == 0 || len(in.Operations) > maxBatchOperations {
+		problems["operations"] = fmt.Sprintf("must hold 1 to %d operations", maxBatchOperations)
+	}
+
+	for i, op := range in.Operations {
+		field := fmt.Sprintf("operations/%d", i)
+
+		switch {
+		case op == nil:
+			problems[field] = "must be an object"
+		case op.Op != OpCreate && op.Op != OpUpdate && op.Op != OpDelete:
+			problems[field] = "op must be create, update or delete"
+		case op.Op != OpCreate && op.ID <= 0:
+			problems[field] = "id is required to " + op.Op
+		case op.Op != OpDelete && op.User == nil:
+			problems[field] = "user is required to " + op.Op
+		}
+	}
+
+	return problems
+}
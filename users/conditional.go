@@ -0,0 +1,85 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	errPreconditionFailed   = errors.New("the user has changed since it was read, fetch it again")
+	errPreconditionRequired = errors.New("an If-Match header with the ETag of the user is required")
+)
+
+// etag returns the strong entity tag of a user, which changes whenever its version does.
+func etag(user *User) string {
+	return `"` + strconv.FormatInt(user.Version, 10) + `"`
+}
+
+// matchETag reports whether an If-Match header lists tag, using the strong comparison of RFC 7232: weak tags never
+// match.
+func matchETag(header, tag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWeakETag reports whether an If-None-Match header lists tag, using the weak comparison of RFC 7232: tags match
+// whether or not either is weak, as caches may weaken the tags they store.
+func matchWeakETag(header, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch verifies the If-Match precondition of a write against the current state of the user, requiring one
+// when the service is configured to.
+func (s *Service) checkIfMatch(header string, user *User) error {
+	if header == "" {
+		if s.requireIfMatch {
+			return errPreconditionRequired
+		}
+		return nil
+	}
+
+	if !matchETag(header, etag(user)) {
+		return errPreconditionFailed
+	}
+
+	return nil
+}
+
+// lockUser locks the user with the given ID for the remainder of tx and checks the If-Match precondition against it,
+// so the user can't change between the check and the write.
+func (s *Service) lockUser(ctx context.Context, tx *sqlx.Tx, id, ifMatch string, includeDeleted bool) (*User, error) {
+	if s.requireIfMatch && ifMatch == "" {
+		return nil, errPreconditionRequired
+	}
+
+	user := &User{}
+	if err := tx.GetContext(ctx, user, SelectOneForUpdateStmt, id, includeDeleted); err != nil {
+		return nil, err
+	}
+
+	if err := s.open(user); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkIfMatch(ifMatch, user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
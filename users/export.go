@@ -0,0 +1,233 @@
+package users
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/render"
+)
+
+const (
+	// Name of the server-side cursor declared for the lifetime of an export transaction.
+	exportCursor = "users_export"
+
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+	contentTypeJSON   = "application/json"
+)
+
+// exportEncoder writes a stream of users in a single wire format.
+type exportEncoder interface {
+	begin() error
+	encode(*User) error
+	end() error
+}
+
+// Export endpoint streams every user to the client without materializing the result set. Rows are read in batches
+// from a server-side cursor and the response is flushed after each batch, so memory use is bounded by the batch size
+// rather than the size of the table.
+func (s *Service) Export(w http.ResponseWriter, r *http.Request) {
+	contentType, ok := negotiateExport(r)
+	if !ok {
+		http.Error(w, "supported types: text/csv, application/x-ndjson, application/json", http.StatusNotAcceptable)
+		return
+	}
+
+	// Use the request context so an export stops as soon as the client goes away.
+	ctx := r.Context()
+
+	tx, err := s.begin(ctx)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	// Rolling back closes the cursor, the export never writes anything.
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(DeclareExportCursorStmt, exportCursor)); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	// Exports outlive SERVER_WRITE_TIMEOUT so lift the write deadline for this response only.
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil && err != http.ErrNotSupported {
+		s.logger.Println(err)
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, exportExtension(contentType)))
+
+	encoder := newExportEncoder(contentType, w)
+	if err := encoder.begin(); err != nil {
+		s.logger.Println(err)
+		return
+	}
+
+	fetch := fmt.Sprintf(FetchExportCursorStmt, s.exportBatchSize, exportCursor)
+	for {
+		batch := []*User{}
+		err := tx.SelectContext(ctx, &batch, fetch)
+		if err == nil {
+			err = s.open(batch...)
+		}
+		if err != nil {
+			// The status line has already been sent, all we can do is log and cut the response short.
+			s.logger.Println(err)
+			return
+		}
+
+		for _, user := range batch {
+			if err := encoder.encode(user); err != nil {
+				s.logger.Println(err)
+				return
+			}
+		}
+
+		if len(batch) < s.exportBatchSize {
+			break
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if err := encoder.end(); err != nil {
+		s.logger.Println(err)
+	}
+}
+
+// StreamingPaths reports the routes of this service which must not be bound by the request timeout.
+func (s *Service) StreamingPaths() []string {
+	return []string{s.exportPath()}
+}
+
+// negotiateExport picks the export format from the format query parameter or the Accept header, in that order.
+// JSON is returned when the client expresses no preference.
+func negotiateExport(r *http.Request) (string, bool) {
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		return contentTypeCSV, true
+	case "ndjson":
+		return contentTypeNDJSON, true
+	case "json":
+		return contentTypeJSON, true
+	case "":
+	default:
+		return "", false
+	}
+
+	contentType, ok := render.Negotiate(r, contentTypeJSON, contentTypeNDJSON, "application/ndjson", contentTypeCSV)
+	if contentType == "application/ndjson" {
+		contentType = contentTypeNDJSON
+	}
+
+	return contentType, ok
+}
+
+func exportExtension(contentType string) string {
+	switch contentType {
+	case contentTypeCSV:
+		return "csv"
+	case contentTypeNDJSON:
+		return "ndjson"
+	default:
+		return "json"
+	}
+}
+
+func newExportEncoder(contentType string, w io.Writer) exportEncoder {
+	switch contentType {
+	case contentTypeCSV:
+		return &csvExportEncoder{w: csv.NewWriter(w)}
+	case contentTypeNDJSON:
+		return &ndjsonExportEncoder{enc: json.NewEncoder(w)}
+	default:
+		return &jsonExportEncoder{w: w}
+	}
+}
+
+type csvExportEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvExportEncoder) begin() error {
+	return e.w.Write([]string{"id", "username", "email", "display_name", "status", "metadata", "tags", "created_at", "updated_at"})
+}
+
+func (e *csvExportEncoder) encode(user *User) error {
+	record := []string{
+		strconv.FormatInt(user.ID, 10),
+		user.Username,
+		user.Email,
+		user.DisplayName,
+		user.Status,
+		user.Metadata.String(),
+		strings.Join(user.Tags, ";"),
+		user.CreatedAt.Format(time.RFC3339Nano),
+		user.UpdatedAt.Format(time.RFC3339Nano),
+	}
+
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+
+	// csv.Writer buffers internally, push each record through so flushing the response has something to send.
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvExportEncoder) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportEncoder struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExportEncoder) begin() error { return nil }
+
+// json.Encoder terminates every value with a newline, which is exactly NDJSON.
+func (e *ndjsonExportEncoder) encode(user *User) error { return e.enc.Encode(user) }
+
+func (e *ndjsonExportEncoder) end() error { return nil }
+
+type jsonExportEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (e *jsonExportEncoder) begin() error {
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExportEncoder) encode(user *User) error {
+	if e.count > 0 {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.count++
+
+	body, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	_, err = e.w.Write(body)
+	return err
+}
+
+func (e *jsonExportEncoder) end() error {
+	_, err := io.WriteString(e.w, "]")
+	return err
+}
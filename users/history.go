@@ -0,0 +1,124 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// HistoryEntry is a single change to a user recorded by the history trigger. Values are the whole row, keyed by
+// column name, before and after the change.
+type HistoryEntry struct {
+	ID        int64           `json:"ID" db:"id"`
+	UserID    int64           `json:"userID" db:"user_id"`
+	Operation string          `json:"operation" db:"operation"`
+	OldValues *types.JSONText `json:"oldValues" db:"old_values"`
+	NewValues *types.JSONText `json:"newValues" db:"new_values"`
+	Actor     string          `json:"actor" db:"actor"`
+	RequestID string          `json:"requestID" db:"request_id"`
+	ChangedAt time.Time       `json:"changedAt" db:"changed_at"`
+}
+
+// History endpoint returns the recorded changes to a user, most recent first, paginated like the list endpoint. The
+// history of purged users remains available.
+func (s *Service) History(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r.URL.Query(), s.selectManyLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := []*HistoryEntry{}
+	err = s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(r.Context(), db, &results, SelectHistoryStmt, mux.Vars(r)["id"], limit, offset)
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, results)
+}
+
+// getAsOf answers GetOne requests carrying ?as_of= with the user as it was at that time.
+func (s *Service) getAsOf(w http.ResponseWriter, r *http.Request, asOf string) {
+	at, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		http.Error(w, "as_of must be an RFC 3339 timestamp", http.StatusBadRequest)
+		return
+	}
+
+	user := &User{}
+	err = s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.GetContext(r.Context(), db, user, SelectAsOfStmt, mux.Vars(r)["id"], at)
+	})
+	if err == nil {
+		err = s.open(user)
+	}
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, user)
+}
+
+// begin starts a transaction attributed to the actor and request of ctx, so the history trigger can record who made
+// each change, and confined by the scope of the service.
+func (s *Service) begin(ctx context.Context) (*sqlx.Tx, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, SetAuditContextStmt, auditActor(ctx), reqctx.RequestID(ctx)); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if s.scope != nil {
+		if err := s.scope(ctx, tx); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
+
+// read runs fn against the database, in a transaction started by begin if the service is scoped so reads see what
+// writes would.
+func (s *Service) read(ctx context.Context, fn func(sqlx.QueryerContext) error) error {
+	if s.scope == nil {
+		return fn(s.db)
+	}
+	return s.inTx(ctx, func(tx *sqlx.Tx) error { return fn(tx) })
+}
+
+// inTx runs fn in a transaction started by begin, committing if it returns nil and rolling back otherwise.
+func (s *Service) inTx(ctx context.Context, fn func(*sqlx.Tx) error) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditActor returns who changes are attributed to in ctx.
+func auditActor(ctx context.Context) string {
+	if actor := reqctx.Actor(ctx); actor != "" {
+		return actor
+	}
+	return "anonymous"
+}
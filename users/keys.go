@@ -0,0 +1,92 @@
+package users
+
+import (
+	"context"
+	"strings"
+
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/jmoiron/sqlx"
+)
+
+// RotateKeys re-encrypts every email not sealed with the primary key of the keyring, plaintexts included, and
+// backfills missing blind indexes. Rows are locked and rewritten batchSize at a time so the service keeps running.
+// Returns the number of users rewritten. Retire an old key only once this has completed after making it non-primary.
+func (s *Service) RotateKeys(ctx context.Context, batchSize int) (int64, error) {
+	ctx = reqctx.WithActor(ctx, "system:rotate-keys")
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	primary := s.keyring.Primary()
+
+	var rotated int64
+	var after int64
+	for {
+		n := 0
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			rows := []struct {
+				ID         int64  `db:"id"`
+				Email      string `db:"email"`
+				EmailIndex string `db:"email_index"`
+			}{}
+			if err := tx.SelectContext(ctx, &rows, SelectEmailsForUpdateStmt, after, batchSize); err != nil {
+				return err
+			}
+			n = len(rows)
+
+			for _, row := range rows {
+				after = row.ID
+
+				email, err := s.keyring.Open(row.Email)
+				if err != nil {
+					return err
+				}
+
+				keyID, _ := fieldcrypt.KeyID(row.Email)
+				index := s.emailIndex(email)
+				if keyID == primary && row.EmailIndex == index {
+					continue
+				}
+
+				sealed, err := s.keyring.Seal(email)
+				if err != nil {
+					return err
+				}
+
+				if _, err := tx.ExecContext(ctx, UpdateEmailStmt, row.ID, sealed, index); err != nil {
+					return err
+				}
+				rotated++
+			}
+
+			return nil
+		})
+		if err != nil {
+			return rotated, err
+		}
+
+		if n < batchSize {
+			return rotated, nil
+		}
+	}
+}
+
+// open decrypts the emails of users read from the database, in place.
+func (s *Service) open(users ...*User) error {
+	for _, user := range users {
+		email, err := s.keyring.Open(user.Email)
+		if err != nil {
+			return err
+		}
+		user.Email = email
+	}
+
+	return nil
+}
+
+// emailIndex returns the blind index of an email, which stands in for the encrypted email in lookups and the unique
+// constraint.
+func (s *Service) emailIndex(email string) string {
+	return s.keyring.BlindIndex(strings.ToLower(email))
+}
@@ -0,0 +1,119 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// The most users removed by a single purge statement.
+const purgeBatchSize = 1000
+
+// Delete endpoint soft deletes a user. The user disappears from every other endpoint until it is restored, and is
+// permanently removed by the purge job once the retention period has passed.
+func (s *Service) Delete(w http.ResponseWriter, r *http.Request) {
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		return s.deleteUser(r.Context(), tx, mux.Vars(r)["id"], r.Header.Get("If-Match"))
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUser soft deletes the user with the given ID within tx, provided it matches ifMatch.
+func (s *Service) deleteUser(ctx context.Context, tx *sqlx.Tx, id, ifMatch string) error {
+	if _, err := s.lockUser(ctx, tx, id, ifMatch, false); err != nil {
+		return err
+	}
+
+	_, err := tx.ExecContext(ctx, SoftDeleteOneStmt, id)
+	return err
+}
+
+// Restore endpoint undoes the soft deletion of a user which hasn't been purged yet.
+func (s *Service) Restore(w http.ResponseWriter, r *http.Request) {
+	user := &User{}
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		if _, err := s.lockUser(r.Context(), tx, mux.Vars(r)["id"], r.Header.Get("If-Match"), true); err != nil {
+			return err
+		}
+
+		if err := tx.GetContext(r.Context(), user, RestoreOneStmt, mux.Vars(r)["id"]); err != nil {
+			return err
+		}
+
+		return s.open(user)
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user))
+	s.render(w, r, http.StatusOK, user)
+}
+
+// Purge permanently removes users soft deleted longer ago than the retention period, in batches, keeping the shape of
+// their history but none of its values as erasure does. Returns the number of users removed.
+func (s *Service) Purge(ctx context.Context) (int64, error) {
+	ctx = reqctx.WithActor(ctx, "system:purge")
+	cutoff := time.Now().Add(-s.purgeRetention)
+
+	var purged int64
+	for {
+		var n int64
+		err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+			ids := []int64{}
+			if err := tx.SelectContext(ctx, &ids, PurgeStmt, cutoff, purgeBatchSize); err != nil {
+				return err
+			}
+			n = int64(len(ids))
+
+			// After the delete, which records history entries of its own.
+			_, err := tx.ExecContext(ctx, AnonymizeManyHistoryStmt, pq.Int64Array(ids))
+			return err
+		})
+		if err != nil {
+			return purged, err
+		}
+
+		purged += n
+		if n < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
+
+// RunPurger calls Purge every purge interval until ctx is done. Blocks, so run it in its own goroutine. Every replica
+// may run a purger: purges are idempotent and batches keep them from contending for long.
+func (s *Service) RunPurger(ctx context.Context) {
+	if s.purgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := s.Purge(ctx)
+			if err != nil {
+				s.logger.Println(err)
+			}
+			if purged > 0 {
+				s.logger.Printf("purged %d soft deleted users", purged)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/b3ntly/twelvefactor_databases/jsonschema"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
+)
+
+// GetMetadata endpoint returns the metadata object of a user.
+func (s *Service) GetMetadata(w http.ResponseWriter, r *http.Request) {
+	user := &User{}
+	err := s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.GetContext(r.Context(), db, user, SelectOneStmt, mux.Vars(r)["id"], false)
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, user.Metadata)
+}
+
+// ReplaceMetadata endpoint overwrites the metadata of a user with the JSON object in the body.
+func (s *Service) ReplaceMetadata(w http.ResponseWriter, r *http.Request) {
+	s.updateMetadata(w, r, func(current, body interface{}) interface{} {
+		return body
+	})
+}
+
+// PatchMetadata endpoint applies a JSON merge patch (RFC 7396) to the metadata of a user: keys set to null are
+// removed, objects are merged recursively and every other value replaces what was there.
+func (s *Service) PatchMetadata(w http.ResponseWriter, r *http.Request) {
+	s.updateMetadata(w, r, mergePatch)
+}
+
+// updateMetadata reads the metadata of a user under a row lock, computes the new document with apply, validates it and
+// writes it back, so concurrent patches never lose each other's keys.
+func (s *Service) updateMetadata(w http.ResponseWriter, r *http.Request, apply func(current, body interface{}) interface{}) {
+	raw, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil && tooLarge(err) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "request body couldn't be read: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := decodeJSON(raw)
+	if err != nil {
+		http.Error(w, "request body must be JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := s.begin(ctx)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	defer tx.Rollback()
+
+	user, err := s.lockUser(ctx, tx, mux.Vars(r)["id"], r.Header.Get("If-Match"), false)
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	current, err := decodeJSON(user.Metadata)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	next := apply(current, body)
+	if _, ok := next.(map[string]interface{}); !ok {
+		s.render(w, r, http.StatusUnprocessableEntity, ValidationError{"metadata": "must be a JSON object"})
+		return
+	}
+
+	metadata, err := json.Marshal(next)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	if len(metadata) > s.metadataMaxBytes {
+		http.Error(w, "metadata exceeds the size limit of this deployment", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if s.metadataSchema != nil {
+		if err := s.metadataSchema.Validate(next); err != nil {
+			if problems, ok := err.(jsonschema.ValidationError); ok {
+				s.render(w, r, http.StatusUnprocessableEntity, map[string][]string{"metadata": problems})
+				return
+			}
+			s.writeError(w, err)
+			return
+		}
+	}
+
+	if err := tx.GetContext(ctx, user, UpdateMetadataStmt, user.ID, types.JSONText(metadata)); err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user))
+	s.render(w, r, http.StatusOK, user.Metadata)
+}
+
+// decodeJSON decodes a document keeping numbers as json.Number so they round trip without losing precision.
+func decodeJSON(data []byte) (interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc, nil
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396.
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+
+	return targetObject
+}
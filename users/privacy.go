@@ -0,0 +1,209 @@
+package users
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+)
+
+// Kinds of PrivacyRequest.
+const (
+	PrivacyAccess  = "access"
+	PrivacyErasure = "erasure"
+)
+
+// Statuses of a PrivacyRequest.
+const (
+	PrivacyPending   = "pending"
+	PrivacyCompleted = "completed"
+	PrivacyFailed    = "failed"
+)
+
+type (
+	// PersonalData is implemented by stores which keep data about users outside of the users table, so access and
+	// erasure requests cover them too. Both methods run inside the transaction of the request.
+	PersonalData interface {
+		// Name keys the data of the store in archives.
+		Name() string
+		// Export returns everything the store holds about a user, in a form encoding/json can marshal.
+		Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error)
+		// Erase deletes or anonymizes everything the store holds about a user.
+		Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error
+	}
+
+	// PrivacyRequest records a data subject request and whether it was honored before it was due.
+	PrivacyRequest struct {
+		ID          int64      `json:"ID" db:"id"`
+		UserID      int64      `json:"userID" db:"user_id"`
+		Kind        string     `json:"kind" db:"kind"`
+		Status      string     `json:"status" db:"status"`
+		RequestedBy string     `json:"requestedBy" db:"requested_by"`
+		RequestID   string     `json:"requestID" db:"request_id"`
+		Error       string     `json:"error,omitempty" db:"error"`
+		RequestedAt time.Time  `json:"requestedAt" db:"requested_at"`
+		DueAt       time.Time  `json:"dueAt" db:"due_at"`
+		CompletedAt *time.Time `json:"completedAt,omitempty" db:"completed_at"`
+	}
+
+	// Archive is everything stored about a user, as returned to an access request.
+	Archive struct {
+		User            *User                  `json:"user"`
+		History         []*HistoryEntry        `json:"history"`
+		PrivacyRequests []*PrivacyRequest      `json:"privacyRequests"`
+		Data            map[string]interface{} `json:"data"`
+		GeneratedAt     time.Time              `json:"generatedAt"`
+	}
+)
+
+// RegisterPersonalData adds stores to be covered by access and erasure requests. Call it before serving requests.
+func (s *Service) RegisterPersonalData(stores ...PersonalData) {
+	s.personalData = append(s.personalData, stores...)
+}
+
+// Archive endpoint answers an access request with everything stored about a user, soft deleted or not. The request is
+// recorded whether or not it succeeds.
+func (s *Service) Archive(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	archive := &Archive{User: &User{}, Data: map[string]interface{}{}}
+
+	req, err := s.handlePrivacyRequest(ctx, mux.Vars(r)["id"], PrivacyAccess, func(tx *sqlx.Tx, userID int64) error {
+		if err := tx.GetContext(ctx, archive.User, SelectOneStmt, userID, true); err != nil {
+			return err
+		}
+
+		if err := s.open(archive.User); err != nil {
+			return err
+		}
+
+		// A NULL limit returns the whole history.
+		archive.History = []*HistoryEntry{}
+		if err := tx.SelectContext(ctx, &archive.History, SelectHistoryStmt, userID, nil, 0); err != nil {
+			return err
+		}
+
+		for _, store := range s.personalData {
+			data, err := store.Export(ctx, tx, userID)
+			if err != nil {
+				return err
+			}
+			archive.Data[store.Name()] = data
+		}
+
+		return nil
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	// Read after completion so the archive shows this request as honored.
+	archive.PrivacyRequests = []*PrivacyRequest{}
+	err = s.read(ctx, func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(ctx, db, &archive.PrivacyRequests, SelectPrivacyRequestsStmt, req.UserID)
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	archive.GeneratedAt = time.Now().UTC()
+	s.render(w, r, http.StatusOK, archive)
+}
+
+// Erase endpoint answers an erasure request: the user is permanently deleted, along with the data of every registered
+// store, and its history is stripped of values. Responds with the recorded request.
+func (s *Service) Erase(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	req, err := s.handlePrivacyRequest(ctx, mux.Vars(r)["id"], PrivacyErasure, func(tx *sqlx.Tx, userID int64) error {
+		for _, store := range s.personalData {
+			if err := store.Erase(ctx, tx, userID); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, EraseOneStmt, userID); err != nil {
+			return err
+		}
+
+		// After the delete, which records a history entry of its own.
+		_, err := tx.ExecContext(ctx, AnonymizeHistoryStmt, userID)
+		return err
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", filepath.Join("/", s.pathPrefix, "privacy-requests", strconv.FormatInt(req.ID, 10)))
+	s.render(w, r, http.StatusCreated, req)
+}
+
+// GetPrivacyRequests endpoint returns every privacy request made for a user, most recent first. Available after
+// erasure, since requests only hold the ID of the user.
+func (s *Service) GetPrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	results := []*PrivacyRequest{}
+	err := s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(r.Context(), db, &results, SelectPrivacyRequestsStmt, mux.Vars(r)["id"])
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, results)
+}
+
+// GetPrivacyRequest endpoint returns a single privacy request by ID.
+func (s *Service) GetPrivacyRequest(w http.ResponseWriter, r *http.Request) {
+	req := &PrivacyRequest{}
+	err := s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.GetContext(r.Context(), db, req, SelectPrivacyRequestStmt, mux.Vars(r)["id"])
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, req)
+}
+
+// handlePrivacyRequest records a request of kind for a user, then runs fn with the ID of the user and completes the
+// request in one transaction. If fn fails the request is kept as failed, so every request made stays on record. Returns
+// sql.ErrNoRows if the user doesn't exist.
+func (s *Service) handlePrivacyRequest(ctx context.Context, userID, kind string, fn func(tx *sqlx.Tx, userID int64) error) (*PrivacyRequest, error) {
+	req := &PrivacyRequest{}
+	err := s.inTx(ctx, func(tx *sqlx.Tx) error {
+		return tx.GetContext(ctx, req, InsertPrivacyRequestStmt, userID, kind, auditActor(ctx), reqctx.RequestID(ctx))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.inTx(ctx, func(tx *sqlx.Tx) error {
+		if err := fn(tx, req.UserID); err != nil {
+			return err
+		}
+
+		return tx.GetContext(ctx, req, CompletePrivacyRequestStmt, req.ID)
+	})
+	if err != nil {
+		// Record the failure even if the request was cancelled, in the tenant of the request.
+		failCtx, message := context.WithoutCancel(ctx), err.Error()
+		if failErr := s.inTx(failCtx, func(tx *sqlx.Tx) error {
+			_, err := tx.ExecContext(failCtx, FailPrivacyRequestStmt, req.ID, message)
+			return err
+		}); failErr != nil {
+			s.logger.Println(failErr)
+		}
+		return nil, err
+	}
+
+	return req, nil
+}
@@ -0,0 +1,153 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+)
+
+// The most rows a single page of the list or search endpoints may hold.
+const maxPageLimit = 1000
+
+// listQuery accumulates the WHERE clause and bind arguments of a list query from request parameters.
+type listQuery struct {
+	conditions []string
+	args       []interface{}
+}
+
+// arg binds a value and returns its placeholder.
+func (q *listQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+// where adds a condition, conditions are joined with AND.
+func (q *listQuery) where(condition string) {
+	q.conditions = append(q.conditions, condition)
+}
+
+// clause returns the conditions as the body of a WHERE clause.
+func (q *listQuery) clause() string {
+	if len(q.conditions) == 0 {
+		return "TRUE"
+	}
+	return strings.Join(q.conditions, " AND ")
+}
+
+// parsePage reads ?limit= and ?offset=. The limit defaults to defaultLimit and may not exceed maxPageLimit.
+func parsePage(values url.Values, defaultLimit int) (int, int, error) {
+	limit, offset := defaultLimit, 0
+
+	if param := values.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		limit = n
+	}
+
+	if param := values.Get("offset"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = n
+	}
+
+	return limit, offset, nil
+}
+
+// parseListQuery builds a listQuery from the filters supported by the list endpoint:
+//
+//	?metadata={"plan":"pro"}    users whose metadata contains the given JSON object
+//	?metadata.plan.tier=gold    users whose metadata has the value at the dotted key path, values are parsed as JSON
+//	                            when possible and compared as strings otherwise
+//	?tag=beta                   users carrying the tag, repeat to require several
+//	?any_tag=beta,staff         users carrying at least one of the tags
+//	?all_tags=beta,staff        users carrying every one of the tags
+//	?email=fred@example.com     users with the email, regardless of case
+//	?include_deleted=true       include soft deleted users, which are excluded by default
+//
+// Metadata and tag filters are answered by the GIN indexes on their columns, email filters by the blind index of the
+// encrypted email under keyring.
+func parseListQuery(values url.Values, keyring *fieldcrypt.Keyring) (*listQuery, error) {
+	q := &listQuery{}
+
+	if values.Get("include_deleted") != "true" {
+		q.where("deleted_at IS NULL")
+	}
+
+	// Visit parameters in order so identical requests produce identical SQL.
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch key {
+		case "tag", "all_tags":
+			if tags := splitTags(values[key]); len(tags) > 0 {
+				q.where("tags @> " + q.arg(tags) + "::text[]")
+			}
+			continue
+
+		case "any_tag":
+			if tags := splitTags(values[key]); len(tags) > 0 {
+				q.where("tags && " + q.arg(tags) + "::text[]")
+			}
+			continue
+
+		case "email":
+			// Emails are encrypted, so they are matched, regardless of case, through their blind index.
+			for _, email := range values[key] {
+				q.where("email_index = " + q.arg(keyring.BlindIndex(strings.ToLower(strings.TrimSpace(email)))))
+			}
+			continue
+		}
+
+		for _, param := range values[key] {
+			switch {
+			case key == "metadata":
+				var doc map[string]interface{}
+				if err := json.Unmarshal([]byte(param), &doc); err != nil {
+					return nil, fmt.Errorf("metadata must be a JSON object: %v", err)
+				}
+
+				q.where("metadata @> " + q.arg(param) + "::jsonb")
+
+			case strings.HasPrefix(key, "metadata."):
+				path := strings.Split(strings.TrimPrefix(key, "metadata."), ".")
+				for _, segment := range path {
+					if segment == "" {
+						return nil, fmt.Errorf("%s is not a valid metadata key path", key)
+					}
+				}
+
+				var value interface{}
+				if err := json.Unmarshal([]byte(param), &value); err != nil {
+					value = param
+				}
+
+				// {"a": {"b": value}} for the path a.b
+				for i := len(path) - 1; i >= 0; i-- {
+					value = map[string]interface{}{path[i]: value}
+				}
+
+				doc, err := json.Marshal(value)
+				if err != nil {
+					return nil, err
+				}
+
+				q.where("metadata @> " + q.arg(string(doc)) + "::jsonb")
+			}
+		}
+	}
+
+	return q, nil
+}
@@ -0,0 +1,88 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var searchTermPattern = regexp.MustCompile(`[\pL\pN]+`)
+
+// SearchResult is a user matching a search, with its relevance and a snippet with the matched terms wrapped in <mark>.
+type SearchResult struct {
+	User
+	Score     float64 `json:"score" db:"score"`
+	Highlight string  `json:"highlight" db:"highlight"`
+}
+
+// Search endpoint finds users by username and display name, most relevant first. Full words are matched against the
+// generated search_vector column and misspellings by trigram similarity. With ?mode=prefix the last word typed may be
+// incomplete, for typeahead. Accepts the filters and pagination of the list endpoint.
+func (s *Service) Search(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+
+	text := strings.TrimSpace(values.Get("q"))
+	if text == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+
+	limit, offset, err := parsePage(values, s.selectManyLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseListQuery(values, s.keyring)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	term := q.arg(text)
+
+	var tsquery string
+	match := fmt.Sprintf("(search_vector @@ query OR username %% %[1]s OR display_name %% %[1]s)", term)
+
+	switch values.Get("mode") {
+	case "", "full":
+		tsquery = "plainto_tsquery('simple', " + term + ")"
+	case "prefix":
+		// Every word must match the start of a word, "fred fl" becomes fred:* & fl:*.
+		words := searchTermPattern.FindAllString(text, -1)
+		for i := range words {
+			words[i] = strings.ToLower(words[i]) + ":*"
+		}
+
+		tsquery = "to_tsquery('simple', " + q.arg(strings.Join(words, " & ")) + ")"
+		match = fmt.Sprintf("(search_vector @@ query OR username ILIKE %s)", q.arg(escapeLike(text)+"%"))
+	default:
+		http.Error(w, "mode must be full or prefix", http.StatusBadRequest)
+		return
+	}
+
+	q.where(match)
+
+	results := []*SearchResult{}
+	stmt := fmt.Sprintf(SearchStmt, tsquery, term, q.clause(), q.arg(limit), q.arg(offset))
+	err = s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(r.Context(), db, &results, stmt, q.args...)
+	})
+	for i := 0; err == nil && i < len(results); i++ {
+		err = s.open(&results[i].User)
+	}
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, results)
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern so user input only ever matches literally.
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+}
@@ -1,5 +1,15 @@
 package users
 
+// Columns selected whenever a full User is read, in the order of the User struct.
+const userColumns = `
+	id, username, email, display_name, status, metadata, tags, created_at, updated_at, deleted_at, version
+`
+
+// Columns selected whenever a full PrivacyRequest is read, in the order of the PrivacyRequest struct.
+const privacyRequestColumns = `
+	id, user_id, kind, status, requested_by, request_id, error, requested_at, due_at, completed_at
+`
+
 const (
 	CreateTableStmt = `
 	CREATE TABLE IF NOT EXISTS users (
@@ -11,21 +21,439 @@ const (
 
 	InsertOneStmt = `
 	INSERT INTO users
-		(username)
+		(username, email, display_name, status, email_index)
 	VALUES
-		($1)
-	RETURNING id;
+		($1, $2, $3, $4, $5)
+	RETURNING ` + userColumns + `;
+	`
+
+	// Soft deleted users are only returned when $2 is true.
+	SelectOneStmt = `
+	SELECT
+	` + userColumns + `
+	FROM users
+	WHERE id = $1 AND (deleted_at IS NULL OR $2);
 	`
 
+	// Lock a single user for the remainder of the transaction. Soft deleted users are only locked when $2 is true.
+	SelectOneForUpdateStmt = `
+	SELECT
+	` + userColumns + `
+	FROM users
+	WHERE id = $1 AND (deleted_at IS NULL OR $2)
+	FOR UPDATE;
+	`
+
+	// Formatted with the WHERE clause, LIMIT and OFFSET placeholders built by a listQuery.
 	SelectManyStmt = `
 	SELECT
-	id, username, created_at
+	` + userColumns + `
+	FROM users
+	WHERE %s
+	ORDER BY created_at DESC, id DESC
+	LIMIT %s OFFSET %s;
+	`
+
+	// Formatted with the tsquery expression, the placeholder of the search text, the WHERE clause, LIMIT and OFFSET.
+	// Relevance adds the full-text rank to the best trigram similarity so misspelled names still rank.
+	SearchStmt = `
+	SELECT
+	` + userColumns + `,
+	ts_rank(search_vector, query) + greatest(similarity(username, %[2]s), similarity(display_name, %[2]s)) AS score,
+	ts_headline('simple', username || ' ' || display_name, query, 'StartSel=<mark>, StopSel=</mark>') AS highlight
+	FROM users, %[1]s AS query
+	WHERE %[3]s
+	ORDER BY score DESC, id
+	LIMIT %[4]s OFFSET %[5]s;
+	`
+
+	UpdateOneStmt = `
+	UPDATE users SET
+		username = $2,
+		email = $3,
+		display_name = $4,
+		status = $5,
+		email_index = $6
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING ` + userColumns + `;
+	`
+
+	UpdateMetadataStmt = `
+	UPDATE users SET
+		metadata = $2
+	WHERE id = $1
+	RETURNING ` + userColumns + `;
+	`
+
+	// Add the tags in $2 and remove those in $3 in one statement, keeping tags sorted and distinct.
+	UpdateTagsStmt = `
+	UPDATE users SET
+		tags = ARRAY(
+			SELECT DISTINCT tag
+			FROM unnest(tags || $2::text[]) AS tag
+			WHERE tag <> ALL($3::text[])
+			ORDER BY tag
+		)
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING ` + userColumns + `;
+	`
+
+	SelectTagCountsStmt = `
+	SELECT
+	tag, count(*) AS count
+	FROM users, unnest(users.tags) AS tag
+	WHERE users.deleted_at IS NULL
+	GROUP BY tag
+	ORDER BY count DESC, tag;
+	`
+
+	// Declare a server-side cursor over every user, formatted with the cursor name. Must run inside a transaction.
+	DeclareExportCursorStmt = `
+	DECLARE %s NO SCROLL CURSOR FOR
+	SELECT
+	` + userColumns + `
+	FROM users
+	WHERE deleted_at IS NULL
+	ORDER BY id;
+	`
+
+	// Fetch the next batch from a cursor declared by DeclareExportCursorStmt, formatted with the batch size and cursor
+	// name. FETCH does not accept bind parameters.
+	FetchExportCursorStmt = `
+	FETCH FORWARD %d FROM %s;
+	`
+
+	SoftDeleteOneStmt = `
+	UPDATE users SET
+		deleted_at = now()
+	WHERE id = $1 AND deleted_at IS NULL
+	RETURNING ` + userColumns + `;
+	`
+
+	RestoreOneStmt = `
+	UPDATE users SET
+		deleted_at = NULL
+	WHERE id = $1 AND deleted_at IS NOT NULL
+	RETURNING ` + userColumns + `;
+	`
+
+	// Permanently remove up to $2 users soft deleted before $1, returning their IDs. Run repeatedly until fewer than $2
+	// rows are removed so a large purge never holds many row locks at once.
+	PurgeStmt = `
+	DELETE FROM users
+	WHERE id IN (
+		SELECT id FROM users
+		WHERE deleted_at < $1
+		LIMIT $2
+	)
+	RETURNING id;
+	`
+
+	// Attribute the writes of the current transaction, read by the history trigger.
+	SetAuditContextStmt = `
+	SELECT set_config('app.actor', $1, true), set_config('app.request_id', $2, true);
+	`
+
+	SelectHistoryStmt = `
+	SELECT
+	id, user_id, operation, old_values, new_values, actor, request_id, changed_at
+	FROM users_history
+	WHERE user_id = $1
+	ORDER BY changed_at DESC, id DESC
+	LIMIT $2 OFFSET $3;
+	`
+
+	// Reconstruct a user as it was at $2 from the latest change recorded at or before then. Returns no rows if the user
+	// didn't exist yet or had been purged.
+	SelectAsOfStmt = `
+	SELECT
+	` + userColumns + `
+	FROM (
+		SELECT operation, new_values FROM users_history
+		WHERE user_id = $1 AND changed_at <= $2
+		ORDER BY changed_at DESC, id DESC
+		LIMIT 1
+	) AS latest, jsonb_populate_record(NULL::users, latest.new_values)
+	WHERE latest.operation <> 'DELETE';
+	`
+
+	// The validator of every list of users, bumped by any statement writing to the table, hard deletes included.
+	SelectChangesStmt = `
+	SELECT counter, changed_at FROM users_changes;
+	`
+
+	// Savepoints isolating the operations of a best effort batch, so one failing doesn't abort the transaction.
+	SavepointStmt         = `SAVEPOINT batch_operation;`
+	RollbackSavepointStmt = `ROLLBACK TO SAVEPOINT batch_operation;`
+	ReleaseSavepointStmt  = `RELEASE SAVEPOINT batch_operation;`
+
+	// Open a privacy request of kind $2 for user $1, returning no rows if the user doesn't exist. Soft deleted users
+	// still have data on record, so they are included.
+	InsertPrivacyRequestStmt = `
+	INSERT INTO users_privacy_requests
+		(user_id, kind, requested_by, request_id)
+	SELECT id, $2, $3, $4 FROM users WHERE id = $1
+	RETURNING ` + privacyRequestColumns + `;
+	`
+
+	CompletePrivacyRequestStmt = `
+	UPDATE users_privacy_requests SET
+		status = 'completed',
+		completed_at = now()
+	WHERE id = $1
+	RETURNING ` + privacyRequestColumns + `;
+	`
+
+	FailPrivacyRequestStmt = `
+	UPDATE users_privacy_requests SET
+		status = 'failed',
+		error = $2
+	WHERE id = $1
+	RETURNING ` + privacyRequestColumns + `;
+	`
+
+	SelectPrivacyRequestStmt = `
+	SELECT
+	` + privacyRequestColumns + `
+	FROM users_privacy_requests
+	WHERE id = $1;
+	`
+
+	SelectPrivacyRequestsStmt = `
+	SELECT
+	` + privacyRequestColumns + `
+	FROM users_privacy_requests
+	WHERE user_id = $1
+	ORDER BY requested_at DESC, id DESC;
+	`
+
+	// Permanently remove a user whether or not it is soft deleted.
+	EraseOneStmt = `
+	DELETE FROM users
+	WHERE id = $1;
+	`
+
+	// Keep the shape of the audit trail of an erased user, who changed what when, but none of the values.
+	AnonymizeHistoryStmt = `
+	UPDATE users_history SET
+		old_values = NULL,
+		new_values = NULL
+	WHERE user_id = $1;
+	`
+
+	// AnonymizeHistoryStmt for every user in the array $1, such as the users removed by PurgeStmt.
+	AnonymizeManyHistoryStmt = `
+	UPDATE users_history SET
+		old_values = NULL,
+		new_values = NULL
+	WHERE user_id = ANY($1);
+	`
+
+	// Lock the next $2 users with an email after ID $1, soft deleted or not, for re-encryption.
+	SelectEmailsForUpdateStmt = `
+	SELECT
+	id, email, email_index
 	FROM users
-	ORDER BY created_at DESC
-	LIMIT $1;
+	WHERE id > $1 AND email <> ''
+	ORDER BY id
+	LIMIT $2
+	FOR UPDATE;
 	`
 
+	UpdateEmailStmt = `
+	UPDATE users SET
+		email = $2,
+		email_index = $3
+	WHERE id = $1;
+	`
+
+	// Hard-deletes every user, soft deleted or not. Only meant for resetting test databases.
 	DeleteManyStmt = `
 	DELETE FROM users;
 	`
 )
+
+// Migrations evolve the table created by CreateTableStmt. Each one is idempotent and they are applied in order every
+// time the service starts, so append new migrations rather than editing old ones. Objects replaced as they run, such
+// as functions, are the exception: define each in a single migration and edit it there, as a later definition would
+// be undone by the earlier one on every start until it runs again.
+var Migrations = []string{
+	// Profile fields. Users created before usernames were required are named after their ID.
+	`
+	UPDATE users SET username = 'user_' || id WHERE username IS NULL;
+	ALTER TABLE users ALTER COLUMN username SET NOT NULL;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '';
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active'
+		CHECK (status IN ('active', 'pending', 'suspended'));
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at timestamp with time zone NOT NULL DEFAULT now();
+	`,
+
+	// Usernames are unique regardless of case. Usernames taken more than once before the index existed keep their
+	// oldest user, the others are suffixed with their ID, and a counter too should that name be taken as well. Emails
+	// are unique through their blind index, see below.
+	`
+	DO $$
+	DECLARE
+		duplicate RECORD;
+		candidate TEXT;
+		attempt INT;
+	BEGIN
+		IF to_regclass('users_username_lower_idx') IS NULL THEN
+			FOR duplicate IN
+				SELECT id, username FROM (
+					SELECT id, username,
+						row_number() OVER (PARTITION BY lower(username) ORDER BY created_at, id) AS n
+					FROM users
+				) ranked
+				WHERE n > 1
+			LOOP
+				candidate := duplicate.username || '-' || duplicate.id;
+				attempt := 1;
+				WHILE EXISTS (SELECT 1 FROM users WHERE lower(username) = lower(candidate)) LOOP
+					attempt := attempt + 1;
+					candidate := duplicate.username || '-' || duplicate.id || '-' || attempt;
+				END LOOP;
+				UPDATE users SET username = candidate WHERE id = duplicate.id;
+			END LOOP;
+		END IF;
+	END
+	$$;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (lower(username));
+	`,
+
+	// Maintain updated_at on every update, and bump the version clients send back in If-Match for optimistic
+	// concurrency.
+	`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+	CREATE OR REPLACE FUNCTION users_set_updated_at() RETURNS trigger AS $$
+	BEGIN
+		NEW.updated_at = now();
+		NEW.version = OLD.version + 1;
+		RETURN NEW;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS users_set_updated_at ON users;
+	CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users
+		FOR EACH ROW EXECUTE PROCEDURE users_set_updated_at();
+	`,
+
+	// Arbitrary attributes, the GIN index answers containment (@>) and key existence (?) queries.
+	`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+	CREATE INDEX IF NOT EXISTS users_metadata_idx ON users USING GIN (metadata);
+	`,
+
+	// Labels, the GIN index answers the overlap (&&) and containment (@>) filters of the list endpoint.
+	`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}'
+		CHECK (cardinality(tags) <= 64);
+	CREATE INDEX IF NOT EXISTS users_tags_idx ON users USING GIN (tags);
+	`,
+
+	// Search: a generated tsvector for whole words and trigram indexes for misspellings and prefixes.
+	`
+	CREATE EXTENSION IF NOT EXISTS pg_trgm;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS search_vector tsvector
+		GENERATED ALWAYS AS (to_tsvector('simple', username || ' ' || display_name)) STORED;
+	CREATE INDEX IF NOT EXISTS users_search_vector_idx ON users USING GIN (search_vector);
+	CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN (username gin_trgm_ops);
+	CREATE INDEX IF NOT EXISTS users_display_name_trgm_idx ON users USING GIN (display_name gin_trgm_ops);
+	`,
+
+	// Soft deletes, the partial index serves the purge job without bloating with live users.
+	`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+	CREATE INDEX IF NOT EXISTS users_deleted_at_idx ON users (deleted_at) WHERE deleted_at IS NOT NULL;
+	`,
+
+	// Audit trail: every change to a row is recorded with the actor and request set by SetAuditContextStmt. Writes made
+	// outside the service are attributed to the database role which made them.
+	`
+	CREATE TABLE IF NOT EXISTS users_history (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		operation TEXT NOT NULL,
+		old_values JSONB,
+		new_values JSONB,
+		actor TEXT NOT NULL,
+		request_id TEXT NOT NULL DEFAULT '',
+		changed_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS users_history_user_id_changed_at_idx ON users_history (user_id, changed_at);
+
+	CREATE OR REPLACE FUNCTION users_record_history() RETURNS trigger AS $$
+	DECLARE
+		change_actor TEXT := COALESCE(NULLIF(current_setting('app.actor', true), ''), 'db:' || current_user);
+		change_request_id TEXT := COALESCE(current_setting('app.request_id', true), '');
+	BEGIN
+		IF TG_OP = 'INSERT' THEN
+			INSERT INTO users_history (user_id, operation, new_values, actor, request_id)
+			VALUES (NEW.id, TG_OP, to_jsonb(NEW) - 'search_vector', change_actor, change_request_id);
+		ELSIF TG_OP = 'UPDATE' THEN
+			INSERT INTO users_history (user_id, operation, old_values, new_values, actor, request_id)
+			VALUES (NEW.id, TG_OP, to_jsonb(OLD) - 'search_vector', to_jsonb(NEW) - 'search_vector', change_actor, change_request_id);
+		ELSE
+			INSERT INTO users_history (user_id, operation, old_values, actor, request_id)
+			VALUES (OLD.id, TG_OP, to_jsonb(OLD) - 'search_vector', change_actor, change_request_id);
+		END IF;
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS users_record_history ON users;
+	CREATE TRIGGER users_record_history AFTER INSERT OR UPDATE OR DELETE ON users
+		FOR EACH ROW EXECUTE PROCEDURE users_record_history();
+	`,
+
+	// Data subject requests: every access and erasure request is kept, with its status, to show they were honored in
+	// time. Only the ID of the user is recorded so the log itself holds no personal data.
+	`
+	CREATE TABLE IF NOT EXISTS users_privacy_requests (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		kind TEXT NOT NULL CHECK (kind IN ('access', 'erasure')),
+		status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'completed', 'failed')),
+		requested_by TEXT NOT NULL,
+		request_id TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		requested_at timestamp with time zone NOT NULL DEFAULT now(),
+		due_at timestamp with time zone NOT NULL DEFAULT now() + interval '30 days',
+		completed_at timestamp with time zone
+	);
+	CREATE INDEX IF NOT EXISTS users_privacy_requests_user_id_idx ON users_privacy_requests (user_id);
+	`,
+
+	// Encrypted emails: ciphertexts are unique, so emails are unique through the blind index of the lower cased email,
+	// users without an email don't conflict. Rows written before this migration have no index until the rotate-keys
+	// command backfills it. Older versions indexed the lower cased email itself, which no longer holds.
+	`
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS email_index TEXT NOT NULL DEFAULT '';
+	DROP INDEX IF EXISTS users_email_lower_idx;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email_index_idx ON users (email_index) WHERE email_index <> '';
+	`,
+
+	// A change counter validating cached lists of users. It is bumped once per statement rather than per row, in the
+	// writing transaction, so it never runs ahead of what readers can see. Deletes, purges and truncation bump it too.
+	`
+	CREATE TABLE IF NOT EXISTS users_changes (
+		id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+		counter BIGINT NOT NULL DEFAULT 0,
+		changed_at timestamp with time zone NOT NULL DEFAULT now()
+	);
+	INSERT INTO users_changes DEFAULT VALUES ON CONFLICT DO NOTHING;
+
+	CREATE OR REPLACE FUNCTION users_count_change() RETURNS trigger AS $$
+	BEGIN
+		UPDATE users_changes SET counter = counter + 1, changed_at = clock_timestamp();
+		RETURN NULL;
+	END;
+	$$ LANGUAGE plpgsql;
+
+	DROP TRIGGER IF EXISTS users_count_change ON users;
+	CREATE TRIGGER users_count_change AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON users
+		FOR EACH STATEMENT EXECUTE PROCEDURE users_count_change();
+	`,
+}
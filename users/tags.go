@@ -0,0 +1,104 @@
+package users
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9:_-]{0,31}$`)
+
+type (
+	// TagsInput is the body accepted by the tags endpoint. Tags are added before they are removed.
+	TagsInput struct {
+		Add    []string `json:"add"`
+		Remove []string `json:"remove"`
+	}
+
+	// TagCount is the number of users carrying a tag.
+	TagCount struct {
+		Tag   string `json:"tag" db:"tag"`
+		Count int64  `json:"count" db:"count"`
+	}
+)
+
+// GetTags endpoint returns every tag in use with the number of users carrying it, most used first.
+func (s *Service) GetTags(w http.ResponseWriter, r *http.Request) {
+	results := []*TagCount{}
+	err := s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(r.Context(), db, &results, SelectTagCountsStmt)
+	})
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, results)
+}
+
+// UpdateTags endpoint adds and removes tags on a user in a single statement, so concurrent updates never lose tags.
+func (s *Service) UpdateTags(w http.ResponseWriter, r *http.Request) {
+	input := &TagsInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	s.updateTags(w, r, input.Add, input.Remove)
+}
+
+// RemoveTag endpoint removes a single tag from a user.
+func (s *Service) RemoveTag(w http.ResponseWriter, r *http.Request) {
+	s.updateTags(w, r, nil, []string{mux.Vars(r)["tag"]})
+}
+
+func (s *Service) updateTags(w http.ResponseWriter, r *http.Request, add, remove []string) {
+	add, remove = normalizeTags(add), normalizeTags(remove)
+
+	for _, tag := range append(add, remove...) {
+		if !tagPattern.MatchString(tag) {
+			s.render(w, r, http.StatusUnprocessableEntity, ValidationError{"tags": "must be 1 to 32 lowercase letters, digits, ':', '_' or '-'"})
+			return
+		}
+	}
+
+	user := &User{}
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		if _, err := s.lockUser(r.Context(), tx, mux.Vars(r)["id"], r.Header.Get("If-Match"), false); err != nil {
+			return err
+		}
+
+		return tx.GetContext(r.Context(), user, UpdateTagsStmt, mux.Vars(r)["id"], add, remove)
+	})
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user))
+	s.render(w, r, http.StatusOK, user.Tags)
+}
+
+// normalizeTags lowercases and trims tags, dropping empty ones. Always returns a non-nil array: a nil pq.StringArray is
+// sent as NULL, which no array operator matches.
+func normalizeTags(tags []string) pq.StringArray {
+	normalized := pq.StringArray{}
+	for _, tag := range tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized
+}
+
+// splitTags reads a tag filter given either as repeated parameters or as a comma separated list.
+func splitTags(params []string) pq.StringArray {
+	tags := []string{}
+	for _, param := range params {
+		tags = append(tags, strings.Split(param, ",")...)
+	}
+	return normalizeTags(tags)
+}
@@ -0,0 +1,107 @@
+package users
+
+import (
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/lib/pq"
+)
+
+const (
+	StatusActive    = "active"
+	StatusPending   = "pending"
+	StatusSuspended = "suspended"
+)
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+type (
+	// User model for the table defined in sql.go .
+	User struct {
+		ID          int64  `json:"ID" db:"id"`
+		Username    string `json:"username" db:"username"`
+		Email       string `json:"email" db:"email"`
+		DisplayName string `json:"displayName" db:"display_name"`
+		Status      string `json:"status" db:"status"`
+		// Free-form JSON object, written through the metadata endpoints.
+		Metadata types.JSONText `json:"metadata" db:"metadata"`
+		// Sorted, distinct labels, written through the tags endpoints.
+		Tags      pq.StringArray `json:"tags" db:"tags"`
+		CreatedAt time.Time      `json:"createdAt" db:"created_at"`
+		UpdatedAt time.Time      `json:"updatedAt" db:"updated_at"`
+		// Set while the user is soft deleted, until it is restored or purged.
+		DeletedAt *time.Time `json:"deletedAt,omitempty" db:"deleted_at"`
+		// Incremented by every update, served as the ETag of the user.
+		Version int64 `json:"version" db:"version"`
+	}
+
+	// UserInput is the body accepted when creating or updating a user. Fields left out of an update are unchanged.
+	UserInput struct {
+		Username    *string `json:"username"`
+		Email       *string `json:"email"`
+		DisplayName *string `json:"displayName"`
+		Status      *string `json:"status"`
+	}
+
+	// ValidationError maps the JSON name of each invalid field to a description of the problem.
+	ValidationError map[string]string
+)
+
+func (e ValidationError) Error() string {
+	problems := make([]string, 0, len(e))
+	for field, problem := range e {
+		problems = append(problems, field+": "+problem)
+	}
+	return "invalid user: " + strings.Join(problems, ", ")
+}
+
+// Apply copies the fields present in the input onto the user, trimming surrounding whitespace.
+func (in *UserInput) Apply(user *User) {
+	if in.Username != nil {
+		user.Username = strings.TrimSpace(*in.Username)
+	}
+	if in.Email != nil {
+		user.Email = strings.TrimSpace(*in.Email)
+	}
+	if in.DisplayName != nil {
+		user.DisplayName = strings.TrimSpace(*in.DisplayName)
+	}
+	if in.Status != nil {
+		user.Status = strings.TrimSpace(*in.Status)
+	}
+}
+
+// Validate the fields of a user which are writable by clients. Returns a ValidationError or nil.
+func (u *User) Validate() error {
+	problems := ValidationError{}
+
+	if !usernamePattern.MatchString(u.Username) {
+		problems["username"] = "must be 3 to 32 letters, digits, '.', '_' or '-'"
+	}
+
+	if u.Email != "" {
+		if address, err := mail.ParseAddress(u.Email); err != nil || address.Address != u.Email {
+			problems["email"] = "must be a bare email address"
+		}
+	}
+
+	if utf8.RuneCountInString(u.DisplayName) > 64 {
+		problems["displayName"] = "must be at most 64 characters"
+	}
+
+	switch u.Status {
+	case StatusActive, StatusPending, StatusSuspended:
+	default:
+		problems["status"] = "must be one of active, pending or suspended"
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+
+	return nil
+}
@@ -2,87 +2,453 @@ package users
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"time"
 
 	"path/filepath"
 
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/jsonschema"
+	"github.com/b3ntly/twelvefactor_databases/render"
 	"github.com/gorilla/mux"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type (
 	// Config for the users service.
 	Config struct {
-		Ctx             context.Context
+		Ctx context.Context
 		// The path prefix to expose the subrouter provided by this service, defaults to /users.
 		UsersPathPrefix string
 		Logger          *log.Logger
 		DB              *sqlx.DB
 		// The number of users to return from the Get endpoint. Defaults to 10.
 		SelectManyLimit int
+		// The number of rows fetched from the export cursor between flushes. Defaults to 500.
+		ExportBatchSize int
+		// Encodes responses in the format negotiated with the client, defaults to render.Default().
+		Renderer *render.Renderer
+		// The largest metadata object, in bytes of JSON, a user may carry. Defaults to 16KiB.
+		MetadataMaxBytes int
+		// Every metadata object written must satisfy this schema when set.
+		MetadataSchema *jsonschema.Schema
+		// How long soft deleted users are kept before RunPurger removes them for good. Defaults to 30 days.
+		PurgeRetention time.Duration
+		// How often RunPurger looks for users to purge, zero or less disables purging.
+		PurgeInterval time.Duration
+		// Reject writes to a user without an If-Match header, so clients can't overwrite changes they haven't seen.
+		RequireIfMatch bool
+		// Cache-Control header of list responses, unset to send none.
+		ListCacheControl string
+		// Authorizes requests against the action and resource each route declares, nil lets every request through.
+		Enforcer access.Enforcer
+		// Let every request through to the routes reading and writing users, for deployments which don't authenticate
+		// their clients yet. Routes requiring the admin action are guarded by Enforcer regardless.
+		AllowAnonymous bool
+		// Applied to every transaction of the service, such as tenancy.Service.Scope confining it to the tenant of the
+		// request. Reads run in transactions as well when it is set.
+		Scope func(ctx context.Context, tx *sqlx.Tx) error
+		// Encrypts emails before they are written and indexes them for lookups. Nil stores them in plaintext, only
+		// acceptable in development.
+		Keyring *fieldcrypt.Keyring
 	}
 
 	// Service: users.
 	Service struct {
-		ctx             context.Context
-		db              *sqlx.DB
-		pathPrefix      string
-		logger          *log.Logger
-		selectManyLimit int
-	}
-
-	// User model for the table defined in sql.go .
-	User struct {
-		ID        int64  `json:"ID" db:"id"`
-		Username  string `json:"username" db:"username"`
-		CreatedAt string `json:"createdAt" db:"created_at"`
+		ctx              context.Context
+		db               *sqlx.DB
+		pathPrefix       string
+		logger           *log.Logger
+		selectManyLimit  int
+		exportBatchSize  int
+		renderer         *render.Renderer
+		metadataMaxBytes int
+		metadataSchema   *jsonschema.Schema
+		purgeRetention   time.Duration
+		purgeInterval    time.Duration
+		requireIfMatch   bool
+		listCacheControl string
+		personalData     []PersonalData
+		enforcer         access.Enforcer
+		allowAnonymous   bool
+		scope            func(ctx context.Context, tx *sqlx.Tx) error
+		keyring          *fieldcrypt.Keyring
 	}
 )
 
+// Largest request body accepted by the write endpoints.
+const maxBodyBytes = 1 << 20
+
 // New: Instantiate a new users service. Fail hard if errors occur (our application shouldn't run without this service).
 func New(config *Config) *Service {
-	_, err := config.DB.Exec(CreateTableStmt)
-
-	if err != nil {
+	if err := Migrate(context.Background(), config.DB); err != nil {
 		config.Logger.Fatal(err)
 	}
 
+	exportBatchSize := config.ExportBatchSize
+	if exportBatchSize <= 0 {
+		exportBatchSize = 500
+	}
+
+	renderer := config.Renderer
+	if renderer == nil {
+		renderer = render.Default()
+	}
+
+	metadataMaxBytes := config.MetadataMaxBytes
+	if metadataMaxBytes <= 0 {
+		metadataMaxBytes = 16 << 10
+	}
+
+	purgeRetention := config.PurgeRetention
+	if purgeRetention <= 0 {
+		purgeRetention = 30 * 24 * time.Hour
+	}
+
 	return &Service{
-		ctx:             config.Ctx,
-		db:              config.DB,
-		pathPrefix:      config.UsersPathPrefix,
-		logger:          config.Logger,
-		selectManyLimit: config.SelectManyLimit,
+		ctx:              config.Ctx,
+		db:               config.DB,
+		pathPrefix:       config.UsersPathPrefix,
+		logger:           config.Logger,
+		selectManyLimit:  config.SelectManyLimit,
+		exportBatchSize:  exportBatchSize,
+		renderer:         renderer,
+		metadataMaxBytes: metadataMaxBytes,
+		metadataSchema:   config.MetadataSchema,
+		purgeRetention:   purgeRetention,
+		purgeInterval:    config.PurgeInterval,
+		requireIfMatch:   config.RequireIfMatch,
+		listCacheControl: config.ListCacheControl,
+		enforcer:         config.Enforcer,
+		allowAnonymous:   config.AllowAnonymous,
+		scope:            config.Scope,
+		keyring:          config.Keyring,
 	}
 }
 
-// Mount the subRouter of this service to the root router.
+// Migrate creates the users table if it doesn't exist and applies every migration to it.
+func Migrate(ctx context.Context, db sqlx.ExecerContext) error {
+	for _, stmt := range append([]string{CreateTableStmt}, Migrations...) {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mount the subRouter of this service to the root router. Every route declares the action it performs, users:read to
+// read users, users:write to change them and admin to act on privacy requests, and the resource it acts on: the users
+// collection or a single user.
 func (s *Service) Mount(r *mux.Router) {
+	read, write, admin := access.UsersRead, access.UsersWrite, access.Admin
+	all, one := access.Static("users"), access.Var("users", "id")
+
 	subRouter := r.PathPrefix(filepath.Join("/", s.pathPrefix)).Subrouter()
-	subRouter.HandleFunc("", s.Get)
+	subRouter.Handle("", s.require(read, all, s.Get)).Methods("GET")
+	subRouter.Handle("", s.require(write, all, s.Create)).Methods("POST")
+	subRouter.Handle("/batch", s.require(write, all, s.Batch)).Methods("POST")
+	subRouter.Handle("/export", s.require(read, all, s.Export)).Methods("GET")
+	subRouter.Handle("/tags", s.require(read, all, s.GetTags)).Methods("GET")
+	subRouter.Handle("/search", s.require(read, all, s.Search)).Methods("GET")
+	subRouter.Handle("/privacy-requests/{id:[0-9]+}",
+		s.require(admin, access.Var("privacy-requests", "id"), s.GetPrivacyRequest)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}", s.require(read, one, s.GetOne)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}", s.require(write, one, s.Update)).Methods("PATCH")
+	subRouter.Handle("/{id:[0-9]+}", s.require(write, one, s.Delete)).Methods("DELETE")
+	subRouter.Handle("/{id:[0-9]+}/restore", s.require(write, one, s.Restore)).Methods("POST")
+	subRouter.Handle("/{id:[0-9]+}/history", s.require(read, one, s.History)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}/archive", s.require(admin, one, s.Archive)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}/erasure", s.require(admin, one, s.Erase)).Methods("POST")
+	subRouter.Handle("/{id:[0-9]+}/privacy-requests", s.require(admin, one, s.GetPrivacyRequests)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}/metadata", s.require(read, one, s.GetMetadata)).Methods("GET")
+	subRouter.Handle("/{id:[0-9]+}/metadata", s.require(write, one, s.ReplaceMetadata)).Methods("PUT")
+	subRouter.Handle("/{id:[0-9]+}/metadata", s.require(write, one, s.PatchMetadata)).Methods("PATCH")
+	subRouter.Handle("/{id:[0-9]+}/tags", s.require(write, one, s.UpdateTags)).Methods("POST")
+	subRouter.Handle("/{id:[0-9]+}/tags/{tag}", s.require(write, one, s.RemoveTag)).Methods("DELETE")
+}
+
+// require guards a route with the enforcer of the service, unless it only reads or writes users and anonymous callers
+// are allowed.
+func (s *Service) require(action string, resource access.Resource, handler http.HandlerFunc) http.Handler {
+	if s.allowAnonymous && action != access.Admin {
+		return handler
+	}
+	return access.Require(s.enforcer, action, resource, handler)
 }
 
-// Get endpoint returns an array of users with JSON encoding.
+// Absolute path of the export endpoint, used to exempt it from the request timeout.
+func (s *Service) exportPath() string {
+	return filepath.Join("/", s.pathPrefix, "export")
+}
+
+// Get endpoint returns a page of users, most recently created first, filtered by the parameters of parseListQuery and
+// paginated by those of parsePage. Responses carry validators of the whole table, so clients and caches revalidate
+// with conditional requests answered without running the query.
 func (s *Service) Get(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r.URL.Query(), s.selectManyLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	q, err := parseListQuery(r.URL.Query(), s.keyring)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	answered, err := s.cacheList(w, r)
+	if err != nil {
+		s.writeError(w, err)
+		return
+	}
+	if answered {
+		return
+	}
+
 	results := []*User{}
-	err := s.db.Select(&results, SelectManyStmt, s.selectManyLimit)
+	stmt := fmt.Sprintf(SelectManyStmt, q.clause(), q.arg(limit), q.arg(offset))
+	err = s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.SelectContext(r.Context(), db, &results, stmt, q.args...)
+	})
+	if err == nil {
+		err = s.open(results...)
+	}
 
 	if err != nil {
 		s.writeError(w, err)
 		return
 	}
 
-	response, err := json.Marshal(results)
+	s.render(w, r, http.StatusOK, results)
+}
+
+// GetOne endpoint returns a single user by ID, tagged with its version as an ETag so clients can revalidate with
+// If-None-Match and make conditional writes with If-Match. Soft deleted users are only returned with
+// ?include_deleted=true, and ?as_of= returns the user as it was at an earlier time instead.
+func (s *Service) GetOne(w http.ResponseWriter, r *http.Request) {
+	if asOf := r.URL.Query().Get("as_of"); asOf != "" {
+		s.getAsOf(w, r, asOf)
+		return
+	}
+
+	includeDeleted := r.URL.Query().Get("include_deleted") == "true"
+
+	user := &User{}
+	err := s.read(r.Context(), func(db sqlx.QueryerContext) error {
+		return sqlx.GetContext(r.Context(), db, user, SelectOneStmt, mux.Vars(r)["id"], includeDeleted)
+	})
+	if err == nil {
+		err = s.open(user)
+	}
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user))
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matchWeakETag(inm, etag(user)) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	s.render(w, r, http.StatusOK, user)
+}
+
+// Create endpoint validates and inserts a new user, responding with the stored representation.
+func (s *Service) Create(w http.ResponseWriter, r *http.Request) {
+	input := &UserInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var user *User
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		user, err = s.createUser(r.Context(), tx, input)
+		return err
+	})
+
+	if problems, ok := err.(ValidationError); ok {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
 	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", filepath.Join("/", s.pathPrefix, strconv.FormatInt(user.ID, 10)))
+	w.Header().Set("ETag", etag(user))
+	s.render(w, r, http.StatusCreated, user)
+}
+
+// Update endpoint applies the fields present in the body to an existing user, if it still matches If-Match.
+func (s *Service) Update(w http.ResponseWriter, r *http.Request) {
+	input := &UserInput{}
+	if !s.decode(w, r, input) {
+		return
+	}
+
+	var user *User
+	err := s.inTx(r.Context(), func(tx *sqlx.Tx) error {
+		var err error
+		user, err = s.updateUser(r.Context(), tx, mux.Vars(r)["id"], r.Header.Get("If-Match"), input)
+		return err
+	})
+
+	if problems, ok := err.(ValidationError); ok {
+		s.render(w, r, http.StatusUnprocessableEntity, problems)
+		return
+	}
+
+	if err != nil {
+		s.writeDBError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(user))
+	s.render(w, r, http.StatusOK, user)
+}
+
+// createUser validates and inserts a new user within tx. Returns a ValidationError if the input is invalid.
+func (s *Service) createUser(ctx context.Context, tx *sqlx.Tx, input *UserInput) (*User, error) {
+	user := &User{Status: StatusActive}
+	input.Apply(user)
+
+	if err := user.Validate(); err != nil {
+		return nil, err
+	}
+
+	email, err := s.keyring.Seal(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.GetContext(ctx, user, InsertOneStmt, user.Username, email, user.DisplayName, user.Status,
+		s.emailIndex(user.Email))
+	if err != nil {
+		return nil, err
+	}
+
+	return user, s.open(user)
+}
+
+// updateUser applies input to the user with the given ID within tx, provided it matches ifMatch. Returns a
+// ValidationError if the result is invalid.
+func (s *Service) updateUser(ctx context.Context, tx *sqlx.Tx, id, ifMatch string, input *UserInput) (*User, error) {
+	user, err := s.lockUser(ctx, tx, id, ifMatch, false)
+	if err != nil {
+		return nil, err
+	}
+
+	input.Apply(user)
+
+	if err := user.Validate(); err != nil {
+		return nil, err
+	}
+
+	email, err := s.keyring.Seal(user.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.GetContext(ctx, user, UpdateOneStmt, user.ID, user.Username, email, user.DisplayName, user.Status,
+		s.emailIndex(user.Email))
+	if err != nil {
+		return nil, err
+	}
+
+	return user, s.open(user)
+}
+
+// Decode a JSON request body into v, answering the request with 400, or 413 when the body is larger than maxBodyBytes,
+// and returning false if that fails.
+func (s *Service) decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		if tooLarge(err) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, "request body must be a JSON object: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// tooLarge reports whether reading a request body failed because it exceeded the limit of its http.MaxBytesReader,
+// rather than because it was malformed or cut short.
+func tooLarge(err error) bool {
+	var maxBytes *http.MaxBytesError
+	return errors.As(err, &maxBytes) || err.Error() == "http: request body too large"
+}
+
+// Write v in the format negotiated with the client.
+func (s *Service) render(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	err := s.renderer.RenderStatus(w, r, status, v)
+
+	// the renderer has already answered requests for formats it doesn't support
+	if err != nil && err != render.ErrNotAcceptable {
+		s.writeError(w, err)
+	}
+}
+
+// Translate errors from the database into client errors where the client is at fault.
+func (s *Service) writeDBError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := errorStatus(err)
+	if status == http.StatusInternalServerError {
 		s.writeError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(response)
+	http.Error(w, message, status)
+}
+
+// errorStatus returns the status and message answering a request which failed with err, 500 when the client isn't at
+// fault.
+func errorStatus(err error) (int, string) {
+	if err == sql.ErrNoRows {
+		return http.StatusNotFound, "user not found"
+	}
+
+	if err == errPreconditionFailed {
+		return http.StatusPreconditionFailed, err.Error()
+	}
+
+	if err == errPreconditionRequired {
+		return http.StatusPreconditionRequired, err.Error()
+	}
+
+	if _, ok := err.(ValidationError); ok {
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		// unique_violation, see https://www.postgresql.org/docs/current/static/errcodes-appendix.html
+		case "23505":
+			return http.StatusConflict, "username or email is already taken"
+		// check_violation, raised by the limits declared on the table.
+		case "23514":
+			return http.StatusUnprocessableEntity, "value is out of range: " + pqErr.Constraint
+		}
+	}
+
+	return http.StatusInternalServerError, ""
 }
 
 // Error handling logic for this service.
@@ -14,12 +14,22 @@ import (
 	// Minimal router middleware that extends net/http
 	"encoding/json"
 	"fmt"
+	"github.com/b3ntly/twelvefactor_databases/access"
+	"github.com/b3ntly/twelvefactor_databases/fieldcrypt"
+	"github.com/b3ntly/twelvefactor_databases/jsonschema"
+	"github.com/b3ntly/twelvefactor_databases/rbac"
+	"github.com/b3ntly/twelvefactor_databases/reqctx"
 	"github.com/b3ntly/twelvefactor_databases/users"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/require"
+	"io"
 	"io/ioutil"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strings"
+	"testing/iotest"
+	"time"
 )
 
 const (
@@ -35,6 +45,8 @@ func setupDatabase(t testing.TB, ctx context.Context) *sqlx.DB {
 	require.Nil(t, err)
 	require.Nil(t, bootstrapDatabase(ctx, database))
 	require.Nil(t, cleanDatabase(ctx, database))
+	// Migrate once the table is empty so unique indexes can't trip over rows left by older test runs.
+	require.Nil(t, users.Migrate(ctx, database))
 	require.Nil(t, populateDatabase(ctx, database))
 	return database
 }
@@ -54,7 +66,7 @@ func cleanDatabase(ctx context.Context, database *sqlx.DB) error {
 // Insert users into the database for testing purposes.
 func populateDatabase(ctx context.Context, database *sqlx.DB) error {
 	for i := 0; i < selectManyLimit; i++ {
-		_, err := database.ExecContext(ctx, users.InsertOneStmt, "fred")
+		_, err := database.ExecContext(ctx, users.InsertOneStmt, fmt.Sprintf("fred%d", i), "", "", users.StatusActive, "")
 
 		if err != nil {
 			return err
@@ -64,6 +76,29 @@ func populateDatabase(ctx context.Context, database *sqlx.DB) error {
 	return nil
 }
 
+// Test that migrating a table holding usernames differing only by case keeps the oldest and renames the others.
+func TestMigrate_DuplicateUsernames(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	_, err := db.ExecContext(ctx, `DROP INDEX users_username_lower_idx;`)
+	require.Nil(t, err)
+
+	ids := make([]int64, 2)
+	for i, username := range []string{"Barney", "barney"} {
+		user := &users.User{}
+		require.Nil(t, db.GetContext(ctx, user, users.InsertOneStmt, username, "", "", users.StatusActive, ""))
+		ids[i] = user.ID
+	}
+
+	require.Nil(t, users.Migrate(ctx, db))
+
+	usernames := []string{}
+	require.Nil(t, db.SelectContext(ctx, &usernames, `SELECT username FROM users WHERE id IN ($1, $2) ORDER BY id;`,
+		ids[0], ids[1]))
+	require.Equal(t, []string{"Barney", fmt.Sprintf("barney-%d", ids[1])}, usernames)
+}
+
 // Test the Get endpoint of the users service.
 func TestService_Get(t *testing.T) {
 	ctx := context.Background()
@@ -89,7 +124,7 @@ func TestService_Get(t *testing.T) {
 	defer res.Body.Close()
 
 	if res.StatusCode >= 299 {
-		require.Nil(t, errors.New(fmt.Sprintf("Invalid status code: %s", res.StatusCode)))
+		require.Nil(t, errors.New(fmt.Sprintf("Invalid status code: %d", res.StatusCode)))
 	}
 
 	response, err := ioutil.ReadAll(res.Body)
@@ -101,6 +136,910 @@ func TestService_Get(t *testing.T) {
 	require.Equal(t, 10, len(rows))
 }
 
+// Test that lists of users are answered with 304 Not Modified until a user is written.
+func TestService_GetConditional(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:              ctx,
+		Logger:           log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:               db,
+		UsersPathPrefix:  usersPathPrefix,
+		SelectManyLimit:  selectManyLimit,
+		ListCacheControl: "private, no-cache",
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("GET", "http://localhost:9090/users", "")
+	require.Equal(t, 200, w.Code)
+	require.Equal(t, "private, no-cache", w.Header().Get("Cache-Control"))
+	tag, lastModified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	require.NotEmpty(t, tag)
+	require.NotEmpty(t, lastModified)
+
+	w = send("GET", "http://localhost:9090/users?tag=beta", "", "If-None-Match", tag)
+	require.Equal(t, 304, w.Code)
+	require.Empty(t, w.Body.String())
+	require.Equal(t, 304, send("GET", "http://localhost:9090/users", "", "If-Modified-Since", lastModified).Code)
+
+	w = send("POST", "http://localhost:9090/users", `{"username": "pebbles"}`)
+	require.Equal(t, 201, w.Code)
+	location := w.Header().Get("Location")
+
+	w = send("GET", "http://localhost:9090/users", "", "If-None-Match", tag)
+	require.Equal(t, 200, w.Code)
+	require.NotEqual(t, tag, w.Header().Get("ETag"))
+
+	// Updates change the validator as well as inserts.
+	tag = w.Header().Get("ETag")
+	require.Equal(t, 200, send("PATCH", "http://localhost:9090"+location, `{"displayName": "Pebbles"}`).Code)
+	w = send("GET", "http://localhost:9090/users", "", "If-None-Match", tag)
+	require.Equal(t, 200, w.Code)
+
+	// And so do hard deletes, such as purges, which leave no row behind.
+	tag = w.Header().Get("ETag")
+	_, err := db.ExecContext(ctx, `DELETE FROM users WHERE username = 'pebbles'`)
+	require.Nil(t, err)
+	require.Equal(t, 200, send("GET", "http://localhost:9090/users", "", "If-None-Match", tag).Code)
+}
+
+// Test the Export endpoint of the users service in each supported format.
+func TestService_Export(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+		// Smaller than the number of rows so the cursor is fetched more than once.
+		ExportBatchSize: 3,
+	})
+
+	service.Mount(router)
+
+	export := func(accept string) (int, string) {
+		req := httptest.NewRequest("GET", "http://localhost:9090/users/export", nil)
+		req.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := export("text/csv")
+	require.Equal(t, 200, code)
+	// One header row followed by a row per user.
+	require.Equal(t, selectManyLimit+1, len(strings.Split(strings.TrimSpace(body), "\n")))
+
+	code, body = export("application/x-ndjson")
+	require.Equal(t, 200, code)
+	require.Equal(t, selectManyLimit, len(strings.Split(strings.TrimSpace(body), "\n")))
+
+	code, body = export("application/json")
+	require.Equal(t, 200, code)
+	rows := make([]*users.User, 0)
+	require.Nil(t, json.Unmarshal([]byte(body), &rows))
+	require.Equal(t, selectManyLimit, len(rows))
+
+	code, _ = export("image/png")
+	require.Equal(t, 406, code)
+}
+
+// Test the Create, GetOne and Update endpoints of the users service.
+func TestService_Create(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "http://localhost:9090/users", `{"username": "Barney", "email": "barney@example.com"}`)
+	require.Equal(t, 201, w.Code)
+
+	created := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+	require.Equal(t, "Barney", created.Username)
+	require.Equal(t, users.StatusActive, created.Status)
+	require.False(t, created.CreatedAt.IsZero())
+	require.Equal(t, fmt.Sprintf("/users/%d", created.ID), w.Header().Get("Location"))
+
+	// Usernames are unique regardless of case.
+	w = send("POST", "http://localhost:9090/users", `{"username": "barney"}`)
+	require.Equal(t, 409, w.Code)
+
+	w = send("POST", "http://localhost:9090/users", `{"username": "b", "status": "asleep"}`)
+	require.Equal(t, 422, w.Code)
+
+	target := fmt.Sprintf("http://localhost:9090/users/%d", created.ID)
+	w = send("PATCH", target, `{"displayName": "Barney Rubble"}`)
+	require.Equal(t, 200, w.Code)
+
+	w = send("GET", target, "")
+	require.Equal(t, 200, w.Code)
+
+	updated := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), updated))
+	require.Equal(t, "Barney Rubble", updated.DisplayName)
+	require.Equal(t, "barney@example.com", string(updated.Email))
+	require.False(t, updated.UpdatedAt.Before(created.UpdatedAt))
+
+	w = send("GET", "http://localhost:9090/users/0", "")
+	require.Equal(t, 404, w.Code)
+}
+
+// Test replacing, merge-patching and filtering on user metadata.
+func TestService_Metadata(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	schema, err := jsonschema.Parse([]byte(`{"type": "object", "properties": {"plan": {"enum": ["free", "pro"]}}}`))
+	require.Nil(t, err)
+
+	service := users.New(&users.Config{
+		Ctx:              ctx,
+		Logger:           log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:               db,
+		UsersPathPrefix:  usersPathPrefix,
+		SelectManyLimit:  selectManyLimit,
+		MetadataMaxBytes: 64,
+		MetadataSchema:   schema,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "http://localhost:9090/users", `{"username": "pebbles"}`)
+	require.Equal(t, 201, w.Code)
+
+	created := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+	require.JSONEq(t, `{}`, created.Metadata.String())
+
+	target := fmt.Sprintf("http://localhost:9090/users/%d/metadata", created.ID)
+
+	w = send("PUT", target, `{"plan": "free", "limits": {"seats": 1, "projects": 2}}`)
+	require.Equal(t, 200, w.Code)
+
+	w = send("PATCH", target, `{"plan": "pro", "limits": {"projects": null}}`)
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `{"plan": "pro", "limits": {"seats": 1}}`, w.Body.String())
+
+	// Rejected by the schema.
+	w = send("PATCH", target, `{"plan": "gold"}`)
+	require.Equal(t, 422, w.Code)
+
+	// Larger than MetadataMaxBytes.
+	w = send("PATCH", target, fmt.Sprintf(`{"notes": "%s"}`, strings.Repeat("x", 64)))
+	require.Equal(t, 413, w.Code)
+
+	// Larger than the service reads at all, or cut short.
+	w = send("PATCH", target, fmt.Sprintf(`{"notes": "%s"}`, strings.Repeat("x", 1<<20)))
+	require.Equal(t, 413, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("PATCH", target, iotest.ErrReader(io.ErrUnexpectedEOF)))
+	require.Equal(t, 400, w.Code)
+
+	list := func(query string) []*users.User {
+		w := send("GET", "http://localhost:9090/users?"+query, "")
+		require.Equal(t, 200, w.Code)
+
+		rows := make([]*users.User, 0)
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		return rows
+	}
+
+	rows := list(url.Values{"metadata": {`{"plan": "pro"}`}}.Encode())
+	require.Equal(t, 1, len(rows))
+	require.Equal(t, created.ID, rows[0].ID)
+
+	rows = list(url.Values{"metadata.limits.seats": {"1"}}.Encode())
+	require.Equal(t, 1, len(rows))
+
+	rows = list(url.Values{"metadata.plan": {"free"}}.Encode())
+	require.Equal(t, 0, len(rows))
+
+	w = send("GET", "http://localhost:9090/users?metadata=pro", "")
+	require.Equal(t, 400, w.Code)
+}
+
+// Test adding, removing, counting and filtering on user tags.
+func TestService_Tags(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	ids := []int64{}
+	for _, username := range []string{"betty", "bamm-bamm"} {
+		w := send("POST", "http://localhost:9090/users", fmt.Sprintf(`{"username": "%s"}`, username))
+		require.Equal(t, 201, w.Code)
+
+		created := &users.User{}
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+		ids = append(ids, created.ID)
+	}
+
+	w := send("POST", fmt.Sprintf("http://localhost:9090/users/%d/tags", ids[0]), `{"add": ["Staff", "beta", "beta"]}`)
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `["beta", "staff"]`, w.Body.String())
+
+	w = send("POST", fmt.Sprintf("http://localhost:9090/users/%d/tags", ids[1]), `{"add": ["beta", "churn-risk"]}`)
+	require.Equal(t, 200, w.Code)
+
+	w = send("DELETE", fmt.Sprintf("http://localhost:9090/users/%d/tags/churn-risk", ids[1]), "")
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `["beta"]`, w.Body.String())
+
+	w = send("POST", fmt.Sprintf("http://localhost:9090/users/%d/tags", ids[1]), `{"add": ["not a tag"]}`)
+	require.Equal(t, 422, w.Code)
+
+	w = send("GET", "http://localhost:9090/users/tags", "")
+	require.Equal(t, 200, w.Code)
+	require.JSONEq(t, `[{"tag": "beta", "count": 2}, {"tag": "staff", "count": 1}]`, w.Body.String())
+
+	count := func(query string) int {
+		w := send("GET", "http://localhost:9090/users?"+query, "")
+		require.Equal(t, 200, w.Code)
+
+		rows := make([]*users.User, 0)
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		return len(rows)
+	}
+
+	require.Equal(t, 2, count("tag=beta"))
+	require.Equal(t, 1, count("tag=beta&tag=staff"))
+	require.Equal(t, 2, count("any_tag=staff,beta"))
+	require.Equal(t, 1, count("all_tags=staff,beta"))
+	require.Equal(t, 0, count("any_tag=churn-risk"))
+}
+
+// Test full-text, fuzzy and prefix searches of users.
+func TestService_Search(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	service.Mount(router)
+
+	for _, body := range []string{
+		`{"username": "dino", "displayName": "Dino Flintstone"}`,
+		`{"username": "gazoo", "displayName": "The Great Gazoo"}`,
+	} {
+		req := httptest.NewRequest("POST", "http://localhost:9090/users", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 201, w.Code)
+	}
+
+	search := func(query string) []*users.SearchResult {
+		req := httptest.NewRequest("GET", "http://localhost:9090/users/search?"+query, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code, w.Body.String())
+
+		results := make([]*users.SearchResult, 0)
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+		return results
+	}
+
+	results := search("q=flintstone")
+	require.Equal(t, 1, len(results))
+	require.Equal(t, "dino", results[0].Username)
+	require.Contains(t, results[0].Highlight, "<mark>Flintstone</mark>")
+	require.True(t, results[0].Score > 0)
+
+	// Misspelled.
+	results = search("q=gazooo")
+	require.Equal(t, 1, len(results))
+	require.Equal(t, "gazoo", results[0].Username)
+
+	results = search("q=flint&mode=prefix")
+	require.Equal(t, 1, len(results))
+
+	results = search("q=flintstone&offset=1")
+	require.Equal(t, 0, len(results))
+
+	req := httptest.NewRequest("GET", "http://localhost:9090/users/search", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, 400, w.Code)
+}
+
+// Test soft deleting, restoring and purging users.
+func TestService_Delete(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+		// Anything deleted before now is due for purging.
+		PurgeRetention: time.Nanosecond,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	count := func(query string) int {
+		w := send("GET", "http://localhost:9090/users?"+query)
+		require.Equal(t, 200, w.Code)
+
+		rows := make([]*users.User, 0)
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rows))
+		return len(rows)
+	}
+
+	rows := make([]*users.User, 0)
+	require.Nil(t, json.Unmarshal(send("GET", "http://localhost:9090/users").Body.Bytes(), &rows))
+	target := fmt.Sprintf("http://localhost:9090/users/%d", rows[0].ID)
+
+	require.Equal(t, 204, send("DELETE", target).Code)
+	require.Equal(t, 404, send("DELETE", target).Code)
+	require.Equal(t, 404, send("GET", target).Code)
+	require.Equal(t, 200, send("GET", target+"?include_deleted=true").Code)
+	require.Equal(t, selectManyLimit-1, count(""))
+	require.Equal(t, selectManyLimit, count("include_deleted=true"))
+
+	require.Equal(t, 200, send("POST", target+"/restore").Code)
+	require.Equal(t, 404, send("POST", target+"/restore").Code)
+	require.Equal(t, selectManyLimit, count(""))
+
+	require.Equal(t, 204, send("DELETE", target).Code)
+	purged, err := service.Purge(ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), purged)
+	require.Equal(t, 404, send("GET", target+"?include_deleted=true").Code)
+
+	// Purged users leave no values behind in their history.
+	var snapshots int
+	require.Nil(t, db.GetContext(ctx, &snapshots, `SELECT count(*) FROM users_history
+		WHERE user_id = $1 AND (old_values IS NOT NULL OR new_values IS NOT NULL);`, rows[0].ID))
+	require.Equal(t, 0, snapshots)
+}
+
+func TestService_History(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body, requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req = req.WithContext(reqctx.WithRequestID(reqctx.WithActor(req.Context(), "user:1"), requestID))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send("POST", "http://localhost:9090/users", `{"username": "barney", "displayName": "Barney"}`, "create")
+	require.Equal(t, 201, w.Code)
+
+	user := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), user))
+	target := fmt.Sprintf("http://localhost:9090/users/%d", user.ID)
+
+	require.Equal(t, 200, send("PATCH", target, `{"displayName": "Barney Rubble"}`, "update").Code)
+
+	w = send("GET", target+"/history", "", "")
+	require.Equal(t, 200, w.Code)
+
+	entries := make([]*users.HistoryEntry, 0)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &entries))
+	require.Equal(t, 2, len(entries))
+	require.Equal(t, "UPDATE", entries[0].Operation)
+	require.Equal(t, "update", entries[0].RequestID)
+	require.Equal(t, "INSERT", entries[1].Operation)
+	require.Equal(t, "create", entries[1].RequestID)
+	require.Nil(t, entries[1].OldValues)
+	for _, entry := range entries {
+		require.Equal(t, "user:1", entry.Actor)
+	}
+
+	// The user as it was right after it was created.
+	asOf := url.QueryEscape(entries[1].ChangedAt.Format(time.RFC3339Nano))
+	w = send("GET", target+"?as_of="+asOf, "", "")
+	require.Equal(t, 200, w.Code)
+
+	past := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), past))
+	require.Equal(t, "Barney", past.DisplayName)
+
+	before := url.QueryEscape(entries[1].ChangedAt.Add(-time.Second).Format(time.RFC3339Nano))
+	require.Equal(t, 404, send("GET", target+"?as_of="+before, "", "").Code)
+	require.Equal(t, 400, send("GET", target+"?as_of=yesterday", "", "").Code)
+}
+
+// Keeps one value per user, to check the data of registered stores is exported and erased.
+type notesStore map[int64]string
+
+func (n notesStore) Name() string {
+	return "notes"
+}
+
+func (n notesStore) Export(ctx context.Context, tx *sqlx.Tx, userID int64) (interface{}, error) {
+	return n[userID], nil
+}
+
+func (n notesStore) Erase(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	delete(n, userID)
+	return nil
+}
+
+func TestService_Privacy(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	notes := notesStore{}
+	service.RegisterPersonalData(notes)
+	service.Mount(router)
+
+	send := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	rows := make([]*users.User, 0)
+	require.Nil(t, json.Unmarshal(send("GET", "http://localhost:9090/users").Body.Bytes(), &rows))
+	user := rows[0]
+	target := fmt.Sprintf("http://localhost:9090/users/%d", user.ID)
+	notes[user.ID] = "likes bowling"
+
+	w := send("GET", target+"/archive")
+	require.Equal(t, 200, w.Code)
+
+	archive := &users.Archive{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), archive))
+	require.Equal(t, user.Username, archive.User.Username)
+	require.Equal(t, "likes bowling", archive.Data["notes"])
+	require.Equal(t, 1, len(archive.PrivacyRequests))
+	require.Equal(t, users.PrivacyAccess, archive.PrivacyRequests[0].Kind)
+	require.Equal(t, users.PrivacyCompleted, archive.PrivacyRequests[0].Status)
+
+	w = send("POST", target+"/erasure")
+	require.Equal(t, 201, w.Code)
+
+	req := &users.PrivacyRequest{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), req))
+	require.Equal(t, users.PrivacyErasure, req.Kind)
+	require.Equal(t, users.PrivacyCompleted, req.Status)
+	require.Equal(t, 200, send("GET", "http://localhost:9090"+w.Header().Get("Location")).Code)
+
+	require.Empty(t, notes)
+	require.Equal(t, 404, send("GET", target+"?include_deleted=true").Code)
+	require.Equal(t, 404, send("POST", target+"/erasure").Code)
+
+	// The history keeps its shape but none of the values.
+	entries := make([]*users.HistoryEntry, 0)
+	require.Nil(t, json.Unmarshal(send("GET", target+"/history").Body.Bytes(), &entries))
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		require.Nil(t, entry.OldValues)
+		require.Nil(t, entry.NewValues)
+	}
+
+	requests := make([]*users.PrivacyRequest, 0)
+	require.Nil(t, json.Unmarshal(send("GET", target+"/privacy-requests").Body.Bytes(), &requests))
+	require.Equal(t, 2, len(requests))
+}
+
+func TestService_Encryption(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	keyring := func(primary string) *fieldcrypt.Keyring {
+		keys := map[string][]byte{"k1": make([]byte, fieldcrypt.KeySize), "k2": make([]byte, fieldcrypt.KeySize)}
+		keys["k2"][0] = 1
+		k, err := fieldcrypt.NewKeyring(primary, keys, make([]byte, fieldcrypt.KeySize))
+		require.Nil(t, err)
+		return k
+	}
+
+	config := &users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+		Keyring:         keyring("k1"),
+	}
+	service := users.New(config)
+
+	service.Mount(router)
+
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	stored := func(id int64) string {
+		var email string
+		require.Nil(t, db.GetContext(ctx, &email, "SELECT email FROM users WHERE id = $1", id))
+		return email
+	}
+
+	w := send("POST", "http://localhost:9090/users", `{"username": "betty", "email": "betty@example.com"}`)
+	require.Equal(t, 201, w.Code)
+
+	created := &users.User{}
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), created))
+	require.Equal(t, "betty@example.com", created.Email)
+
+	keyID, ok := fieldcrypt.KeyID(stored(created.ID))
+	require.True(t, ok)
+	require.Equal(t, "k1", keyID)
+
+	// Encrypted emails are still looked up, and unique, regardless of case.
+	w = send("GET", "http://localhost:9090/users?email=BETTY@example.com", "")
+	require.Equal(t, 200, w.Code)
+
+	rows := make([]*users.User, 0)
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rows))
+	require.Equal(t, 1, len(rows))
+	require.Equal(t, created.ID, rows[0].ID)
+
+	w = send("POST", "http://localhost:9090/users", `{"username": "betty2", "email": "Betty@example.com"}`)
+	require.Equal(t, 409, w.Code)
+
+	// Deployments rotate by restarting with a new primary key.
+	config.Keyring = keyring("k2")
+	service = users.New(config)
+	rotated, err := service.RotateKeys(ctx, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), rotated)
+
+	keyID, _ = fieldcrypt.KeyID(stored(created.ID))
+	require.Equal(t, "k2", keyID)
+
+	rotated, err = service.RotateKeys(ctx, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), rotated)
+
+	router = mux.NewRouter()
+	service.Mount(router)
+	w = send("GET", fmt.Sprintf("http://localhost:9090/users/%d", created.ID), "")
+	require.Equal(t, 200, w.Code)
+	require.Contains(t, w.Body.String(), "betty@example.com")
+}
+
+func TestService_ETag(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+		RequireIfMatch:  true,
+	})
+
+	service.Mount(router)
+
+	send := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	rows := make([]*users.User, 0)
+	require.Nil(t, json.Unmarshal(send("GET", "http://localhost:9090/users", "").Body.Bytes(), &rows))
+	target := fmt.Sprintf("http://localhost:9090/users/%d", rows[0].ID)
+
+	w := send("GET", target, "")
+	require.Equal(t, 200, w.Code)
+	tag := w.Header().Get("ETag")
+	require.Equal(t, fmt.Sprintf(`"%d"`, rows[0].Version), tag)
+
+	require.Equal(t, 304, send("GET", target, "", "If-None-Match", tag).Code)
+	require.Equal(t, 304, send("GET", target, "", "If-None-Match", "W/"+tag).Code)
+	require.Equal(t, 200, send("GET", target, "", "If-None-Match", `"0"`).Code)
+
+	require.Equal(t, 428, send("PATCH", target, `{"displayName": "Fred"}`).Code)
+	require.Equal(t, 412, send("PATCH", target, `{"displayName": "Fred"}`, "If-Match", "W/"+tag).Code)
+
+	w = send("PATCH", target, `{"displayName": "Fred"}`, "If-Match", tag)
+	require.Equal(t, 200, w.Code)
+	require.NotEqual(t, tag, w.Header().Get("ETag"))
+
+	// The second admin still holds the old ETag.
+	require.Equal(t, 412, send("PATCH", target, `{"displayName": "Freddy"}`, "If-Match", tag).Code)
+	require.Equal(t, 412, send("DELETE", target, "", "If-Match", tag).Code)
+	require.Equal(t, 204, send("DELETE", target, "", "If-Match", w.Header().Get("ETag")).Code)
+}
+
+func TestService_Batch(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          log.New(os.Stdout, "logger: ", log.Lshortfile),
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+	})
+
+	service.Mount(router)
+
+	batch := func(body string) (int, []*users.BatchResult) {
+		req := httptest.NewRequest("POST", "http://localhost:9090/users/batch", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		results := make([]*users.BatchResult, 0)
+		if w.Code == 207 {
+			require.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+		}
+		return w.Code, results
+	}
+
+	rows := make([]*users.User, 0)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "http://localhost:9090/users", nil))
+	require.Nil(t, json.Unmarshal(w.Body.Bytes(), &rows))
+
+	code, results := batch(fmt.Sprintf(`{"operations": [
+		{"op": "create", "user": {"username": "bamm-bamm"}},
+		{"op": "update", "id": %d, "user": {"displayName": "Fred Flintstone"}},
+		{"op": "delete", "id": %d}
+	]}`, rows[0].ID, rows[1].ID))
+	require.Equal(t, 207, code)
+	require.Equal(t, []int{201, 200, 204}, []int{results[0].Status, results[1].Status, results[2].Status})
+	require.Equal(t, "bamm-bamm", results[0].User.Username)
+	require.Equal(t, "Fred Flintstone", results[1].User.DisplayName)
+
+	// Atomic batches are all-or-nothing.
+	code, results = batch(`{"operations": [
+		{"op": "create", "user": {"username": "gazoo"}},
+		{"op": "create", "user": {"username": "bamm-bamm"}}
+	]}`)
+	require.Equal(t, 207, code)
+	require.Equal(t, 424, results[0].Status)
+	require.Equal(t, 409, results[1].Status)
+
+	// Best effort batches apply what they can.
+	code, results = batch(`{"mode": "best_effort", "operations": [
+		{"op": "create", "user": {"username": "gazoo"}},
+		{"op": "create", "user": {"username": "x"}},
+		{"op": "delete", "id": 999999999}
+	]}`)
+	require.Equal(t, 207, code)
+	require.Equal(t, 201, results[0].Status)
+	require.Equal(t, 422, results[1].Status)
+	require.NotEmpty(t, results[1].Problems["username"])
+	require.Equal(t, 404, results[2].Status)
+
+	code, _ = batch(`{"mode": "eventually", "operations": [{"op": "update"}]}`)
+	require.Equal(t, 422, code)
+}
+
+// Every route of the service is allowed to the roles granting its action on its resource, and denied to everyone else.
+func TestService_Authorization(t *testing.T) {
+	ctx := context.Background()
+
+	db := setupDatabase(t, ctx)
+	router := mux.NewRouter()
+	logger := log.New(os.Stdout, "logger: ", log.Lshortfile)
+
+	policy := rbac.New(&rbac.Config{Ctx: ctx, Logger: logger, DB: db})
+
+	service := users.New(&users.Config{
+		Ctx:             ctx,
+		Logger:          logger,
+		DB:              db,
+		UsersPathPrefix: usersPathPrefix,
+		SelectManyLimit: selectManyLimit,
+		Enforcer:        policy,
+	})
+
+	service.Mount(router)
+
+	rows := make([]*users.User, 0)
+	require.Nil(t, db.SelectContext(ctx, &rows, "SELECT id FROM users ORDER BY id LIMIT 2"))
+	own, other := fmt.Sprint(rows[0].ID), fmt.Sprint(rows[1].ID)
+
+	// The member is the owner of the first user.
+	subjects := map[string]string{
+		"member": "user:" + own,
+		"reader": "test:reader",
+		"editor": "test:editor",
+		"admin":  "test:admin",
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM role_assignments WHERE subject LIKE 'test:%' OR subject LIKE 'user:%'")
+	require.Nil(t, err)
+	for role, subject := range subjects {
+		require.Nil(t, policy.Assign(ctx, subject, role, "system:test"))
+	}
+
+	routes := []struct {
+		method  string
+		path    string
+		allowed []string
+	}{
+		{"GET", "/users", []string{"reader", "editor", "admin"}},
+		{"POST", "/users", []string{"editor", "admin"}},
+		{"POST", "/users/batch", []string{"editor", "admin"}},
+		{"GET", "/users/export", []string{"reader", "editor", "admin"}},
+		{"GET", "/users/tags", []string{"reader", "editor", "admin"}},
+		{"GET", "/users/search?q=fred", []string{"reader", "editor", "admin"}},
+		{"GET", "/users/privacy-requests/1", []string{"admin"}},
+		{"GET", "/users/" + own, []string{"member", "reader", "editor", "admin"}},
+		{"GET", "/users/" + other, []string{"reader", "editor", "admin"}},
+		{"PATCH", "/users/" + own, []string{"member", "editor", "admin"}},
+		{"PATCH", "/users/" + other, []string{"editor", "admin"}},
+		{"GET", "/users/" + own + "/history", []string{"member", "reader", "editor", "admin"}},
+		{"GET", "/users/" + other + "/history", []string{"reader", "editor", "admin"}},
+		{"GET", "/users/" + own + "/metadata", []string{"member", "reader", "editor", "admin"}},
+		{"PUT", "/users/" + own + "/metadata", []string{"member", "editor", "admin"}},
+		{"PATCH", "/users/" + other + "/metadata", []string{"editor", "admin"}},
+		{"POST", "/users/" + own + "/tags", []string{"member", "editor", "admin"}},
+		{"DELETE", "/users/" + other + "/tags/vip", []string{"editor", "admin"}},
+		{"GET", "/users/" + own + "/archive", []string{"admin"}},
+		{"GET", "/users/" + own + "/privacy-requests", []string{"admin"}},
+		{"DELETE", "/users/" + other, []string{"editor", "admin"}},
+		{"POST", "/users/" + other + "/restore", []string{"editor", "admin"}},
+		{"DELETE", "/users/" + own, []string{"member", "editor", "admin"}},
+		{"POST", "/users/" + other + "/erasure", []string{"admin"}},
+	}
+
+	for _, route := range routes {
+		allowed := map[string]bool{}
+		for _, role := range route.allowed {
+			allowed[role] = true
+		}
+
+		for _, role := range []string{"anonymous", "member", "reader", "editor", "admin"} {
+			req := httptest.NewRequest(route.method, "http://localhost:9090"+route.path, strings.NewReader("{}"))
+			if subject, ok := subjects[role]; ok {
+				// As if logged in with a second factor, which the admin role requires.
+				principal := &access.Principal{ID: subject, MultiFactor: true}
+				req = req.WithContext(access.WithPrincipal(req.Context(), principal))
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			switch {
+			case role == "anonymous":
+				require.Equal(t, 401, w.Code, "%s %s as %s", route.method, route.path, role)
+			case allowed[role]:
+				require.NotContains(t, []int{401, 403}, w.Code, "%s %s as %s", route.method, route.path, role)
+			default:
+				require.Equal(t, 403, w.Code, "%s %s as %s", route.method, route.path, role)
+			}
+		}
+	}
+}
+
+func TestUser_Validate(t *testing.T) {
+	valid := users.User{Username: "fred.flintstone", Email: "fred@example.com", Status: users.StatusActive}
+	require.Nil(t, valid.Validate())
+
+	invalid := users.User{Username: "fred flintstone", Email: "Fred <fred@example.com>", Status: "asleep"}
+	err := invalid.Validate()
+	require.NotNil(t, err)
+
+	problems, ok := err.(users.ValidationError)
+	require.True(t, ok)
+	require.Contains(t, problems, "username")
+	require.Contains(t, problems, "email")
+	require.Contains(t, problems, "status")
+}
+
 // YOU MIGHT NEED TO RAISE YOUR ULIMIT ON MACOS TO RUN THIS
 func BenchmarkService_Ping(b *testing.B) {
 	ctx := context.Background()